@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes a file through a temporary file in the same
+// directory, which is flushed to disk, given the mode regardless of the umask
+// and renamed over the file. The directory is then flushed too, so that after
+// a crash the file is either complete or as it was before, never empty or
+// truncated.
+func writeFileAtomic(path string, mode os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, TmpFilePrefix+fmt.Sprintf("%d.", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return renameSynced(tmp.Name(), path)
+}
+
+// renameSynced flushes a complete file to disk and renames it into place,
+// then flushes the directory so that the rename survives a crash
+func renameSynced(src, dst string) error {
+	if err := syncFile(src); err != nil {
+		return err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncFile flushes the content of a file to disk
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// syncDir flushes a directory to disk, so that files created, renamed or
+// removed in it survive a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// syncTree flushes every file and directory of a tree to disk, such as
+// metadata written by createrepo, before it is published
+func syncTree(root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		if info.IsDir() {
+			return syncDir(p)
+		}
+
+		return syncFile(p)
+	})
+}
+
+// syncNewPackages flushes the packages of a repo which were added or changed
+// since it had the given package sizes, and their directories, to disk, as
+// reposync and rsync do not
+func syncNewPackages(root string, before, after map[string]int64) error {
+	dirs := make(map[string]bool, 0)
+	for rel, size := range after {
+		if prev, ok := before[rel]; ok && prev == size {
+			continue
+		}
+
+		path := filepath.Join(root, rel)
+		if err := syncFile(path); err != nil {
+			return err
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeEmptyPackages removes empty packages from a repo, such as those left
+// by a crash before a download was flushed to disk, so that they are
+// downloaded again rather than taken to be present, and drops them from the
+// given package sizes
+func removeEmptyPackages(root string, sizes map[string]int64) error {
+	for rel, size := range sizes {
+		if size > 0 {
+			continue
+		}
+
+		Warnf(nil, "Removing empty package %s", filepath.Join(root, rel))
+		if err := os.Remove(filepath.Join(root, rel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(sizes, rel)
+	}
+
+	return nil
+}
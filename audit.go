@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Audit events recorded for each package
+const (
+	AuditAdded   = "added"
+	AuditDeleted = "deleted"
+)
+
+// AuditEvent records a package being added to or deleted from a repo
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Run      string    `json:"run"`
+	Repo     string    `json:"repo"`
+	Event    string    `json:"event"`
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	NEVRA    string    `json:"nevra"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Checksum string    `json:"upstream_checksum,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	KeyID    string    `json:"key_id,omitempty"`
+}
+
+// auditLogPath returns the path of the audit log of a repo. The log has one
+// JSON event per line and is only ever appended to. It is kept in the repo's
+// state directory rather than its cache, which clean may remove.
+func (c *Repo) auditLogPath() string {
+	return filepath.Join(c.StateDir(), "audit.jsonl")
+}
+
+// migrateAuditLog moves an audit log written by earlier versions from the
+// cache directory of a repo to its state directory
+func migrateAuditLog(repo *Repo) error {
+	old := filepath.Join(repo.CacheDir(), repo.ID, "audit.jsonl")
+	if _, err := os.Stat(old); err != nil {
+		return nil
+	}
+
+	path := repo.auditLogPath()
+	if _, err := os.Stat(path); err == nil {
+		Warnf(nil, "Not moving audit log %s of repo %s to %s, which already exists", old, repo.ID, path)
+		return nil
+	}
+
+	Dprintf("Moving audit log of repo %s to %s\n", repo.ID, path)
+	return moveFile(old, path)
+}
+
+// upstreamPackageInfo returns the base URL packages of a repo are downloaded
+// from and the upstream checksum of each package, keyed by location. Both
+// are best effort, as the packages have already been downloaded.
+func upstreamPackageInfo(repo *Repo) (string, map[string]string) {
+	sums := make(map[string]string, 0)
+	source, repomd, err := upstreamRepomd(repo)
+	if err != nil {
+		Dprintf("Unable to read upstream metadata of %s for the audit log: %v\n", repo.ID, err)
+		return "", sums
+	}
+
+	baseurl := source
+	primary := ""
+	if data := repomd.Get("primary"); data != nil {
+		if repo.RsyncURL() != "" {
+			baseurl = strings.TrimSuffix(repo.RsyncURL(), "/")
+			primary = filepath.Join(source, data.Location.Href)
+		} else if primary, err = repo.fetchUpstreamMetadata(source, data); err != nil {
+			Dprintf("Unable to read upstream packages of %s for the audit log: %v\n", repo.ID, err)
+			return baseurl, sums
+		}
+	}
+
+	if primary != "" {
+		EachPackage(primary, func(pkg *Package) error {
+			sums[filepath.Clean(pkg.Location.Href)] = strings.ToLower(pkg.Checksum.Type) + ":" + pkg.Checksum.Value
+			return nil
+		})
+	}
+
+	return baseurl, sums
+}
+
+// recordAudit appends an event to a repo's audit log for each package added
+// or deleted by a sync, given listings of the repo before and after it, as
+// returned by packageSizes. Added packages are recorded with their checksums,
+// origin and signing key. Deleted packages are recorded with the checksums
+// and key of the package when it was added, if it is in the log.
+func recordAudit(repo *Repo, report *RepoReport, before, after map[string]int64, upstream bool) error {
+	added := make([]string, 0)
+	for rel := range after {
+		if _, ok := before[rel]; !ok {
+			added = append(added, rel)
+		}
+	}
+	deleted := make([]string, 0)
+	for rel := range before {
+		if _, ok := after[rel]; !ok {
+			deleted = append(deleted, rel)
+		}
+	}
+	if len(added) == 0 && len(deleted) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	sort.Strings(deleted)
+
+	now := time.Now().UTC()
+	run := report.Start.UTC().Format(time.RFC3339)
+	newEvent := func(event, rel string, size int64) *AuditEvent {
+		nevra := strings.TrimSuffix(filepath.Base(rel), ".rpm")
+		name, _, _ := parsePackageFilename(rel)
+		return &AuditEvent{Time: now, Run: run, Repo: repo.ID, Event: event, Path: rel, Name: name, NEVRA: nevra, Size: size}
+	}
+
+	events := make([]*AuditEvent, 0, len(added)+len(deleted))
+	if len(added) > 0 {
+		baseurl, sums := "", map[string]string{}
+		if upstream {
+			baseurl, sums = upstreamPackageInfo(repo)
+		}
+
+		files := make([]string, len(added))
+		for i, rel := range added {
+			files[i] = filepath.Join(repo.Path(), rel)
+		}
+
+		sigs, err := queryPackages(files, rpmSignatureFormat)
+		if err != nil || len(sigs) != len(files) {
+			Dprintf("Unable to read package signatures for the audit log: %v\n", err)
+			sigs = nil
+		}
+
+		cache := LoadChecksumCache(repo, false)
+		for i, rel := range added {
+			event := newEvent(AuditAdded, rel, after[rel])
+			if sum, _, err := cache.Sum(files[i]); err == nil {
+				event.SHA256 = sum
+			}
+			event.Checksum = sums[filepath.Clean(rel)]
+			if baseurl != "" {
+				event.URL = baseurl + "/" + filepath.ToSlash(rel)
+			}
+			if sigs != nil {
+				if m := keyIDPattern.FindStringSubmatch(sigs[i]); m != nil {
+					event.KeyID = m[1]
+				}
+			}
+			events = append(events, event)
+		}
+
+		if err := cache.Save(); err != nil {
+			return err
+		}
+	}
+
+	if len(deleted) > 0 {
+		previous, err := ReadAuditLog(repo)
+		if err != nil {
+			return err
+		}
+
+		last := make(map[string]*AuditEvent, len(previous))
+		for i := range previous {
+			if previous[i].Event == AuditAdded {
+				last[previous[i].Path] = &previous[i]
+			}
+		}
+
+		for _, rel := range deleted {
+			event := newEvent(AuditDeleted, rel, before[rel])
+			if prev := last[rel]; prev != nil {
+				event.SHA256, event.Checksum, event.URL, event.KeyID = prev.SHA256, prev.Checksum, prev.URL, prev.KeyID
+			}
+			events = append(events, event)
+		}
+	}
+
+	return appendAuditLog(repo, events)
+}
+
+// appendAuditLog appends events to a repo's audit log
+func appendAuditLog(repo *Repo, events []*AuditEvent) error {
+	if err := migrateAuditLog(repo); err != nil {
+		return err
+	}
+
+	path := repo.auditLogPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// ReadAuditLog returns all events in a repo's audit log, oldest first
+func ReadAuditLog(repo *Repo) ([]AuditEvent, error) {
+	if err := migrateAuditLog(repo); err != nil {
+		return nil, err
+	}
+
+	events := make([]AuditEvent, 0)
+	f, err := os.Open(repo.auditLogPath())
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		event := AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, NewErrorf("Invalid audit log entry in %s:%d: %v", repo.auditLogPath(), line, err)
+		}
+		events = append(events, event)
+	}
+
+	return events, scanner.Err()
+}
+
+// Match returns true if an event is for a package whose name, NEVRA, file
+// name or checksum matches a shell glob
+func (c *AuditEvent) Match(pattern string) bool {
+	for _, s := range []string{c.Name, c.NEVRA, filepath.Base(c.Path), c.SHA256} {
+		if ok, _ := path.Match(pattern, s); ok && s != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Audit returns the events of the given repos for packages which match a
+// shell glob, oldest first
+func Audit(repos []Repo, pattern string) ([]AuditEvent, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, NewErrorf("Invalid pattern: %s", pattern)
+	}
+
+	matches := make([]AuditEvent, 0)
+	for i := range repos {
+		events, err := ReadAuditLog(&repos[i])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, event := range events {
+			if event.Match(pattern) {
+				matches = append(matches, event)
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Time.Before(matches[j].Time)
+	})
+
+	return matches, nil
+}
+
+// PrintAuditEvents prints one line per audit event
+func PrintAuditEvents(events []AuditEvent) {
+	for _, event := range events {
+		fmt.Printf("%s %-7s %-20s %s\n", event.Time.Format(time.RFC3339), event.Event, event.Repo, event.NEVRA)
+		if event.SHA256 != "" {
+			fmt.Printf("  sha256:   %s\n", event.SHA256)
+		}
+		if event.Checksum != "" {
+			fmt.Printf("  upstream: %s\n", event.Checksum)
+		}
+		if event.URL != "" {
+			fmt.Printf("  url:      %s\n", event.URL)
+		}
+		if event.KeyID != "" {
+			fmt.Printf("  key:      %s\n", event.KeyID)
+		}
+		fmt.Printf("  run:      %s\n", event.Run)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// serveAuth holds the credentials which grant access to a served repo
+type serveAuth struct {
+	// Users maps user names to password hashes from an htpasswd file
+	Users map[string]string
+
+	// Tokens are the bearer tokens which grant access
+	Tokens []string
+}
+
+// loadServeAuth reads the htpasswd and token files configured for a repo. It
+// returns nil if the repo does not require authentication.
+func loadServeAuth(repo *Repo) (*serveAuth, error) {
+	if repo.ServeHtpasswd == "" && repo.ServeTokens == "" {
+		return nil, nil
+	}
+
+	auth := &serveAuth{
+		Users:  make(map[string]string, 0),
+		Tokens: make([]string, 0),
+	}
+
+	if repo.ServeHtpasswd != "" {
+		err := readAuthFile(repo.ServeHtpasswd, func(line string) error {
+			i := strings.Index(line, ":")
+			if i <= 0 {
+				return NewErrorf("Invalid htpasswd entry in %s", repo.ServeHtpasswd)
+			}
+			auth.Users[line[:i]] = line[i+1:]
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if repo.ServeTokens != "" {
+		err := readAuthFile(repo.ServeTokens, func(line string) error {
+			auth.Tokens = append(auth.Tokens, line)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(auth.Users) == 0 && len(auth.Tokens) == 0 {
+		return nil, NewErrorf("No credentials found for '%s'; all requests would be refused", repo.ID)
+	}
+
+	return auth, nil
+}
+
+// readAuthFile calls fn for each line of a credentials file, ignoring blank
+// lines and comments
+func readAuthFile(path string, fn func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && fi.Mode().Perm()&0004 != 0 {
+		Warnf(nil, "Credentials file %s is world-readable", path)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Allow returns true if a request carries valid basic auth credentials or a
+// valid bearer token
+func (c *serveAuth) Allow(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, ok := c.Users[user]
+		return ok && checkPassword(hash, password)
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token := []byte(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	allowed := false
+	for _, t := range c.Tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			allowed = true
+		}
+	}
+
+	return allowed
+}
+
+// Challenge writes a 401 response asking for the supported credentials
+func (c *serveAuth) Challenge(w http.ResponseWriter) {
+	if len(c.Users) > 0 {
+		w.Header().Add("WWW-Authenticate", `Basic realm="y10k"`)
+	}
+	if len(c.Tokens) > 0 {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="y10k"`)
+	}
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// checkPassword compares a password with an htpasswd hash. bcrypt ($2y$) and
+// SHA1 ({SHA}) hashes are supported, as created by `htpasswd -B` and
+// `htpasswd -s`.
+func checkPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expect := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(hash, "{SHA}")), []byte(expect)) == 1
+	}
+
+	Dprintf("Unsupported htpasswd hash format\n")
+	return false
+}
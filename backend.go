@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Backends which run reposync and repoquery for a repo
+const (
+	// BackendAuto uses dnf if it is installed, as on EL8 and later, and
+	// yum-utils otherwise
+	BackendAuto = "auto"
+
+	// BackendYum runs the reposync and repoquery commands of yum-utils
+	BackendYum = "yum"
+
+	// BackendDNF runs dnf reposync and dnf repoquery of dnf-plugins-core
+	BackendDNF = "dnf"
+)
+
+var (
+	detectedBackend   string
+	detectBackendOnce sync.Once
+)
+
+// parseBackend parses the backend option of a repo
+func parseBackend(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case BackendAuto, BackendYum, BackendDNF:
+		return s, nil
+	}
+
+	return "", NewErrorf("Invalid backend: %s (expected auto, yum or dnf)", s)
+}
+
+// detectBackend returns dnf if it is installed, or else yum
+func detectBackend() string {
+	detectBackendOnce.Do(func() {
+		detectedBackend = BackendYum
+		if _, err := exec.LookPath("dnf"); err == nil {
+			detectedBackend = BackendDNF
+		}
+		Dprintf("Detected %s backend for reposync and repoquery\n", detectedBackend)
+	})
+
+	return detectedBackend
+}
+
+// yumBackend returns the backend which runs reposync and repoquery for a repo
+func (c *Repo) yumBackend() string {
+	if c.Backend == "" || c.Backend == BackendAuto {
+		return detectBackend()
+	}
+
+	return c.Backend
+}
+
+// backendCommand returns the command and leading arguments which run a
+// yum-utils tool, such as reposync, with the backend of a repo
+func (c *Repo) backendCommand(tool string, args ...string) (string, []string) {
+	if c.yumBackend() == BackendDNF {
+		return "dnf", append([]string{tool}, args...)
+	}
+
+	return tool, args
+}
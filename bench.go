@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// benchBlockSize is the size of buffers used by the disk and hash benchmarks
+const benchBlockSize = 1 << 20
+
+// BenchResult is the measured throughput of one stage of the sync pipeline
+type BenchResult struct {
+	Stage    string
+	Bytes    int64
+	Count    int
+	Duration time.Duration
+}
+
+// Rate returns the throughput of the stage in bytes per second
+func (c BenchResult) Rate() float64 {
+	if c.Duration <= 0 {
+		return 0
+	}
+
+	return float64(c.Bytes) / c.Duration.Seconds()
+}
+
+// Bench measures the performance of each stage of synchronizing a repo:
+// metadata download and parsing, package download, hashing and disk writes.
+// Packages are downloaded up to the given total size. If repo is nil, packages
+// are downloaded from a synthetic upstream served by this process.
+func Bench(repo *Repo, size int64, dir string) ([]BenchResult, error) {
+	tmp, err := ioutil.TempDir(dir, TmpFilePrefix+fmt.Sprintf("%d.bench.", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	results := make([]BenchResult, 0)
+	var urls []string
+	if repo == nil {
+		repo = NewRepo()
+		url, err := serveSynthetic(size)
+		if err != nil {
+			return nil, err
+		}
+		urls = []string{url}
+	} else {
+		var packageResults []BenchResult
+		packageResults, urls, err = benchMetadata(repo, size, tmp)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, packageResults...)
+	}
+
+	// package download
+	result := BenchResult{Stage: "package download"}
+	files := make([]string, 0, len(urls))
+	start := time.Now()
+	for i, url := range urls {
+		path := filepath.Join(tmp, fmt.Sprintf("package-%d.rpm", i))
+		n, err := download(repo, url, path)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Bytes += n
+		result.Count++
+		files = append(files, path)
+	}
+	result.Duration = time.Since(start)
+	results = append(results, result)
+
+	// hashing
+	result = BenchResult{Stage: "sha256 hashing"}
+	start = time.Now()
+	for _, path := range files {
+		_, n, err := sha256File(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Bytes += n
+		result.Count++
+	}
+	result.Duration = time.Since(start)
+	results = append(results, result)
+
+	// disk write
+	result, err = benchDiskWrite(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+	results = append(results, result)
+
+	return results, nil
+}
+
+// benchMetadata downloads and parses the primary metadata of a repo and
+// returns the URLs of the largest packages, up to the given total size.
+func benchMetadata(repo *Repo, size int64, dir string) ([]BenchResult, []string, error) {
+	baseurls, err := repo.UpstreamURLs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(baseurls) == 0 {
+		return nil, nil, NewErrorf("No upstream URLs found for %s", repo.ID)
+	}
+	baseurl := strings.TrimSuffix(baseurls[0], "/")
+	Printf("Benchmarking %s using %s\n", repo.ID, baseurl)
+
+	results := make([]BenchResult, 0, 2)
+	start := time.Now()
+	_, path, err := fetchRepodata(repo, baseurl, "primary", dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	results = append(results, BenchResult{Stage: "metadata download", Bytes: fi.Size(), Count: 1, Duration: time.Since(start)})
+
+	start = time.Now()
+	packages, err := ReadPrimary(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	results = append(results, BenchResult{Stage: "metadata parse", Bytes: fi.Size(), Count: len(packages), Duration: time.Since(start)})
+
+	// choose the largest packages, so latency affects the result less
+	sort.Sort(sort.Reverse(packagesBySize(packages)))
+	urls := make([]string, 0)
+	var total int64
+	for _, p := range packages {
+		if total >= size {
+			break
+		}
+
+		if p.Size.Package > size {
+			continue
+		}
+
+		urls = append(urls, baseurl+"/"+p.Location.Href)
+		total += p.Size.Package
+	}
+
+	return results, urls, nil
+}
+
+// benchDiskWrite measures the rate at which random data can be written and
+// synced to disk in the given directory.
+func benchDiskWrite(dir string, size int64) (BenchResult, error) {
+	result := BenchResult{Stage: "disk write", Count: 1}
+	buf := make([]byte, benchBlockSize)
+	if _, err := rand.Read(buf); err != nil {
+		return result, err
+	}
+
+	f, err := os.Create(filepath.Join(dir, "disk-write"))
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	for result.Bytes < size {
+		n, err := f.Write(buf)
+		if err != nil {
+			return result, err
+		}
+		result.Bytes += int64(n)
+	}
+
+	if err := f.Sync(); err != nil {
+		return result, err
+	}
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// serveSynthetic serves random data of the given size on a local port and
+// returns its URL. The server runs until the process exits.
+func serveSynthetic(size int64) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, benchBlockSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		for written := int64(0); written < size; written += int64(len(buf)) {
+			n := int64(len(buf))
+			if size-written < n {
+				n = size - written
+			}
+
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}))
+
+	return fmt.Sprintf("http://%s/synthetic.rpm", l.Addr()), nil
+}
+
+// PrintBenchResults prints benchmark results and identifies the slowest
+// stage of the pipeline which moves package data.
+func PrintBenchResults(results []BenchResult) {
+	var slowest *BenchResult
+	for i, result := range results {
+		switch result.Stage {
+		case "metadata parse":
+			Printf("  %-18s %d packages in %v\n", result.Stage+":", result.Count, result.Duration)
+
+		default:
+			Printf("  %-18s %s in %v (%s/s)\n", result.Stage+":", formatBytes(result.Bytes), result.Duration, formatBytes(int64(result.Rate())))
+		}
+
+		switch result.Stage {
+		case "package download", "sha256 hashing", "disk write":
+			if slowest == nil || result.Rate() < slowest.Rate() {
+				slowest = &results[i]
+			}
+		}
+	}
+
+	if slowest != nil {
+		Printf("Bottleneck: %s at %s/s\n", slowest.Stage, formatBytes(int64(slowest.Rate())))
+	}
+}
+
+// formatBytes formats a byte count using binary unit prefixes
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// packagesBySize sorts packages by their download size
+type packagesBySize []Package
+
+func (c packagesBySize) Len() int           { return len(c) }
+func (c packagesBySize) Less(i, j int) bool { return c[i].Size.Package < c[j].Size.Package }
+func (c packagesBySize) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ImportOptions control how a bundle is applied to a repo
+type ImportOptions struct {
+	// Repo is the ID of the repo to import into. If empty, the repo named in
+	// the bundle's manifest is used.
+	Repo string
+
+	// NoGPG skips the signature checks of imported packages
+	NoGPG bool
+
+	// Force applies a delta bundle even if its base revision does not match
+	// the repo
+	Force bool
+}
+
+// bundleDecompressors are the external decompression commands by file
+// extension
+var bundleDecompressors = map[string][]string{
+	".xz":   {"xz", "-dc"},
+	".zst":  {"zstd", "-q", "-dc"},
+	".tzst": {"zstd", "-q", "-dc"},
+}
+
+// bundleReader reads a bundle file, decompressing it according to its
+// extension
+type bundleReader struct {
+	f   *os.File
+	r   io.Reader
+	cmd *exec.Cmd
+}
+
+// openBundle opens a bundle file written by Export
+func openBundle(path string) (*bundleReader, error) {
+	ext, err := bundleFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &bundleReader{f: f, r: f}
+	switch ext {
+	case ".tar":
+
+	case ".gz":
+		if c.r, err = gzip.NewReader(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+	default:
+		args := bundleDecompressors[ext]
+		c.cmd = exec.Command(args[0], args[1:]...)
+		c.cmd.Stdin = f
+		c.cmd.Stderr = os.Stderr
+		if c.r, err = c.cmd.StdoutPipe(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := startChild(c.cmd); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *bundleReader) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Close closes the bundle, stopping the decompressor if it was not read to
+// the end
+func (c *bundleReader) Close() error {
+	var err error
+	if c.cmd != nil {
+		io.Copy(ioutil.Discard, c.r)
+		if werr := waitChild(c.cmd); werr != nil {
+			err = NewErrorf("%s failed: %v", c.cmd.Args[0], werr)
+		}
+	}
+
+	if cerr := c.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// importStagingDir returns the directory beside a repo where a bundle is
+// unpacked before it is applied, on the same filesystem so that files can be
+// moved into place
+func (c *Repo) importStagingDir() string {
+	return strings.TrimSuffix(c.Path(), "/") + ".import"
+}
+
+// ImportBundle applies a bundle written by Export to a repo. Every file is
+// checked against the checksums in the bundle's manifest and, if the repo
+// checks GPG signatures, every package must have a valid signature. A delta
+// bundle is refused unless the repo is at the revision it was exported
+// since, and any bundle is refused if the repo would be missing packages
+// listed in its metadata. Packages are then moved into the repo, removed
+// packages are deleted and the repo metadata is replaced.
+func (c *Yumfile) ImportBundle(path string, opts ImportOptions) (*BundleManifest, error) {
+	r, err := openBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	manifest, err := readBundleManifest(tr)
+	if err != nil {
+		return nil, NewErrorf("Invalid bundle %s: %v", path, err)
+	}
+
+	id := opts.Repo
+	if id == "" {
+		id = manifest.Repo
+	}
+
+	repo := c.GetRepoByID(id)
+	if repo == nil {
+		return nil, NewErrorf("No such repo found in Yumfile: %s", id)
+	}
+
+	unlock, err := c.lockRepo(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := checkBundleBase(repo, manifest, opts.Force); err != nil {
+		return nil, err
+	}
+
+	staging := repo.importStagingDir()
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	Printf("Unpacking %s: %s\n", path, repo.ID)
+	if err := unpackBundle(tr, staging, manifest); err != nil {
+		return nil, NewErrorf("Invalid bundle %s: %v", path, err)
+	}
+
+	if !opts.NoGPG && (repo.GPGCheck || len(repo.Fingerprints) > 0) && len(manifest.Packages) > 0 {
+		Printf("Verifying package signatures: %s\n", repo.ID)
+		files := make([]string, 0, len(manifest.Packages))
+		for _, entry := range manifest.Packages {
+			files = append(files, filepath.Join(staging, entry.Path))
+		}
+
+		bad, err := checkSignatures(repo, files)
+		if err != nil {
+			return nil, err
+		}
+		if len(bad) > 0 {
+			for _, file := range bad {
+				Errorf(nil, "Invalid signature: %s", strings.TrimPrefix(file, staging+"/"))
+			}
+			return nil, NewErrorf("Refusing bundle with %d packages which failed signature checks", len(bad))
+		}
+	}
+
+	keep, err := checkBundleComplete(repo, staging, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyBundle(repo, staging, manifest, keep); err != nil {
+		return nil, err
+	}
+
+	clearSyncState(repo)
+	return manifest, nil
+}
+
+// readBundleManifest reads the manifest, which must be the first entry of a
+// bundle
+func readBundleManifest(tr *tar.Reader) (*BundleManifest, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Name != bundleManifestName {
+		return nil, NewErrorf("%s not found", bundleManifestName)
+	}
+
+	manifest := &BundleManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// checkBundleBase returns an error if a delta bundle was exported since a
+// revision other than the repo's current revision
+func checkBundleBase(repo *Repo, manifest *BundleManifest, force bool) error {
+	if manifest.Full || manifest.BaseRevision == "" {
+		return nil
+	}
+
+	revision := ""
+	if repomd, err := ReadRepomd(filepath.Join(repo.Path(), "repodata", "repomd.xml")); err == nil {
+		revision = repomd.Revision
+	}
+
+	if revision == manifest.BaseRevision {
+		return nil
+	}
+
+	if force {
+		Warnf(nil, "Applying bundle based on revision %s to %s at revision %s", manifest.BaseRevision, repo.ID, revision)
+		return nil
+	}
+
+	return NewErrorf("Bundle is based on revision %s of %s, but the repo is at revision %q; import the bundles in order", manifest.BaseRevision, manifest.Repo, revision)
+}
+
+// bundleEntryPath returns the cleaned path of a bundle entry, or an error if
+// it is not a relative path within the repo
+func bundleEntryPath(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", NewErrorf("Invalid path in bundle: %s", name)
+	}
+
+	return rel, nil
+}
+
+// unpackBundle extracts the files of a bundle into dir, verifying each
+// against the manifest
+func unpackBundle(tr *tar.Reader, dir string, manifest *BundleManifest) error {
+	expected := make(map[string]ManifestEntry, len(manifest.Metadata)+len(manifest.Packages))
+	for _, entry := range append(append([]ManifestEntry{}, manifest.Metadata...), manifest.Packages...) {
+		rel, err := bundleEntryPath(entry.Path)
+		if err != nil {
+			return err
+		}
+		expected[rel] = entry
+	}
+
+	for {
+		if interrupted() {
+			return errInterrupted
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return NewErrorf("Unexpected entry in bundle: %s", hdr.Name)
+		}
+
+		rel, err := bundleEntryPath(hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		entry, ok := expected[rel]
+		if !ok {
+			return NewErrorf("%s is not listed in the manifest", hdr.Name)
+		}
+		delete(expected, rel)
+
+		if err := unpackBundleFile(tr, hdr, filepath.Join(dir, rel), entry); err != nil {
+			return err
+		}
+	}
+
+	if len(expected) > 0 {
+		return NewErrorf("%d files listed in the manifest are missing", len(expected))
+	}
+
+	return nil
+}
+
+// unpackBundleFile writes a file from a bundle, returning an error if its size
+// or checksum does not match its manifest entry
+func unpackBundleFile(r io.Reader, hdr *tar.Header, path string, entry ManifestEntry) error {
+	err := writeFileAtomic(path, 0644, func(w io.Writer) error {
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), r)
+		if err != nil {
+			return err
+		}
+
+		if n != entry.Size || hex.EncodeToString(h.Sum(nil)) != entry.Checksum {
+			return NewErrorf("Checksum mismatch for %s", entry.Path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+// checkBundleComplete returns an error if any package listed in a bundle's
+// metadata would be missing from the repo once the bundle is applied, and
+// otherwise the local packages to keep
+func checkBundleComplete(repo *Repo, staging string, manifest *BundleManifest) (map[string]bool, error) {
+	source, err := localDiffSource(manifest.Repo, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := localPackages(repo.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	staged := make(map[string]bool, len(manifest.Packages))
+	for _, entry := range manifest.Packages {
+		staged[filepath.Clean(entry.Path)] = true
+	}
+
+	keep := make(map[string]bool, 0)
+	missing := make([]string, 0)
+	err = EachPackage(source.Primary, func(pkg *Package) error {
+		rel := filepath.Clean(pkg.Location.Href)
+		switch {
+		case staged[rel]:
+		case local[rel]:
+			keep[rel] = true
+		default:
+			missing = append(missing, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) > 0 {
+		for _, rel := range missing {
+			Dprintf("Missing package: %s\n", rel)
+		}
+		return nil, NewErrorf("Refusing bundle: %d packages in its metadata are neither in the bundle nor in %s; import the bundles in order", len(missing), repo.ID)
+	}
+
+	return keep, nil
+}
+
+// applyBundle moves the packages of an unpacked bundle into a repo, deletes
+// packages which are no longer listed in its metadata and replaces the repo
+// metadata
+func applyBundle(repo *Repo, staging string, manifest *BundleManifest, keep map[string]bool) error {
+	root := repo.Path()
+	for _, entry := range manifest.Packages {
+		rel := filepath.Clean(entry.Path)
+		dst := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := renameSynced(filepath.Join(staging, rel), dst); err != nil {
+			return err
+		}
+		keep[rel] = true
+	}
+
+	// swap in the new metadata, as createrepo does, so clients never see a
+	// partial set of metadata files
+	repodata := filepath.Join(root, "repodata")
+	old := filepath.Join(root, fmt.Sprintf(".repodata.old.%d", os.Getpid()))
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(repodata, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncTree(filepath.Join(staging, "repodata")); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(staging, "repodata"), repodata); err != nil {
+		os.Rename(old, repodata)
+		return err
+	}
+	if err := syncDir(root); err != nil {
+		return err
+	}
+	os.RemoveAll(old)
+
+	// packages removed upstream are listed by delta bundles; a full bundle
+	// replaces the repo
+	local, err := localPackages(root)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool, len(manifest.Removed))
+	for _, rel := range manifest.Removed {
+		removed[filepath.Clean(rel)] = true
+	}
+
+	n := 0
+	for rel := range local {
+		if keep[rel] || (!manifest.Full && !removed[rel]) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(root, rel)); err != nil {
+			return err
+		}
+		Dprintf("Removed package %s\n", rel)
+		n++
+	}
+
+	Printf("Imported %d packages and removed %d packages: %s\n", len(manifest.Packages), n, repo.ID)
+	return nil
+}
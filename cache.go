@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// cacheMetadataExts are the file extensions of metadata files in a cache
+// directory which may be evicted once they are no longer listed in the
+// repomd.xml beside them
+var cacheMetadataExts = map[string]bool{
+	".bz2":    true,
+	".gz":     true,
+	".sqlite": true,
+	".xml":    true,
+	".xz":     true,
+	".yaml":   true,
+	".zck":    true,
+	".zst":    true,
+}
+
+// cacheFile is a file in a repo's cache directory
+type cacheFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+
+	// Stale is true for metadata files of an older generation of the
+	// upstream metadata, which are not listed in the repomd.xml beside them
+	Stale bool
+}
+
+// CacheUsage is the disk usage of the cache directory of a repo
+type CacheUsage struct {
+	Repo    string `json:"repo"`
+	Path    string `json:"path"`
+	Files   int    `json:"files"`
+	Size    int64  `json:"size"`
+	Stale   int64  `json:"stale_size"`
+	MaxSize int64  `json:"max_size,omitempty"`
+}
+
+// repoCacheDir returns the cache directory of a repo, which holds the yum
+// metadata cache, the upstream metadata cache and the state of the repo
+func (c *Repo) repoCacheDir() string {
+	return filepath.Join(c.CacheDir(), c.ID)
+}
+
+// listCacheFiles returns every file in a cache directory tree, with metadata
+// files not listed in the repomd.xml of their directory marked as stale
+func listCacheFiles(dir string) ([]cacheFile, error) {
+	files := make([]cacheFile, 0)
+	current := make(map[string]map[string]bool, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		file := cacheFile{Path: path, Size: info.Size(), ModTime: info.ModTime()}
+		name := filepath.Base(path)
+		if cacheMetadataExts[strings.ToLower(filepath.Ext(name))] && !strings.HasPrefix(name, "repomd.xml") {
+			parent := filepath.Dir(path)
+			listed, ok := current[parent]
+			if !ok {
+				listed = repomdFileNames(parent)
+				current[parent] = listed
+			}
+			file.Stale = listed != nil && !listed[name]
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// repomdFileNames returns the names of the files listed in the repomd.xml of
+// a directory, or nil if it has none
+func repomdFileNames(dir string) map[string]bool {
+	repomd, err := ReadRepomd(filepath.Join(dir, "repomd.xml"))
+	if err != nil {
+		return nil
+	}
+
+	names := make(map[string]bool, len(repomd.Data))
+	for _, data := range repomd.Data {
+		names[filepath.Base(data.Location.Href)] = true
+	}
+
+	return names
+}
+
+// RepoCacheUsage returns the disk usage of the cache directory of a repo
+func RepoCacheUsage(repo *Repo) (*CacheUsage, error) {
+	usage := &CacheUsage{Repo: repo.ID, Path: repo.repoCacheDir(), MaxSize: repo.CacheMaxSize}
+	files, err := listCacheFiles(usage.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		usage.Files++
+		usage.Size += file.Size
+		if file.Stale {
+			usage.Stale += file.Size
+		}
+	}
+
+	return usage, nil
+}
+
+// MetadataCacheUsage returns the disk usage of the decompressed metadata
+// copies shared by all repos, with the given size limit
+func MetadataCacheUsage(max int64) (*CacheUsage, error) {
+	usage := &CacheUsage{Repo: metadataCacheDirName, Path: metadataCacheDir(), MaxSize: max}
+	files, err := ioutil.ReadDir(usage.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, file := range files {
+		usage.Files++
+		usage.Size += file.Size()
+	}
+
+	return usage, nil
+}
+
+// evictCache removes the least recently used stale metadata files from the
+// cache directory of a repo until it is within the repo's cache_max_size.
+// Current metadata and the repo's state are never evicted.
+func evictCache(repo *Repo) error {
+	if repo.CacheMaxSize <= 0 {
+		return nil
+	}
+
+	files, err := listCacheFiles(repo.repoCacheDir())
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	stale := make([]cacheFile, 0)
+	for _, file := range files {
+		size += file.Size
+		if file.Stale {
+			stale = append(stale, file)
+		}
+	}
+
+	evicted, freed, err := evictFiles(stale, size-repo.CacheMaxSize)
+	if evicted > 0 {
+		Printf("Evicted %d old metadata files (%s) from the cache of %s\n", evicted, formatBytes(freed), repo.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if size-freed > repo.CacheMaxSize {
+		Warnf(nil, "Cache of %s is %s, over its cache_max_size of %s, with no old metadata left to evict", repo.ID, formatBytes(size-freed), formatBytes(repo.CacheMaxSize))
+	}
+
+	return nil
+}
+
+// evictMetadataCache removes the least recently read decompressed metadata
+// copies until they are within the given size
+func evictMetadataCache(max int64) error {
+	if max <= 0 {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(metadataCacheDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var size int64
+	files := make([]cacheFile, 0, len(infos))
+	for _, info := range infos {
+		size += info.Size()
+		if !tempFilePattern().MatchString(info.Name()) {
+			files = append(files, cacheFile{Path: filepath.Join(metadataCacheDir(), info.Name()), Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+
+	evicted, freed, err := evictFiles(files, size-max)
+	if evicted > 0 {
+		Printf("Evicted %d decompressed metadata files (%s) from %s\n", evicted, formatBytes(freed), metadataCacheDir())
+	}
+
+	return err
+}
+
+// metadataCacheMaxSize returns the size limit of the decompressed metadata
+// copies shared by all repos, which is the global cache_max_size
+func (c *Yumfile) metadataCacheMaxSize() int64 {
+	if s := c.Globals["cache_max_size"]; s != "" {
+		if n, err := parseByteSize(s); err == nil {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// evictFiles removes files, least recently modified first, until at least
+// the given number of bytes is freed, and returns the number of files removed
+// and the bytes freed
+func evictFiles(files []cacheFile, excess int64) (int, int64, error) {
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+
+	evicted, freed := 0, int64(0)
+	for _, file := range files {
+		if freed >= excess {
+			break
+		}
+
+		Dprintf("Evicting %s from the cache\n", file.Path)
+		if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+			return evicted, freed, err
+		}
+		evicted++
+		freed += file.Size
+	}
+
+	return evicted, freed, nil
+}
+
+// PrintCacheUsage prints the cache usage of each repo and a total
+func PrintCacheUsage(usages []*CacheUsage) {
+	var total int64
+	for _, usage := range usages {
+		limit := "-"
+		if usage.MaxSize > 0 {
+			limit = formatBytes(usage.MaxSize)
+		}
+		fmt.Printf("%-30s %6d files %10s %10s old %10s limit  %s\n", usage.Repo, usage.Files, formatBytes(usage.Size), formatBytes(usage.Stale), limit, usage.Path)
+		total += usage.Size
+	}
+	fmt.Printf("%s in %d caches\n", formatBytes(total), len(usages))
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// checksumCacheFileName is the name of the file in a repo's cache directory
+// which stores the checksums of its local packages
+const checksumCacheFileName = "checksums.json"
+
+// checksumWorkers is the number of files hashed at once when the packages of
+// a repo are scanned
+var checksumWorkers = runtime.NumCPU()
+
+// checksumCacheEntry is the checksum of a file at a known size and
+// modification time
+type checksumCacheEntry struct {
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"`
+	Checksum string `json:"sha256"`
+}
+
+// ChecksumCache stores the sha256 checksums of local files so that files
+// which have not changed since the last run, according to their size and
+// modification time, are not hashed again.
+type ChecksumCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]checksumCacheEntry
+	seen    map[string]bool
+	hits    int
+	misses  int
+}
+
+// LoadChecksumCache loads the checksum cache of a repo. If verifyAll is true,
+// previously cached checksums are ignored and every file is hashed again.
+func LoadChecksumCache(repo *Repo, verifyAll bool) *ChecksumCache {
+	c := &ChecksumCache{
+		path:    filepath.Join(repo.CacheDir(), repo.ID, checksumCacheFileName),
+		entries: make(map[string]checksumCacheEntry, 0),
+		seen:    make(map[string]bool, 0),
+	}
+
+	if verifyAll {
+		return c
+	}
+
+	if err := readJSON(c.path, &c.entries); err != nil && !os.IsNotExist(err) {
+		// a corrupt cache is rebuilt rather than failing the sync
+		Dprintf("Ignoring unreadable checksum cache %s: %v\n", c.path, err)
+		c.entries = make(map[string]checksumCacheEntry, 0)
+	}
+
+	return c
+}
+
+// Sum returns the sha256 checksum and size of a file, from the cache if the
+// file's size and modification time have not changed. It is safe to call
+// from several goroutines.
+func (c *ChecksumCache) Sum(path string) (string, int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	c.mu.Lock()
+	c.seen[path] = true
+	if entry, ok := c.entries[path]; ok && entry.Size == fi.Size() && entry.ModTime == fi.ModTime().UnixNano() {
+		c.hits++
+		c.mu.Unlock()
+		return entry.Checksum, entry.Size, nil
+	}
+	c.mu.Unlock()
+
+	sum, size, err := sha256File(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.misses++
+	c.entries[path] = checksumCacheEntry{
+		Size:     size,
+		ModTime:  fi.ModTime().UnixNano(),
+		Checksum: sum,
+	}
+
+	return sum, size, nil
+}
+
+// fileChecksum is the sha256 checksum and size of a file
+type fileChecksum struct {
+	Sum  string
+	Size int64
+}
+
+// SumAll returns the sha256 checksum and size of each of the given files,
+// hashing up to checksumWorkers files at once
+func (c *ChecksumCache) SumAll(paths []string) ([]fileChecksum, error) {
+	sums := make([]fileChecksum, len(paths))
+	err := forEachParallel(len(paths), func(i int) error {
+		sum, size, err := c.Sum(paths[i])
+		sums[i] = fileChecksum{Sum: sum, Size: size}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
+
+// forEachParallel calls fn with each index from 0 to n-1, from a pool of
+// checksumWorkers goroutines, and returns the first error. No more calls are
+// made once fn returns an error or y10k is interrupted.
+func forEachParallel(n int, fn func(i int) error) error {
+	workers := checksumWorkers
+	if workers > n {
+		workers = n
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	next := make(chan int)
+	errs := make(chan error, workers)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for i := 0; i < n; i++ {
+		if interrupted() {
+			err = errInterrupted
+			break
+		}
+
+		select {
+		case next <- i:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+
+	return err
+}
+
+// Save writes the cache to disk, dropping entries for files which were not
+// looked up since it was loaded.
+func (c *ChecksumCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path := range c.entries {
+		if !c.seen[path] {
+			delete(c.entries, path)
+		}
+	}
+
+	Dprintf("Checksum cache %s: %d cached, %d hashed\n", c.path, c.hits, c.misses)
+	return writeJSON(c.path, c.entries)
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// partFileSuffix is the file extension of incomplete package downloads
+const partFileSuffix = ".part"
+
+// staleTempFileMaxAge is the age after which the temporary files of another
+// y10k process are removed before a sync, even if its PID is in use
+const staleTempFileMaxAge = 7 * 24 * time.Hour
+
+// repodataKeepFiles are files in a repodata directory which are not listed in
+// repomd.xml but must not be removed
+var repodataKeepFiles = map[string]bool{
+	"repomd.xml":     true,
+	"repomd.xml.asc": true,
+	"repomd.xml.key": true,
+}
+
+// tempFilePattern returns a pattern which matches temporary files created by
+// a y10k process and captures the PID of the process that created them.
+func tempFilePattern() *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(TmpFilePrefix) + "(\\d+)\\.")
+}
+
+// CleanOptions configures the clean command
+type CleanOptions struct {
+	// DryRun reports what would be removed without removing anything
+	DryRun bool
+
+	// MaxAge is the age after which temporary files are removed even if the
+	// process which created them appears to be running, in case its PID has
+	// been reused. Zero disables the age check.
+	MaxAge time.Duration
+}
+
+// cleaner removes files and keeps count of what was removed
+type cleaner struct {
+	CleanOptions
+	Files int
+	Bytes int64
+}
+
+// remove removes a file or directory tree, unless in dry-run mode
+func (c *cleaner) remove(path string) error {
+	size := diskUsage(path)
+	if c.DryRun {
+		Dprintf("Would remove %s (%s)\n", path, formatBytes(size))
+	} else {
+		Dprintf("Removing %s (%s)\n", path, formatBytes(size))
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	c.Files++
+	c.Bytes += size
+	return nil
+}
+
+// report prints and resets the count of removed files
+func (c *cleaner) report(what, path string) {
+	if c.Files > 0 {
+		verb := "Removed"
+		if c.DryRun {
+			verb = "Would remove"
+		}
+		Printf("%s %d %s (%s) from %s\n", verb, c.Files, what, formatBytes(c.Bytes), path)
+	}
+
+	c.Files, c.Bytes = 0, 0
+}
+
+// CleanUp removes temporary artifacts left behind by previous runs of y10k
+// for all repos in a Yumfile: temporary files, incomplete downloads, cache
+// directories of repos which are no longer in the Yumfile and metadata files
+// which are no longer referenced by a repo's repomd.xml.
+func (c *Yumfile) CleanUp(opts CleanOptions) error {
+	cl := &cleaner{CleanOptions: opts}
+	var total int64
+
+	if err := cl.cleanUpTempFiles(); err != nil {
+		return err
+	}
+	total += cl.Bytes
+	cl.report("temporary files", TmpBasePath)
+
+	// remove cache directories of repos no longer in the Yumfile
+	ids := make(map[string]bool, len(c.Repos))
+	cacheDirs := make(map[string]bool, 0)
+	for _, repo := range c.Repos {
+		ids[repo.ID] = true
+		cacheDirs[repo.CacheDir()] = true
+	}
+
+	if err := cl.cleanUpMetadataCache(); err != nil {
+		return err
+	}
+	total += cl.Bytes
+	cl.report("unused decompressed metadata", metadataCacheDir())
+
+	for dir := range cacheDirs {
+		if err := cl.cleanUpCache(dir, ids); err != nil {
+			return err
+		}
+		total += cl.Bytes
+		cl.report("stale cache directories", dir)
+	}
+
+	for i := range c.Repos {
+		n, err := cl.cleanUpRepo(&c.Repos[i])
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+
+	stores := make(map[string]bool, 0)
+	for _, repo := range c.Repos {
+		if repo.StorePath != "" && !stores[repo.StorePath] {
+			stores[repo.StorePath] = true
+			if err := cl.cleanUpStore(repo.StorePath); err != nil {
+				return err
+			}
+			total += cl.Bytes
+			cl.report("unreferenced packages", repo.StorePath)
+		}
+	}
+
+	if opts.DryRun {
+		Printf("Would free %s\n", formatBytes(total))
+	} else {
+		Printf("Freed %s\n", formatBytes(total))
+	}
+
+	return nil
+}
+
+// cleanUpRepo removes the incomplete downloads and superseded metadata files
+// of a repo and returns the number of bytes freed. Repos which are being
+// synchronized are skipped, as their downloads and metadata are in use.
+func (c *cleaner) cleanUpRepo(repo *Repo) (int64, error) {
+	var total int64
+	if _, err := os.Stat(repo.repoLockPath()); err == nil {
+		l, owner, err := tryLock(repo.repoLockPath(), false)
+		if err != nil {
+			return 0, err
+		}
+		if owner != nil {
+			Printf("Skipping %s (in use by %s)\n", repo.ID, owner)
+			return 0, nil
+		}
+		defer l.Unlock()
+	}
+
+	if err := c.cleanUpPartFiles(repo.Path()); err != nil {
+		return 0, err
+	}
+	total += c.Bytes
+	c.report("incomplete downloads", repo.Path())
+
+	if staging := repo.downloadStagingDir(); staging != "" {
+		if err := c.cleanUpPartFiles(staging); err != nil {
+			return 0, err
+		}
+		total += c.Bytes
+		c.report("incomplete downloads", staging)
+	}
+
+	if err := c.cleanUpRepodata(repo.Path(), repo.RetainOldMetadata); err != nil {
+		return 0, err
+	}
+	total += c.Bytes
+	c.report("superseded metadata files", repo.Path())
+
+	return total, nil
+}
+
+// cleanUpTempFiles removes all temporary files in TmpBasePath which were
+// created by a y10k process that is no longer running, or which are older
+// than the maximum age.
+func (c *cleaner) cleanUpTempFiles() error {
+	files, err := ioutil.ReadDir(TmpBasePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pattern := tempFilePattern()
+	for _, file := range files {
+		m := pattern.FindStringSubmatch(file.Name())
+		if m == nil {
+			continue
+		}
+
+		pid, _ := strconv.Atoi(m[1])
+		aged := c.MaxAge > 0 && time.Since(file.ModTime()) > c.MaxAge
+		if processAlive(pid) && (pid == os.Getpid() || !aged) {
+			Dprintf("Skipping %s (PID %d is still running)\n", file.Name(), pid)
+			continue
+		}
+
+		if err := c.remove(filepath.Join(TmpBasePath, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeStaleTempFiles removes the temporary files, such as the yum.conf and
+// log files, which y10k processes that have exited left in TmpBasePath, so
+// that failed runs do not accumulate them between runs of the clean command
+func removeStaleTempFiles() {
+	cl := &cleaner{CleanOptions: CleanOptions{MaxAge: staleTempFileMaxAge}}
+	if err := cl.cleanUpTempFiles(); err != nil {
+		Warnf(err, "Error removing stale temporary files")
+	}
+
+	if cl.Files > 0 {
+		Dprintf("Removed %d stale temporary files (%s) from %s\n", cl.Files, formatBytes(cl.Bytes), TmpBasePath)
+	}
+}
+
+// cleanUpCache removes directories from a yum cache directory which do not
+// belong to any of the given repos. Directories which are locked by another
+// process, such as a y10k run with another Yumfile sharing the cache
+// directory, are skipped.
+func (c *cleaner) cleanUpCache(dir string, ids map[string]bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || ids[file.Name()] || file.Name() == metadataCacheDirName {
+			continue
+		}
+
+		path := filepath.Join(dir, file.Name())
+		unlock, owner, err := lockCacheDir(path)
+		if err != nil {
+			return err
+		}
+		if owner != nil {
+			Dprintf("Skipping %s (in use by %s)\n", path, owner)
+			continue
+		}
+
+		err = c.remove(path)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lockCacheDir locks the sync and reader lock files of a repo cache directory
+// without waiting, so that it can be removed. If either is held by another
+// process, its owner is returned instead.
+func lockCacheDir(dir string) (func(), *lockOwner, error) {
+	locks := make([]*fileLock, 0, 2)
+	unlock := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+
+	for _, name := range []string{cacheLockName, cacheReadLockName} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		l, owner, err := tryLock(path, false)
+		if err != nil || owner != nil {
+			unlock()
+			return nil, owner, err
+		}
+		locks = append(locks, l)
+	}
+
+	return unlock, nil, nil
+}
+
+// cleanUpPartFiles removes incomplete downloads from a repo directory
+func (c *cleaner) cleanUpPartFiles(path string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// segmented downloads leave a marker beside the part file
+		if info.IsDir() || !strings.HasSuffix(p, partFileSuffix) && !strings.HasSuffix(p, partFileSuffix+".segments") {
+			return nil
+		}
+
+		return c.remove(p)
+	})
+}
+
+// cleanUpRepodata removes metadata files which are not referenced by a repo's
+// repomd.xml, and temporary metadata directories left by createrepo. The
+// newest retain unreferenced files of each type, such as primary.xml.gz, are
+// kept, as createrepo keeps them for retain_old_md.
+func (c *cleaner) cleanUpRepodata(path string, retain int) error {
+	for _, name := range []string{".repodata", ".olddata"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			if err := c.remove(filepath.Join(path, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	dir := filepath.Join(path, "repodata")
+	repomd, err := ReadRepomd(filepath.Join(dir, "repomd.xml"))
+	if err != nil {
+		// nothing is known to be superseded without a valid repomd.xml
+		Dprintf("Skipping metadata cleanup of %s: %v\n", path, err)
+		return nil
+	}
+
+	referenced := make(map[string]bool, len(repomd.Data))
+	for _, data := range repomd.Data {
+		referenced[filepath.Base(data.Location.Href)] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// newest first, so the first retain files of each type are kept
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	retained := make(map[string]int, 0)
+	for _, file := range files {
+		if file.IsDir() || referenced[file.Name()] || repodataKeepFiles[file.Name()] {
+			continue
+		}
+
+		// files are named <checksum>-<type>
+		if k := strings.Index(file.Name(), "-"); k > 0 && retain > 0 {
+			typ := file.Name()[k+1:]
+			if retained[typ] < retain {
+				retained[typ]++
+				continue
+			}
+		}
+
+		if err := c.remove(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cleanUpStore removes packages from a package store which are no longer
+// linked from any repo or snapshot
+func (c *cleaner) cleanUpStore(store string) error {
+	return filepath.Walk(store, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(p, ".rpm") {
+			return nil
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Nlink > 1 {
+			return nil
+		}
+
+		return c.remove(p)
+	})
+}
+
+// diskUsage returns the total size of a file or directory tree
+func diskUsage(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+// processAlive returns true if a process with the given PID is running
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	if pid == os.Getpid() {
+		return true
+	}
+
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
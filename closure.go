@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Comparison bits of capability flags, as used by rpm to compare version
+// ranges
+const (
+	capLess = 1 << iota
+	capGreater
+	capEqual
+)
+
+// capabilityFlagBits maps the flags of a capability to comparison bits
+var capabilityFlagBits = map[string]int{
+	"EQ": capEqual,
+	"LT": capLess,
+	"LE": capLess | capEqual,
+	"GT": capGreater,
+	"GE": capGreater | capEqual,
+}
+
+// ClosureProblem is a requirement of a package which no package in the
+// checked repos provides
+type ClosureProblem struct {
+	Repo     string `json:"repo"`
+	NEVRA    string `json:"nevra"`
+	Requires string `json:"requires"`
+
+	// Filtered is true if the upstream of the checked repos provides the
+	// requirement, so it was lost to filtering
+	Filtered bool `json:"filtered"`
+}
+
+// ClosureResult is the result of a dependency closure check of a repo
+type ClosureResult struct {
+	Repo     string           `json:"repo"`
+	With     []string         `json:"with,omitempty"`
+	Packages int              `json:"packages"`
+	Problems []ClosureProblem `json:"problems"`
+
+	// Upstream is true if the upstream metadata of every checked repo was
+	// read, so Filtered is known for each problem
+	Upstream bool `json:"upstream_checked"`
+}
+
+// Passed returns true if every requirement of the repo was resolved
+func (c *ClosureResult) Passed() bool {
+	return len(c.Problems) == 0
+}
+
+// providerIndex indexes the capabilities and files provided by packages
+type providerIndex struct {
+	caps  map[string][]Capability
+	files map[string]bool
+}
+
+func newProviderIndex() *providerIndex {
+	return &providerIndex{
+		caps:  make(map[string][]Capability, 0),
+		files: make(map[string]bool, 0),
+	}
+}
+
+// add indexes the capabilities and files provided by a package, including
+// the implicit provide of its own name and version
+func (c *providerIndex) add(pkg *Package) {
+	v := pkg.Version
+	c.caps[pkg.Name] = append(c.caps[pkg.Name], Capability{Name: pkg.Name, Flags: "EQ", Epoch: v.Epoch, Version: v.Version, Release: v.Release})
+	for _, p := range pkg.Format.Provides {
+		c.caps[p.Name] = append(c.caps[p.Name], p)
+	}
+	for _, file := range pkg.Format.Files {
+		c.files[file] = true
+	}
+}
+
+// addPrimary indexes every package in a primary metadata file
+func (c *providerIndex) addPrimary(path string) (int, error) {
+	n := 0
+	err := EachPackage(path, func(pkg *Package) error {
+		c.add(pkg)
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// Satisfies returns true if any indexed package provides a requirement
+func (c *providerIndex) Satisfies(req Capability) bool {
+	if strings.HasPrefix(req.Name, "/") && c.files[req.Name] {
+		return true
+	}
+
+	for _, p := range c.caps[req.Name] {
+		if capabilitiesOverlap(p, req) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// capabilityEVR returns the epoch, version and release of a capability
+func capabilityEVR(c Capability) Version {
+	return Version{Epoch: c.Epoch, Version: c.Version, Release: c.Release}
+}
+
+// capabilitiesOverlap returns true if the version range of a provide
+// overlaps that of a requirement, as rpm decides it. A provide or
+// requirement without a version matches any version, and releases are only
+// compared if both have one.
+func capabilitiesOverlap(provide, req Capability) bool {
+	a, b := capabilityFlagBits[provide.Flags], capabilityFlagBits[req.Flags]
+	if a == 0 || b == 0 || provide.Version == "" || req.Version == "" {
+		return true
+	}
+
+	pv, rv := capabilityEVR(provide), capabilityEVR(req)
+	if pv.Release == "" || rv.Release == "" {
+		pv.Release, rv.Release = "", ""
+	}
+
+	switch sense := compareVersions(pv, rv); {
+	case sense < 0:
+		return a&capGreater != 0 || b&capLess != 0
+	case sense > 0:
+		return a&capLess != 0 || b&capGreater != 0
+	default:
+		return (a&capEqual != 0 && b&capEqual != 0) || (a&capLess != 0 && b&capLess != 0) || (a&capGreater != 0 && b&capGreater != 0)
+	}
+}
+
+// closureIgnored returns true if a requirement cannot be resolved from
+// repository metadata: rpmlib features, which are provided by rpm itself,
+// and rich dependencies
+func closureIgnored(req Capability) bool {
+	return strings.HasPrefix(req.Name, "rpmlib(") || strings.HasPrefix(req.Name, "(")
+}
+
+// localPrimary returns the path of the primary metadata of a local mirror
+func localPrimary(repo *Repo) (string, error) {
+	source, err := localDiffSource(repo.ID, repo.Path())
+	if err != nil {
+		return "", NewErrorf("Repo %s has not been synchronized: %v", repo.ID, err)
+	}
+
+	return source.Primary, nil
+}
+
+// upstreamPrimary returns the path of the primary metadata of a repo's
+// upstream, fetching it into the repo's upstream cache
+func upstreamPrimary(repo *Repo) (string, error) {
+	source, repomd, err := upstreamRepomd(repo)
+	if err != nil {
+		return "", err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return "", NewErrorf("No primary metadata found at %s", source)
+	}
+
+	if repo.RsyncURL() != "" {
+		return filepath.Join(source, data.Location.Href), nil
+	}
+
+	return repo.fetchUpstreamMetadata(source, data)
+}
+
+// CheckClosure resolves the requirements of every package in the local
+// metadata of a repo against the packages of the repo and the given other
+// repos, such as the base repo of an add-on, and returns the requirements
+// which cannot be resolved. Each of these is checked against the upstream
+// metadata of the same repos, to find requirements lost to filtering.
+func CheckClosure(repo *Repo, with []*Repo) (*ClosureResult, error) {
+	result := &ClosureResult{Repo: repo.ID, Problems: make([]ClosureProblem, 0)}
+
+	unlock, err := readLockCaches(append([]*Repo{repo}, with...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	primary, err := localPrimary(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newProviderIndex()
+	if result.Packages, err = index.addPrimary(primary); err != nil {
+		return nil, err
+	}
+	for _, r := range with {
+		path, err := localPrimary(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := index.addPrimary(path); err != nil {
+			return nil, err
+		}
+		result.With = append(result.With, r.ID)
+	}
+
+	Printf("Checking dependency closure of %d packages: %s\n", result.Packages, repo.ID)
+	unresolved := make(map[string]Capability, 0)
+	err = EachPackage(primary, func(pkg *Package) error {
+		seen := make(map[string]bool, len(pkg.Format.Requires))
+		for _, req := range pkg.Format.Requires {
+			s := req.String()
+			if seen[s] || closureIgnored(req) || index.Satisfies(req) {
+				continue
+			}
+			seen[s] = true
+
+			unresolved[s] = req
+			result.Problems = append(result.Problems, ClosureProblem{Repo: repo.ID, NEVRA: pkg.NEVRA(), Requires: s})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Problems) == 0 {
+		return result, nil
+	}
+
+	// find the requirements provided upstream, but filtered from the mirrors
+	upstream := newProviderIndex()
+	result.Upstream = true
+	for _, r := range append([]*Repo{repo}, with...) {
+		path, err := upstreamPrimary(r)
+		if err != nil {
+			Warnf(err, "Unable to read upstream metadata of %s; requirements lost to filtering are not identified", r.ID)
+			result.Upstream = false
+			continue
+		}
+		if _, err := upstream.addPrimary(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range result.Problems {
+		problem := &result.Problems[i]
+		problem.Filtered = upstream.Satisfies(unresolved[problem.Requires])
+	}
+
+	sort.SliceStable(result.Problems, func(i, j int) bool {
+		return result.Problems[i].NEVRA < result.Problems[j].NEVRA
+	})
+
+	return result, nil
+}
+
+// checkRequiredClosure fails the sync of a repo with require_closure if
+// filtering left requirements of its packages unresolved, before the repo is
+// published. Requirements which upstream cannot resolve either are only
+// logged, unless the upstream metadata could not be read.
+func (c *Yumfile) checkRequiredClosure(repo *Repo, report *RepoReport) error {
+	if !repo.RequireClosure {
+		return nil
+	}
+
+	with := make([]*Repo, 0, len(repo.ClosureWith))
+	for _, id := range repo.ClosureWith {
+		r := c.GetRepoByID(id)
+		if r == nil {
+			return NewErrorf("No such repo for closure check of %s: %s", repo.ID, id)
+		}
+		with = append(with, r)
+	}
+
+	result, err := CheckClosure(repo, with)
+	if err != nil {
+		return err
+	}
+
+	broken := make([]ClosureProblem, 0)
+	for _, problem := range result.Problems {
+		if problem.Filtered || !result.Upstream {
+			Errorf(nil, "%s of %s requires %s, which no mirrored package provides", problem.NEVRA, repo.ID, problem.Requires)
+			broken = append(broken, problem)
+		} else {
+			Warnf(nil, "%s of %s requires %s, which upstream does not provide either", problem.NEVRA, repo.ID, problem.Requires)
+		}
+	}
+
+	if len(broken) == 0 {
+		return nil
+	}
+
+	report.Unresolved = broken
+	return NewErrorf("%d requirements cannot be resolved", len(broken))
+}
+
+// PrintClosureResults prints the unresolved requirements of each package,
+// followed by a summary of each repo
+func PrintClosureResults(results []*ClosureResult) {
+	for _, result := range results {
+		nevra := ""
+		for _, problem := range result.Problems {
+			if problem.NEVRA != nevra {
+				nevra = problem.NEVRA
+				fmt.Printf("%s (%s)\n", nevra, problem.Repo)
+			}
+
+			note := ""
+			if problem.Filtered {
+				note = " (provided upstream, but filtered)"
+			}
+			fmt.Printf("  unresolved: %s%s\n", problem.Requires, note)
+		}
+
+		with := ""
+		if len(result.With) > 0 {
+			with = " with " + strings.Join(result.With, ", ")
+		}
+		fmt.Printf("%s: %d packages, %d unresolved requirements%s\n", result.Repo, result.Packages, len(result.Problems), with)
+	}
+}
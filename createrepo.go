@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Tools which generate the metadata of a repo
+const (
+	// CreaterepoAuto uses createrepo_c if it is installed, as on EL8 and
+	// later where classic createrepo is gone, and createrepo otherwise
+	CreaterepoAuto = "auto"
+
+	// Createrepo is the classic createrepo, written in Python
+	Createrepo = "createrepo"
+
+	// CreaterepoC is createrepo_c, the C rewrite of createrepo
+	CreaterepoC = "createrepo_c"
+)
+
+// compressTypes are the compression types createrepo_c may use for metadata
+var compressTypes = map[string]bool{
+	"gz":   true,
+	"bz2":  true,
+	"xz":   true,
+	"zck":  true,
+	"zstd": true,
+}
+
+var (
+	detectedCreaterepo   string
+	detectCreaterepoOnce sync.Once
+)
+
+// parseCreaterepoTool parses the createrepo_tool option of a repo
+func parseCreaterepoTool(s string) (string, error) {
+	switch s = strings.ToLower(s); s {
+	case CreaterepoAuto, Createrepo, CreaterepoC:
+		return s, nil
+	}
+
+	return "", NewErrorf("Invalid createrepo_tool: %s (expected auto, createrepo or createrepo_c)", s)
+}
+
+// parseCompressType parses the compress_type option of a repo
+func parseCompressType(s string) (string, error) {
+	if s = strings.ToLower(s); !compressTypes[s] {
+		return "", NewErrorf("Invalid compress_type: %s (expected gz, bz2, xz, zck or zstd)", s)
+	}
+
+	return s, nil
+}
+
+// detectCreaterepo returns createrepo_c if it is installed, or else
+// createrepo
+func detectCreaterepo() string {
+	detectCreaterepoOnce.Do(func() {
+		detectedCreaterepo = Createrepo
+		if _, err := exec.LookPath(CreaterepoC); err == nil {
+			detectedCreaterepo = CreaterepoC
+		}
+		Dprintf("Detected %s for metadata generation\n", detectedCreaterepo)
+	})
+
+	return detectedCreaterepo
+}
+
+// createrepoTool returns the tool which generates the metadata of a repo
+func (c *Repo) createrepoTool() string {
+	if c.CreaterepoTool == "" || c.CreaterepoTool == CreaterepoAuto {
+		return detectCreaterepo()
+	}
+
+	return c.CreaterepoTool
+}
+
+// modifyrepoTool returns the tool which adds metadata, such as updateinfo, to
+// a repo generated by its createrepo tool
+func (c *Repo) modifyrepoTool() string {
+	if c.createrepoTool() == CreaterepoC {
+		return "modifyrepo_c"
+	}
+
+	return "modifyrepo"
+}
+
+// createrepoToolArgs returns the arguments specific to the createrepo tool of
+// a repo. The options which only createrepo_c supports are ignored with a
+// warning for classic createrepo.
+func (c *Repo) createrepoToolArgs() []string {
+	args := []string{}
+	if c.RetainOldMetadata > 0 {
+		args = append(args, fmt.Sprintf("--retain-old-md=%d", c.RetainOldMetadata))
+	}
+
+	if c.createrepoTool() != CreaterepoC {
+		if c.Zchunk || c.CompressType != "" {
+			Warnf(nil, "zck and compress_type of %s require createrepo_c and are ignored by createrepo", c.ID)
+		}
+		return args
+	}
+
+	if c.Zchunk {
+		args = append(args, "--zck")
+	}
+
+	if c.CompressType != "" {
+		args = append(args, "--general-compress-type="+c.CompressType)
+	}
+
+	return args
+}
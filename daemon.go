@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultDaemonInterval is how often the daemon synchronizes repos which have
+// no schedule or interval
+const DefaultDaemonInterval = 24 * time.Hour
+
+// daemonRepo is the schedule and last outcome of a repo managed by the daemon
+type daemonRepo struct {
+	Repo     *Repo     `json:"-"`
+	ID       string    `json:"id"`
+	Status   string    `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	LastSync time.Time `json:"last_sync"`
+	NextSync time.Time `json:"next_sync"`
+}
+
+// Daemon stays resident and synchronizes each repo of a Yumfile when it is
+// due according to its schedule or interval. Repos are synchronized one at a
+// time.
+type Daemon struct {
+	Path string
+
+	// Interval is the sync interval of repos with no schedule or interval
+	Interval time.Duration
+
+	// Jitter is the maximum random delay added to each sync, so that many
+	// repos or mirrors do not all start at once
+	Jitter time.Duration
+
+	// Listen is the address where health and metrics are served, or empty
+	Listen      string
+	MetricsPath string
+
+	// Watch is how often the Yumfile and its includes are checked for
+	// changes, or zero to only reload on SIGHUP
+	Watch time.Duration
+
+	mu        sync.Mutex
+	yumfile   *Yumfile
+	repos     []*daemonRepo
+	signature string
+	running   string
+	started   time.Time
+}
+
+// daemonHealth is the document served by the health endpoint
+type daemonHealth struct {
+	Status  string        `json:"status"`
+	Started time.Time     `json:"started"`
+	Running string        `json:"running,omitempty"`
+	Repos   []*daemonRepo `json:"repos"`
+}
+
+// NewDaemon returns a daemon for the Yumfile at the given path
+func NewDaemon(path string) *Daemon {
+	return &Daemon{
+		Path:        path,
+		Interval:    DefaultDaemonInterval,
+		MetricsPath: "/metrics",
+	}
+}
+
+// jitter returns a random delay of up to the configured jitter
+func (c *Daemon) jitter() time.Duration {
+	if c.Jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(c.Jitter)))
+}
+
+// load loads the Yumfile and schedules each of its repos. A repo is next due
+// after its last recorded sync, so a restart does not synchronize every repo
+// again; repos which were never synchronized, or missed their last sync while
+// the daemon was stopped, are due immediately.
+//
+// When the Yumfile is reloaded, repos which were added or removed are
+// scheduled or dropped, and repos whose schedule changed are rescheduled from
+// their last sync. Other repos keep their schedule. A repo being synchronized
+// finishes with its previous configuration.
+func (c *Daemon) load() error {
+	yumfile, err := LoadYumfile(c.Path)
+	if err != nil {
+		return err
+	}
+
+	if errs := yumfile.CheckPaths(yumfile.Repos); len(errs) > 0 {
+		for _, err := range errs {
+			Errorf(err, "Invalid path")
+		}
+		return NewErrorf("Found %d invalid paths in Yumfile", len(errs))
+	}
+	yumfile.Progress = false
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reload := c.yumfile != nil
+	previous := make(map[string]*daemonRepo, len(c.repos))
+	for _, r := range c.repos {
+		previous[r.ID] = r
+	}
+
+	now := time.Now()
+	repos := make([]*daemonRepo, 0, len(yumfile.Repos))
+	for i := range yumfile.Repos {
+		repo := &yumfile.Repos[i]
+
+		// pull-through repos are populated on demand by the serve command,
+		// and disabled repos are never synchronized
+		if repo.PullThrough || repo.Disabled {
+			continue
+		}
+
+		r := &daemonRepo{Repo: repo, ID: repo.ID}
+		p, ok := previous[repo.ID]
+		delete(previous, repo.ID)
+
+		switch {
+		case ok && repoSchedule(p.Repo) == repoSchedule(repo):
+			*r = *p
+			r.Repo = repo
+			if p.Repo.optionsHash() != repo.optionsHash() {
+				Printf("Reconfigured repo %s\n", repo.ID)
+			}
+			repos = append(repos, r)
+			continue
+
+		case ok:
+			r.Status, r.Error, r.LastSync = p.Status, p.Error, p.LastSync
+			Printf("Rescheduled repo %s\n", repo.ID)
+
+		default:
+			m, err := readRepoMetrics(repo)
+			if err != nil {
+				Warnf(err, "Error reading metrics of %s", repo.ID)
+				m = &repoMetrics{}
+			}
+			r.LastSync = m.LastSync
+			if reload {
+				Printf("Added repo %s\n", repo.ID)
+			}
+		}
+
+		r.NextSync = now
+		if !r.LastSync.IsZero() {
+			if next := repo.NextSync(r.LastSync, c.Interval); next.After(now) {
+				r.NextSync = next
+			}
+		}
+		r.NextSync = c.deferToWindow(repo, r.NextSync)
+
+		Printf("Next sync of %s at %s\n", repo.ID, r.NextSync.Format(time.RFC3339))
+		repos = append(repos, r)
+	}
+
+	for id := range previous {
+		Printf("Removed repo %s\n", id)
+	}
+
+	c.yumfile = yumfile
+	c.repos = repos
+	c.signature = yumfileSignature(yumfile)
+
+	return nil
+}
+
+// deferToWindow adds jitter to the time a repo is due and, if that is outside
+// the repo's allowed_window, defers it until the window next opens
+func (c *Daemon) deferToWindow(repo *Repo, t time.Time) time.Time {
+	t = t.Add(c.jitter())
+	if repo.AllowedWindow != nil {
+		t = repo.AllowedWindow.Next(t)
+	}
+
+	return t
+}
+
+// repoSchedule returns the schedule, interval and allowed window of a repo as
+// a string, so that a change to them can be detected
+func repoSchedule(repo *Repo) string {
+	window := ""
+	if repo.AllowedWindow != nil {
+		window = " allowed_window=" + repo.AllowedWindow.String()
+	}
+
+	if repo.Schedule != nil {
+		return "schedule=" + repo.Schedule.String() + window
+	}
+
+	return "interval=" + repo.Interval.String() + window
+}
+
+// yumfileSignature returns the modification time and size of each file of a
+// Yumfile and the files matching its include patterns, so that changes to
+// any of them, including new includes, can be detected
+func yumfileSignature(yumfile *Yumfile) string {
+	files := append([]string{}, yumfile.Files...)
+	for _, pattern := range yumfile.Includes {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	sig := &bytes.Buffer{}
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			fmt.Fprintf(sig, "%s %d %d\n", file, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(sig, "%s missing\n", file)
+		}
+	}
+
+	return sig.String()
+}
+
+// reload reloads the Yumfile, keeping the previous configuration if it is
+// invalid
+func (c *Daemon) reload() {
+	Printf("Reloading %s\n", c.Path)
+	if err := c.load(); err != nil {
+		Errorf(err, "Error reloading Yumfile; keeping the previous configuration")
+	}
+}
+
+// changed returns true if any file of the Yumfile has changed since it was
+// last checked
+func (c *Daemon) changed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sig := yumfileSignature(c.yumfile)
+	if sig == c.signature {
+		return false
+	}
+
+	// an invalid Yumfile is only reported once per change
+	c.signature = sig
+	return true
+}
+
+// next returns the repo which is due next, or nil if there are none
+func (c *Daemon) next() *daemonRepo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next *daemonRepo
+	for _, r := range c.repos {
+		if r.NextSync.IsZero() {
+			continue
+		}
+
+		if next == nil || r.NextSync.Before(next.NextSync) {
+			next = r
+		}
+	}
+
+	return next
+}
+
+// sync synchronizes a repo and schedules its next sync. The Yumfile may be
+// reloaded before or while the repo is synchronized, in which case the repo's
+// current configuration is used to schedule it, if it still exists.
+func (c *Daemon) sync(id string) {
+	c.mu.Lock()
+	var repo Repo
+	found := false
+	for _, r := range c.repos {
+		if r.ID == id {
+			repo = *r.Repo
+			found = true
+		}
+	}
+	if !found {
+		c.mu.Unlock()
+		Printf("Repo %s was removed from the Yumfile before it was synchronized\n", id)
+		return
+	}
+	c.running = id
+	yumfile := c.yumfile
+	c.mu.Unlock()
+
+	start := time.Now()
+
+	// failures are logged and recorded in the report by Sync
+	report, _ := yumfile.Sync([]Repo{repo})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running = ""
+
+	var r *daemonRepo
+	for _, state := range c.repos {
+		if state.ID == id {
+			r = state
+		}
+	}
+	if r == nil {
+		Printf("Repo %s was removed from the Yumfile while it was synchronized\n", id)
+		return
+	}
+
+	if len(report.Repos) > 0 {
+		r.Status = report.Repos[0].Status
+		r.Error = report.Repos[0].Error
+
+		// a sync stopped by its window closing is not finished, and
+		// resumes when the window next opens
+		if report.Repos[0].WindowClosed && r.Repo.AllowedWindow != nil {
+			r.NextSync = c.deferToWindow(r.Repo, time.Now())
+			Printf("Next sync of %s at %s\n", r.ID, r.NextSync.Format(time.RFC3339))
+			return
+		}
+	}
+
+	r.LastSync = start
+	r.NextSync = r.Repo.NextSync(start, c.Interval)
+	if r.NextSync.IsZero() {
+		Warnf(nil, "Schedule of %s never matches; it will not be synchronized again", r.ID)
+		return
+	}
+
+	// never run a repo back to back if its sync took longer than its interval
+	if now := time.Now(); r.NextSync.Before(now) {
+		r.NextSync = r.Repo.NextSync(now, c.Interval)
+	}
+	r.NextSync = c.deferToWindow(r.Repo, r.NextSync)
+
+	Printf("Next sync of %s at %s\n", r.ID, r.NextSync.Format(time.RFC3339))
+}
+
+// Run synchronizes repos as they become due until y10k is asked to stop, when
+// the current sync is interrupted. The Yumfile is reloaded on SIGHUP, or when
+// it changes if Watch is set, including while a repo is being synchronized.
+func (c *Daemon) Run() error {
+	rand.Seed(time.Now().UnixNano())
+	c.started = time.Now()
+
+	if err := c.load(); err != nil {
+		return err
+	}
+
+	if c.Listen != "" {
+		go func() {
+			Printf("Serving health checks on %s\n", c.Listen)
+			if err := http.ListenAndServe(c.Listen, c); err != nil {
+				Fatalf(err, "Error serving health checks")
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	// SIGINT and SIGTERM interrupt the current sync
+	shutdown := ShutdownContext().Done()
+
+	var watch <-chan time.Time
+	if c.Watch > 0 {
+		ticker := time.NewTicker(c.Watch)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+
+	done := make(chan bool)
+	syncing := false
+	stopping := false
+	for {
+		if stopping && !syncing {
+			return nil
+		}
+
+		// only one repo is synchronized at a time; with no repos to
+		// schedule, wait for a reload or to be stopped
+		var timer *time.Timer
+		var due <-chan time.Time
+		var r *daemonRepo
+		if !syncing && !stopping {
+			if r = c.next(); r != nil {
+				timer = time.NewTimer(r.NextSync.Sub(time.Now()))
+				due = timer.C
+			}
+		}
+
+		select {
+		case <-signals:
+			c.reload()
+
+		case <-shutdown:
+			Printf("Stopping daemon\n")
+			shutdown = nil
+			stopping = true
+
+		case <-watch:
+			if c.changed() {
+				c.reload()
+			}
+
+		case <-done:
+			syncing = false
+
+		case <-due:
+			syncing = true
+			go func(id string) {
+				c.sync(id)
+				done <- true
+			}(r.ID)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// ServeHTTP serves the health of the daemon and metrics of its repos
+func (c *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	switch {
+	case urlPath == "/health" || urlPath == "/healthz":
+		c.serveHealth(w, r)
+
+	case c.MetricsPath != "" && urlPath == c.MetricsPath:
+		c.serveMetrics(w, r)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveHealth writes the schedule and last outcome of each repo as JSON. The
+// status is 503 Service Unavailable if the last sync of any repo failed.
+func (c *Daemon) serveHealth(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	health := &daemonHealth{
+		Status:  "ok",
+		Started: c.started,
+		Running: c.running,
+		Repos:   make([]*daemonRepo, len(c.repos)),
+	}
+	for i, repo := range c.repos {
+		state := *repo
+		health.Repos[i] = &state
+		if repo.Status == RepoStatusFailed {
+			health.Status = "failing"
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(health.Repos, func(i, j int) bool { return health.Repos[i].ID < health.Repos[j].ID })
+
+	b, err := json.MarshalIndent(health, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(b)
+	fmt.Fprintf(w, "\n")
+}
+
+// serveMetrics writes the sync statistics and next sync time of each repo in
+// the Prometheus text format
+func (c *Daemon) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	repos := make([]*Repo, len(c.repos))
+	next := make([]time.Time, len(c.repos))
+	for i, repo := range c.repos {
+		repos[i] = repo.Repo
+		next[i] = repo.NextSync
+	}
+	running := c.running
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", metricsContentType)
+	writeRepoMetrics(w, repos)
+
+	fmt.Fprintf(w, "# HELP y10k_repo_next_sync_timestamp_seconds Time the repo is next due to be synchronized.\n# TYPE y10k_repo_next_sync_timestamp_seconds gauge\n")
+	for i, repo := range repos {
+		if v, ok := timestamp(next[i]); ok {
+			fmt.Fprintf(w, "y10k_repo_next_sync_timestamp_seconds{repo=\"%s\"} %g\n", metricLabelEscaper.Replace(repo.ID), v)
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP y10k_repo_syncing Whether the repo is being synchronized.\n# TYPE y10k_repo_syncing gauge\n")
+	for _, repo := range repos {
+		syncing := 0
+		if repo.ID == running {
+			syncing = 1
+		}
+		fmt.Fprintf(w, "y10k_repo_syncing{repo=\"%s\"} %d\n", metricLabelEscaper.Replace(repo.ID), syncing)
+	}
+
+	if v, ok := timestamp(c.started); ok {
+		fmt.Fprintf(w, "# HELP y10k_daemon_start_time_seconds Time the daemon was started.\n# TYPE y10k_daemon_start_time_seconds gauge\ny10k_daemon_start_time_seconds %g\n", v)
+	}
+}
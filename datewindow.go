@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// dateBoundLayouts are the absolute date formats accepted by min_date and
+// max_date. Dates without a time zone are read as UTC, so a window means the
+// same thing on every host.
+var dateBoundLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// parseDateBound parses a bound of a date window: an RFC3339 timestamp, a
+// date such as 2024-01-31, or a time relative to now such as -30d, -12w or
+// -72h
+func parseDateBound(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if isRelativeDateBound(s) {
+		d, err := parseRetention(strings.TrimPrefix(s, "-"))
+		if err != nil {
+			return time.Time{}, NewErrorf("Invalid date: %s", s)
+		}
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range dateBoundLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, NewErrorf("Invalid date: %s (expected RFC3339, YYYY-MM-DD or a relative time such as -30d)", s)
+}
+
+// isRelativeDateBound returns true if a bound of a date window is relative to
+// the current time
+func isRelativeDateBound(s string) bool {
+	return strings.HasPrefix(strings.TrimSpace(s), "-")
+}
+
+// hasRelativeDateWindow returns true if the packages in a repo's date window
+// depend on the current time
+func (c *Repo) hasRelativeDateWindow() bool {
+	return isRelativeDateBound(c.MinDate) || isRelativeDateBound(c.MaxDate)
+}
+
+// packageTime returns the build time of a package, or the time its file was
+// added to the upstream repo if date_type is file
+func (c *Repo) packageTime(pkg *upstreamPackage) int64 {
+	if c.DateType == "file" {
+		return pkg.FileTime
+	}
+	return pkg.BuildTime
+}
+
+// applyDateWindow excludes upstream packages outside the repo's min_date and
+// max_date window from the installed yum.conf, so they are not downloaded,
+// and returns them
+func (c *Yumfile) applyDateWindow(repo *Repo) ([]upstreamPackage, error) {
+	if repo.MinDate == "" && repo.MaxDate == "" {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var min, max time.Time
+	var err error
+	if repo.MinDate != "" {
+		if min, err = parseDateBound(repo.MinDate, now); err != nil {
+			return nil, err
+		}
+	}
+	if repo.MaxDate != "" {
+		if max, err = parseDateBound(repo.MaxDate, now); err != nil {
+			return nil, err
+		}
+	}
+
+	packages, err := c.repoquery(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]upstreamPackage, 0)
+	for i := range packages {
+		t := repo.packageTime(&packages[i])
+		if (!min.IsZero() && t < min.Unix()) || (!max.IsZero() && t > max.Unix()) {
+			filtered = append(filtered, packages[i])
+		}
+	}
+
+	Printf("Keeping %d of %d packages by %s time in the date window: %s\n", len(packages)-len(filtered), len(packages), repo.DateType, repo.ID)
+	if len(filtered) == 0 {
+		return filtered, nil
+	}
+
+	if err := c.excludeUpstream(repo, filtered); err != nil {
+		return nil, err
+	}
+
+	return filtered, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	centosURLPattern        = regexp.MustCompile("^(https?)://[^/]+/(?:[^/]+/)*?centos/(\\d+)(?:\\.[\\d.]+)?/[^/]+/([^/]+)/?$")
+	fedoraReleaseURLPattern = regexp.MustCompile("^(.*/releases/\\d+/[^/]+/[^/]+)/os/?$")
+	fedoraUpdateURLPattern  = regexp.MustCompile("^(.*/updates/\\d+/[^/]+/[^/]+)/?$")
+	epelURLPattern          = regexp.MustCompile("^(.*/epel/\\d+/(?:[^/]+/)?[^/]+)/?$")
+	mirrorlistRepoPattern   = regexp.MustCompile("([?&]repo=)([^&]+)")
+	srpmNamePattern         = regexp.MustCompile("^(.+)-[^-]+-[^-]+\\.(?:no)?src\\.rpm$")
+	rpmNamePattern          = regexp.MustCompile("^(.+)-[^-]+-[^-]+\\.[^.]+\\.rpm$")
+)
+
+// addDebugInfoRepos appends a companion debuginfo repo directly after each
+// repo with the debuginfo option enabled.
+func (c *Yumfile) addDebugInfoRepos() error {
+	repos := make([]Repo, 0, len(c.Repos))
+	for _, repo := range c.Repos {
+		repos = append(repos, repo)
+		if !repo.DebugInfo {
+			continue
+		}
+
+		debug, err := repo.debugInfoRepo()
+		if err != nil {
+			if err := c.repoError(&repo, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		repos = append(repos, *debug)
+	}
+
+	c.Repos = repos
+	return nil
+}
+
+// debugInfoClearedKeys are the options of a repo which are not copied to its
+// debuginfo companion
+var debugInfoClearedKeys = []string{
+	"as_of", "baseurl", "closure_with", "debuginfo", "debuginfourl", "groupfile",
+	"history_url", "merge_into", "metalink", "mirrorlist", "pin_revision",
+	"plugin", "preset", "preset_repo", "publish", "push", "require_closure",
+	"serve_prefix", "smoketest", "smoketest_with", "snapshotpath", "split",
+	"state_path",
+}
+
+// debugInfoRepo derives the companion debuginfo repo for a repo using the
+// standard Fedora/CentOS/EPEL URL layouts or the debuginfourl option. The
+// companion is a copy of the repo, so it shares its tags, schedule, window,
+// paths and permissions, without the options which describe the content or
+// upstream of the repo itself.
+func (c *Repo) debugInfoRepo() (*Repo, error) {
+	d := *c
+	debug := &d
+	debug.ID = c.ID + "-debuginfo"
+	debug.DebugInfo = false
+	debug.DebugInfoURL = ""
+	debug.DebugInfoFor = c.ID
+
+	// options which only apply to the content of the parent
+	debug.Groupfile = ""
+	debug.AsOf = ""
+	debug.PinRevision = ""
+	debug.HistoryURL = ""
+	debug.Preset = ""
+	debug.PresetRepo = ""
+	debug.PublishTargets = nil
+	debug.SnapshotPath = ""
+	debug.StatePath = ""
+	debug.SmokeTest = nil
+	debug.SmokeTestWith = nil
+	debug.RequireClosure = false
+	debug.ClosureWith = nil
+	debug.ServePrefix = ""
+	debug.Plugins = nil
+	debug.MergeInto = ""
+	debug.MergeSources = nil
+	debug.Splits = nil
+	debug.Mirrors = nil
+	debug.RsyncUpstream = ""
+
+	// slices and maps are copied so the companion cannot modify its parent
+	debug.Fingerprints = append([]string{}, c.Fingerprints...)
+	debug.Tags = append([]string{}, c.Tags...)
+	debug.Options = make(map[string]string, len(c.Options))
+	for key, val := range c.Options {
+		debug.Options[key] = val
+	}
+	debug.Inherited = make(map[string]bool, len(c.Inherited))
+	for key, val := range c.Inherited {
+		debug.Inherited[key] = val
+	}
+	for _, key := range debugInfoClearedKeys {
+		delete(debug.Options, key)
+		delete(debug.Inherited, key)
+	}
+
+	if c.LocalPath != "" {
+		debug.LocalPath = c.LocalPath + "-debuginfo"
+	}
+
+	if c.StagingPath != "" {
+		debug.StagingPath = c.StagingPath + "-debuginfo"
+	}
+
+	// inherit yum parameters except the upstream location
+	debug.Parameters = make(map[string]string, len(c.Parameters))
+	for key, val := range c.Parameters {
+		switch key {
+		case "baseurl", "mirrorlist", "metalink":
+		default:
+			debug.Parameters[key] = val
+		}
+	}
+
+	if name := c.Parameters["name"]; name != "" {
+		debug.Parameters["name"] = name + " - Debuginfo"
+	}
+
+	// derive upstream location
+	if c.DebugInfoURL != "" {
+		debug.Parameters["baseurl"] = c.DebugInfoURL
+	} else if baseurl := c.Parameters["baseurl"]; baseurl != "" {
+		url, err := deriveDebugInfoURL(baseurl)
+		if err != nil {
+			return nil, NewErrorf("%s for '%s' (in %s:%d)", err.Error(), c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+		debug.Parameters["baseurl"] = url
+	} else {
+		key := "mirrorlist"
+		if c.Parameters["metalink"] != "" {
+			key = "metalink"
+		}
+
+		url, err := deriveDebugInfoMirrorlist(c.Parameters[key])
+		if err != nil {
+			return nil, NewErrorf("%s for '%s' (in %s:%d)", err.Error(), c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+		debug.Parameters[key] = url
+	}
+
+	return debug, nil
+}
+
+// deriveDebugInfoURL returns the debuginfo base URL for a binary repo base URL
+func deriveDebugInfoURL(baseurl string) (string, error) {
+	if m := centosURLPattern.FindStringSubmatch(baseurl); m != nil {
+		return fmt.Sprintf("%s://debuginfo.centos.org/%s/%s/", m[1], m[2], m[3]), nil
+	}
+
+	if m := fedoraReleaseURLPattern.FindStringSubmatch(baseurl); m != nil {
+		return m[1] + "/debug/tree/", nil
+	}
+
+	if m := fedoraUpdateURLPattern.FindStringSubmatch(baseurl); m != nil {
+		return m[1] + "/debug/", nil
+	}
+
+	if m := epelURLPattern.FindStringSubmatch(baseurl); m != nil {
+		return m[1] + "/debug/", nil
+	}
+
+	return "", NewErrorf("Unable to derive debuginfo URL from %s; set debuginfourl", baseurl)
+}
+
+// deriveDebugInfoMirrorlist returns the debuginfo mirror list for a Fedora or
+// EPEL mirror list by inserting 'debug' before the release in the repo name,
+// E.g. 'repo=epel-7' becomes 'repo=epel-debug-7'.
+func deriveDebugInfoMirrorlist(mirrorlist string) (string, error) {
+	m := mirrorlistRepoPattern.FindStringSubmatchIndex(mirrorlist)
+	if m == nil {
+		return "", NewErrorf("Unable to derive debuginfo mirror list from %s; set debuginfourl", mirrorlist)
+	}
+
+	name := mirrorlist[m[4]:m[5]]
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return "", NewErrorf("Unable to derive debuginfo mirror list from %s; set debuginfourl", mirrorlist)
+	}
+
+	name = name[:i] + "-debug" + name[i:]
+	return mirrorlist[:m[4]] + name + mirrorlist[m[5]:], nil
+}
+
+// filterDebugInfo restricts a debuginfo companion repo to the debuginfo and
+// debugsource packages of the binaries mirrored locally by its parent repo.
+func (c *Yumfile) filterDebugInfo(repo *Repo) error {
+	parent := c.GetRepoByID(repo.DebugInfoFor)
+	if parent == nil {
+		return NewErrorf("No such repo found in Yumfile: %s", repo.DebugInfoFor)
+	}
+
+	names, err := mirroredSourceNames(parent.Path())
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return NewErrorf("No packages have been mirrored for %s", parent.ID)
+	}
+
+	patterns := make([]string, 0, len(names)*2)
+	for _, name := range names {
+		patterns = append(patterns, name+"-debuginfo", name+"-debugsource")
+	}
+
+	// restrict reposync without modifying the parameters shared with other
+	// copies of the repo, such as the one in the Yumfile
+	Dprintf("Including %d debuginfo packages for %s\n", len(patterns), repo.ID)
+	params := make(map[string]string, len(repo.Parameters)+1)
+	for key, val := range repo.Parameters {
+		params[key] = val
+	}
+	params["includepkgs"] = strings.Join(patterns, " ")
+	repo.Parameters = params
+
+	return nil
+}
+
+// mirroredSourceNames returns the sorted, unique binary and source package
+// names of all packages found in the given directory tree.
+func mirroredSourceNames(path string) ([]string, error) {
+	files, err := findPackages(path)
+	if err != nil {
+		return nil, err
+	}
+
+	unique := make(map[string]bool, 0)
+	binaries := make([]string, 0, len(files))
+	for _, file := range files {
+		if strings.HasSuffix(file, ".src.rpm") {
+			continue
+		}
+
+		// binary package name from filename
+		if m := rpmNamePattern.FindStringSubmatch(filepath.Base(file)); m != nil {
+			unique[m[1]] = true
+		}
+
+		binaries = append(binaries, file)
+	}
+
+	// source package names from package headers
+	srpms, err := queryPackages(binaries, "%{SOURCERPM}")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, srpm := range srpms {
+		if m := srpmNamePattern.FindStringSubmatch(srpm); m != nil {
+			unique[m[1]] = true
+		}
+	}
+
+	names := make([]string, 0, len(unique))
+	for name := range unique {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DedupReport describes how much disk space the packages of mirrored repos
+// and their snapshots use, and how much is shared through hardlinks
+type DedupReport struct {
+	Repos  []*DedupRepoReport `json:"repos"`
+	Size   int64              `json:"size"`
+	Used   int64              `json:"used"`
+	Saved  int64              `json:"saved"`
+	Linked int                `json:"linked"`
+}
+
+// DedupRepoReport describes the packages of one repo and its snapshots
+type DedupRepoReport struct {
+	Repo      string `json:"repo"`
+	Store     string `json:"store,omitempty"`
+	Packages  int    `json:"packages"`
+	Size      int64  `json:"size"`
+	Linked    int    `json:"linked"`
+	Snapshots int    `json:"snapshots"`
+	Error     string `json:"error,omitempty"`
+}
+
+// storedPackagePath returns the path of a package in a content-addressed
+// store, by its sha256 checksum
+func storedPackagePath(store, sum string) string {
+	return filepath.Join(store, sum[:2], sum+".rpm")
+}
+
+// dedupTrees returns the local path of a repo and the paths of its snapshots
+func dedupTrees(repo *Repo) ([]string, error) {
+	trees := []string{repo.Path()}
+	snapshots, err := ListSnapshots(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, snapshot := range snapshots {
+		trees = append(trees, filepath.Join(repo.SnapshotDir(), snapshot.Name))
+	}
+
+	return trees, nil
+}
+
+// dedupRepo replaces every package of a repo and its snapshots with a
+// hardlink to the copy of the same content in the repo's package store,
+// adding packages to the store which are not yet in it. Packages which are
+// identical across repos and snapshots then share the same disk space. The
+// number of packages replaced with a link is returned.
+func dedupRepo(repo *Repo) (int, error) {
+	if repo.StorePath == "" {
+		return 0, nil
+	}
+
+	trees, err := dedupTrees(repo)
+	if err != nil {
+		return 0, err
+	}
+
+	cache := LoadChecksumCache(repo, false)
+	linked := 0
+	for i, tree := range trees {
+		// snapshot directories are read-only
+		if i > 0 {
+			if err := setTreeWritable(tree, true); err != nil {
+				return linked, err
+			}
+		}
+
+		n, err := dedupTree(repo.StorePath, tree, cache)
+		linked += n
+
+		if i > 0 {
+			if werr := setTreeWritable(tree, false); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if err != nil {
+			return linked, err
+		}
+	}
+
+	if err := cache.Save(); err != nil {
+		return linked, err
+	}
+
+	if linked > 0 {
+		Printf("Linked %d packages to the package store: %s\n", linked, repo.ID)
+	}
+
+	return linked, nil
+}
+
+// dedupTree links the packages in a directory tree with a package store
+func dedupTree(store, root string, cache *ChecksumCache) (int, error) {
+	files, err := findPackages(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	// packages are hashed in parallel, but linked one at a time so copies of
+	// the same package do not race to be added to the store
+	sums, err := cache.SumAll(files)
+	if err != nil {
+		return 0, err
+	}
+
+	linked := 0
+	for i, path := range files {
+		if interrupted() {
+			return linked, errInterrupted
+		}
+
+		ok, err := linkStoredPackage(store, sums[i].Sum, path)
+		if err != nil {
+			return linked, err
+		}
+		if ok {
+			linked++
+		}
+	}
+
+	return linked, nil
+}
+
+// linkStoredPackage replaces a package with a hardlink to the stored copy of
+// its content, or adds it to the store if there is none. true is returned if
+// the package was replaced.
+func linkStoredPackage(store, sum, path string) (bool, error) {
+	stored := storedPackagePath(store, sum)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	sfi, err := os.Stat(stored)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(stored), 0755); err != nil {
+			return false, err
+		}
+		if err := os.Link(path, stored); err != nil {
+			return false, NewErrorf("Failed to add %s to the package store (store_path must be on the same filesystem as the repo): %v", path, err)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if os.SameFile(fi, sfi) {
+		return false, nil
+	}
+
+	// replace the package atomically, so it is never missing
+	tmp := fmt.Sprintf("%s.%d%s", path, os.Getpid(), partFileSuffix)
+	if err := os.Link(stored, tmp); err != nil {
+		return false, NewErrorf("Failed to link %s from the package store (store_path must be on the same filesystem as the repo): %v", path, err)
+	}
+
+	if err := renameSynced(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	Dprintf("Linked %s to %s\n", path, stored)
+	return true, nil
+}
+
+// NewDedupReport returns the disk space used by the packages of repos and their
+// snapshots. Files hardlinked more than once, whether through a package store
+// or between a repo and its snapshots, are counted once in the space used.
+func NewDedupReport(repos []Repo) *DedupReport {
+	report := &DedupReport{Repos: make([]*DedupRepoReport, 0, len(repos))}
+	seen := make(map[[2]uint64]bool, 0)
+	for i := range repos {
+		repo := &repos[i]
+		r := &DedupRepoReport{Repo: repo.ID, Store: repo.StorePath}
+		report.Repos = append(report.Repos, r)
+
+		trees, err := dedupTrees(repo)
+		if err != nil {
+			r.Error = err.Error()
+			continue
+		}
+		r.Snapshots = len(trees) - 1
+
+		for _, tree := range trees {
+			files, err := findPackages(tree)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				r.Error = err.Error()
+				break
+			}
+
+			for _, path := range files {
+				fi, err := os.Stat(path)
+				if err != nil {
+					continue
+				}
+
+				r.Packages++
+				r.Size += fi.Size()
+				st, ok := fi.Sys().(*syscall.Stat_t)
+				if !ok {
+					report.Used += fi.Size()
+					continue
+				}
+
+				if st.Nlink > 1 {
+					r.Linked++
+				}
+
+				key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+				if !seen[key] {
+					seen[key] = true
+					report.Used += fi.Size()
+				}
+			}
+		}
+
+		report.Size += r.Size
+		report.Linked += r.Linked
+	}
+	report.Saved = report.Size - report.Used
+
+	return report
+}
+
+// PrintDedupReport prints the packages and size of each repo and the space
+// saved by hardlinks across all of them
+func PrintDedupReport(report *DedupReport) {
+	fmt.Printf("%-30s %10s %10s %10s %10s\n", "REPO", "PACKAGES", "LINKED", "SNAPSHOTS", "SIZE")
+	for _, r := range report.Repos {
+		if r.Error != "" {
+			fmt.Printf("%-30s error: %s\n", r.Repo, r.Error)
+			continue
+		}
+		fmt.Printf("%-30s %10d %10d %10d %10s\n", r.Repo, r.Packages, r.Linked, r.Snapshots, formatBytes(r.Size))
+	}
+
+	percent := 0.0
+	if report.Size > 0 {
+		percent = float64(report.Saved) * 100 / float64(report.Size)
+	}
+	fmt.Printf("%s of packages use %s on disk; hardlinks save %s (%.1f%%)\n", formatBytes(report.Size), formatBytes(report.Used), formatBytes(report.Saved), percent)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deltaDirName is the directory within a repo where delta manifests are kept
+const deltaDirName = "y10k-deltas"
+
+// manifestFileName is the name of the full package manifest of a repo, from
+// which the next delta is computed
+const manifestFileName = "manifest.json"
+
+// ManifestEntry describes a package file in a repo manifest
+type ManifestEntry struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"sha256"`
+}
+
+// Manifest lists all package files in a repo at a metadata revision
+type Manifest struct {
+	Revision string          `json:"revision"`
+	Packages []ManifestEntry `json:"packages"`
+}
+
+// Delta lists the package files added and removed in one sync run
+type Delta struct {
+	Timestamp        time.Time       `json:"timestamp"`
+	Revision         string          `json:"revision"`
+	PreviousRevision string          `json:"previous_revision"`
+	Added            []ManifestEntry `json:"added"`
+	Removed          []ManifestEntry `json:"removed"`
+}
+
+// buildManifest computes the manifest of all packages in a local repo, using
+// the given cache to avoid hashing unchanged packages
+func buildManifest(path string, cache *ChecksumCache) (*Manifest, error) {
+	files, err := findPackages(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Packages: make([]ManifestEntry, 0, len(files)),
+	}
+
+	if repomd, err := ReadRepomd(filepath.Join(path, "repodata", "repomd.xml")); err == nil {
+		manifest.Revision = repomd.Revision
+	}
+
+	sums, err := cache.SumAll(files)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range files {
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Packages = append(manifest.Packages, ManifestEntry{
+			Path:     rel,
+			Size:     sums[i].Size,
+			Checksum: sums[i].Sum,
+		})
+	}
+
+	return manifest, nil
+}
+
+// sha256File returns the hex encoded sha256 checksum and size of a file
+func sha256File(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// readJSON decodes a JSON file into v
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON encodes v as indented JSON into a file, which is replaced
+// atomically so that other processes never read a partial file
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(append(b, '\n'))
+		return err
+	})
+}
+
+// diffManifests returns the packages added and removed between two manifests
+func diffManifests(prev, cur *Manifest) *Delta {
+	delta := &Delta{
+		Timestamp:        time.Now().UTC(),
+		Revision:         cur.Revision,
+		PreviousRevision: prev.Revision,
+		Added:            make([]ManifestEntry, 0),
+		Removed:          make([]ManifestEntry, 0),
+	}
+
+	prevIndex := make(map[string]ManifestEntry, len(prev.Packages))
+	for _, entry := range prev.Packages {
+		prevIndex[entry.Path] = entry
+	}
+
+	curIndex := make(map[string]bool, len(cur.Packages))
+	for _, entry := range cur.Packages {
+		curIndex[entry.Path] = true
+		if old, ok := prevIndex[entry.Path]; !ok || old.Checksum != entry.Checksum {
+			delta.Added = append(delta.Added, entry)
+		}
+	}
+
+	for _, entry := range prev.Packages {
+		if !curIndex[entry.Path] {
+			delta.Removed = append(delta.Removed, entry)
+		}
+	}
+
+	return delta
+}
+
+// writeDelta records the packages added and removed from a repo since the
+// last sync in a new delta manifest and prunes old deltas beyond the repo's
+// configured history. If the repo has a manifest signing key, the new delta
+// and the full manifest are signed, so consumers can verify which packages
+// the mirror added in each run.
+func (c *Yumfile) writeDelta(repo *Repo) error {
+	if repo.DeltaHistory <= 0 {
+		return nil
+	}
+
+	dir := filepath.Join(repo.Path(), deltaDirName)
+	manifestPath := filepath.Join(dir, manifestFileName)
+
+	prev := &Manifest{}
+	if err := readJSON(manifestPath, prev); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	cache := LoadChecksumCache(repo, c.VerifyAll)
+	cur, err := buildManifest(repo.Path(), cache)
+	if err != nil {
+		return err
+	}
+
+	if err := cache.Save(); err != nil {
+		return err
+	}
+
+	delta := diffManifests(prev, cur)
+	if len(delta.Added) > 0 || len(delta.Removed) > 0 {
+		name := delta.Timestamp.Format("20060102T150405Z") + ".json"
+		Dprintf("Writing delta manifest %s (%d added, %d removed)\n", name, len(delta.Added), len(delta.Removed))
+		if err := writeJSON(filepath.Join(dir, name), delta); err != nil {
+			return err
+		}
+
+		if repo.ManifestSignKey != "" {
+			if err := signFile(repo.ManifestSignKey, filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeJSON(manifestPath, cur); err != nil {
+		return err
+	}
+
+	if repo.ManifestSignKey != "" {
+		if err := signFile(repo.ManifestSignKey, manifestPath); err != nil {
+			return err
+		}
+	}
+
+	return pruneDeltas(dir, repo.DeltaHistory)
+}
+
+// pruneDeltas removes all but the newest n delta manifests from dir
+func pruneDeltas(dir string, n int) error {
+	deltas, err := listDeltas(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(deltas)-n; i++ {
+		Dprintf("Removing old delta manifest %s\n", deltas[i])
+		if err := os.Remove(filepath.Join(dir, deltas[i])); err != nil {
+			return err
+		}
+
+		if err := os.Remove(filepath.Join(dir, deltas[i]+".asc")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listDeltas returns the file names of all delta manifests in dir, oldest
+// first
+func listDeltas(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	deltas := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Name() != manifestFileName && strings.HasSuffix(file.Name(), ".json") {
+			deltas = append(deltas, file.Name())
+		}
+	}
+	sort.Strings(deltas)
+
+	return deltas, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RepoDiff lists the packages which differ between two versions of a repo,
+// such as a local mirror and its upstream. Packages are compared by name,
+// epoch, version, release and architecture; a package is changed if both
+// sides have it with a different checksum, as when upstream rebuilds a
+// package without bumping its release. Packages whose metadata uses different
+// checksum types, as when a mirror regenerates its metadata with sha512, are
+// compared by size instead.
+type RepoDiff struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Added   []DiffPackage `json:"added"`
+	Removed []DiffPackage `json:"removed"`
+	Changed []DiffPackage `json:"changed"`
+}
+
+// DiffPackage is a package listed in a RepoDiff
+type DiffPackage struct {
+	NEVRA        string `json:"nevra"`
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+}
+
+// Differs returns true if two packages with the same NEVRA have different
+// content
+func (c *DiffPackage) Differs(other *DiffPackage) bool {
+	if c.ChecksumType != other.ChecksumType {
+		return c.Size != other.Size
+	}
+
+	return c.Checksum != other.Checksum
+}
+
+// Empty returns true if there are no differences
+func (c *RepoDiff) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Changed) == 0
+}
+
+// diffSource is one side of a diff: a description and the path of its
+// primary metadata
+type diffSource struct {
+	Name    string
+	Primary string
+}
+
+// localDiffSource returns the primary metadata of a local repo tree, such as
+// a mirror or a snapshot
+func localDiffSource(name, root string) (*diffSource, error) {
+	repomd, err := ReadRepomd(filepath.Join(root, "repodata", "repomd.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return nil, NewErrorf("No primary metadata found in %s", root)
+	}
+
+	return &diffSource{Name: name, Primary: filepath.Join(root, data.Location.Href)}, nil
+}
+
+// upstreamDiffSource returns the current primary metadata of a repo's
+// upstream, fetching it into the repo's upstream cache
+func upstreamDiffSource(repo *Repo) (*diffSource, error) {
+	if repo.RsyncURL() != "" {
+		return nil, NewErrorf("Cannot compare %s with an rsync upstream; compare it with another mirror instead", repo.ID)
+	}
+
+	baseurl, repomd, err := repo.fetchUpstreamRepomd()
+	if err != nil {
+		return nil, err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return nil, NewErrorf("No primary metadata found at %s", baseurl)
+	}
+
+	path, err := repo.fetchUpstreamMetadata(baseurl, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &diffSource{Name: baseurl, Primary: path}, nil
+}
+
+// localDiffSpec returns a repo and the primary metadata of its local mirror,
+// or of one of its snapshots, described by a repo[@snapshot] spec
+func (c *Yumfile) localDiffSpec(spec string) (*Repo, *diffSource, error) {
+	id, snapshot := spec, ""
+	if i := strings.Index(spec, "@"); i >= 0 {
+		id, snapshot = spec[:i], spec[i+1:]
+		if err := validSnapshotName(snapshot); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	repo := c.GetRepoByID(id)
+	if repo == nil {
+		return nil, nil, NewErrorf("No such repo found in Yumfile: %s", id)
+	}
+
+	root := repo.Path()
+	if snapshot != "" {
+		root = filepath.Join(repo.SnapshotDir(), snapshot)
+	}
+
+	source, err := localDiffSource(spec, root)
+	return repo, source, err
+}
+
+// DiffRepos compares two repo trees. from is a repo ID for its local mirror
+// or repo@name for a snapshot or channel of a repo. to is either of those, or
+// "upstream" for the current upstream of the repo in from.
+func (c *Yumfile) DiffRepos(from, to string) (*RepoDiff, error) {
+	repo, a, err := c.localDiffSpec(from)
+	if err != nil {
+		return nil, err
+	}
+
+	var b *diffSource
+	if to == "upstream" {
+		// hold the upstream cache until the diff is read
+		var unlock func()
+		if unlock, err = readLockCaches(repo); err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		b, err = upstreamDiffSource(repo)
+	} else {
+		_, b, err = c.localDiffSpec(to)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return diffSources(a, b)
+}
+
+// normalChecksumType returns a checksum type found in repo metadata in lower
+// case, with the legacy name sha for sha1
+func normalChecksumType(typ string) string {
+	typ = strings.ToLower(typ)
+	if typ == "sha" {
+		return "sha1"
+	}
+
+	return typ
+}
+
+// readDiffPackages returns the packages listed in primary metadata, keyed by
+// NEVRA
+func readDiffPackages(path string) (map[string]DiffPackage, error) {
+	packages := make(map[string]DiffPackage, 0)
+	err := EachPackage(path, func(pkg *Package) error {
+		nevra := pkg.NEVRA()
+		packages[nevra] = DiffPackage{
+			NEVRA:        nevra,
+			Path:         filepath.Clean(pkg.Location.Href),
+			Size:         pkg.Size.Package,
+			Checksum:     strings.ToLower(pkg.Checksum.Value),
+			ChecksumType: normalChecksumType(pkg.Checksum.Type),
+		}
+		return nil
+	})
+
+	return packages, err
+}
+
+// diffSources compares the packages of two repo trees
+func diffSources(from, to *diffSource) (*RepoDiff, error) {
+	a, err := readDiffPackages(from.Primary)
+	if err != nil {
+		return nil, NewErrorf("Error reading %s: %v", from.Name, err)
+	}
+
+	b, err := readDiffPackages(to.Primary)
+	if err != nil {
+		return nil, NewErrorf("Error reading %s: %v", to.Name, err)
+	}
+
+	diff := &RepoDiff{
+		From:    from.Name,
+		To:      to.Name,
+		Added:   make([]DiffPackage, 0),
+		Removed: make([]DiffPackage, 0),
+		Changed: make([]DiffPackage, 0),
+	}
+
+	for nevra, pkg := range b {
+		old, ok := a[nevra]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, pkg)
+		case old.Differs(&pkg):
+			diff.Changed = append(diff.Changed, pkg)
+		}
+	}
+
+	for nevra, pkg := range a {
+		if _, ok := b[nevra]; !ok {
+			diff.Removed = append(diff.Removed, pkg)
+		}
+	}
+
+	for _, list := range [][]DiffPackage{diff.Added, diff.Removed, diff.Changed} {
+		sort.Sort(diffPackagesByNEVRA(list))
+	}
+
+	return diff, nil
+}
+
+// PrintDiff prints the packages added, removed and changed in a diff, one per
+// line prefixed with +, - or ~, followed by a summary
+func PrintDiff(diff *RepoDiff) {
+	for _, pkg := range diff.Added {
+		fmt.Printf("+ %s\n", pkg.NEVRA)
+	}
+	for _, pkg := range diff.Removed {
+		fmt.Printf("- %s\n", pkg.NEVRA)
+	}
+	for _, pkg := range diff.Changed {
+		fmt.Printf("~ %s\n", pkg.NEVRA)
+	}
+
+	var bytes int64
+	for _, pkg := range diff.Added {
+		bytes += pkg.Size
+	}
+	for _, pkg := range diff.Changed {
+		bytes += pkg.Size
+	}
+
+	fmt.Printf("%s -> %s: %d added, %d removed, %d changed (%s to download)\n", diff.From, diff.To, len(diff.Added), len(diff.Removed), len(diff.Changed), formatBytes(bytes))
+}
+
+// diffPackagesByNEVRA sorts packages by NEVRA
+type diffPackagesByNEVRA []DiffPackage
+
+func (c diffPackagesByNEVRA) Len() int           { return len(c) }
+func (c diffPackagesByNEVRA) Less(i, j int) bool { return c[i].NEVRA < c[j].NEVRA }
+func (c diffPackagesByNEVRA) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
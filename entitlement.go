@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultEntitlementPath is where subscription-manager stores entitlement
+// certificates
+const DefaultEntitlementPath = "/etc/pki/entitlement"
+
+// DefaultEntitlementCDN is the base URL of the Red Hat CDN
+const DefaultEntitlementCDN = "https://cdn.redhat.com"
+
+// DefaultEntitlementCACert is the CA certificate of the Red Hat CDN installed
+// by subscription-manager
+const DefaultEntitlementCACert = "/etc/rhsm/ca/redhat-uep.pem"
+
+// entitlementDataHeader starts the compressed content set payload of a v3
+// entitlement certificate
+const entitlementDataHeader = "-----BEGIN ENTITLEMENT DATA-----"
+
+// entitlementDataFooter ends the payload
+const entitlementDataFooter = "-----END ENTITLEMENT DATA-----"
+
+// EntitledContent is a content set granted by an entitlement certificate
+type EntitledContent struct {
+	Label   string   `json:"label"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Path    string   `json:"path"`
+	GPGURL  string   `json:"gpg_url"`
+	Arches  []string `json:"arches"`
+	Cert    string   `json:"-"`
+	CertKey string   `json:"-"`
+}
+
+// entitlementData is the decoded payload of a v3 entitlement certificate
+type entitlementData struct {
+	Products []struct {
+		Name    string            `json:"name"`
+		Content []EntitledContent `json:"content"`
+	} `json:"products"`
+}
+
+// ReadEntitlements returns the yum content sets granted by all entitlement
+// certificates in a directory, sorted by label. Each certificate <serial>.pem
+// must be accompanied by its key <serial>-key.pem.
+func ReadEntitlements(dir string) ([]EntitledContent, error) {
+	certs, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]EntitledContent, 0)
+	for _, cert := range certs {
+		if strings.HasSuffix(cert, "-key.pem") {
+			continue
+		}
+
+		key := strings.TrimSuffix(cert, ".pem") + "-key.pem"
+		if _, err := os.Stat(key); err != nil {
+			Dprintf("Skipping entitlement %s without key: %v\n", cert, err)
+			continue
+		}
+
+		data, err := readEntitlementData(cert)
+		if err != nil {
+			return nil, NewErrorf("Error reading entitlement %s: %v", cert, err)
+		}
+
+		for _, product := range data.Products {
+			for _, c := range product.Content {
+				if c.Type != "yum" {
+					continue
+				}
+
+				c.Cert, c.CertKey = cert, key
+				content = append(content, c)
+			}
+		}
+	}
+
+	sort.Sort(entitledContentByLabel(content))
+	return content, nil
+}
+
+// readEntitlementData decodes the zlib compressed JSON payload of a v3
+// entitlement certificate
+func readEntitlementData(path string) (*entitlementData, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := string(b)
+	i := strings.Index(s, entitlementDataHeader)
+	j := strings.Index(s, entitlementDataFooter)
+	if i < 0 || j < i {
+		return nil, NewErrorf("No entitlement data found; only v3 entitlement certificates are supported")
+	}
+
+	payload := strings.Join(strings.Fields(s[i+len(entitlementDataHeader):j]), "")
+	compressed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data := &entitlementData{}
+	if err := json.NewDecoder(r).Decode(data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// applyEntitlement sets the base URL and client certificate of a repo which
+// syncs content from the Red Hat CDN using a subscription entitlement. The
+// content set is selected by the repo's entitlement_label, or its ID.
+func (c *Repo) applyEntitlement() error {
+	if !c.Entitlement {
+		return nil
+	}
+
+	label := c.EntitlementLabel
+	if label == "" {
+		label = c.ID
+	}
+
+	if c.Parameters["baseurl"] != "" || c.Parameters["mirrorlist"] != "" || c.Parameters["metalink"] != "" {
+		return NewErrorf("Entitlement for '%s' conflicts with its baseurl, mirrorlist or metalink (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	dir := c.EntitlementPath
+	if dir == "" {
+		dir = DefaultEntitlementPath
+	}
+
+	content, err := ReadEntitlements(dir)
+	if err != nil {
+		return err
+	}
+
+	var entitled *EntitledContent
+	for i := range content {
+		if content[i].Label == label {
+			entitled = &content[i]
+			break
+		}
+	}
+
+	if entitled == nil {
+		return NewErrorf("No entitlement found in %s for '%s' (in %s:%d)", dir, label, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	path := entitled.Path
+	if strings.Contains(path, "$releasever") {
+		if c.Release == "" {
+			return NewErrorf("Entitled content %s for '%s' requires a release (in %s:%d)", label, c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+		path = strings.Replace(path, "$releasever", c.Release, -1)
+	}
+
+	cdn := c.EntitlementCDN
+	if cdn == "" {
+		cdn = DefaultEntitlementCDN
+	}
+
+	c.Parameters["baseurl"] = strings.TrimSuffix(cdn, "/") + path
+	c.Parameters["sslclientcert"] = entitled.Cert
+	c.Parameters["sslclientkey"] = entitled.CertKey
+	if c.Parameters["sslcacert"] == "" {
+		if _, err := os.Stat(DefaultEntitlementCACert); err == nil {
+			c.Parameters["sslcacert"] = DefaultEntitlementCACert
+		}
+	}
+
+	if c.Parameters["gpgkey"] == "" && entitled.GPGURL != "" {
+		c.Parameters["gpgkey"] = entitled.GPGURL
+	}
+
+	if c.Parameters["name"] == "" {
+		c.Parameters["name"] = entitled.Name
+	}
+
+	Dprintf("Using entitlement %s for %s: %s\n", entitled.Cert, c.ID, c.Parameters["baseurl"])
+	return nil
+}
+
+// PrintEntitlements prints the label and CDN path of each entitled yum
+// content set
+func PrintEntitlements(content []EntitledContent) {
+	for _, c := range content {
+		fmt.Printf("%-48s %s\n", c.Label, c.Path)
+	}
+}
+
+// entitledContentByLabel sorts content sets by label
+type entitledContentByLabel []EntitledContent
+
+func (c entitledContentByLabel) Len() int           { return len(c) }
+func (c entitledContentByLabel) Less(i, j int) bool { return c[i].Label < c[j].Label }
+func (c entitledContentByLabel) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
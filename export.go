@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundleManifestName is the name of the manifest at the start of a bundle
+const bundleManifestName = "y10k-bundle.json"
+
+// BundleManifest describes the content of a bundle exported for transfer to a
+// disconnected network. A full bundle contains every package of a repo; a
+// delta bundle contains the packages added or changed since a date or
+// snapshot, and lists the packages removed since the snapshot.
+type BundleManifest struct {
+	Repo         string          `json:"repo"`
+	Created      time.Time       `json:"created"`
+	Revision     string          `json:"revision"`
+	Full         bool            `json:"full"`
+	Since        string          `json:"since,omitempty"`
+	BaseRevision string          `json:"base_revision,omitempty"`
+	Packages     []ManifestEntry `json:"packages"`
+	Removed      []string        `json:"removed"`
+	Metadata     []ManifestEntry `json:"metadata"`
+	Disc         int             `json:"disc,omitempty"`
+	Discs        int             `json:"discs,omitempty"`
+}
+
+// ExportOptions select what is exported from a repo
+type ExportOptions struct {
+	// Since is a date (2006-01-02 or RFC 3339) or the name of a snapshot or
+	// channel of the repo. Only packages added or changed since then are
+	// exported. If empty, all packages are exported.
+	Since string
+
+	// Output is the path of the bundle. Its extension selects the
+	// compression: .tar, .tar.gz, .tgz, .tar.xz, .tar.zst or .tzst.
+	Output string
+
+	// Format is "tar" for a single archive or "iso" for ISO images
+	Format string
+
+	// ISOSize is the capacity of each ISO image. Packages are split across as
+	// many images as needed.
+	ISOSize int64
+}
+
+// sinceDateFormats are the date formats accepted by ExportOptions.Since
+var sinceDateFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// parseSinceDate parses a date accepted by ExportOptions.Since
+func parseSinceDate(s string) (time.Time, bool) {
+	for _, format := range sinceDateFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Export writes a bundle of a repo's packages and metadata, with a manifest of
+// their checksums, to a compressed tar archive or to ISO images
+func Export(repo *Repo, opts ExportOptions) (*BundleManifest, error) {
+	switch opts.Format {
+	case "", "tar":
+		if _, err := bundleFormat(opts.Output); err != nil {
+			return nil, err
+		}
+
+	case "iso":
+		if _, err := isoTool(); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, NewErrorf("Unsupported export format: %s (expected tar or iso)", opts.Format)
+	}
+
+	source, err := localDiffSource(repo.ID, repo.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	repomd, err := ReadRepomd(filepath.Join(repo.Path(), "repodata", "repomd.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BundleManifest{
+		Repo:     repo.ID,
+		Created:  time.Now().UTC(),
+		Revision: repomd.Revision,
+		Full:     opts.Since == "",
+		Since:    opts.Since,
+		Packages: make([]ManifestEntry, 0),
+		Removed:  make([]string, 0),
+		Metadata: make([]ManifestEntry, 0),
+	}
+
+	paths, err := selectExportPackages(repo, source, opts.Since, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := LoadChecksumCache(repo, false)
+	for _, rel := range paths {
+		sum, size, err := cache.Sum(filepath.Join(repo.Path(), rel))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Packages = append(manifest.Packages, ManifestEntry{Path: rel, Size: size, Checksum: sum})
+	}
+	if err := cache.Save(); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(repo.Path(), "repodata", "*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		sum, size, err := sha256File(file)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Metadata = append(manifest.Metadata, ManifestEntry{Path: filepath.Join("repodata", filepath.Base(file)), Size: size, Checksum: sum})
+	}
+
+	if opts.Format == "iso" {
+		if _, err := writeISOs(repo, opts.Output, opts.ISOSize, manifest); err != nil {
+			return nil, err
+		}
+		return manifest, nil
+	}
+
+	if err := writeBundle(repo.Path(), opts.Output, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// selectExportPackages returns the paths of the packages in a repo's metadata
+// to export since a date or snapshot, or all of them if since is empty. The
+// base revision and removed packages are recorded in the manifest when since
+// is a snapshot.
+func selectExportPackages(repo *Repo, source *diffSource, since string, manifest *BundleManifest) ([]string, error) {
+	paths := make([]string, 0)
+	if since == "" {
+		err := EachPackage(source.Primary, func(pkg *Package) error {
+			paths = append(paths, filepath.Clean(pkg.Location.Href))
+			return nil
+		})
+		return paths, err
+	}
+
+	// packages added to the mirror since a date, by modification time
+	if t, ok := parseSinceDate(since); ok {
+		err := EachPackage(source.Primary, func(pkg *Package) error {
+			rel := filepath.Clean(pkg.Location.Href)
+			fi, err := os.Stat(filepath.Join(repo.Path(), rel))
+			if err != nil {
+				return err
+			}
+			if !fi.ModTime().Before(t) {
+				paths = append(paths, rel)
+			}
+			return nil
+		})
+		return paths, err
+	}
+
+	if err := validSnapshotName(since); err != nil {
+		return nil, NewErrorf("Invalid --since: %s is neither a date nor a snapshot", since)
+	}
+
+	root := filepath.Join(repo.SnapshotDir(), since)
+	base, err := localDiffSource(repo.ID+"@"+since, root)
+	if err != nil {
+		return nil, err
+	}
+
+	if repomd, err := ReadRepomd(filepath.Join(root, "repodata", "repomd.xml")); err == nil {
+		manifest.BaseRevision = repomd.Revision
+	}
+
+	diff, err := diffSources(base, source)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range [][]DiffPackage{diff.Added, diff.Changed} {
+		for _, pkg := range list {
+			paths = append(paths, pkg.Path)
+		}
+	}
+	for _, pkg := range diff.Removed {
+		manifest.Removed = append(manifest.Removed, pkg.Path)
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// bundleWriter writes a bundle file, compressing it in process with gzip or
+// by piping it through xz or zstd
+type bundleWriter struct {
+	w   io.Writer
+	c   io.Closer
+	cmd *exec.Cmd
+}
+
+// bundleCompressors are the external compression commands by file extension
+var bundleCompressors = map[string][]string{
+	".xz":   {"xz", "-T0", "-c"},
+	".zst":  {"zstd", "-q", "-T0", "-c"},
+	".tzst": {"zstd", "-q", "-T0", "-c"},
+}
+
+// bundleFormat returns the extension which selects the compression of a
+// bundle: .tar, .gz or an extension in bundleCompressors
+func bundleFormat(name string) (string, error) {
+	ext := filepath.Ext(name)
+	switch {
+	case ext == ".tar" || bundleCompressors[ext] != nil:
+		return ext, nil
+	case ext == ".tgz" || strings.HasSuffix(name, ".tar.gz"):
+		return ".gz", nil
+	}
+
+	return "", NewErrorf("Unsupported bundle format: %s (expected .tar, .tar.gz, .tar.xz or .tar.zst)", name)
+}
+
+// newBundleWriter writes a bundle to w, compressed according to the extension
+// of name
+func newBundleWriter(w io.Writer, name string) (*bundleWriter, error) {
+	ext, err := bundleFormat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &bundleWriter{w: w}
+	switch ext {
+	case ".tar":
+
+	case ".gz":
+		gz := gzip.NewWriter(w)
+		c.w, c.c = gz, gz
+
+	default:
+		args := bundleCompressors[ext]
+		c.cmd = exec.Command(args[0], args[1:]...)
+		c.cmd.Stdout = w
+		c.cmd.Stderr = os.Stderr
+		stdin, err := c.cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := startChild(c.cmd); err != nil {
+			return nil, err
+		}
+		c.w, c.c = stdin, stdin
+	}
+
+	return c, nil
+}
+
+func (c *bundleWriter) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Close flushes the compressor. The underlying writer is not closed.
+func (c *bundleWriter) Close() error {
+	var err error
+	if c.c != nil {
+		err = c.c.Close()
+	}
+
+	if c.cmd != nil {
+		if werr := waitChild(c.cmd); werr != nil && err == nil {
+			err = NewErrorf("%s failed: %v", c.cmd.Args[0], werr)
+		}
+	}
+
+	return err
+}
+
+// writeBundle writes the manifest, metadata and packages of a bundle to a
+// tar archive. The archive is written to a temporary file which is renamed
+// once complete.
+func writeBundle(root, path string, manifest *BundleManifest) error {
+	return writeFileAtomic(path, 0644, func(f io.Writer) error {
+		w, err := newBundleWriter(f, path)
+		if err != nil {
+			return err
+		}
+
+		if err := writeBundleEntries(w, root, manifest); err != nil {
+			w.Close()
+			return err
+		}
+
+		return w.Close()
+	})
+}
+
+func writeBundleEntries(w io.Writer, root string, manifest *BundleManifest) error {
+	tw := tar.NewWriter(w)
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:    bundleManifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: manifest.Created,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return err
+	}
+
+	// metadata first, so an importer can verify it before unpacking packages
+	entries := append(append([]ManifestEntry{}, manifest.Metadata...), manifest.Packages...)
+	for _, entry := range entries {
+		if interrupted() {
+			return errInterrupted
+		}
+
+		if err := writeBundleFile(tw, root, entry.Path); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// writeBundleFile adds a file of a repo to a tar archive
+func writeBundleFile(tw *tar.Writer, root, rel string) error {
+	f, err := os.Open(filepath.Join(root, rel))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Uid, hdr.Gid = 0, 0
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// fipsWeakChecksums are the checksum types refused in FIPS mode
+var fipsWeakChecksums = map[string]bool{
+	"md5":  true,
+	"sha":  true,
+	"sha1": true,
+}
+
+// fipsWeakChecksum returns true if a checksum type is refused in FIPS mode
+func fipsWeakChecksum(typ string) bool {
+	return FIPSMode && fipsWeakChecksums[strings.ToLower(typ)]
+}
+
+// applyFIPS enables the signature checks required in FIPS mode: every
+// package, and the upstream repomd.xml, must be signed by one of the repo's
+// pinned keys. Merge targets are built from repos which are checked
+// themselves.
+func (c *Repo) applyFIPS() error {
+	if !FIPSMode || len(c.MergeSources) > 0 {
+		return nil
+	}
+
+	if fipsWeakChecksums[c.Checksum] {
+		return NewErrorf("Checksum type %s is not allowed in FIPS mode for '%s' (in %s:%d)", c.Checksum, c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	if len(c.Fingerprints) == 0 {
+		return NewErrorf("FIPS mode requires pin_fingerprint for '%s' (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	c.GPGCheck = true
+	c.Parameters["gpgcheck"] = "1"
+	c.Parameters["repo_gpgcheck"] = "1"
+
+	return nil
+}
+
+// checkFIPSChecksums returns an error if the upstream metadata of a repo, or
+// any of its packages, is listed with an md5 or sha1 checksum
+func checkFIPSChecksums(repo *Repo) error {
+	if !FIPSMode {
+		return nil
+	}
+
+	var repomd *Repomd
+	var primary string
+	if repo.RsyncURL() != "" {
+		dir := repo.rsyncMetadataDir()
+		r, err := ReadRepomd(filepath.Join(dir, "repodata", "repomd.xml"))
+		if err != nil {
+			return err
+		}
+
+		repomd = r
+		if data := repomd.Get("primary"); data != nil {
+			primary = filepath.Join(dir, data.Location.Href)
+		}
+	} else {
+		baseurl, r, err := repo.fetchUpstreamRepomd()
+		if err != nil {
+			return err
+		}
+
+		repomd = r
+		if data := repomd.Get("primary"); data != nil && !fipsWeakChecksum(data.Checksum.Type) {
+			if primary, err = repo.fetchUpstreamMetadata(baseurl, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, data := range repomd.Data {
+		if fipsWeakChecksum(data.Checksum.Type) {
+			return NewErrorf("Upstream %s metadata has a %s checksum, which is not allowed in FIPS mode", data.Type, data.Checksum.Type)
+		}
+	}
+
+	if primary == "" {
+		return NewErrorf("No primary metadata found for %s", repo.ID)
+	}
+
+	weak := 0
+	typ := ""
+	err := EachPackage(primary, func(pkg *Package) error {
+		if fipsWeakChecksum(pkg.Checksum.Type) {
+			Dprintf("Package %s has a %s checksum\n", pkg.Location.Href, pkg.Checksum.Type)
+			typ = pkg.Checksum.Type
+			weak++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if weak > 0 {
+		return NewErrorf("%d upstream packages have %s checksums, which are not allowed in FIPS mode", weak, typ)
+	}
+
+	return nil
+}
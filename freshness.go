@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// upstreamAge returns how long ago the upstream metadata of a repo was
+// generated, from the newest timestamp of its metadata files, or from its
+// revision if the files have no timestamps and it is a timestamp
+func upstreamAge(repomd *Repomd, now time.Time) (time.Duration, bool) {
+	newest := int64(0)
+	for _, data := range repomd.Data {
+		if data.Timestamp > newest {
+			newest = data.Timestamp
+		}
+	}
+
+	if newest == 0 {
+		ts, err := strconv.ParseInt(repomd.Revision, 10, 64)
+		if err != nil || ts <= 0 {
+			return 0, false
+		}
+		newest = ts
+	}
+
+	return now.Sub(time.Unix(newest, 0)), true
+}
+
+// checkFreshness warns if the upstream metadata of a repo with
+// max_upstream_age is older than it, which happens when a repo is mirrored
+// from a mirror which has itself stopped updating, or fails if the Yumfile
+// has StrictFreshness. Pinned repos are expected to be old and are not
+// checked.
+func (c *Yumfile) checkFreshness(repo *Repo, report *RepoReport) error {
+	if repo.MaxUpstreamAge <= 0 || repo.isPinned() {
+		return nil
+	}
+
+	_, repomd, err := upstreamRepomd(repo)
+	if err != nil {
+		Warnf(err, "Unable to check the age of the upstream metadata of %s", repo.ID)
+		return nil
+	}
+
+	age, ok := upstreamAge(repomd, time.Now())
+	if !ok {
+		Dprintf("Upstream metadata of %s has no timestamps\n", repo.ID)
+		return nil
+	}
+
+	report.UpstreamAge = age
+	if age <= repo.MaxUpstreamAge {
+		return nil
+	}
+
+	report.StaleUpstream = true
+	err = NewErrorf("Upstream metadata of %s was generated %v ago, more than max_upstream_age %v", repo.ID, age.Truncate(time.Minute), repo.MaxUpstreamAge)
+	if c.StrictFreshness {
+		return err
+	}
+
+	Warnf(nil, "%v", err)
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// rpmSignatureFormat is an rpm query format which prints the signature
+// details of a package, regardless of the signature type.
+const rpmSignatureFormat = "%|DSAHEADER?{%{DSAHEADER:pgpsig}}:{%|RSAHEADER?{%{RSAHEADER:pgpsig}}:{%|SIGGPG?{%{SIGGPG:pgpsig}}:{%|SIGPGP?{%{SIGPGP:pgpsig}}:{(none)}|}|}|}|"
+
+var (
+	fingerprintPattern = regexp.MustCompile("^[0-9A-F]{40}$")
+	keyIDPattern       = regexp.MustCompile("Key ID ([0-9a-fA-F]+)")
+	validSigPattern    = regexp.MustCompile("(?m)^\\[GNUPG:\\] VALIDSIG (.*)$")
+)
+
+// parseFingerprints parses a comma separated list of GPG key fingerprints,
+// ignoring whitespace and case.
+func parseFingerprints(s string) []string {
+	fprs := make([]string, 0)
+	for _, fpr := range strings.Split(s, ",") {
+		fpr = strings.ToUpper(strings.Join(strings.Fields(fpr), ""))
+		fpr = strings.TrimPrefix(fpr, "0X")
+		if fpr != "" {
+			fprs = append(fprs, fpr)
+		}
+	}
+
+	return fprs
+}
+
+// matchFingerprint returns true if a full fingerprint is one of the given
+// pinned fingerprints. Key IDs never match, as they can collide.
+func matchFingerprint(pinned []string, fpr string) bool {
+	fpr = strings.ToUpper(fpr)
+	if !fingerprintPattern.MatchString(fpr) {
+		return false
+	}
+
+	for _, p := range pinned {
+		if p == fpr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signingKey is a key or subkey imported from the gpgkey of a repo
+type signingKey struct {
+	Fingerprint string
+	Primary     string // fingerprint of its primary key
+}
+
+// repoKeyring holds the keys imported from the gpgkey of a repo, in a private
+// rpm database which packages are verified against and a private gpg home
+// directory which repo metadata is verified against, keyed by long key ID
+type repoKeyring struct {
+	DBPath  string
+	GPGHome string
+	Keys    map[string][]signingKey
+}
+
+var (
+	repoKeyrings   = make(map[string]*repoKeyring, 0)
+	repoKeyringsMu sync.Mutex
+)
+
+// loadRepoKeyring imports the keys of the gpgkey of a repo into a private rpm
+// database and gpg home directory, so packages and metadata are only verified
+// against the keys the repo names, and reads their fingerprints. Keyrings are
+// loaded once per run.
+func loadRepoKeyring(repo *Repo) (*repoKeyring, error) {
+	repoKeyringsMu.Lock()
+	defer repoKeyringsMu.Unlock()
+	if k, ok := repoKeyrings[repo.ID]; ok {
+		return k, nil
+	}
+
+	urls := strings.FieldsFunc(repo.expandYumVars(repo.Parameters["gpgkey"]), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	if len(urls) == 0 {
+		return nil, NewErrorf("pin_fingerprint requires gpgkey for '%s'", repo.ID)
+	}
+
+	dir := filepath.Join(repo.CacheDir(), repo.ID)
+	k := &repoKeyring{
+		DBPath:  absPath(filepath.Join(dir, "rpmdb")),
+		GPGHome: absPath(filepath.Join(dir, "gpgdir")),
+		Keys:    make(map[string][]signingKey, 0),
+	}
+	for _, path := range []string{k.DBPath, k.GPGHome} {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := Exec("rpm", "--dbpath", k.DBPath, "--initdb"); err != nil {
+		return nil, err
+	}
+
+	for i, u := range urls {
+		path := strings.TrimPrefix(u, "file://")
+		if path == u {
+			path = filepath.Join(dir, "gpgkeys", fmt.Sprintf("%d.asc", i))
+			if _, err := download(repo, u, path); err != nil {
+				return nil, NewErrorf("Failed to download gpgkey %s: %v", u, err)
+			}
+		}
+
+		if err := Exec("rpm", "--dbpath", k.DBPath, "--import", path); err != nil {
+			return nil, NewErrorf("Failed to import gpgkey %s: %v", u, err)
+		}
+
+		out, err := ExecOutput("gpg", "--homedir", k.GPGHome, "--batch", "--with-colons", "--import-options", "show-only", "--import", path)
+		if err != nil {
+			return nil, NewErrorf("Failed to read gpgkey %s: %v", u, err)
+		}
+		k.add(string(out))
+
+		if err := importGPGKey(k.GPGHome, path); err != nil {
+			return nil, NewErrorf("Failed to import gpgkey %s: %v", u, err)
+		}
+	}
+
+	repoKeyrings[repo.ID] = k
+	return k, nil
+}
+
+// importGPGKey imports the keys of a key file into a gpg home directory
+func importGPGKey(home, path string) error {
+	return Exec("gpg", "--homedir", home, "--batch", "--quiet", "--import", path)
+}
+
+// add adds the keys listed by gpg --with-colons to a keyring
+func (c *repoKeyring) add(out string) {
+	primary, next := "", ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "pub" || fields[0] == "sub":
+			next = fields[0]
+
+		case fields[0] == "fpr" && len(fields) > 9 && next != "":
+			fpr := strings.ToUpper(fields[9])
+			if next == "pub" {
+				primary = fpr
+			}
+			if len(fpr) >= 16 {
+				id := fpr[len(fpr)-16:]
+				c.Keys[id] = append(c.Keys[id], signingKey{Fingerprint: fpr, Primary: primary})
+			}
+			next = ""
+		}
+	}
+}
+
+// signer returns the imported key with the long key ID read from the
+// signature header of a package. Key IDs shared by several imported keys are
+// refused rather than guessed.
+func (c *repoKeyring) signer(sig string) (*signingKey, error) {
+	m := keyIDPattern.FindStringSubmatch(sig)
+	if m == nil {
+		return nil, NewErrorf("unsigned")
+	}
+
+	id := strings.ToUpper(m[1])
+	switch keys := c.Keys[id]; len(keys) {
+	case 0:
+		return nil, NewErrorf("signed with key %s, which is not in gpgkey", id)
+	case 1:
+		return &keys[0], nil
+	}
+
+	return nil, NewErrorf("signed with key %s, which matches several keys in gpgkey", id)
+}
+
+// pinned returns true if a key or its primary key is pinned for a repo
+func (c *signingKey) pinned(repo *Repo) bool {
+	return matchFingerprint(repo.Fingerprints, c.Fingerprint) || matchFingerprint(repo.Fingerprints, c.Primary)
+}
+
+// verifyFingerprints ensures that all packages in a repo, and the repo
+// metadata if repo_gpgcheck is enabled, are signed by one of the repo's pinned
+// GPG keys. Packages which are not are deleted so they are not published and
+// the number of rejected packages is returned.
+func (c *Yumfile) verifyFingerprints(repo *Repo) (int, error) {
+	if len(repo.Fingerprints) == 0 {
+		return 0, nil
+	}
+
+	if b, _ := strToBool(repo.Parameters["repo_gpgcheck"]); b {
+		if err := verifyRepomdSignature(repo); err != nil {
+			return 0, err
+		}
+	}
+
+	Printf("Verifying package signatures: %s\n", repo.ID)
+	files, err := findPackages(repo.downloadPath())
+	if err != nil {
+		return 0, err
+	}
+
+	bad, err := checkSignatures(repo, files)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range bad {
+		Errorf(nil, "Rejected package %s, which is not signed by a pinned key", file)
+		if err := os.Remove(file); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(bad) > 0 {
+		Printf("Rejected %d packages not signed by a pinned key: %s\n", len(bad), repo.ID)
+	}
+
+	return len(bad), nil
+}
+
+// verifyRepomdSignature checks the detached signature of the upstream
+// repomd.xml of a repo against the repo's pinned GPG keys. The upstream copy
+// is read rather than the one cached by yum, whose location differs between
+// yum and dnf.
+func verifyRepomdSignature(repo *Repo) error {
+	k, err := loadRepoKeyring(repo)
+	if err != nil {
+		return err
+	}
+
+	source, _, err := upstreamRepomd(repo)
+	if err != nil {
+		return err
+	}
+
+	repomd := filepath.Join(repo.upstreamCacheDir(), "repomd.xml")
+	if repo.RsyncURL() != "" {
+		repomd = filepath.Join(source, "repodata", "repomd.xml")
+	} else if _, err := download(repo, source+"/repodata/repomd.xml.asc", repomd+".asc"); err != nil {
+		os.Remove(repomd + ".asc")
+		Dprintf("No upstream signature for repomd.xml of %s: %v\n", repo.ID, err)
+	}
+
+	return checkRepomdSignature(k.GPGHome, repo.Fingerprints, repomd)
+}
+
+// checkRepomdSignature checks the detached signature <repomd>.asc of a
+// repomd.xml with the keys in a gpg home directory, and that it was made by
+// one of the pinned keys or one of their subkeys
+func checkRepomdSignature(home string, pinned []string, repomd string) error {
+	asc := repomd + ".asc"
+	if _, err := os.Stat(asc); os.IsNotExist(err) {
+		return NewErrorf("Repository metadata is not signed: %s", repomd)
+	}
+
+	out, err := ExecOutput("gpg", "--homedir", home, "--batch", "--status-fd", "1", "--verify", asc, repomd)
+	if err != nil {
+		return NewErrorf("Invalid repository metadata signature: %s", asc)
+	}
+
+	for _, m := range validSigPattern.FindAllStringSubmatch(string(out), -1) {
+		// match the signing key or its primary key
+		fields := strings.Fields(m[1])
+		if len(fields) > 0 && matchFingerprint(pinned, fields[0]) {
+			return nil
+		}
+
+		if len(fields) > 9 && matchFingerprint(pinned, fields[9]) {
+			return nil
+		}
+	}
+
+	return NewErrorf("Repository metadata is not signed by a pinned key: %s", repomd)
+}
+
+// signFile writes an ASCII armored detached signature of a file to
+// <path>.asc, using the given key from the gpg keyring of the current user
+func signFile(key, path string) error {
+	args := []string{"--batch", "--yes", "--armor", "--local-user", key, "--output", path + ".asc", "--detach-sign", path}
+	if err := Exec("gpg", args...); err != nil {
+		os.Remove(path + ".asc")
+		return NewErrorf("Failed to sign %s with key %s: %v", path, key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRepomdSignature(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+
+	home, err := ioutil.TempDir("", "y10k-gpg-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	if err := importGPGKey(home, "testdata/RPM-GPG-KEY-y10k-test"); err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := []string{"AA6EAAE9F13671F8DEE5FEBEE344DA64DE760320"}
+	if err := checkRepomdSignature(home, pinned, "testdata/repomd.xml"); err != nil {
+		t.Errorf("expected signature by pinned key to verify: %v", err)
+	}
+
+	other := []string{"0000000000000000000000000000000000000000"}
+	if err := checkRepomdSignature(home, other, "testdata/repomd.xml"); err == nil {
+		t.Errorf("expected signature by unpinned key to be rejected")
+	}
+
+	// a modified repomd.xml must not verify
+	b, err := ioutil.ReadFile("testdata/repomd.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := filepath.Join(home, "repomd.xml")
+	if err := ioutil.WriteFile(tampered, append(b, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	asc, err := ioutil.ReadFile("testdata/repomd.xml.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tampered+".asc", asc, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRepomdSignature(home, pinned, tampered); err == nil {
+		t.Errorf("expected modified repomd.xml to be rejected")
+	}
+
+	// metadata without a signature is rejected
+	if err := os.Remove(tampered + ".asc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkRepomdSignature(home, pinned, tampered); err == nil {
+		t.Errorf("expected unsigned repomd.xml to be rejected")
+	}
+}
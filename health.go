@@ -6,7 +6,7 @@ import (
 	"regexp"
 )
 
-var createrepoVersionPattern = regexp.MustCompile("^createrepo\\s+(.*)")
+var createrepoVersionPattern = regexp.MustCompile("^(?:createrepo|Version:)\\s+(.*)")
 var repoqueryVersionPattern = regexp.MustCompile("^Repoquery version (.*)")
 var rpmVersionPattern = regexp.MustCompile("^RPM version (.*)")
 var yumVersionPattern = regexp.MustCompile("^(.*)")
@@ -64,8 +64,8 @@ func HealthCheck() error {
 	}
 	Dprintf("  %-*s%s\n", colWidth, "reposync:", msg)
 
-	// check for createrepo
-	cmd = exec.Command("createrepo", "--version")
+	// check for createrepo or createrepo_c
+	cmd = exec.Command(detectCreaterepo(), "--version")
 	out, err = cmd.CombinedOutput()
 	if err != nil {
 		return err
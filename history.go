@@ -0,0 +1,234 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyDatePattern matches the {date} and {date:<layout>} placeholders of a
+// history_url, where layout is a Go time layout such as 20060102
+var historyDatePattern = regexp.MustCompile(`\{date(?::([^}]+))?\}`)
+
+// isPinned returns true if a repo is mirrored as it existed at a past
+// revision or date, rather than as upstream is now
+func (c *Repo) isPinned() bool {
+	return c.AsOf != "" || c.PinRevision != ""
+}
+
+// asOfTime returns the time a repo is mirrored as of
+func (c *Repo) asOfTime() (time.Time, error) {
+	if isRelativeDateBound(c.AsOf) {
+		return time.Time{}, NewErrorf("Invalid as_of date: %s (relative dates are not reproducible)", c.AsOf)
+	}
+
+	return parseDateBound(c.AsOf, time.Now())
+}
+
+// applyHistory points a pinned repo at the upstream archive of its revision
+// or date, by expanding the {date} and {revision} placeholders of its
+// history_url into its base URL. Without a history_url, the upstream repo
+// itself must still be at the pinned revision.
+func (c *Repo) applyHistory() error {
+	if !c.isPinned() {
+		return nil
+	}
+
+	if c.Retain > 0 || c.MinDate != "" || c.MaxDate != "" || c.NewOnly {
+		return NewErrorf("as_of and pin_revision cannot be combined with retain, min_date, max_date or newonly for '%s' (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	if c.HistoryURL == "" {
+		if c.AsOf != "" {
+			return NewErrorf("as_of requires history_url for '%s' (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+		return nil
+	}
+
+	url := c.HistoryURL
+	if historyDatePattern.MatchString(url) {
+		if c.AsOf == "" {
+			return NewErrorf("history_url of '%s' requires as_of (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+
+		t, err := c.asOfTime()
+		if err != nil {
+			return err
+		}
+
+		url = historyDatePattern.ReplaceAllStringFunc(url, func(s string) string {
+			layout := historyDatePattern.FindStringSubmatch(s)[1]
+			if layout == "" {
+				layout = "2006-01-02"
+			}
+			return t.Format(layout)
+		})
+	}
+
+	if strings.Contains(url, "{revision}") {
+		if c.PinRevision == "" {
+			return NewErrorf("history_url of '%s' requires pin_revision (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+		url = strings.Replace(url, "{revision}", c.PinRevision, -1)
+	}
+
+	c.Parameters["baseurl"] = url
+	delete(c.Parameters, "mirrorlist")
+	delete(c.Parameters, "metalink")
+	Dprintf("Using upstream history for %s: %s\n", c.ID, url)
+
+	return nil
+}
+
+// upstreamRepomd returns the upstream repomd.xml of a repo and the directory
+// its metadata files are read from, or the base URL they are downloaded from
+func upstreamRepomd(repo *Repo) (string, *Repomd, error) {
+	if repo.RsyncURL() != "" {
+		dir := repo.rsyncMetadataDir()
+		repomd, err := ReadRepomd(filepath.Join(dir, "repodata", "repomd.xml"))
+		return dir, repomd, err
+	}
+
+	return repo.fetchUpstreamRepomd()
+}
+
+// checkPinnedRevision returns an error if the upstream metadata of a pinned
+// repo is not at its pinned revision, or was published after its as_of date.
+// Revisions which are not timestamps cannot be compared with as_of.
+func checkPinnedRevision(repo *Repo) error {
+	if !repo.isPinned() {
+		return nil
+	}
+
+	_, repomd, err := upstreamRepomd(repo)
+	if err != nil {
+		return err
+	}
+
+	if repo.PinRevision != "" && repomd.Revision != repo.PinRevision {
+		return NewErrorf("Upstream metadata is at revision %s, not the pinned revision %s", repomd.Revision, repo.PinRevision)
+	}
+
+	if repo.AsOf != "" {
+		t, err := repo.asOfTime()
+		if err != nil {
+			return err
+		}
+
+		if ts, err := strconv.ParseInt(repomd.Revision, 10, 64); err == nil && ts > t.Unix() {
+			return NewErrorf("Upstream metadata revision %s was published after %s", repomd.Revision, repo.AsOf)
+		}
+	}
+
+	return nil
+}
+
+// installUpstreamRepodata replaces the metadata of a pinned repo with a
+// verbatim copy of the upstream metadata, in place of createrepo, so a mirror
+// rebuilt at the same revision is byte-identical. Every package listed in the
+// upstream metadata must be in the mirror.
+func (c *Yumfile) installUpstreamRepodata(repo *Repo) error {
+	source, repomd, err := upstreamRepomd(repo)
+	if err != nil {
+		return err
+	}
+	Printf("Installing upstream metadata at revision %s: %s\n", repomd.Revision, repo.ID)
+
+	// find or fetch each metadata file
+	files := make(map[string]string, len(repomd.Data)+2)
+	for i := range repomd.Data {
+		data := &repomd.Data[i]
+		path := filepath.Join(source, data.Location.Href)
+		if repo.RsyncURL() == "" {
+			if path, err = repo.fetchUpstreamMetadata(source, data); err != nil {
+				return err
+			}
+		} else if err := checkRepomdData(path, data); err != nil {
+			return err
+		}
+		files[filepath.Base(data.Location.Href)] = path
+	}
+
+	if repo.RsyncURL() != "" {
+		files["repomd.xml"] = filepath.Join(source, "repodata", "repomd.xml")
+		if _, err := os.Stat(files["repomd.xml"] + ".asc"); err == nil {
+			files["repomd.xml.asc"] = files["repomd.xml"] + ".asc"
+		}
+	} else {
+		files["repomd.xml"] = filepath.Join(repo.upstreamCacheDir(), "repomd.xml")
+		asc := filepath.Join(repo.upstreamCacheDir(), "repomd.xml.asc")
+		if _, err := download(repo, source+"/repodata/repomd.xml.asc", asc); err == nil {
+			files["repomd.xml.asc"] = asc
+		} else {
+			os.Remove(asc)
+			Dprintf("No upstream signature for repomd.xml of %s: %v\n", repo.ID, err)
+		}
+	}
+
+	if data := repomd.Get("primary"); data != nil {
+		if err := checkPinnedPackages(repo, files[filepath.Base(data.Location.Href)]); err != nil {
+			return err
+		}
+	}
+
+	// write the new metadata beside the old and swap them
+	dir := filepath.Join(repo.Path(), "repodata")
+	tmp := filepath.Join(repo.Path(), ".repodata")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+
+	for name, path := range files {
+		if err := cloneFile(path, filepath.Join(tmp, name)); err != nil {
+			return err
+		}
+	}
+
+	old := filepath.Join(repo.Path(), ".olddata")
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(dir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := syncTree(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	if err := syncDir(repo.Path()); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// checkPinnedPackages returns an error if any package listed in the upstream
+// primary metadata of a pinned repo is missing from the mirror
+func checkPinnedPackages(repo *Repo, primary string) error {
+	missing := 0
+	err := EachPackage(primary, func(pkg *Package) error {
+		fi, err := os.Stat(filepath.Join(repo.Path(), pkg.Location.Href))
+		if err != nil || (pkg.Size.Package > 0 && fi.Size() != pkg.Size.Package) {
+			Dprintf("Package %s is not in the mirror\n", pkg.Location.Href)
+			missing++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if missing > 0 {
+		return NewErrorf("%d packages listed in the upstream metadata are not in the mirror, so it cannot be copied verbatim (are packages filtered by exclude, includepkgs or arch?)", missing)
+	}
+
+	return nil
+}
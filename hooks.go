@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// hookEnv returns the environment variables which describe a repo and the
+// outcome of its sync to presync and postsync hooks
+func hookEnv(hook string, repo *Repo, report *RepoReport, err error) []string {
+	env := []string{
+		"Y10K_HOOK=" + hook,
+		"Y10K_REPO_ID=" + repo.ID,
+		"Y10K_REPO_PATH=" + absPath(repo.Path()),
+		"Y10K_REPO_URL=" + repo.ObjectStoreURL(),
+	}
+
+	if hook == "presync" {
+		return env
+	}
+
+	status := report.Status
+	if err != nil {
+		status = RepoStatusFailed
+	}
+
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+
+	return append(env,
+		"Y10K_STATUS="+status,
+		"Y10K_ERROR="+errMsg,
+		fmt.Sprintf("Y10K_DOWNLOADED=%d", report.Downloaded),
+		fmt.Sprintf("Y10K_DELETED=%d", report.Deleted),
+		fmt.Sprintf("Y10K_FILTERED=%d", report.Filtered),
+		fmt.Sprintf("Y10K_BYTES=%d", report.Bytes),
+		fmt.Sprintf("Y10K_GPG_FAILURES=%d", report.GPGFailures),
+		fmt.Sprintf("Y10K_DOWNLOAD_FAILURES=%d", report.DownloadFailures),
+		fmt.Sprintf("Y10K_DURATION=%d", int64(time.Since(report.Start).Seconds())),
+	)
+}
+
+// runHook runs a presync or postsync command of a repo with the shell. Its
+// output is logged, and it is terminated with y10k.
+func runHook(hook, command string, repo *Repo, report *RepoReport, syncErr error) error {
+	if command == "" {
+		return nil
+	}
+
+	Printf("Running %s hook: %s\n", hook, repo.ID)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), hookEnv(hook, repo, report, syncErr)...)
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+
+	if err := startChild(cmd); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		Printf("%s: %s\n", hook, scanner.Text())
+	}
+
+	if err := waitChild(cmd); err != nil {
+		return NewErrorf("%s hook failed: %v", hook, err)
+	}
+
+	return nil
+}
+
+// syncRepoWithHooks runs a repo's presync hook, synchronizes it and runs its
+// postsync hook. A failing presync hook fails the repo without synchronizing
+// it. The postsync hook runs whether or not the sync succeeded; if it fails,
+// the error is logged and counted, but the repo, which is already
+// synchronized, does not fail.
+func (c *Yumfile) syncRepoWithHooks(repo *Repo, report *RepoReport) error {
+	if err := runHook("presync", repo.PreSync, repo, report, nil); err != nil {
+		return err
+	}
+
+	err := c.syncRepo(repo, report)
+
+	if herr := runHook("postsync", repo.PostSync, repo, report, err); herr != nil {
+		Errorf(herr, "Repo %s", repo.ID)
+		report.Errors++
+	}
+
+	return err
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpTimeout is the default timeout for upstream HTTP requests
+const httpTimeout = 5 * time.Minute
+
+// Defaults of the HTTP transport options of a repo
+const (
+	DefaultConnectTimeout        = 30 * time.Second
+	DefaultResponseTimeout       = 2 * time.Minute
+	DefaultMaxConnectionsPerHost = 16
+	defaultIdleConnTimeout       = 90 * time.Second
+)
+
+var metalinkURLPattern = regexp.MustCompile("<url[^>]*>\\s*([^<\\s]+)\\s*</url>")
+
+// httpTransport is the shared transport of upstream HTTP requests for repos
+// with default HTTP options
+var httpTransport = newTransport("tcp", DefaultConnectTimeout, DefaultResponseTimeout, DefaultMaxConnectionsPerHost, true, true)
+
+// fileTransport serves file:// URLs, which are only requested for repos whose
+// baseurl is a local path, such as the local copy of the metadata of repos
+// synchronized with rsync
+var fileTransport = http.NewFileTransport(http.Dir("/"))
+
+// newTransport returns a HTTP transport which dials the given network (tcp,
+// tcp4 or tcp6), gives up on connections and responses after the given
+// timeouts, and opens at most the given number of connections to each host.
+// Idle connections are kept open for reuse unless keepAlive is false.
+func newTransport(network string, connectTimeout, responseTimeout time.Duration, maxConns int, keepAlive, http2 bool) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxConns,
+		MaxConnsPerHost:       maxConns,
+		DisableKeepAlives:     !keepAlive,
+		ForceAttemptHTTP2:     http2,
+	}
+
+	if !http2 {
+		// a non-nil, empty map disables HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper, 0)
+	}
+
+	return t
+}
+
+// repoTransports are the transports of repos with proxy, TLS or connection
+// options, keyed by the options which configure them
+var (
+	repoTransports   = make(map[string]*http.Transport, 0)
+	repoTransportsMu sync.Mutex
+)
+
+// transportKeys are the repo options which configure its HTTP transport
+var transportKeys = []string{
+	"proxy",
+	"proxy_username",
+	"proxy_password",
+	"sslcacert",
+	"sslclientcert",
+	"sslclientkey",
+	"sslverify",
+	"timeout",
+	"keepalive",
+	"ip_resolve",
+}
+
+// noProxy is the value of the yum proxy option which disables proxies
+const noProxy = "_none_"
+
+// parseProxy parses a yum proxy option, which may include credentials
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, NewErrorf("Invalid proxy URL: %s", s)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, NewErrorf("Unsupported proxy scheme: %s", s)
+	}
+
+	return u, nil
+}
+
+// proxyURL returns the proxy configured for a repo, including the credentials
+// from proxy_username and proxy_password. nil is returned if no proxy is
+// configured for the repo.
+func (c *Repo) proxyURL() (*url.URL, error) {
+	proxy := c.Parameters["proxy"]
+	if proxy == "" || proxy == noProxy {
+		return nil, nil
+	}
+
+	u, err := parseProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	if username := c.Parameters["proxy_username"]; username != "" {
+		u.User = url.UserPassword(username, c.Parameters["proxy_password"])
+	}
+
+	return u, nil
+}
+
+// responseTimeout returns how long to wait for the response of the upstream
+// of a repo, from the yum timeout option in seconds
+func (c *Repo) responseTimeout() (time.Duration, error) {
+	s := c.Parameters["timeout"]
+	if s == "" {
+		return DefaultResponseTimeout, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, NewErrorf("Invalid timeout: %s", s)
+	}
+
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// network returns the network y10k dials the upstream of a repo on, which is
+// limited to IPv4 or IPv6 by the ip_resolve option
+func (c *Repo) network() string {
+	switch c.Parameters["ip_resolve"] {
+	case "4":
+		return "tcp4"
+	case "6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// hasTransportOptions returns true if any of the connection options of a repo
+// differ from their defaults
+func (c *Repo) hasTransportOptions() bool {
+	return c.ConnectTimeout != DefaultConnectTimeout || c.MaxConnsPerHost != DefaultMaxConnectionsPerHost || !c.HTTP2
+}
+
+// repoTransport returns the HTTP transport for the upstream of a repo. Repos
+// without a proxy option use the proxy set in the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables, if any. Repos with default options share a
+// single transport, so connections to the same mirror are reused and limited
+// across repos.
+func repoTransport(repo *Repo) (*http.Transport, error) {
+	if repo == nil {
+		return httpTransport, nil
+	}
+
+	key := ""
+	for _, k := range transportKeys {
+		key += repo.Parameters[k] + "\x00"
+	}
+
+	if strings.Trim(key, "\x00") == "" && !repo.hasTransportOptions() {
+		return httpTransport, nil
+	}
+	key += fmt.Sprintf("%v\x00%d\x00%v", repo.ConnectTimeout, repo.MaxConnsPerHost, repo.HTTP2)
+
+	repoTransportsMu.Lock()
+	defer repoTransportsMu.Unlock()
+	if t, ok := repoTransports[key]; ok {
+		return t, nil
+	}
+
+	responseTimeout, err := repo.responseTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive := true
+	if s := repo.Parameters["keepalive"]; s != "" {
+		if keepAlive, err = strToBool(s); err != nil {
+			return nil, err
+		}
+	}
+
+	t := newTransport(repo.network(), repo.ConnectTimeout, responseTimeout, repo.MaxConnsPerHost, keepAlive, repo.HTTP2)
+	if repo.Parameters["proxy"] != "" {
+		proxy, err := repo.proxyURL()
+		if err != nil {
+			return nil, err
+		}
+
+		t.Proxy = nil
+		if proxy != nil {
+			t.Proxy = http.ProxyURL(proxy)
+		}
+	}
+
+	tlsConfig, err := repo.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t.TLSClientConfig = tlsConfig
+	repoTransports[key] = t
+
+	return t, nil
+}
+
+// tlsConfig returns the TLS configuration of a repo from its sslcacert,
+// sslclientcert, sslclientkey and sslverify options, as used by the Red Hat
+// CDN and Satellite. A client certificate file may also contain its key.
+func (c *Repo) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if s := c.Parameters["sslverify"]; s != "" {
+		verify, err := strToBool(s)
+		if err != nil {
+			return nil, err
+		}
+
+		if !verify {
+			Dprintf("TLS certificate verification is disabled for %s\n", c.ID)
+			config.InsecureSkipVerify = true
+		}
+	}
+
+	if path := c.Parameters["sslcacert"]; path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, NewErrorf("No CA certificates found in %s", path)
+		}
+		config.RootCAs = pool
+	}
+
+	if cert := c.Parameters["sslclientcert"]; cert != "" {
+		key := c.Parameters["sslclientkey"]
+		if key == "" {
+			key = cert
+		}
+
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, NewErrorf("Error loading client certificate %s: %v", cert, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	} else if c.Parameters["sslclientkey"] != "" {
+		return nil, NewErrorf("sslclientkey is set without sslclientcert")
+	}
+
+	return config, nil
+}
+
+// hasFileUpstream returns true if the baseurl of a repo is a local file://
+// URL
+func (c *Repo) hasFileUpstream() bool {
+	if c == nil {
+		return false
+	}
+
+	for _, u := range strings.Fields(c.Parameters["baseurl"]) {
+		if strings.HasPrefix(u, "file://") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkRedirect refuses redirects to any scheme but http and https, so that
+// an upstream server cannot redirect y10k to local files, and stops after 10
+// redirects like the default policy
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return NewErrorf("Refused redirect to %s", req.URL)
+	}
+
+	if len(via) >= 10 {
+		return NewErrorf("Stopped after 10 redirects")
+	}
+
+	return nil
+}
+
+// httpClient returns a HTTP client configured for the upstream of a repo
+func httpClient(repo *Repo) (*http.Client, error) {
+	t, err := repoTransport(repo)
+	if err != nil {
+		return nil, NewErrorf("Invalid HTTP options for '%s': %v", repo.ID, err)
+	}
+
+	return &http.Client{Timeout: httpTimeout, Transport: t, CheckRedirect: checkRedirect}, nil
+}
+
+// httpRequest requests a URL with the given method, the repo's credentials
+// and the given headers, and returns the response whatever its status
+func httpRequest(repo *Repo, method, url string, header http.Header) (*http.Response, error) {
+	client, err := httpClient(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL.Scheme == "file" {
+		if !repo.hasFileUpstream() {
+			return nil, NewErrorf("Refused to read %s for a repo without a file:// baseurl", url)
+		}
+		client = &http.Client{Transport: fileTransport, CheckRedirect: checkRedirect}
+	}
+	req = req.WithContext(RepoContext())
+
+	for key, val := range header {
+		req.Header[key] = val
+	}
+
+	// authenticate with the repo's credentials, as yum does
+	if repo != nil && repo.Parameters["username"] != "" {
+		req.SetBasicAuth(repo.Parameters["username"], repo.Parameters["password"])
+	}
+
+	return client.Do(req)
+}
+
+// httpStatusError is returned for a request which fails with an unexpected
+// HTTP status
+type httpStatusError struct {
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (c *httpStatusError) Error() string {
+	return fmt.Sprintf("Error retrieving %s: %s", c.URL, c.Status)
+}
+
+// newHTTPStatusError returns an error for a response with an unexpected status
+func newHTTPStatusError(url string, resp *http.Response) error {
+	return &httpStatusError{URL: url, Status: resp.Status, StatusCode: resp.StatusCode}
+}
+
+// isServerError returns true if err is a 5xx response from a server
+func isServerError(err error) bool {
+	e, ok := err.(*httpStatusError)
+	return ok && e.StatusCode >= 500
+}
+
+// notFoundPattern matches the errors of y10k, yum and dnf for an upstream
+// file which does not exist
+var notFoundPattern = regexp.MustCompile(`(?i)\b(404 not found|410 gone)\b|http error (404|410)\b|status code:?\s*(404|410)\b`)
+
+// isNotFound returns true if an error means that the upstream of a repo, or
+// a file in it, does not exist, rather than that it could not be read
+func isNotFound(err error) bool {
+	if e, ok := err.(*httpStatusError); ok {
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone
+	}
+
+	return err != nil && notFoundPattern.MatchString(err.Error())
+}
+
+// unreachablePattern matches the errors of y10k, yum and dnf for an upstream
+// which cannot be reached: name resolution failures, refused or reset
+// connections, timeouts and TLS errors
+var unreachablePattern = regexp.MustCompile(`(?i)no such host|could not resolve|name or service not known|temporary failure in name resolution|connection refused|connection reset|network is unreachable|no route to host|failed to connect|i/o timeout|connection timed out|operation timed out|timeout was reached|tls handshake|x509:|ssl connect error|ssl certificate problem|curl error \((6|7|28|35|60)\)`)
+
+// isUnreachable returns true if an error means that the upstream of a repo
+// could not be reached over the network
+func isUnreachable(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	return err != nil && unreachablePattern.MatchString(err.Error())
+}
+
+// isUpstreamUnavailable returns true if an error means that the upstream of
+// a repo does not exist or cannot be reached, as opposed to a local error
+// such as a permission or parse error
+func isUpstreamUnavailable(err error) bool {
+	return isNotFound(err) || isUnreachable(err)
+}
+
+// httpGet requests a URL and returns the response if its status is OK
+func httpGet(repo *Repo, url string) (*http.Response, error) {
+	resp, err := httpRequest(repo, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newHTTPStatusError(url, resp)
+	}
+
+	return resp, nil
+}
+
+// download saves the content of a URL to a local file and returns the number
+// of bytes written
+func download(repo *Repo, url, path string) (int64, error) {
+	resp, err := httpGet(repo, url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	n, err := saveResponse(resp, path)
+	if err != nil {
+		return n, err
+	}
+
+	return n, setRemoteTime(repo, resp, path)
+}
+
+// resumeDownload continues a download into a partial local file with a range
+// request, or downloads the whole file if there is no partial file or the
+// server does not support ranges, and returns the number of bytes written.
+// The file is not verified, so callers must check its checksum.
+func resumeDownload(repo *Repo, url, path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() == 0 {
+		return download(repo, url, path)
+	}
+
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-", fi.Size()))
+	resp, err := httpRequest(repo, "GET", url, header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", fi.Size())):
+		Dprintf("Resuming %s from %s\n", url, formatBytes(fi.Size()))
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+
+		n, err := io.Copy(f, resp.Body)
+		if err != nil {
+			return n, err
+		}
+
+		return n, setRemoteTime(repo, resp, path)
+
+	case resp.StatusCode == http.StatusOK:
+		n, err := saveResponse(resp, path)
+		if err != nil {
+			return n, err
+		}
+
+		return n, setRemoteTime(repo, resp, path)
+
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is already complete, or is not a prefix of the
+		// upstream file, which its checksum will show
+		return 0, nil
+	}
+
+	return 0, newHTTPStatusError(url, resp)
+}
+
+// saveResponse writes the body of a response to a local file
+func saveResponse(resp *http.Response, path string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(f, resp.Body)
+}
+
+// setRemoteTime sets the modification time of a downloaded file to the
+// Last-Modified time of the response if the repo has remote_time, so that
+// rsync-based consumers of the mirror see the same times as upstream
+func setRemoteTime(repo *Repo, resp *http.Response, path string) error {
+	if !repo.RemoteTime {
+		return nil
+	}
+
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return nil
+	}
+
+	return os.Chtimes(path, t, t)
+}
+
+// httpValidators are the cache validators returned with a downloaded file.
+// They are stored alongside the file so it is only downloaded again if it
+// has changed upstream.
+type httpValidators struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// validatorsPath returns the path of the cache validators of a file
+func validatorsPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".http.json")
+}
+
+// downloadIfModified saves the content of a URL to a local file, unless the
+// file was downloaded from the same URL before and the server reports that it
+// has not changed since. It returns true if the file was downloaded.
+func downloadIfModified(repo *Repo, url, path string) (bool, error) {
+	header := http.Header{}
+	v := httpValidators{}
+	if _, err := os.Stat(path); err == nil && readJSON(validatorsPath(path), &v) == nil && v.URL == url {
+		if v.ETag != "" {
+			header.Set("If-None-Match", v.ETag)
+		}
+		if v.LastModified != "" {
+			header.Set("If-Modified-Since", v.LastModified)
+		}
+	}
+
+	resp, err := httpRequest(repo, "GET", url, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		Dprintf("Not modified: %s\n", url)
+		return false, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, newHTTPStatusError(url, resp)
+	}
+
+	// replace the file atomically so an interrupted download is not mistaken
+	// for an unmodified one
+	os.Remove(validatorsPath(path))
+	if _, err := saveResponse(resp, path+partFileSuffix); err != nil {
+		os.Remove(path + partFileSuffix)
+		return false, err
+	}
+
+	if err := renameSynced(path+partFileSuffix, path); err != nil {
+		return false, err
+	}
+
+	v = httpValidators{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if v.ETag != "" || v.LastModified != "" {
+		if err := writeJSON(validatorsPath(path), &v); err != nil {
+			Dprintf("Error saving cache validators for %s: %v\n", path, err)
+		}
+	}
+
+	return true, nil
+}
+
+// UpstreamURLs returns the base URLs of a repo's upstream mirrors, taken from
+// its baseurl option or retrieved from its mirror list or metalink, fastest
+// first if they were ranked by fastestmirror.
+func (c *Repo) UpstreamURLs() ([]string, error) {
+	if len(c.Mirrors) > 0 {
+		return c.Mirrors, nil
+	}
+
+	urls := make([]string, 0)
+	if baseurl := c.Parameters["baseurl"]; baseurl != "" {
+		for _, url := range strings.Fields(strings.Replace(baseurl, ",", " ", -1)) {
+			urls = append(urls, c.expandYumVars(url))
+		}
+
+		return urls, nil
+	}
+
+	if metalink := c.Parameters["metalink"]; metalink != "" {
+		resp, err := httpGet(c, c.expandYumVars(metalink))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range metalinkURLPattern.FindAllStringSubmatch(string(b), -1) {
+			if strings.HasPrefix(m[1], "http") {
+				urls = append(urls, strings.TrimSuffix(m[1], "repodata/repomd.xml"))
+			}
+		}
+
+		return urls, nil
+	}
+
+	if mirrorlist := c.Parameters["mirrorlist"]; mirrorlist != "" {
+		resp, err := httpGet(c, c.expandYumVars(mirrorlist))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				urls = append(urls, line)
+			}
+		}
+
+		return urls, scanner.Err()
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsUpstreamUnavailable(t *testing.T) {
+	tests := []struct {
+		err  string
+		want bool
+	}{
+		{"GET https://example.com/repodata/repomd.xml: 404 Not Found", true},
+		{"Failed to download repomd.xml: 410 Gone", true},
+		{`Get "https://mirror.invalid/repodata/repomd.xml": dial tcp: lookup mirror.invalid: no such host`, true},
+		{`Get "https://10.0.0.1/repodata/repomd.xml": dial tcp 10.0.0.1:443: connect: connection refused`, true},
+		{`Get "https://example.com/": net/http: TLS handshake timeout`, true},
+		{`Get "https://example.com/": x509: certificate signed by unknown authority`, true},
+		{"Curl error (28): Timeout was reached for https://example.com/repodata/repomd.xml", true},
+		{"Curl error (6): Couldn't resolve host name for https://mirror.invalid/", true},
+		{"open /srv/repo/.y10k.lock: permission denied", false},
+		{"Error reading primary.xml: XML syntax error on line 1", false},
+		{"Timed out after 2h0m0s (sync_timeout)", false},
+		{"createrepo: exit status 1", false},
+	}
+
+	for _, test := range tests {
+		if got := isUpstreamUnavailable(errors.New(test.err)); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.err, test.want, got)
+		}
+	}
+}
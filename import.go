@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	repoFileKeyValPattern = regexp.MustCompile("^([\\w.-]+)\\s*=\\s*(.*)")
+	importKeyPattern      = regexp.MustCompile("^\\w+$")
+)
+
+// repoFileSection is a repo definition read from a yum .repo file
+type repoFileSection struct {
+	ID      string
+	Path    string
+	Keys    []string
+	Options map[string]string
+}
+
+// ImportRepoFiles parses standard yum .repo files and writes an equivalent
+// Yumfile stanza for each repo they define. Nothing is written if any repo ID
+// or key cannot be written to a Yumfile.
+func ImportRepoFiles(w io.Writer, paths ...string) error {
+	sections := make([]*repoFileSection, 0)
+	for _, path := range paths {
+		s, err := parseRepoFile(path)
+		if err != nil {
+			return err
+		}
+		sections = append(sections, s...)
+	}
+
+	for _, section := range sections {
+		if err := checkImportID(section); err != nil {
+			return err
+		}
+		for _, key := range section.Keys {
+			if !importKeyPattern.MatchString(key) {
+				return NewErrorf("Invalid key in repo %s in %s: %q", section.ID, section.Path, key)
+			}
+		}
+	}
+
+	for _, section := range sections {
+		writeYumfileStanza(w, section)
+	}
+
+	return nil
+}
+
+// parseRepoFile reads all repo sections from a yum .repo file. Indented lines
+// continue the value of the previous key, as in yum.
+func parseRepoFile(path string) ([]*repoFileSection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections := make([]*repoFileSection, 0)
+	var section *repoFileSection
+	var lastKey string
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+		s := scanner.Text()
+
+		if commentPattern.MatchString(s) {
+			continue
+		}
+
+		if matches := sectionHeadPattern.FindStringSubmatch(s); matches != nil {
+			section = nil
+			lastKey = ""
+			if matches[1] == "main" {
+				continue
+			}
+
+			section = &repoFileSection{
+				ID:      matches[1],
+				Path:    path,
+				Options: make(map[string]string, 0),
+			}
+			sections = append(sections, section)
+			continue
+		}
+
+		if section == nil {
+			continue
+		}
+
+		if s[0] == ' ' || s[0] == '\t' {
+			// continuation line
+			if lastKey == "" {
+				return nil, NewErrorf("Syntax error in %s on line %d: %s", path, n, s)
+			}
+			section.Options[lastKey] = strings.TrimSpace(section.Options[lastKey] + " " + strings.TrimSpace(s))
+			continue
+		}
+
+		matches := repoFileKeyValPattern.FindStringSubmatch(s)
+		if matches == nil {
+			return nil, NewErrorf("Syntax error in %s on line %d: %s", path, n, s)
+		}
+
+		lastKey = matches[1]
+		if _, ok := section.Options[lastKey]; !ok {
+			section.Keys = append(section.Keys, lastKey)
+		}
+		section.Options[lastKey] = strings.TrimSpace(matches[2])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sections, nil
+}
+
+// checkImportID returns an error if the ID of a repo read from a .repo file
+// cannot be written to a Yumfile without changing its meaning
+func checkImportID(section *repoFileSection) error {
+	if section.ID == "" || strings.ContainsAny(section.ID, "=]\r\n") {
+		return NewErrorf("Invalid repo ID in %s: %q", section.Path, section.ID)
+	}
+
+	return nil
+}
+
+// escapeYumfileValue escapes the ${ of a value read from a .repo file, so it
+// is not read as a Yumfile variable and reaches yum unchanged
+func escapeYumfileValue(s string) string {
+	return strings.Replace(s, "${", "$${", -1)
+}
+
+// writeYumfileStanza writes a repo section from a .repo file as a Yumfile
+// stanza. Multiple URLs are joined on a single line and a local path is added
+// based on the repo ID.
+func writeYumfileStanza(w io.Writer, section *repoFileSection) {
+	fmt.Fprintf(w, "# imported from %s\n", section.Path)
+	if b, err := strToBool(section.Options["enabled"]); err == nil && !b {
+		fmt.Fprintf(w, "# repo is disabled on this host\n")
+	}
+
+	fmt.Fprintf(w, "[%s]\n", escapeYumfileValue(section.ID))
+	for _, key := range section.Keys {
+		val := section.Options[key]
+		if key == "baseurl" || key == "gpgkey" {
+			val = strings.Join(strings.Fields(strings.Replace(val, ",", " ", -1)), " ")
+		}
+
+		fmt.Fprintf(w, "%s=%s\n", key, escapeYumfileValue(val))
+	}
+
+	if _, ok := section.Options["localpath"]; !ok {
+		fmt.Fprintf(w, "localpath=%s\n", escapeYumfileValue(section.ID))
+	}
+
+	fmt.Fprintf(w, "\n")
+}
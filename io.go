@@ -2,117 +2,81 @@ package main
 
 import (
 	"bufio"
-	"fmt"
-	"log"
-	"os"
+	"bytes"
+	"io"
 	"os/exec"
 	"strings"
-)
-
-const (
-	LOG_CAT_ERROR = iota
-	LOG_CAT_WARN
-	LOG_CAT_INFO
-	LOG_CAT_DEBUG
+	"sync"
+	"syscall"
 )
 
 var (
-	cmd           *exec.Cmd   = nil
-	logfileHandle *os.File    = nil
-	logger        *log.Logger = nil
+	cmds     map[*exec.Cmd]bool = make(map[*exec.Cmd]bool, 0)
+	cmdsLock sync.Mutex
 )
 
-func InitLogFile() {
-	if LogFilePath == "" {
-		return
+// startChild registers a child process so it can be terminated on exit
+func startChild(c *exec.Cmd) error {
+	cmdsLock.Lock()
+	defer cmdsLock.Unlock()
+
+	// no new processes are started once y10k is shutting down
+	if interrupted() {
+		return errInterrupted
 	}
 
-	f, err := os.OpenFile(LogFilePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	PanicOn(err)
+	Dprintf("exec: %s %s\n", c.Path, strings.Join(c.Args[1:], " "))
+	if err := c.Start(); err != nil {
+		return err
+	}
+	Dprintf("exec: started with PID: %d\n", c.Process.Pid)
 
-	logger = log.New(f, "", log.LstdFlags)
+	cmds[c] = true
+	return nil
 }
 
-// CloseLogFile cleans up any file handles associates with the log file.
-func CloseLogFile() {
-	if logfileHandle != nil {
-		PanicOn(logfileHandle.Close())
+// waitChild waits for a registered child process to finish
+func waitChild(c *exec.Cmd) error {
+	defer func() {
+		cmdsLock.Lock()
+		delete(cmds, c)
+		cmdsLock.Unlock()
+	}()
+
+	if err := c.Wait(); err != nil {
+		return err
 	}
-}
+	Dprintf("exec: finished PID: %d\n", c.Process.Pid)
 
-// Logf prints output to a logfile with a category and timestamp
-func Logf(category int, format string, a ...interface{}) {
-	var cat string
-	switch category {
-	case LOG_CAT_ERROR:
-		cat = "ERROR"
-	case LOG_CAT_WARN:
-		cat = "WARNING"
-	case LOG_CAT_INFO:
-		cat = "INFO"
-	case LOG_CAT_DEBUG:
-		cat = "DEBUG"
-	default:
-		panic(fmt.Sprintf("Unrecognized log category: %s", category))
-	}
-
-	logger.Printf("%s %s", cat, fmt.Sprintf(format, a...))
+	return nil
 }
 
-// Printf prints output to STDOUT or the logfile
-func Printf(format string, a ...interface{}) {
-	if logger == nil {
-		fmt.Printf(format, a...)
-	} else {
-		Logf(LOG_CAT_INFO, format, a...)
-	}
-}
+// KillChildren terminates all running child processes
+func KillChildren() {
+	cmdsLock.Lock()
+	defer cmdsLock.Unlock()
 
-// Errorf prints an error message to log or STDOUT
-func Errorf(err error, format string, a ...interface{}) {
-	if logger == nil {
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", fmt.Sprintf(format, a...), err.Error())
-		} else {
-			fmt.Fprintf(os.Stderr, "ERROR: %s\n", fmt.Sprintf(format, a...))
-		}
-	} else {
-		if err != nil {
-			Logf(LOG_CAT_ERROR, "%s: %s\n", fmt.Sprintf(format, a...), err.Error())
-		} else {
-			Logf(LOG_CAT_ERROR, format, a...)
-		}
+	for c := range cmds {
+		Printf("Attempting to terminate %s (PID: %d)...\n", c.Path, c.Process.Pid)
+		c.Process.Kill()
 	}
 }
 
-// Fatalf prints an error message to log or STDOUT and exits the program with
-// a non-zero exit code
-func Fatalf(err error, format string, a ...interface{}) {
-	Errorf(err, format, a...)
-	os.Exit(1)
-}
+// TerminateChildren asks all running child processes to exit, so that tools
+// such as rsync can clean up and keep partial transfers
+func TerminateChildren() {
+	cmdsLock.Lock()
+	defer cmdsLock.Unlock()
 
-// Dprintf prints verbose output only if debug mode is enabled
-func Dprintf(format string, a ...interface{}) {
-	if DebugMode {
-		if logger == nil {
-			fmt.Fprintf(os.Stderr, fmt.Sprintf("DEBUG: %s", format), a...)
-		} else {
-			Logf(LOG_CAT_DEBUG, format, a...)
-		}
+	for c := range cmds {
+		Dprintf("Terminating %s (PID: %d)\n", c.Path, c.Process.Pid)
+		c.Process.Signal(syscall.SIGTERM)
 	}
 }
 
 // Exec executes a system command and redirects the commands output to debug
 func Exec(path string, args ...string) error {
-	if cmd != nil {
-		return NewErrorf("Child process is aleady running (%s:%d)", cmd.Path, cmd.Process.Pid)
-	}
-
-	cmd = exec.Command(path, args...)
-	defer func() {
-		cmd = nil
-	}()
+	cmd := exec.Command(path, args...)
 
 	// parse stdout async
 	stdout, err := cmd.StdoutPipe()
@@ -140,21 +104,106 @@ func Exec(path string, args ...string) error {
 		}
 	}()
 
-	// execute
-	Dprintf("exec: %s %s\n", path, strings.Join(args, " "))
-	err = cmd.Start()
+	// execute and wait for process to finish
+	if err := startChild(cmd); err != nil {
+		return err
+	}
+
+	return waitChild(cmd)
+}
+
+// ExecLines executes a system command and passes each line of its standard
+// output and standard error to a function, one at a time, as well as to debug
+func ExecLines(line func(string), path string, args ...string) error {
+	cmd := exec.Command(path, args...)
+
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
 	}
-	Dprintf("exec: started with PID: %d\n", cmd.Process.Pid)
 
-	// wait for process to finish
-	err = cmd.Wait()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return err
 	}
-	Dprintf("exec: finished\n")
-	cmd = nil
 
-	return nil
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	scan := func(r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			Dprintf("%s: %s\n", cmd.Path, scanner.Text())
+			mu.Lock()
+			line(scanner.Text())
+			mu.Unlock()
+		}
+	}
+
+	if err := startChild(cmd); err != nil {
+		return err
+	}
+
+	// all output is read before waiting, as Wait closes the pipes
+	wg.Add(2)
+	go scan(stdout)
+	go scan(stderr)
+	wg.Wait()
+
+	return waitChild(cmd)
+}
+
+// ExecOutput executes a system command and returns its standard output, even
+// if the command fails. Standard error is redirected to debug.
+func ExecOutput(path string, args ...string) ([]byte, error) {
+	cmd := exec.Command(path, args...)
+
+	// capture stdout
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	// attach to stderr
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			Dprintf("%s: %s\n", cmd.Path, scanner.Text())
+		}
+	}()
+
+	// execute and wait for process to finish
+	if err := startChild(cmd); err != nil {
+		return nil, err
+	}
+
+	if err := waitChild(cmd); err != nil {
+		return stdout.Bytes(), err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// ExecCombinedOutput executes a system command and returns its standard
+// output and standard error combined, even if the command fails.
+func ExecCombinedOutput(path string, args ...string) ([]byte, error) {
+	cmd := exec.Command(path, args...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := startChild(cmd); err != nil {
+		return nil, err
+	}
+
+	err := waitChild(cmd)
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		Dprintf("%s: %s\n", cmd.Path, line)
+	}
+
+	return out.Bytes(), err
 }
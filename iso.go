@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultISOSize is the capacity of a single layer DVD
+const DefaultISOSize = 4700372992
+
+// isoOverhead is the space reserved on each disc for the ISO 9660 and Joliet
+// directory structures
+const isoOverhead = 16 << 20
+
+// isoBootFiles are the files of an installation tree which are copied to the
+// first disc, which is made bootable if isolinux is found
+var isoBootFiles = []string{".discinfo", ".treeinfo", "EFI", "images", "isolinux"}
+
+// isoTools are the commands which can write ISO images, in order of
+// preference
+var isoTools = [][]string{
+	{"xorriso", "-as", "mkisofs"},
+	{"genisoimage"},
+	{"mkisofs"},
+}
+
+// graftPointEscaper escapes paths in an mkisofs path list
+var graftPointEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`)
+
+// isoDisc is one disc of an ISO export: its packages and their total size
+type isoDisc struct {
+	Packages []ManifestEntry
+	Size     int64
+}
+
+// isoTool returns the command used to write ISO images
+func isoTool() ([]string, error) {
+	for _, tool := range isoTools {
+		if _, err := exec.LookPath(tool[0]); err == nil {
+			return tool, nil
+		}
+	}
+
+	return nil, NewErrorf("No ISO image tool found; install xorriso or genisoimage")
+}
+
+// isoVolumeID returns the volume label of a disc, which is limited to 32
+// characters
+func isoVolumeID(repo *Repo, disc, discs int) string {
+	label := strings.ToUpper(repo.ID)
+	suffix := ""
+	if discs > 1 {
+		suffix = fmt.Sprintf("-%d", disc)
+	}
+
+	if len(label)+len(suffix) > 32 {
+		label = label[:32-len(suffix)]
+	}
+
+	return label + suffix
+}
+
+// isoPath returns the path of a disc of an ISO export. A single disc is
+// written to output; multiple discs are numbered.
+func isoPath(output string, disc, discs int) string {
+	if discs == 1 {
+		return output
+	}
+
+	return fmt.Sprintf("%s-%d.iso", strings.TrimSuffix(output, ".iso"), disc)
+}
+
+// splitISODiscs assigns packages to discs of the given capacity, after the
+// metadata and manifest which are written to every disc and the boot files
+// written to the first
+func splitISODiscs(packages []ManifestEntry, capacity, common, boot int64) ([]isoDisc, error) {
+	discs := []isoDisc{{Size: common + boot}}
+	for _, pkg := range packages {
+		if common+pkg.Size > capacity {
+			return nil, NewErrorf("%s (%s) does not fit on a disc of %s", pkg.Path, formatBytes(pkg.Size), formatBytes(capacity))
+		}
+
+		disc := &discs[len(discs)-1]
+		if disc.Size+pkg.Size > capacity {
+			discs = append(discs, isoDisc{Size: common})
+			disc = &discs[len(discs)-1]
+		}
+
+		disc.Packages = append(disc.Packages, pkg)
+		disc.Size += pkg.Size
+	}
+
+	return discs, nil
+}
+
+// writeISOs writes the packages and metadata of a bundle to one or more ISO
+// images of at most size bytes. Every disc holds the repo metadata and a
+// manifest of its own packages, so the repo is complete once the content of
+// every disc is copied into one directory.
+func writeISOs(repo *Repo, output string, size int64, manifest *BundleManifest) ([]string, error) {
+	tool, err := isoTool()
+	if err != nil {
+		return nil, err
+	}
+
+	if size <= 0 {
+		size = DefaultISOSize
+	}
+	capacity := size - isoOverhead
+
+	var common int64 = 1 << 20 // the manifest
+	for _, entry := range manifest.Metadata {
+		common += entry.Size
+	}
+
+	// an installation tree is made bootable from its first disc
+	root := repo.Path()
+	bootFiles := make([]string, 0)
+	var boot int64
+	for _, name := range isoBootFiles {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			bootFiles = append(bootFiles, name)
+			boot += diskUsage(filepath.Join(root, name))
+		}
+	}
+
+	discs, err := splitISODiscs(manifest.Packages, capacity, common, boot)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(discs))
+	for i, disc := range discs {
+		if interrupted() {
+			return nil, errInterrupted
+		}
+
+		files := make([]string, 0, len(manifest.Metadata)+len(disc.Packages))
+		for _, entry := range manifest.Metadata {
+			files = append(files, entry.Path)
+		}
+		for _, entry := range disc.Packages {
+			files = append(files, entry.Path)
+		}
+
+		discManifest := *manifest
+		discManifest.Packages = disc.Packages
+		discManifest.Disc = i + 1
+		discManifest.Discs = len(discs)
+
+		bootable := false
+		if i == 0 {
+			files = append(files, bootFiles...)
+			_, err := os.Stat(filepath.Join(root, "isolinux", "isolinux.bin"))
+			bootable = err == nil
+		}
+
+		path := isoPath(output, i+1, len(discs))
+		Printf("Writing disc %d of %d (%s): %s\n", i+1, len(discs), formatBytes(disc.Size), path)
+		if err := writeISO(tool, root, path, isoVolumeID(repo, i+1, len(discs)), files, &discManifest, bootable); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// writeISO writes files of a repo, and a manifest, to an ISO image. Files are
+// added with graft points, so the disc's content is not copied first.
+func writeISO(tool []string, root, path, label string, files []string, manifest *BundleManifest, bootable bool) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestFile, err := ioutil.TempFile(filepath.Dir(path), ".y10k-manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(manifestFile.Name())
+
+	_, err = manifestFile.Write(append(b, '\n'))
+	if cerr := manifestFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// map each file on the disc to its path in the repo
+	pathList, err := ioutil.TempFile(filepath.Dir(path), ".y10k-paths-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pathList.Name())
+
+	grafts := make(map[string]string, len(files)+1)
+	grafts[bundleManifestName] = manifestFile.Name()
+	for _, rel := range files {
+		grafts[filepath.ToSlash(rel)] = filepath.Join(root, rel)
+	}
+
+	// genisoimage patches the boot info table into the source boot image, so
+	// the isolinux directory is grafted file by file with a copy of it
+	if bootable {
+		dir := filepath.Join(root, "isolinux")
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		delete(grafts, "isolinux")
+		for _, fi := range entries {
+			grafts["isolinux/"+fi.Name()] = filepath.Join(dir, fi.Name())
+		}
+
+		bootImage := filepath.Join(filepath.Dir(path), fmt.Sprintf(".y10k-isolinux-%d.bin", os.Getpid()))
+		if err := cloneFile(filepath.Join(dir, "isolinux.bin"), bootImage); err != nil {
+			return err
+		}
+		defer os.Remove(bootImage)
+		grafts["isolinux/isolinux.bin"] = bootImage
+	}
+
+	for dst, src := range grafts {
+		fmt.Fprintf(pathList, "%s=%s\n", graftPointEscaper.Replace(dst), graftPointEscaper.Replace(src))
+	}
+	if err := pathList.Close(); err != nil {
+		return err
+	}
+
+	args := append([]string{}, tool[1:]...)
+	args = append(args,
+		"-quiet",
+		"-r",
+		"-J",
+		"-joliet-long",
+		"-V", label,
+		"-o", path+partFileSuffix,
+		"-graft-points",
+		"-path-list", pathList.Name(),
+	)
+
+	if bootable {
+		args = append(args,
+			"-b", "isolinux/isolinux.bin",
+			"-c", "isolinux/boot.cat",
+			"-no-emul-boot",
+			"-boot-load-size", "4",
+			"-boot-info-table",
+		)
+	}
+
+	if err := Exec(tool[0], args...); err != nil {
+		os.Remove(path + partFileSuffix)
+		return err
+	}
+
+	return renameSynced(path+partFileSuffix, path)
+}
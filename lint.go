@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Lint diagnostic severities
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// Diagnostic is a single problem found while linting a Yumfile
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (c Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", c.File, c.Line, c.Column, c.Severity, c.Message)
+}
+
+// y10kRepoKeys are the repo options interpreted by y10k
+var y10kRepoKeys = map[string]bool{
+	"as_of":             true,
+	"closure_with":      true,
+	"debuginfo":         true,
+	"debuginfourl":      true,
+	"entitlement_label": true,
+	"groupfile":         true,
+	"history_url":       true,
+	"localpath":         true,
+	"merge_into":        true,
+	"merge_priority":    true,
+	"pin_revision":      true,
+	"preset_repo":       true,
+	"priority":          true,
+	"publish":           true,
+	"pullthrough":       true,
+	"push":              true,
+	"serve_prefix":      true,
+	"smoketest":         true,
+	"smoketest_with":    true,
+	"snapshotpath":      true,
+	"split":             true,
+	"stagingpath":       true,
+	"state_path":        true,
+	"tags":              true,
+}
+
+// yumRepoKeys are the repo options understood by yum which may be passed
+// through from a Yumfile
+var yumRepoKeys = map[string]bool{
+	"async":                      true,
+	"baseurl":                    true,
+	"cost":                       true,
+	"deltarpm_percentage":        true,
+	"enabled":                    true,
+	"enablegroups":               true,
+	"failovermethod":             true,
+	"http_caching":               true,
+	"keepalive":                  true,
+	"metadata_expire":            true,
+	"metalink":                   true,
+	"mirrorlist":                 true,
+	"mirrorlist_expire":          true,
+	"name":                       true,
+	"skip_if_unavailable":        true,
+	"ssl_check_cert_permissions": true,
+}
+
+// isKnownRepoKey returns true if a repo option is understood by y10k or yum
+func isKnownRepoKey(key string) bool {
+	return inheritableKeys[key] || y10kRepoKeys[key] || yumRepoKeys[key]
+}
+
+// lintf records a diagnostic if the Yumfile is being linted
+func (c *Yumfile) lintf(path string, n, col int, severity string, format string, a ...interface{}) {
+	if c.diagnostics == nil {
+		return
+	}
+
+	*c.diagnostics = append(*c.diagnostics, Diagnostic{
+		File:     path,
+		Line:     n,
+		Column:   col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// LintYumfile loads a Yumfile and returns all problems found in it, instead of
+// only the first. If online is true, the upstream URL of each repo is also
+// checked for reachability.
+func LintYumfile(path string, online bool) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+
+	yumfile := NewYumfile()
+	yumfile.diagnostics = &diagnostics
+	if err := yumfile.loadAll(path); err != nil {
+		yumfile.lintf(path, 0, 0, LintError, "%s", err.Error())
+		return diagnostics
+	}
+
+	for _, repo := range yumfile.Repos {
+		yumfile.lintRepo(&repo, online)
+	}
+
+	return diagnostics
+}
+
+// lintRepo records warnings for conflicting options and, if online is true,
+// unreachable upstream URLs of a repo.
+func (c *Yumfile) lintRepo(repo *Repo, online bool) {
+	warnf := func(format string, a ...interface{}) {
+		c.lintf(repo.YumfilePath, repo.YumfileLineNo, 1, LintWarning, format, a...)
+	}
+
+	// conflicting options
+	if repo.Parameters["baseurl"] != "" && (repo.Parameters["mirrorlist"] != "" || repo.Parameters["metalink"] != "") {
+		warnf("Repo '%s' sets both baseurl and a mirror list", repo.ID)
+	}
+
+	if repo.DebugInfoURL != "" && !repo.DebugInfo {
+		warnf("Repo '%s' sets debuginfourl but debuginfo is not enabled", repo.ID)
+	}
+
+	if b, _ := strToBool(repo.Parameters["repo_gpgcheck"]); b && repo.Parameters["gpgkey"] == "" {
+		warnf("Repo '%s' enables repo_gpgcheck but has no gpgkey", repo.ID)
+	}
+
+	if repo.GPGCheck && repo.Parameters["gpgkey"] == "" {
+		warnf("Repo '%s' enables gpgcheck but has no gpgkey", repo.ID)
+	}
+
+	if !online {
+		return
+	}
+
+	// reachability
+	for _, key := range []string{"baseurl", "mirrorlist", "metalink"} {
+		for _, url := range strings.Fields(strings.Replace(repo.Parameters[key], ",", " ", -1)) {
+			if strings.Contains(url, "$") {
+				warnf("Not checking %s with yum variables: %s", key, url)
+				continue
+			}
+
+			if key == "baseurl" {
+				url = strings.TrimSuffix(url, "/") + "/repodata/repomd.xml"
+			}
+
+			if err := checkURL(repo, url); err != nil {
+				c.lintf(repo.YumfilePath, repo.YumfileLineNo, 1, LintError, "Repo '%s' %s is unreachable: %s", repo.ID, key, err.Error())
+			}
+		}
+	}
+}
+
+// checkURL returns an error if a HTTP(S) or FTP URL cannot be retrieved
+func checkURL(repo *Repo, url string) error {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil
+	}
+
+	// use the repo's proxy and TLS options
+	client, err := httpClient(repo)
+	if err != nil {
+		return err
+	}
+	client.Timeout = 30 * time.Second
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return NewErrorf("%s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// repoLockName is the name of the lock file in a repo's local path
+const repoLockName = ".y10k.lock"
+
+// cacheLockName is the name of the lock file in a repo's cache directory
+// which is held while the repo is synchronized
+const cacheLockName = "lock"
+
+// cacheReadLockName is the name of the lock file in a repo's cache directory
+// which is held shared by every process reading the cache, so that it is not
+// removed by clean while in use
+const cacheReadLockName = "readers.lock"
+
+// upstreamLockName is the name of the lock file in a repo's cache directory
+// which is held while the upstream metadata cache is updated
+const upstreamLockName = "upstream.lock"
+
+// staleLockAge is the age after which a lock file is considered stale on
+// filesystems which do not support flock
+const staleLockAge = 24 * time.Hour
+
+// lockPollInterval is how often a held lock is retried while waiting for it
+const lockPollInterval = time.Second
+
+// fileLock is an advisory lock on a file, held with flock so that it is
+// released if its owner dies. The file records the PID, host and start time
+// of the owner for diagnostics, and to detect stale locks where flock is not
+// supported, such as on some network filesystems. Shared locks may be held
+// by many processes at once and do not record an owner.
+type fileLock struct {
+	path    string
+	f       *os.File
+	flocked bool
+	shared  bool
+}
+
+// lockOwner is the owner of a lock recorded in its file
+type lockOwner struct {
+	PID      int
+	Hostname string
+	Time     time.Time
+}
+
+// String describes the owner of a lock
+func (c *lockOwner) String() string {
+	if c.PID == 0 {
+		return "another process"
+	}
+
+	return fmt.Sprintf("PID %d on %s since %s", c.PID, c.Hostname, c.Time.Format(time.RFC3339))
+}
+
+// stale returns true if the owner of a lock has exited or the lock is older
+// than staleLockAge. A process on another host can only be detected by age.
+func (c *lockOwner) stale() bool {
+	if time.Since(c.Time) > staleLockAge {
+		return true
+	}
+
+	hostname, _ := os.Hostname()
+	if c.Hostname != hostname {
+		return false
+	}
+
+	return syscall.Kill(c.PID, 0) == syscall.ESRCH
+}
+
+// readLockOwner returns the owner recorded in a lock file, or nil if there is
+// none
+func readLockOwner(path string) *lockOwner {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	owner := &lockOwner{}
+	var t string
+	if n, _ := fmt.Sscanf(strings.TrimSpace(string(b)), "%d %s %s", &owner.PID, &owner.Hostname, &t); n != 3 {
+		return nil
+	}
+
+	owner.Time, _ = time.Parse(time.RFC3339, t)
+	return owner
+}
+
+// tryLock attempts to lock a file without blocking, exclusively or shared
+// with other readers. If the lock is held by another process, its owner is
+// returned.
+func tryLock(path string, shared bool) (*fileLock, *lockOwner, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	c := &fileLock{path: path, f: f, flocked: true, shared: shared}
+	switch err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err {
+	case nil:
+
+	case syscall.EWOULDBLOCK:
+		f.Close()
+		owner := readLockOwner(path)
+		if owner == nil {
+			// only shared locks are held, which record no owner
+			owner = &lockOwner{}
+		}
+		return nil, owner, nil
+
+	case syscall.ENOLCK, syscall.EOPNOTSUPP, syscall.EINVAL:
+		// flock is not supported, so rely on the recorded owner
+		c.flocked = false
+		if owner := readLockOwner(path); owner != nil {
+			if !owner.stale() {
+				f.Close()
+				return nil, owner, nil
+			}
+			Warnf(nil, "Removing stale lock %s held by %s", path, owner)
+		}
+
+	default:
+		f.Close()
+		return nil, nil, err
+	}
+
+	if shared {
+		return c, nil, nil
+	}
+
+	hostname, _ := os.Hostname()
+	if err := f.Truncate(0); err != nil {
+		c.Unlock()
+		return nil, nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%d %s %s\n", os.Getpid(), hostname, time.Now().Format(time.RFC3339)); err != nil {
+		c.Unlock()
+		return nil, nil, err
+	}
+
+	return c, nil, nil
+}
+
+// acquireLock locks a file, exclusively or shared with other readers. If it
+// is held by another process and wait is false, an error naming the owner is
+// returned; otherwise the lock is retried until it is acquired, timeout
+// expires (if not zero) or y10k is interrupted.
+func acquireLock(path string, shared, wait bool, timeout time.Duration) (*fileLock, error) {
+	start := time.Now()
+	waiting := false
+	for {
+		c, owner, err := tryLock(path, shared)
+		if err != nil {
+			return nil, err
+		}
+
+		if c != nil {
+			return c, nil
+		}
+
+		if !wait {
+			return nil, NewErrorf("%s is locked by %s", path, owner)
+		}
+
+		if timeout > 0 && time.Since(start) > timeout {
+			return nil, NewErrorf("Timed out after %v waiting for %s, locked by %s", timeout, path, owner)
+		}
+
+		if !waiting {
+			Printf("Waiting for %s, locked by %s\n", path, owner)
+			waiting = true
+		}
+
+		select {
+		case <-RepoContext().Done():
+			return nil, errInterrupted
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// Unlock releases a lock. The lock file of an exclusive lock is emptied
+// rather than removed, as another process may already have opened it.
+func (c *fileLock) Unlock() {
+	if c == nil {
+		return
+	}
+
+	if !c.shared {
+		c.f.Truncate(0)
+	}
+	if c.flocked {
+		syscall.Flock(int(c.f.Fd()), syscall.LOCK_UN)
+	}
+	c.f.Close()
+}
+
+// repoLockPath returns the path of the lock file in a repo's local path, or
+// its staging directory if it is mirrored to object storage
+func (c *Repo) repoLockPath() string {
+	return filepath.Join(c.Path(), repoLockName)
+}
+
+// cacheLockPath returns the path of the lock file in a repo's cache
+// directory
+func (c *Repo) cacheLockPath() string {
+	return filepath.Join(c.CacheDir(), c.ID, cacheLockName)
+}
+
+// lockRepo locks a repo's local path and cache directory for the duration
+// of a sync, so that overlapping runs cannot corrupt its metadata, and
+// returns a function which releases both locks.
+func (c *Yumfile) lockRepo(repo *Repo) (func(), error) {
+	locks := make([]*fileLock, 0, 2)
+	unlock := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+
+	for _, path := range []string{repo.repoLockPath(), repo.cacheLockPath()} {
+		l, err := acquireLock(path, false, c.Wait, c.WaitTimeout)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+
+	return unlock, nil
+}
+
+// cacheReadLockPath returns the path of the lock file held by readers of a
+// repo's cache directory
+func (c *Repo) cacheReadLockPath() string {
+	return filepath.Join(c.CacheDir(), c.ID, cacheReadLockName)
+}
+
+// upstreamLockPath returns the path of the lock file held while a repo's
+// upstream metadata cache is updated
+func (c *Repo) upstreamLockPath() string {
+	return filepath.Join(c.CacheDir(), c.ID, upstreamLockName)
+}
+
+// readLockCaches takes a shared lock on the cache directory of each of the
+// given repos, so that another y10k process cannot remove them while they
+// are read, and returns a function which releases the locks. Readers do not
+// wait for syncs, which replace cached files atomically.
+func readLockCaches(repos ...*Repo) (func(), error) {
+	locks := make([]*fileLock, 0, len(repos))
+	unlock := func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+
+	for _, repo := range repos {
+		l, err := acquireLock(repo.cacheReadLockPath(), true, true, 0)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+
+	return unlock, nil
+}
+
+// lockUpstreamCache locks a repo's upstream metadata cache while it is
+// updated, so that concurrent processes do not download the same file over
+// each other or prune a file another has just downloaded, and returns a
+// function which releases the lock. Holders only download metadata, so the
+// lock is always waited for.
+func (c *Repo) lockUpstreamCache() (func(), error) {
+	l, err := acquireLock(c.upstreamLockPath(), false, true, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.Unlock, nil
+}
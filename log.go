@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, from most to least severe. Messages are logged if their level
+// is at or below the configured LogLevel.
+const (
+	LOG_CAT_ERROR = iota
+	LOG_CAT_WARN
+	LOG_CAT_INFO
+	LOG_CAT_DEBUG
+)
+
+// logLevelNames are the names of each log level, as accepted by --log-level
+var logLevelNames = map[int]string{
+	LOG_CAT_ERROR: "error",
+	LOG_CAT_WARN:  "warn",
+	LOG_CAT_INFO:  "info",
+	LOG_CAT_DEBUG: "debug",
+}
+
+// logTimeFormat is the timestamp format of text log files
+const logTimeFormat = "2006/01/02 15:04:05"
+
+var (
+	LogLevel      = LOG_CAT_INFO
+	LogFormat     = "text"
+	LogMaxSize    int64
+	LogMaxBackups = 5
+	LogTarget     string
+
+	// LogToStderr sends info messages to STDERR rather than STDOUT, such as
+	// when STDOUT is reserved for a report
+	LogToStderr bool
+
+	logLock       sync.Mutex
+	logFile       *rotatingFile
+	logSinkTarget logSink
+	logRepo       string
+)
+
+// logRecord is a log message in JSON format
+type logRecord struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Repo  string    `json:"repo,omitempty"`
+	Msg   string    `json:"msg"`
+}
+
+// ParseLogLevel returns the log level with the given name
+func ParseLogLevel(s string) (int, error) {
+	s = strings.ToLower(s)
+	if s == "warning" {
+		s = "warn"
+	}
+
+	for level, name := range logLevelNames {
+		if name == s {
+			return level, nil
+		}
+	}
+
+	return 0, NewErrorf("Invalid log level: %s (expected error, warn, info or debug)", s)
+}
+
+// SetLogRepo sets the repo which subsequent log messages relate to, or clears
+// it if id is empty
+func SetLogRepo(id string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logRepo = id
+}
+
+// InitLogFile redirects all log messages to LogTarget or LogFilePath, if set
+func InitLogFile() {
+	sink, err := openLogSink(LogTarget)
+	PanicOn(err)
+	logSinkTarget = sink
+
+	if LogFilePath == "" || logSinkTarget != nil {
+		return
+	}
+
+	f, err := openRotatingFile(LogFilePath, LogMaxSize, LogMaxBackups)
+	PanicOn(err)
+
+	logFile = f
+}
+
+// CloseLogFile cleans up any file handles associates with the log file.
+func CloseLogFile() {
+	if logSinkTarget != nil {
+		PanicOn(logSinkTarget.Close())
+	}
+
+	if logFile != nil {
+		PanicOn(logFile.Close())
+	}
+}
+
+// Logf writes a message with the given level to syslog, the journal, the log
+// file, or to STDOUT or STDERR, in the configured format. Messages above the
+// configured level are discarded.
+func Logf(category int, format string, a ...interface{}) {
+	if category > LogLevel {
+		return
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	var w io.Writer = os.Stderr
+	if logFile != nil {
+		w = logFile
+	} else if category == LOG_CAT_INFO && !LogToStderr {
+		w = os.Stdout
+	}
+
+	level, ok := logLevelNames[category]
+	if !ok {
+		panic(fmt.Sprintf("Unrecognized log category: %d", category))
+	}
+
+	msg := strings.TrimRight(fmt.Sprintf(format, a...), "\n")
+	if logSinkTarget != nil {
+		logSinkTarget.Log(category, logRepo, msg)
+		return
+	}
+
+	if LogFormat == "json" {
+		b, err := json.Marshal(&logRecord{
+			Time:  time.Now().UTC(),
+			Level: level,
+			Repo:  logRepo,
+			Msg:   msg,
+		})
+		if err == nil {
+			fmt.Fprintf(w, "%s\n", b)
+		}
+		return
+	}
+
+	// log files get a timestamp, level and repo on every line
+	if logFile != nil {
+		repo := ""
+		if logRepo != "" {
+			repo = "[" + logRepo + "] "
+		}
+		fmt.Fprintf(w, "%s %s %s%s\n", time.Now().Format(logTimeFormat), strings.ToUpper(level), repo, msg)
+		return
+	}
+
+	switch category {
+	case LOG_CAT_ERROR:
+		fmt.Fprintf(w, "ERROR: %s\n", msg)
+	case LOG_CAT_WARN:
+		fmt.Fprintf(w, "WARNING: %s\n", msg)
+	case LOG_CAT_DEBUG:
+		fmt.Fprintf(w, "DEBUG: %s\n", msg)
+	default:
+		fmt.Fprintf(w, format, a...)
+	}
+}
+
+// Printf prints output to STDOUT or the logfile
+func Printf(format string, a ...interface{}) {
+	Logf(LOG_CAT_INFO, format, a...)
+}
+
+// Errorf prints an error message to log or STDERR
+func Errorf(err error, format string, a ...interface{}) {
+	if err != nil {
+		Logf(LOG_CAT_ERROR, "%s: %s", fmt.Sprintf(format, a...), err.Error())
+	} else {
+		Logf(LOG_CAT_ERROR, format, a...)
+	}
+}
+
+// Warnf prints a warning message to log or STDERR
+func Warnf(err error, format string, a ...interface{}) {
+	if err != nil {
+		Logf(LOG_CAT_WARN, "%s: %s", fmt.Sprintf(format, a...), err.Error())
+	} else {
+		Logf(LOG_CAT_WARN, format, a...)
+	}
+}
+
+// Fatalf prints an error message to log or STDERR and exits the program with
+// a non-zero exit code
+func Fatalf(err error, format string, a ...interface{}) {
+	Errorf(err, format, a...)
+	os.Exit(ExitError)
+}
+
+// Dprintf prints verbose output only if debug logging is enabled
+func Dprintf(format string, a ...interface{}) {
+	Logf(LOG_CAT_DEBUG, format, a...)
+}
+
+// rotatingFile is a log file which is rotated when it reaches a maximum size.
+// Rotated files are renamed with a numeric suffix, path.1 being the newest.
+type rotatingFile struct {
+	path    string
+	f       *os.File
+	size    int64
+	maxSize int64
+	backups int
+}
+
+// openRotatingFile opens a log file for appending. If maxSize is zero the
+// file is never rotated.
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	c := &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *rotatingFile) open() error {
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	c.f, c.size = f, fi.Size()
+	return nil
+}
+
+func (c *rotatingFile) Write(p []byte) (int, error) {
+	if c.maxSize > 0 && c.size > 0 && c.size+int64(len(p)) > c.maxSize {
+		if err := c.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.f.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current log file and any older ones, deleting the
+// oldest, and opens a new file
+func (c *rotatingFile) rotate() error {
+	if err := c.f.Close(); err != nil {
+		return err
+	}
+
+	if c.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", c.path, c.backups))
+		for i := c.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+		}
+		if err := os.Rename(c.path, c.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(c.path); err != nil {
+		return err
+	}
+
+	return c.open()
+}
+
+func (c *rotatingFile) Close() error {
+	return c.f.Close()
+}
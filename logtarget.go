@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+)
+
+// journalSocket is the native protocol socket of the systemd journal
+const journalSocket = "/run/systemd/journal/socket"
+
+// logSyslogTag identifies y10k messages in syslog and the journal
+const logSyslogTag = "y10k"
+
+// logSink receives log messages in place of the console or a log file
+type logSink interface {
+	Log(category int, repo, msg string) error
+	Close() error
+}
+
+// logPriorities are the syslog priorities of each log level
+var logPriorities = map[int]syslog.Priority{
+	LOG_CAT_ERROR: syslog.LOG_ERR,
+	LOG_CAT_WARN:  syslog.LOG_WARNING,
+	LOG_CAT_INFO:  syslog.LOG_INFO,
+	LOG_CAT_DEBUG: syslog.LOG_DEBUG,
+}
+
+// openLogSink connects to a log target: "syslog" or "journal". Any other
+// target returns a nil sink, so messages are printed to the console.
+func openLogSink(target string) (logSink, error) {
+	switch target {
+	case "", "console":
+		return nil, nil
+
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logSyslogTag)
+		if err != nil {
+			return nil, err
+		}
+		return &syslogSink{w: w}, nil
+
+	case "journal":
+		addr := &net.UnixAddr{Name: journalSocket, Net: "unixgram"}
+		conn, err := net.DialUnix("unixgram", nil, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &journalSink{conn: conn}, nil
+	}
+
+	return nil, NewErrorf("Invalid log target: %s (expected console, syslog or journal)", target)
+}
+
+// syslogSink writes log messages to the local syslog daemon
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (c *syslogSink) Log(category int, repo, msg string) error {
+	if repo != "" {
+		msg = "[" + repo + "] " + msg
+	}
+
+	switch category {
+	case LOG_CAT_ERROR:
+		return c.w.Err(msg)
+	case LOG_CAT_WARN:
+		return c.w.Warning(msg)
+	case LOG_CAT_DEBUG:
+		return c.w.Debug(msg)
+	}
+
+	return c.w.Info(msg)
+}
+
+func (c *syslogSink) Close() error {
+	return c.w.Close()
+}
+
+// journalSink writes log messages to the systemd journal using its native
+// protocol, so the repo is recorded as a separate field
+type journalSink struct {
+	conn *net.UnixConn
+}
+
+func (c *journalSink) Log(category int, repo, msg string) error {
+	b := &bytes.Buffer{}
+	writeJournalField(b, "MESSAGE", msg)
+	writeJournalField(b, "PRIORITY", fmt.Sprintf("%d", logPriorities[category]))
+	writeJournalField(b, "SYSLOG_IDENTIFIER", logSyslogTag)
+	writeJournalField(b, "SYSLOG_PID", fmt.Sprintf("%d", os.Getpid()))
+	if repo != "" {
+		writeJournalField(b, "Y10K_REPO", repo)
+	}
+
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+func (c *journalSink) Close() error {
+	return c.conn.Close()
+}
+
+// writeJournalField appends a field in the journal's native format. Values
+// containing newlines are written with an explicit length.
+func writeJournalField(b *bytes.Buffer, key, val string) {
+	if !strings.Contains(val, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, val)
+		return
+	}
+
+	fmt.Fprintf(b, "%s\n", key)
+	binary.Write(b, binary.LittleEndian, uint64(len(val)))
+	fmt.Fprintf(b, "%s\n", val)
+}
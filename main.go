@@ -1,19 +1,33 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"os"
-	"os/signal"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exit codes
+const (
+	ExitError      = 1 // fatal error, such as an invalid Yumfile
+	ExitSyncFailed = 2 // one or more repos failed to synchronize
+	ExitAllFailed  = 3 // every repo which was attempted failed to synchronize
 )
 
 var (
 	QuietMode       bool
 	DebugMode       bool
+	FIPSMode        bool
 	YumfilePath     string
 	LogFilePath     string
 	TmpBasePath     string
+	TmpFilePrefix   string
 	TmpYumConfPath  string
 	TmpYumLogFile   string
 	TmpYumCachePath string
@@ -32,10 +46,36 @@ func main() {
 	app.Usage = "simplified yum mirror management"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:   "logfile, l",
+			Name:   "logfile, log-file, l",
 			Usage:  "redirect output to a log file",
 			EnvVar: "Y10K_LOGFILE",
 		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "minimum level of messages to log (error, warn, info or debug)",
+			EnvVar: "Y10K_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "format of log messages (text or json)",
+			Value:  "text",
+			EnvVar: "Y10K_LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-target",
+			Usage:  "send log messages to the console, syslog or journal",
+			Value:  "console",
+			EnvVar: "Y10K_LOG_TARGET",
+		},
+		cli.StringFlag{
+			Name:  "log-max-size",
+			Usage: "rotate the log file when it reaches this size (e.g. 100M)",
+		},
+		cli.IntFlag{
+			Name:  "log-max-backups",
+			Usage: "number of rotated log files to keep",
+			Value: 5,
+		},
 		cli.BoolFlag{
 			Name:  "quiet, q",
 			Usage: "less verbose",
@@ -45,12 +85,23 @@ func main() {
 			Usage:  "print debug output",
 			EnvVar: "Y10K_DEBUG",
 		},
+		cli.BoolFlag{
+			Name:   "fips",
+			Usage:  "refuse md5 and sha1 checksums, and unsigned packages and metadata",
+			EnvVar: "Y10K_FIPS",
+		},
 		cli.StringFlag{
 			Name:   "tmppath, t",
 			Usage:  "path to y10k temporary objects",
 			Value:  "/tmp/y10k",
 			EnvVar: "Y10K_TMPPATH",
 		},
+		cli.StringFlag{
+			Name:   "tmpprefix",
+			Usage:  "file name prefix for y10k temporary objects",
+			Value:  "tmp-y10k-",
+			EnvVar: "Y10K_TMPPREFIX",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -74,113 +125,1677 @@ func main() {
 					Usage:  "validate a Yumfile's syntax",
 					Action: ActionYumfileValidate,
 				},
+				{
+					Name:   "import",
+					Usage:  "print Yumfile repos equivalent to yum .repo files",
+					Action: ActionYumfileImport,
+				},
+				{
+					Name:   "lint",
+					Usage:  "report all problems found in a Yumfile",
+					Action: ActionYumfileLint,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "online",
+							Usage: "check that upstream URLs are reachable",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Usage: "output format (text or json)",
+							Value: "text",
+						},
+					},
+				},
 				{
 					Name:   "list",
 					Usage:  "list repositories in a Yumfile",
 					Action: ActionYumfileList,
 				},
+				{
+					Name:  "presets",
+					Usage: "list the upstream URL presets available to repos",
+					Action: func(context *cli.Context) {
+						PrintPresets()
+					},
+				},
+				{
+					Name:  "entitlements",
+					Usage: "list the Red Hat CDN content available to repos from entitlement certificates",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "path",
+							Usage: "path to entitlement certificates",
+							Value: DefaultEntitlementPath,
+						},
+					},
+					Action: func(context *cli.Context) {
+						content, err := ReadEntitlements(context.String("path"))
+						if err != nil {
+							Fatalf(err, "Error reading entitlements")
+						}
+						PrintEntitlements(content)
+					},
+				},
+				{
+					Name:   "show",
+					Usage:  "show the options of repositories in a Yumfile",
+					Action: ActionYumfileShow,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "effective, e",
+							Usage: "show resolved options including globals and defaults",
+						},
+					},
+				},
 				{
 					Name:   "sync",
 					Usage:  "syncronize repos described in a Yumfile",
 					Action: ActionYumfileSync,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "report what a sync would change without downloading",
+						},
+						cli.StringSliceFlag{
+							Name:  "only",
+							Usage: "only sync repos whose IDs match these comma separated globs (may be repeated)",
+						},
+						cli.StringSliceFlag{
+							Name:  "tags",
+							Usage: "only sync repos with any of these comma separated tags (may be repeated)",
+						},
+						cli.StringSliceFlag{
+							Name:  "skip",
+							Usage: "do not sync repos whose IDs match these comma separated globs (may be repeated)",
+						},
+						cli.BoolFlag{
+							Name:  "keep-going, k",
+							Usage: "continue with remaining repos after a failure (default)",
+						},
+						cli.BoolFlag{
+							Name:  "fail-fast",
+							Usage: "stop at the first repo which fails",
+						},
+						cli.Float64Flag{
+							Name:  "max-delete-percent",
+							Usage: "abort a repo if more than this percentage of its packages would be deleted",
+						},
+						cli.BoolFlag{
+							Name:  "verify-all",
+							Usage: "hash every local package instead of using cached checksums",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "synchronize repos even if their upstream metadata is unchanged",
+						},
+						cli.BoolFlag{
+							Name:  "strict-freshness",
+							Usage: "fail repos whose upstream metadata is older than their max_upstream_age",
+						},
+						cli.BoolFlag{
+							Name:  "wait",
+							Usage: "wait for repos locked by another run instead of failing",
+						},
+						cli.StringFlag{
+							Name:  "wait-timeout",
+							Usage: "give up waiting for a locked repo after this long (e.g. 2h)",
+						},
+						cli.BoolFlag{
+							Name:  "no-progress",
+							Usage: "do not report download progress",
+						},
+						cli.StringFlag{
+							Name:  "report",
+							Usage: "write a report of the run to a file ('-' for STDOUT)",
+						},
+						cli.StringFlag{
+							Name:  "report-format",
+							Usage: "format of the run report (json, text or template)",
+						},
+						cli.StringFlag{
+							Name:  "report-template",
+							Usage: "Go template file used to render the run report",
+						},
+					},
 				},
 			},
 		},
 		{
-			Name:  "version",
-			Usage: "print the version of y10k",
-			Action: func(context *cli.Context) {
-				fmt.Printf("%s version %s\n", app.Name, app.Version)
+			Name:  "bench",
+			Usage: "measure sync performance for a repo in a Yumfile",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.IntFlag{
+					Name:  "size, s",
+					Usage: "megabytes of package data to download",
+					Value: 100,
+				},
+				cli.BoolFlag{
+					Name:  "synthetic",
+					Usage: "download from a synthetic local upstream",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
 			},
+			Action: ActionBench,
 		},
-	}
-
-	app.Before = func(context *cli.Context) error {
-		// set globals from command line context
-		QuietMode = context.GlobalBool("quiet")
-		DebugMode = context.GlobalBool("debug")
-		LogFilePath = context.GlobalString("logfile")
-
-		TmpBasePath = context.GlobalString("tmppath")
-		TmpYumConfPath = context.GlobalString("tmppath") + "/" + "yum.conf"
-		TmpYumLogFile = context.GlobalString("tmppath") + "/" + "yum.log"
-		TmpYumCachePath = context.GlobalString("tmppath") + "/" + "cache"
-
-		// configure logging
-		InitLogFile()
-
-		return nil
-	}
-
-	// sig handler
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for _ = range c {
-			Printf("Caught SIGINT/Ctrl-C. Cleaning up...\n")
-
-			if cmd != nil {
-				Printf("Attempting to terminate %s (PID: %d)...\n", cmd.Path, cmd.Process.Pid)
-				cmd.Process.Kill()
-			}
-
-			Printf("Exiting\n")
-			os.Exit(2)
-		}
-	}()
-
-	app.Run(os.Args)
-}
-
-// ActionYumfileValidate processes the 'yumfile validate' command
-func ActionYumfileValidate(context *cli.Context) {
-	yumfile, err := LoadYumfile(YumfilePath)
-	PanicOn(err)
-	Printf("Yumfile appears valid (%d repos)\n", len(yumfile.Repos))
-}
-
-// ActionYumfileList processes the 'yumfile list' command
-func ActionYumfileList(context *cli.Context) {
-	yumfile, err := LoadYumfile(YumfilePath)
-	PanicOn(err)
-
-	repoCount := len(yumfile.Repos)
-	padding := (len(fmt.Sprintf("%d", repoCount)) * 2) + 1
-	for i, repo := range yumfile.Repos {
-		Printf("%*s %s -> %s\n", padding, fmt.Sprintf("%d/%d", i+1, repoCount), repo.ID, repo.LocalPath)
-	}
-}
-
-// ActionYumfileSync processes the 'yumfile sync' command
-func ActionYumfileSync(context *cli.Context) {
-	yumfile, err := LoadYumfile(YumfilePath)
-	PanicOn(err)
-
-	repo := context.Args().First()
-	if repo == "" {
-		// sync/update all repos in Yumfile
-		if err := yumfile.SyncAll(); err != nil {
-			Fatalf(err, "Error running Yumfile")
-		}
-	} else {
-		// sync/update one repo in the Yumfile
-		mirror := yumfile.GetRepoByID(repo)
-		if mirror == nil {
-			Fatalf(nil, "No such repo found in Yumfile: %s", repo)
-		}
-
-		if err := yumfile.Sync([]Repo{*mirror}); err != nil {
-			Fatalf(err, "Error syncronizing repo '%s'", mirror.ID)
-		}
-	}
-}
-
-func PanicOn(err error) {
-	if err != nil {
-		Fatalf(err, "Fatal error")
-	}
-}
-
-func NewErrorf(format string, a ...interface{}) error {
-	return errors.New(fmt.Sprintf(format, a...))
+		{
+			Name:    "clean",
+			Aliases: []string{"cleanup"},
+			Usage:   "remove temporary files, stale caches and superseded metadata",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "report what would be removed without removing anything",
+				},
+				cli.DurationFlag{
+					Name:  "max-age",
+					Usage: "remove temporary files older than this even if their process appears to be running",
+					Value: 7 * 24 * time.Hour,
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionCleanup,
+		},
+		{
+			Name:  "serve",
+			Usage: "serve mirrored repos over HTTP",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:   "listen, l",
+					Usage:  "address to listen on",
+					Value:  ":8080",
+					EnvVar: "Y10K_LISTEN",
+				},
+				cli.BoolFlag{
+					Name:  "listings",
+					Usage: "enable directory listings",
+				},
+				cli.BoolFlag{
+					Name:  "pull-through",
+					Usage: "fetch packages from upstream on first request for all repos",
+				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Usage: "path to a TLS certificate to serve HTTPS",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Usage: "path to the private key of the TLS certificate",
+				},
+				cli.StringSliceFlag{
+					Name:  "acme-domain",
+					Usage: "obtain a certificate for a domain from Let's Encrypt",
+					Value: &cli.StringSlice{},
+				},
+				cli.StringFlag{
+					Name:  "acme-cache",
+					Usage: "path to cache ACME certificates",
+					Value: "/var/lib/y10k/acme",
+				},
+				cli.StringFlag{
+					Name:  "acme-email",
+					Usage: "contact email address for the ACME account",
+				},
+				cli.StringFlag{
+					Name:  "metrics-path",
+					Usage: "URL path of the Prometheus metrics endpoint (empty to disable)",
+					Value: "/metrics",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionServe,
+		},
+		{
+			Name:  "daemon",
+			Usage: "stay resident and synchronize each repo on its schedule",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:   "listen, l",
+					Usage:  "address to serve health checks and metrics on (empty to disable)",
+					Value:  ":8081",
+					EnvVar: "Y10K_DAEMON_LISTEN",
+				},
+				cli.StringFlag{
+					Name:  "interval",
+					Usage: "sync interval of repos with no schedule or interval",
+					Value: "24h",
+				},
+				cli.StringFlag{
+					Name:  "jitter",
+					Usage: "maximum random delay added to each sync",
+					Value: "5m",
+				},
+				cli.StringFlag{
+					Name:  "watch",
+					Usage: "how often to check the Yumfile for changes (0 to only reload on SIGHUP)",
+					Value: "10s",
+				},
+				cli.StringFlag{
+					Name:  "metrics-path",
+					Usage: "URL path of the Prometheus metrics endpoint (empty to disable)",
+					Value: "/metrics",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionDaemon,
+		},
+		{
+			Name:  "snapshot",
+			Usage: "manage point-in-time copies of mirrored repos",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "create",
+					Usage:  "create a snapshot of a repo: create <repo> [name]",
+					Action: ActionSnapshotCreate,
+				},
+				{
+					Name:   "list",
+					Usage:  "list the snapshots of all repos or one repo: list [repo]",
+					Action: ActionSnapshotList,
+				},
+				{
+					Name:   "delete",
+					Usage:  "delete a snapshot of a repo: delete <repo> <name>",
+					Action: ActionSnapshotDelete,
+				},
+				{
+					Name:   "prune",
+					Usage:  "delete snapshots beyond each repo's snapshot_retention: prune [repo]",
+					Action: ActionSnapshotPrune,
+				},
+				{
+					Name:   "promote",
+					Usage:  "point a channel at a snapshot: promote <repo> <name> <channel>",
+					Action: ActionSnapshotPromote,
+				},
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "list packages which differ between a mirror and its upstream or another mirror: diff <repo[@snapshot]> [upstream|repo[@snapshot]]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionDiff,
+		},
+		{
+			Name:  "export",
+			Usage: "bundle a repo's packages and metadata into an archive for a disconnected network: export <repo>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only export packages added since a date (e.g. 2024-01-31) or snapshot",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "path of the bundle (.tar, .tar.gz, .tar.xz or .tar.zst) or ISO image",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "bundle format (tar or iso)",
+					Value: "tar",
+				},
+				cli.StringFlag{
+					Name:  "iso-size",
+					Usage: "capacity of each ISO image; packages are split across as many images as needed",
+					Value: "4700372992",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionExport,
+		},
+		{
+			Name:  "import",
+			Usage: "apply a bundle created by export to a repo: import <bundle>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:  "repo, r",
+					Usage: "repo to import into, instead of the repo named in the bundle",
+				},
+				cli.BoolFlag{
+					Name:  "nogpg",
+					Usage: "skip GPG signature checks",
+				},
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "apply a delta bundle even if the repo is not at its base revision",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionImport,
+		},
+		{
+			Name:  "list",
+			Usage: "list the packages in mirrored repos: list [repo...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionList,
+		},
+		{
+			Name:  "search",
+			Usage: "find packages in mirrored repos by name, NEVRA or capability: search <pattern> [repo...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+				cli.BoolFlag{
+					Name:  "provides",
+					Usage: "match capabilities and files provided by packages",
+				},
+				cli.BoolFlag{
+					Name:  "requires",
+					Usage: "match capabilities required by packages",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionSearch,
+		},
+		{
+			Name:  "audit",
+			Usage: "show when packages were added to or deleted from mirrored repos: audit <package>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringSliceFlag{
+					Name:  "repo, r",
+					Usage: "only show events of the given repo (may be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionAudit,
+		},
+		{
+			Name:  "stats",
+			Usage: "show the sync history and trends of a repo: stats <repo>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.IntFlag{
+					Name:  "last, n",
+					Usage: "only show the last N syncs (0 for all)",
+					Value: 30,
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text, csv or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionStats,
+		},
+		{
+			Name:  "dedup",
+			Usage: "link the packages of repos and their snapshots to their package store and report the disk space saved",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.BoolFlag{
+					Name:  "report",
+					Usage: "only report disk usage without linking any packages",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionDedup,
+		},
+		{
+			Name:  "status",
+			Usage: "show the freshness of local mirrors",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.BoolFlag{
+					Name:  "online",
+					Usage: "fetch the latest upstream metadata instead of using the cached copy",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionStatus,
+		},
+		{
+			Name:  "verify",
+			Usage: "audit the integrity of local mirrors without contacting upstream",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.BoolFlag{
+					Name:  "nogpg",
+					Usage: "skip GPG signature checks",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionVerify,
+		},
+		{
+			Name:  "check-closure",
+			Usage: "report package requirements which cannot be resolved in mirrored repos: check-closure <repo...>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+				cli.StringSliceFlag{
+					Name:  "with, w",
+					Usage: "also resolve requirements against the packages of the given repo (may be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "output format (text or json)",
+					Value: "text",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Action: ActionCheckClosure,
+		},
+		{
+			Name:  "cache",
+			Usage: "inspect the metadata caches of mirrored repos",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "path to Yumfile",
+					Value: "./Yumfile",
+				},
+			},
+			Before: func(context *cli.Context) error {
+				YumfilePath = context.String("file")
+				return nil
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "stats",
+					Usage:  "show the cache usage of all repos or the given repos: stats [repo...]",
+					Action: ActionCacheStats,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "format",
+							Usage: "output format (text or json)",
+							Value: "text",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "print the version of y10k",
+			Action: func(context *cli.Context) {
+				fmt.Printf("%s version %s\n", app.Name, app.Version)
+			},
+		},
+	}
+
+	app.Before = func(context *cli.Context) error {
+		// set globals from command line context
+		QuietMode = context.GlobalBool("quiet")
+		DebugMode = context.GlobalBool("debug")
+		FIPSMode = context.GlobalBool("fips")
+		LogFilePath = context.GlobalString("logfile")
+
+		// --debug is shorthand for --log-level=debug
+		if s := context.GlobalString("log-level"); s != "" {
+			level, err := ParseLogLevel(s)
+			if err != nil {
+				Fatalf(err, "Invalid --log-level")
+			}
+			LogLevel = level
+		} else if DebugMode {
+			LogLevel = LOG_CAT_DEBUG
+		}
+		DebugMode = LogLevel == LOG_CAT_DEBUG
+
+		switch LogFormat = context.GlobalString("log-format"); LogFormat {
+		case "text", "json":
+		default:
+			Fatalf(nil, "Invalid log format: %s (expected text or json)", LogFormat)
+		}
+
+		if s := context.GlobalString("log-max-size"); s != "" {
+			n, err := parseByteSize(s)
+			if err != nil {
+				Fatalf(err, "Invalid --log-max-size")
+			}
+			LogMaxSize = n
+		}
+		LogMaxBackups = context.GlobalInt("log-max-backups")
+		LogTarget = context.GlobalString("log-target")
+
+		TmpBasePath = context.GlobalString("tmppath")
+		TmpFilePrefix = context.GlobalString("tmpprefix")
+		TmpYumConfPath = fmt.Sprintf("%s/%s%d.conf", TmpBasePath, TmpFilePrefix, os.Getpid())
+		TmpYumLogFile = fmt.Sprintf("%s/%s%d.log", TmpBasePath, TmpFilePrefix, os.Getpid())
+		TmpYumCachePath = context.GlobalString("tmppath") + "/" + "cache"
+
+		// configure logging
+		InitLogFile()
+
+		return nil
+	}
+
+	handleSignals()
+
+	app.Run(os.Args)
+}
+
+// ActionYumfileValidate processes the 'yumfile validate' command
+func ActionYumfileValidate(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+	Printf("Yumfile appears valid (%d repos)\n", len(yumfile.Repos))
+}
+
+// ActionYumfileImport processes the 'yumfile import' command
+func ActionYumfileImport(context *cli.Context) {
+	paths := []string(context.Args())
+	if len(paths) == 0 {
+		Fatalf(nil, "No .repo files specified")
+	}
+
+	if err := ImportRepoFiles(os.Stdout, paths...); err != nil {
+		Fatalf(err, "Error importing repo files")
+	}
+}
+
+// ActionYumfileLint processes the 'yumfile lint' command
+func ActionYumfileLint(context *cli.Context) {
+	diagnostics := LintYumfile(YumfilePath, context.Bool("online"))
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(diagnostics, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "text":
+		for _, d := range diagnostics {
+			fmt.Printf("%s\n", d)
+		}
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+
+	for _, d := range diagnostics {
+		if d.Severity == LintError {
+			os.Exit(1)
+		}
+	}
+}
+
+// ActionYumfileList processes the 'yumfile list' command
+func ActionYumfileList(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repoCount := len(yumfile.Repos)
+	padding := (len(fmt.Sprintf("%d", repoCount)) * 2) + 1
+	for i, repo := range yumfile.Repos {
+		tags := ""
+		if len(repo.Tags) > 0 {
+			tags = fmt.Sprintf(" [%s]", strings.Join(repo.Tags, ","))
+		}
+		if repo.Disabled {
+			tags += " (disabled)"
+		}
+		Printf("%*s %s -> %s%s\n", padding, fmt.Sprintf("%d/%d", i+1, repoCount), repo.ID, repo.LocalPath, tags)
+	}
+}
+
+// ActionYumfileShow processes the 'yumfile show' command
+func ActionYumfileShow(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if id := context.Args().First(); id != "" {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+		repos = []Repo{*repo}
+	}
+
+	for i, repo := range repos {
+		if i > 0 {
+			fmt.Printf("\n")
+		}
+
+		fmt.Printf("[%s]\n", repo.ID)
+		options := repo.EffectiveOptions()
+		for i := range options {
+			if secretKeys[options[i][0]] && options[i][1] != "" {
+				options[i][1] = "********"
+			}
+		}
+
+		if context.Bool("effective") {
+			for _, opt := range options {
+				fmt.Printf("%-*s ; %s\n", 40, fmt.Sprintf("%s=%s", opt[0], opt[1]), repo.OptionSource(opt[0]))
+			}
+		} else {
+			for _, opt := range options {
+				if repo.OptionSource(opt[0]) == "repo" {
+					fmt.Printf("%s=%s\n", opt[0], opt[1])
+				}
+			}
+		}
+	}
+}
+
+// ActionYumfileSync processes the 'yumfile sync' command
+func ActionYumfileSync(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if id := context.Args().First(); id != "" {
+		// sync/update one repo in the Yumfile
+		mirror := yumfile.GetRepoByID(id)
+		if mirror == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+		repos = []Repo{*mirror}
+	}
+
+	repos, err = SelectRepos(repos, context.StringSlice("only"), context.StringSlice("skip"))
+	if err != nil {
+		Fatalf(err, "Error selecting repos")
+	}
+	repos, err = SelectReposByTags(repos, context.StringSlice("tags"))
+	if err != nil {
+		Fatalf(err, "Error selecting repos")
+	}
+	if len(repos) == 0 {
+		Fatalf(nil, "No repos selected to sync")
+	}
+
+	if context.Bool("dry-run") {
+		plans, err := yumfile.Plan(repos)
+		PrintPlans(plans)
+		if err != nil {
+			Errorf(err, "Error planning sync")
+			os.Exit(ExitSyncFailed)
+		}
+		return
+	}
+
+	// check all local paths before starting a long run
+	if errs := yumfile.CheckPaths(repos); len(errs) > 0 {
+		for _, err := range errs {
+			Errorf(err, "Invalid path")
+		}
+		Fatalf(nil, "Found %d invalid paths in Yumfile", len(errs))
+	}
+
+	if context.Bool("keep-going") && context.Bool("fail-fast") {
+		Fatalf(nil, "--keep-going and --fail-fast may not be used together")
+	}
+	yumfile.FailFast = context.Bool("fail-fast")
+	yumfile.MaxDeletePercent = context.Float64("max-delete-percent")
+	yumfile.VerifyAll = context.Bool("verify-all")
+	yumfile.Force = context.Bool("force")
+	yumfile.StrictFreshness = context.Bool("strict-freshness")
+	yumfile.Progress = !context.Bool("no-progress")
+	yumfile.Wait = context.Bool("wait")
+	if s := context.String("wait-timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			Fatalf(nil, "Invalid --wait-timeout: %s", s)
+		}
+		yumfile.Wait, yumfile.WaitTimeout = true, d
+	}
+
+	// check the report options before a long run, and keep STDOUT for the
+	// report if it is written there
+	reportPath, reportFormat, reportTemplate := context.String("report"), context.String("report-format"), context.String("report-template")
+	writeReport := reportPath != "" || reportFormat != "" || reportTemplate != ""
+	if writeReport {
+		if reportFormat == "" {
+			reportFormat = "json"
+			if reportTemplate != "" {
+				reportFormat = "template"
+			}
+		}
+
+		if err := CheckReportFormat(reportFormat, reportTemplate); err != nil {
+			Fatalf(err, "Invalid report options")
+		}
+
+		if reportPath == "" || reportPath == "-" {
+			LogToStderr = true
+			yumfile.Progress = false
+		}
+	}
+
+	EnableGracefulShutdown()
+	report, err := yumfile.Sync(repos)
+
+	// write report
+	reportFailed := false
+	if writeReport {
+		if err := WriteReport(report, reportFormat, reportTemplate, reportPath); err != nil {
+			Errorf(err, "Error writing report")
+			reportFailed = true
+		}
+	}
+
+	if err != nil {
+		Errorf(err, "Error running Yumfile")
+		if report.AllFailed() {
+			os.Exit(ExitAllFailed)
+		}
+		os.Exit(ExitSyncFailed)
+	}
+
+	if reportFailed {
+		os.Exit(ExitError)
+	}
+}
+
+// ActionBench processes the 'bench' command
+func ActionBench(context *cli.Context) {
+	var repo *Repo
+	dir := TmpBasePath
+	if !context.Bool("synthetic") {
+		yumfile, err := LoadYumfile(YumfilePath)
+		PanicOn(err)
+
+		id := context.Args().First()
+		if id == "" {
+			Fatalf(nil, "No repo specified")
+		}
+
+		repo = yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+
+		// benchmark the disk the repo is mirrored to
+		dir = repo.Path()
+	}
+
+	PanicOn(os.MkdirAll(dir, 0750))
+	results, err := Bench(repo, int64(context.Int("size"))<<20, dir)
+	if err != nil {
+		Fatalf(err, "Error running benchmark")
+	}
+
+	PrintBenchResults(results)
+}
+
+// ActionServe processes the 'serve' command
+func ActionServe(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if context.NArg() > 0 {
+		repos = make([]Repo, 0, context.NArg())
+		for _, id := range context.Args() {
+			repo := yumfile.GetRepoByID(id)
+			if repo == nil {
+				Fatalf(nil, "No such repo found in Yumfile: %s", id)
+			}
+			repos = append(repos, *repo)
+		}
+	}
+
+	if context.Bool("pull-through") {
+		for i := range repos {
+			repos[i].PullThrough = true
+		}
+	}
+
+	server, err := NewServer(repos, context.String("listen"), context.Bool("listings"))
+	if err != nil {
+		Fatalf(err, "Error configuring server")
+	}
+
+	server.TLSCert = context.String("tls-cert")
+	server.TLSKey = context.String("tls-key")
+	server.ACMEDomains = context.StringSlice("acme-domain")
+	server.ACMECache = context.String("acme-cache")
+	server.ACMEEmail = context.String("acme-email")
+	if s := context.String("metrics-path"); s != "" {
+		server.MetricsPath = path.Clean("/" + s)
+	}
+
+	if err := server.ListenAndServe(); err != nil {
+		Fatalf(err, "Error serving repos")
+	}
+}
+
+// ActionDaemon processes the 'daemon' command
+func ActionDaemon(context *cli.Context) {
+	daemon := NewDaemon(YumfilePath)
+	daemon.Listen = context.String("listen")
+
+	interval, err := parseInterval(context.String("interval"))
+	if err != nil {
+		Fatalf(err, "Invalid --interval")
+	}
+	daemon.Interval = interval
+
+	jitter, err := time.ParseDuration(context.String("jitter"))
+	if err != nil || jitter < 0 {
+		Fatalf(nil, "Invalid --jitter: %s", context.String("jitter"))
+	}
+	daemon.Jitter = jitter
+
+	watch, err := time.ParseDuration(context.String("watch"))
+	if err != nil || watch < 0 {
+		Fatalf(nil, "Invalid --watch: %s", context.String("watch"))
+	}
+	daemon.Watch = watch
+
+	daemon.MetricsPath = ""
+	if s := context.String("metrics-path"); s != "" {
+		daemon.MetricsPath = path.Clean("/" + s)
+	}
+
+	EnableGracefulShutdown()
+	if err := daemon.Run(); err != nil {
+		Fatalf(err, "Error running daemon")
+	}
+}
+
+// snapshotRepo returns the repo named by the first argument of a snapshot
+// command
+func snapshotRepo(context *cli.Context) *Repo {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	id := context.Args().First()
+	if id == "" {
+		Fatalf(nil, "No repo specified")
+	}
+
+	repo := yumfile.GetRepoByID(id)
+	if repo == nil {
+		Fatalf(nil, "No such repo found in Yumfile: %s", id)
+	}
+
+	return repo
+}
+
+// ActionSnapshotCreate processes the 'snapshot create' command
+func ActionSnapshotCreate(context *cli.Context) {
+	repo := snapshotRepo(context)
+	info, err := CreateSnapshot(repo, context.Args().Get(1))
+	if err != nil {
+		Fatalf(err, "Error creating snapshot of %s", repo.ID)
+	}
+
+	Printf("Created snapshot %s of %s with %d packages (%s)\n", info.Name, repo.ID, info.Packages, formatBytes(info.Size))
+
+	if err := PruneSnapshots(repo); err != nil {
+		Fatalf(err, "Error pruning snapshots of %s", repo.ID)
+	}
+}
+
+// ActionSnapshotList processes the 'snapshot list' command
+func ActionSnapshotList(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if id := context.Args().First(); id != "" {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+		repos = []Repo{*repo}
+	}
+
+	for i := range repos {
+		snapshots, err := ListSnapshots(&repos[i])
+		if err != nil {
+			Fatalf(err, "Error listing snapshots of %s", repos[i].ID)
+		}
+
+		channels, err := ListChannels(&repos[i])
+		if err != nil {
+			Fatalf(err, "Error listing channels of %s", repos[i].ID)
+		}
+
+		for _, info := range snapshots {
+			promoted := make([]string, 0)
+			for channel, name := range channels {
+				if name == info.Name {
+					promoted = append(promoted, channel)
+				}
+			}
+			sort.Strings(promoted)
+
+			fmt.Printf("%-30s %-20s %s %6d packages %10s %s %s\n", info.Repo, info.Name, info.Created.Format(time.RFC3339), info.Packages, formatBytes(info.Size), info.Revision, strings.Join(promoted, ","))
+		}
+	}
+}
+
+// ActionSnapshotPrune processes the 'snapshot prune' command
+func ActionSnapshotPrune(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if id := context.Args().First(); id != "" {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+		repos = []Repo{*repo}
+	}
+
+	for i := range repos {
+		if err := PruneSnapshots(&repos[i]); err != nil {
+			Fatalf(err, "Error pruning snapshots of %s", repos[i].ID)
+		}
+	}
+}
+
+// ActionSnapshotPromote processes the 'snapshot promote' command
+func ActionSnapshotPromote(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	id, name, channel := context.Args().First(), context.Args().Get(1), context.Args().Get(2)
+	if id == "" || name == "" || channel == "" {
+		Fatalf(nil, "Usage: snapshot promote <repo> <name> <channel>")
+	}
+
+	repo := yumfile.GetRepoByID(id)
+	if repo == nil {
+		Fatalf(nil, "No such repo found in Yumfile: %s", id)
+	}
+
+	if err := yumfile.PromoteSnapshot(repo, name, channel); err != nil {
+		Fatalf(err, "Error promoting snapshot of %s", repo.ID)
+	}
+}
+
+// ActionSnapshotDelete processes the 'snapshot delete' command
+func ActionSnapshotDelete(context *cli.Context) {
+	repo := snapshotRepo(context)
+	name := context.Args().Get(1)
+	if name == "" {
+		Fatalf(nil, "No snapshot specified")
+	}
+
+	if err := DeleteSnapshot(repo, name); err != nil {
+		Fatalf(err, "Error deleting snapshot of %s", repo.ID)
+	}
+}
+
+// ActionVerify processes the 'verify' command
+func ActionVerify(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if context.NArg() > 0 {
+		repos = make([]Repo, 0, context.NArg())
+		for _, id := range context.Args() {
+			repo := yumfile.GetRepoByID(id)
+			if repo == nil {
+				Fatalf(nil, "No such repo found in Yumfile: %s", id)
+			}
+			repos = append(repos, *repo)
+		}
+	}
+
+	if FIPSMode && context.Bool("nogpg") {
+		Fatalf(nil, "--nogpg cannot be used in FIPS mode")
+	}
+
+	results := make([]*VerifyResult, 0, len(repos))
+	for i := range repos {
+		results = append(results, Verify(&repos[i], !context.Bool("nogpg")))
+	}
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(results, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "text":
+		PrintVerifyResults(results)
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+
+	for _, result := range results {
+		if !result.Passed() {
+			os.Exit(ExitSyncFailed)
+		}
+	}
+}
+
+// ActionCheckClosure processes the 'check-closure' command
+func ActionCheckClosure(context *cli.Context) {
+	if context.NArg() < 1 {
+		Fatalf(nil, "Usage: check-closure <repo...> [--with repo...]")
+	}
+
+	format := context.String("format")
+	if format != "text" && format != "json" {
+		Fatalf(nil, "Unsupported output format: %s", format)
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	with := make([]*Repo, 0, len(context.StringSlice("with")))
+	for _, id := range context.StringSlice("with") {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+		with = append(with, repo)
+	}
+
+	results := make([]*ClosureResult, 0, context.NArg())
+	for _, id := range context.Args() {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+
+		result, err := CheckClosure(repo, with)
+		if err != nil {
+			Fatalf(err, "Error checking the dependency closure of %s", id)
+		}
+		results = append(results, result)
+	}
+
+	if format == "json" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+	} else {
+		PrintClosureResults(results)
+	}
+
+	for _, result := range results {
+		if !result.Passed() {
+			os.Exit(ExitSyncFailed)
+		}
+	}
+}
+
+// ActionCacheStats processes the 'cache stats' command
+func ActionCacheStats(context *cli.Context) {
+	format := context.String("format")
+	if format != "text" && format != "json" {
+		Fatalf(nil, "Unsupported output format: %s", format)
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := make([]*Repo, 0, len(yumfile.Repos))
+	if context.NArg() == 0 {
+		for i := range yumfile.Repos {
+			repos = append(repos, &yumfile.Repos[i])
+		}
+	}
+	for _, id := range context.Args() {
+		repo := yumfile.GetRepoByID(id)
+		if repo == nil {
+			Fatalf(nil, "No such repo found in Yumfile: %s", id)
+		}
+		repos = append(repos, repo)
+	}
+
+	usages := make([]*CacheUsage, 0, len(repos)+1)
+	for _, repo := range repos {
+		usage, err := RepoCacheUsage(repo)
+		if err != nil {
+			Fatalf(err, "Error reading the cache of %s", repo.ID)
+		}
+		usages = append(usages, usage)
+	}
+
+	usage, err := MetadataCacheUsage(yumfile.metadataCacheMaxSize())
+	if err != nil {
+		Fatalf(err, "Error reading the decompressed metadata cache")
+	}
+	usages = append(usages, usage)
+
+	if format == "json" {
+		b, err := json.MarshalIndent(usages, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+	} else {
+		PrintCacheUsage(usages)
+	}
+}
+
+// ActionDiff processes the 'diff' command
+func ActionDiff(context *cli.Context) {
+	if context.NArg() < 1 || context.NArg() > 2 {
+		Fatalf(nil, "Usage: diff <repo[@snapshot]> [upstream|repo[@snapshot]]")
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	to := "upstream"
+	if context.NArg() == 2 {
+		to = context.Args().Get(1)
+	}
+
+	diff, err := yumfile.DiffRepos(context.Args().First(), to)
+	if err != nil {
+		Fatalf(err, "Error comparing %s with %s", context.Args().First(), to)
+	}
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(diff, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "text":
+		PrintDiff(diff)
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+}
+
+// ActionExport processes the 'export' command
+func ActionExport(context *cli.Context) {
+	repo := snapshotRepo(context)
+	opts := ExportOptions{
+		Since:  context.String("since"),
+		Output: context.String("output"),
+		Format: context.String("format"),
+	}
+
+	if opts.Format == "iso" {
+		n, err := parseByteSize(context.String("iso-size"))
+		if err != nil {
+			Fatalf(err, "Invalid --iso-size")
+		}
+		opts.ISOSize = n
+	}
+
+	if opts.Output == "" {
+		opts.Output = repo.ID + ".tar.zst"
+		if opts.Format == "iso" {
+			opts.Output = repo.ID + ".iso"
+		}
+	}
+
+	EnableGracefulShutdown()
+	manifest, err := Export(repo, opts)
+	if err != nil {
+		Fatalf(err, "Error exporting %s", repo.ID)
+	}
+
+	var size int64
+	for _, entry := range manifest.Packages {
+		size += entry.Size
+	}
+
+	Printf("Exported %d packages (%s) and %d removals of %s to %s\n", len(manifest.Packages), formatBytes(size), len(manifest.Removed), repo.ID, opts.Output)
+}
+
+// ActionImport processes the 'import' command
+func ActionImport(context *cli.Context) {
+	path := context.Args().First()
+	if path == "" {
+		Fatalf(nil, "No bundle specified")
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	if FIPSMode && context.Bool("nogpg") {
+		Fatalf(nil, "--nogpg cannot be used in FIPS mode")
+	}
+
+	opts := ImportOptions{
+		Repo:  context.String("repo"),
+		NoGPG: context.Bool("nogpg"),
+		Force: context.Bool("force"),
+	}
+
+	EnableGracefulShutdown()
+	if _, err := yumfile.ImportBundle(path, opts); err != nil {
+		Fatalf(err, "Error importing %s", path)
+	}
+}
+
+// ActionList processes the 'list' command
+func ActionList(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	queryRepos(context, yumfile, context.Args(), &PackageQuery{Field: QueryName})
+}
+
+// ActionSearch processes the 'search' command
+func ActionSearch(context *cli.Context) {
+	if context.NArg() < 1 {
+		Fatalf(nil, "No search pattern specified")
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	query := &PackageQuery{Pattern: context.Args().First(), Field: QueryName}
+	switch {
+	case context.Bool("provides") && context.Bool("requires"):
+		Fatalf(nil, "--provides and --requires cannot be used together")
+	case context.Bool("provides"):
+		query.Field = QueryProvides
+	case context.Bool("requires"):
+		query.Field = QueryRequires
+	}
+
+	if err := query.Validate(); err != nil {
+		Fatalf(err, "Invalid search")
+	}
+
+	if n := queryRepos(context, yumfile, context.Args().Tail(), query); n == 0 {
+		os.Exit(1)
+	}
+}
+
+// queryRepos prints the packages matching a query in the local metadata of
+// the given repos, or all repos, and returns the number of matches. Repos
+// which have not been mirrored yet are skipped with a warning.
+func queryRepos(context *cli.Context, yumfile *Yumfile, ids []string, query *PackageQuery) int {
+	repos := yumfile.Repos
+	if len(ids) > 0 {
+		repos = make([]Repo, 0, len(ids))
+		for _, id := range ids {
+			repo := yumfile.GetRepoByID(id)
+			if repo == nil {
+				Fatalf(nil, "No such repo found in Yumfile: %s", id)
+			}
+			repos = append(repos, *repo)
+		}
+	}
+
+	matches := make([]PackageMatch, 0)
+	for i := range repos {
+		m, err := QueryRepo(&repos[i], query)
+		if err != nil {
+			Warnf(err, "Skipping %s", repos[i].ID)
+			continue
+		}
+		matches = append(matches, m...)
+	}
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(matches, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "text":
+		PrintPackageMatches(matches)
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+
+	return len(matches)
+}
+
+// ActionStatus processes the 'status' command
+func ActionStatus(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if context.NArg() > 0 {
+		repos = make([]Repo, 0, context.NArg())
+		for _, id := range context.Args() {
+			repo := yumfile.GetRepoByID(id)
+			if repo == nil {
+				Fatalf(nil, "No such repo found in Yumfile: %s", id)
+			}
+			repos = append(repos, *repo)
+		}
+	}
+
+	statuses := make([]*RepoStatus, 0, len(repos))
+	for i := range repos {
+		statuses = append(statuses, Status(&repos[i], context.Bool("online")))
+	}
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(statuses, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "text":
+		PrintRepoStatuses(statuses)
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+}
+
+// ActionAudit processes the 'audit' command
+func ActionAudit(context *cli.Context) {
+	if context.NArg() != 1 {
+		Fatalf(nil, "Usage: audit <package>")
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if ids := context.StringSlice("repo"); len(ids) > 0 {
+		repos = make([]Repo, 0, len(ids))
+		for _, id := range ids {
+			repo := yumfile.GetRepoByID(id)
+			if repo == nil {
+				Fatalf(nil, "No such repo found in Yumfile: %s", id)
+			}
+			repos = append(repos, *repo)
+		}
+	}
+
+	events, err := Audit(repos, context.Args().First())
+	if err != nil {
+		Fatalf(err, "Error reading audit logs")
+	}
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(events, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "text":
+		PrintAuditEvents(events)
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+}
+
+// ActionStats processes the 'stats' command
+func ActionStats(context *cli.Context) {
+	if context.NArg() != 1 {
+		Fatalf(nil, "Usage: stats <repo>")
+	}
+
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repo := yumfile.GetRepoByID(context.Args().First())
+	if repo == nil {
+		Fatalf(nil, "No such repo found in Yumfile: %s", context.Args().First())
+	}
+
+	if context.Int("last") < 0 {
+		Fatalf(nil, "Invalid --last: %d", context.Int("last"))
+	}
+
+	entries, err := ReadStats(repo, context.Int("last"))
+	if err != nil {
+		Fatalf(err, "Error reading stats history")
+	}
+
+	switch context.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(entries, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+
+	case "csv":
+		if err := WriteStatsCSV(os.Stdout, repo, entries); err != nil {
+			Fatalf(err, "Error writing stats")
+		}
+
+	case "text":
+		PrintStats(os.Stdout, repo, entries)
+
+	default:
+		Fatalf(nil, "Unsupported output format: %s", context.String("format"))
+	}
+}
+
+// ActionDedup processes the 'dedup' command
+func ActionDedup(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	repos := yumfile.Repos
+	if context.NArg() > 0 {
+		repos = make([]Repo, 0, context.NArg())
+		for _, id := range context.Args() {
+			repo := yumfile.GetRepoByID(id)
+			if repo == nil {
+				Fatalf(nil, "No such repo found in Yumfile: %s", id)
+			}
+			repos = append(repos, *repo)
+		}
+	}
+
+	format := context.String("format")
+	if format != "text" && format != "json" {
+		Fatalf(nil, "Unsupported output format: %s", format)
+	}
+
+	if !context.Bool("report") {
+		for i := range repos {
+			repo := &repos[i]
+			if repo.StorePath == "" {
+				continue
+			}
+
+			unlock, err := yumfile.lockRepo(repo)
+			if err != nil {
+				Fatalf(err, "Error locking %s", repo.ID)
+			}
+
+			_, err = dedupRepo(repo)
+			unlock()
+			if err != nil {
+				Fatalf(err, "Error linking %s to the package store", repo.ID)
+			}
+		}
+	}
+
+	report := NewDedupReport(repos)
+	if format == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		PanicOn(err)
+		fmt.Printf("%s\n", b)
+	} else {
+		PrintDedupReport(report)
+	}
+}
+
+// ActionCleanup processes the 'clean' command
+func ActionCleanup(context *cli.Context) {
+	yumfile, err := LoadYumfile(YumfilePath)
+	PanicOn(err)
+
+	opts := CleanOptions{
+		DryRun: context.Bool("dry-run"),
+		MaxAge: context.Duration("max-age"),
+	}
+
+	if err := yumfile.CleanUp(opts); err != nil {
+		Fatalf(err, "Error cleaning up temporary artifacts")
+	}
+}
+
+func PanicOn(err error) {
+	if err != nil {
+		Fatalf(err, "Fatal error")
+	}
+}
+
+func NewErrorf(format string, a ...interface{}) error {
+	return errors.New(fmt.Sprintf(format, a...))
+}
+
+// RecoverError recovers from a panic in the calling goroutine and stores it
+// as an error in err. It must be deferred directly.
+func RecoverError(err *error, format string, a ...interface{}) {
+	if r := recover(); r != nil {
+		Dprintf("%s", debug.Stack())
+		*err = NewErrorf("%s: panic: %v", fmt.Sprintf(format, a...), r)
+	}
 }
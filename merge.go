@@ -0,0 +1,646 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultMergePriority is the priority of a repo merged into another if it
+// sets no merge_priority. As with the yum priorities plugin, lower numbers
+// take precedence.
+const DefaultMergePriority = 99
+
+// Policies for packages with the same NEVRA but different content in more
+// than one source of a merge target
+const (
+	MergeConflictPriority = "priority" // take the package of the highest priority
+	MergeConflictFail     = "fail"     // fail the merge
+)
+
+// mergedCompsName is the name of the comps file written to a merge target
+const mergedCompsName = "comps.xml"
+
+// mergedUpdateinfoName is the name of the updateinfo file added to the
+// metadata of a merge target
+const mergedUpdateinfoName = "updateinfo.xml"
+
+// resolveMergeTargets records the repos merged into each merge target, in
+// order of priority, and moves each target after all other repos so that it
+// is synchronized once its sources are up to date.
+func (c *Yumfile) resolveMergeTargets() error {
+	targets := make(map[string][]*Repo, 0)
+	for i := range c.Repos {
+		repo := &c.Repos[i]
+		if repo.MergeInto == "" {
+			continue
+		}
+
+		var err error
+		switch target := c.GetRepoByID(repo.MergeInto); {
+		case target == nil:
+			err = NewErrorf("No such repo to merge '%s' into: %s (in %s:%d)", repo.ID, repo.MergeInto, repo.YumfilePath, repo.YumfileLineNo)
+		case target.ID == repo.ID:
+			err = NewErrorf("Repo '%s' cannot be merged into itself (in %s:%d)", repo.ID, repo.YumfilePath, repo.YumfileLineNo)
+		case target.MergeInto != "":
+			err = NewErrorf("Repo '%s' cannot be merged into '%s', which is itself merged into '%s' (in %s:%d)", repo.ID, target.ID, target.MergeInto, repo.YumfilePath, repo.YumfileLineNo)
+		}
+		if err != nil {
+			if err := c.repoError(repo, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		targets[repo.MergeInto] = append(targets[repo.MergeInto], repo)
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	repos := make([]Repo, 0, len(c.Repos))
+	merged := make([]Repo, 0, len(targets))
+	for _, repo := range c.Repos {
+		sources, ok := targets[repo.ID]
+		if !ok {
+			repos = append(repos, repo)
+			continue
+		}
+
+		// sort.Stable keeps Yumfile order between sources of equal priority
+		sort.Stable(reposByMergePriority(sources))
+		repo.MergeSources = make([]string, len(sources))
+		for i, source := range sources {
+			repo.MergeSources[i] = source.ID
+		}
+		merged = append(merged, repo)
+	}
+
+	c.Repos = append(repos, merged...)
+	return nil
+}
+
+// syncMergedRepo builds a merge target from the local mirrors of its sources,
+// updates its metadata and publishes it to all configured targets.
+func (c *Yumfile) syncMergedRepo(repo *Repo, report *RepoReport) error {
+	Printf("Merging %d repos into: %s\n", len(repo.MergeSources), repo.ID)
+
+	before, err := packageSizes(repo.Path())
+	if err != nil {
+		return NewErrorf("Failed to read local packages: %v", err)
+	}
+
+	sources, err := c.mergeSources(repo)
+	if err != nil {
+		return err
+	}
+
+	if err := mergePackages(repo, sources); err != nil {
+		return NewErrorf("Failed to merge packages: %v", err)
+	}
+	if interrupted() {
+		return errInterrupted
+	}
+
+	after, err := packageSizes(repo.Path())
+	if err != nil {
+		return NewErrorf("Failed to read local packages: %v", err)
+	}
+	report.countChanges(before, after)
+
+	if err := recordAudit(repo, report, before, after, false); err != nil {
+		return NewErrorf("Failed to write audit log: %v", err)
+	}
+
+	if ok, err := mergeComps(repo, sources); err != nil {
+		return NewErrorf("Failed to merge comps: %v", err)
+	} else if ok && repo.Groupfile == "" {
+		repo.Groupfile = mergedCompsName
+	}
+
+	if err := c.createrepo(repo); err != nil {
+		return NewErrorf("Failed to update repo database: %v", err)
+	}
+
+	if err := c.writeSplits(repo); err != nil {
+		return err
+	}
+
+	if err := mergeUpdateinfo(repo, sources); err != nil {
+		return NewErrorf("Failed to merge advisories: %v", err)
+	}
+
+	if err := c.smokeTest(repo, repo.Path()); err != nil {
+		return NewErrorf("Smoke test failed: %v", err)
+	}
+
+	if err := c.checkRequiredClosure(repo, report); err != nil {
+		return NewErrorf("Dependency closure check failed: %v", err)
+	}
+
+	if err := c.writeDelta(repo); err != nil {
+		return NewErrorf("Failed to write delta manifest: %v", err)
+	}
+
+	if err := applyFilePermissions(repo); err != nil {
+		return NewErrorf("Failed to set file permissions: %v", err)
+	}
+
+	if interrupted() {
+		return errInterrupted
+	}
+
+	if err := c.publish(repo); err != nil {
+		return NewErrorf("Failed to publish: %v", err)
+	}
+
+	if err := c.publishSplits(repo); err != nil {
+		return NewErrorf("Failed to publish splits: %v", err)
+	}
+
+	if err := runPublishPlugins(repo, report); err != nil {
+		return NewErrorf("Failed to run publish plugins: %v", err)
+	}
+
+	return nil
+}
+
+// mergeSources returns the repos merged into a merge target, in order of
+// priority
+func (c *Yumfile) mergeSources(repo *Repo) ([]*Repo, error) {
+	sources := make([]*Repo, 0, len(repo.MergeSources))
+	for _, id := range repo.MergeSources {
+		source := c.GetRepoByID(id)
+		if source == nil {
+			return nil, NewErrorf("No such repo found in Yumfile: %s", id)
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// mergedPackage is a package merged into a merge target
+type mergedPackage struct {
+	Source   string
+	Path     string
+	Checksum Checksum
+}
+
+// samePackage returns true if two packages with the same NEVRA have the same
+// content
+func samePackage(a, b *mergedPackage) bool {
+	if strings.EqualFold(a.Checksum.Type, b.Checksum.Type) {
+		return strings.EqualFold(a.Checksum.Value, b.Checksum.Value)
+	}
+
+	sumA, errA := checksumFile(a.Path, "sha256")
+	sumB, errB := checksumFile(b.Path, "sha256")
+	return errA == nil && errB == nil && sumA == sumB
+}
+
+// mergePackages links the packages of each source into a merge target. A
+// package found in more than one source, by NEVRA, is taken from the source
+// with the highest priority. If the copies differ, and the target's
+// merge_conflict policy is fail, the merge fails instead. Packages no longer
+// found in any source are removed from the target.
+func mergePackages(repo *Repo, sources []*Repo) error {
+	files := make(map[string]string, 0)
+	nevras := make(map[string]*mergedPackage, 0)
+	conflicts := make([]string, 0)
+	for _, source := range sources {
+		primary, err := localDiffSource(source.ID, source.Path())
+		if err != nil {
+			return NewErrorf("Repo %s has not been synchronized: %v", source.ID, err)
+		}
+
+		duplicates := 0
+		err = EachPackage(primary.Primary, func(pkg *Package) error {
+			nevra := pkg.NEVRA()
+			rel := filepath.Clean(pkg.Location.Href)
+			if strings.HasPrefix(rel, "..") || filepath.IsAbs(rel) {
+				return NewErrorf("Invalid package location in %s: %s", source.ID, pkg.Location.Href)
+			}
+
+			merged := &mergedPackage{Source: source.ID, Path: filepath.Join(source.Path(), rel), Checksum: pkg.Checksum}
+			if prev, ok := nevras[nevra]; ok {
+				if !samePackage(prev, merged) {
+					if repo.MergeConflict == MergeConflictFail {
+						conflicts = append(conflicts, fmt.Sprintf("%s (in %s and %s)", nevra, prev.Source, source.ID))
+						return nil
+					}
+					Dprintf("Package %s of %s differs from that of %s\n", nevra, source.ID, prev.Source)
+				}
+				Dprintf("Skipping %s from %s, already merged from %s\n", nevra, source.ID, prev.Source)
+				duplicates++
+				return nil
+			}
+
+			if _, ok := files[rel]; ok {
+				if repo.MergeConflict == MergeConflictFail {
+					conflicts = append(conflicts, fmt.Sprintf("%s (%s in %s and another repo)", nevra, rel, source.ID))
+					return nil
+				}
+				Warnf(nil, "Skipping %s from %s: %s is already merged from another repo", nevra, source.ID, rel)
+				return nil
+			}
+
+			nevras[nevra] = merged
+			files[rel] = merged.Path
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if duplicates > 0 {
+			Printf("Skipped %d packages of %s found in a repo of higher priority\n", duplicates, source.ID)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		for _, conflict := range conflicts {
+			Errorf(nil, "Conflicting package: %s", conflict)
+		}
+		return NewErrorf("%d packages differ between the sources of %s", len(conflicts), repo.ID)
+	}
+
+	paths := make([]string, 0, len(files))
+	for rel := range files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		if interrupted() {
+			return errInterrupted
+		}
+
+		if err := linkPackage(files[rel], filepath.Join(repo.Path(), rel)); err != nil {
+			return err
+		}
+	}
+
+	// remove packages dropped by every source, or now merged from another
+	current, err := localPackages(repo.Path())
+	if err != nil {
+		return err
+	}
+
+	stale := make([]upstreamPackage, 0)
+	for rel := range current {
+		if _, ok := files[rel]; !ok {
+			stale = append(stale, upstreamPackage{Path: rel})
+		}
+	}
+
+	return prunePackages(repo, stale, "unmerged")
+}
+
+// linkPackage hardlinks a package of one repo into another, replacing any
+// other file at the same path. The package is copied if it cannot be linked,
+// as when the repos are on different filesystems.
+func linkPackage(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if dstInfo, err := os.Stat(dst); err == nil {
+		if os.SameFile(srcInfo, dstInfo) || (dstInfo.Size() == srcInfo.Size() && dstInfo.ModTime().Equal(srcInfo.ModTime())) {
+			return nil
+		}
+		if err := os.Remove(dst); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Link(src, dst); err != nil {
+		Dprintf("Failed to hardlink %s, copying instead: %v\n", src, err)
+		return cloneFile(src, dst)
+	}
+
+	return nil
+}
+
+// xmlNode is an XML element which is copied verbatim
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// compsEntry is a group, category or environment in a comps file. Its
+// package and group lists are merged; all other elements are copied from the
+// source of the highest priority.
+type compsEntry struct {
+	XMLName     xml.Name
+	ID          string     `xml:"id"`
+	Other       []xmlNode  `xml:",any"`
+	PackageList *compsList `xml:"packagelist,omitempty"`
+	GroupList   *compsList `xml:"grouplist,omitempty"`
+	OptionList  *compsList `xml:"optionlist,omitempty"`
+}
+
+// compsList is a list of packages or groups in a comps entry
+type compsList struct {
+	Items []xmlNode `xml:",any"`
+}
+
+// compsXML is the root element of a comps file
+type compsXML struct {
+	XMLName      xml.Name     `xml:"comps"`
+	Groups       []compsEntry `xml:"group"`
+	Categories   []compsEntry `xml:"category"`
+	Environments []compsEntry `xml:"environment"`
+	Langpacks    []xmlNode    `xml:"langpacks"`
+}
+
+// sourceComps returns the path of the comps file of a source repo: the group
+// metadata of its local repodata, or the comps.xml downloaded by reposync. An
+// empty path is returned if it has none.
+func sourceComps(source *Repo) string {
+	if repomd, err := ReadRepomd(filepath.Join(source.Path(), "repodata", "repomd.xml")); err == nil {
+		if data := repomd.Get("group"); data != nil {
+			return filepath.Join(source.Path(), data.Location.Href)
+		}
+	}
+
+	path := filepath.Join(source.Path(), mergedCompsName)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+
+	return ""
+}
+
+// mergeComps writes the union of the comps files of the sources of a merge
+// target to its comps.xml. Groups, categories and environments are merged by
+// ID. false is returned if no source has a comps file.
+func mergeComps(repo *Repo, sources []*Repo) (bool, error) {
+	merged := &compsXML{}
+	found := false
+	for _, source := range sources {
+		path := sourceComps(source)
+		if path == "" {
+			continue
+		}
+
+		comps, err := readComps(path)
+		if err != nil {
+			return false, NewErrorf("Error reading comps of %s: %v", source.ID, err)
+		}
+		found = true
+
+		merged.Groups = mergeCompsEntries(merged.Groups, comps.Groups)
+		merged.Categories = mergeCompsEntries(merged.Categories, comps.Categories)
+		merged.Environments = mergeCompsEntries(merged.Environments, comps.Environments)
+		if len(merged.Langpacks) == 0 {
+			merged.Langpacks = comps.Langpacks
+		}
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	if repo.Groupfile != "" && repo.Groupfile != mergedCompsName {
+		Warnf(nil, "Merged comps of %s are not used, as groupfile is set to %s", repo.ID, repo.Groupfile)
+		return false, nil
+	}
+
+	return true, writeXML(filepath.Join(repo.Path(), mergedCompsName), merged)
+}
+
+// readComps reads a comps file, which may be compressed
+func readComps(path string) (*compsXML, error) {
+	r, err := openCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	comps := &compsXML{}
+	if err := xml.NewDecoder(r).Decode(comps); err != nil {
+		return nil, err
+	}
+
+	return comps, nil
+}
+
+// mergeCompsEntries adds entries to a list of comps entries. The package and
+// group lists of an entry already in the list are extended with any packages
+// or groups they do not yet have.
+func mergeCompsEntries(entries, add []compsEntry) []compsEntry {
+	index := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		index[entry.ID] = i
+	}
+
+	for _, entry := range add {
+		i, ok := index[entry.ID]
+		if !ok {
+			index[entry.ID] = len(entries)
+			entries = append(entries, entry)
+			continue
+		}
+
+		existing := &entries[i]
+		existing.PackageList = mergeCompsLists(existing.PackageList, entry.PackageList)
+		existing.GroupList = mergeCompsLists(existing.GroupList, entry.GroupList)
+		existing.OptionList = mergeCompsLists(existing.OptionList, entry.OptionList)
+	}
+
+	return entries
+}
+
+// mergeCompsLists appends the items of add whose content is not already in
+// list
+func mergeCompsLists(list, add *compsList) *compsList {
+	if add == nil {
+		return list
+	}
+	if list == nil {
+		list = &compsList{}
+	}
+
+	seen := make(map[string]bool, len(list.Items))
+	for _, item := range list.Items {
+		seen[strings.TrimSpace(item.Inner)] = true
+	}
+
+	for _, item := range add.Items {
+		key := strings.TrimSpace(item.Inner)
+		if !seen[key] {
+			seen[key] = true
+			list.Items = append(list.Items, item)
+		}
+	}
+
+	return list
+}
+
+// advisoryNode is an update element of updateinfo.xml, copied verbatim
+type advisoryNode struct {
+	xmlNode
+	ID string
+}
+
+// sourceUpdateinfo returns the path of the updateinfo of a source repo: the
+// updateinfo in its local repodata, or else that of its upstream. An empty
+// path is returned if it publishes no advisories.
+func sourceUpdateinfo(source *Repo) (string, error) {
+	if repomd, err := ReadRepomd(filepath.Join(source.Path(), "repodata", "repomd.xml")); err == nil {
+		if data := repomd.Get("updateinfo"); data != nil {
+			return filepath.Join(source.Path(), data.Location.Href), nil
+		}
+	}
+
+	if source.RsyncURL() != "" {
+		dir := filepath.Join(source.upstreamCacheDir(), "repodata")
+		if repomd, err := ReadRepomd(filepath.Join(dir, "repomd.xml")); err == nil {
+			if data := repomd.Get("updateinfo"); data != nil {
+				return filepath.Join(dir, filepath.Base(data.Location.Href)), nil
+			}
+		}
+		return "", nil
+	}
+
+	baseurl, repomd, err := source.fetchUpstreamRepomd()
+	if err != nil {
+		return "", err
+	}
+
+	data := repomd.Get("updateinfo")
+	if data == nil {
+		return "", nil
+	}
+
+	return source.fetchUpstreamMetadata(baseurl, data)
+}
+
+// readAdvisoryNodes reads the update elements of an updateinfo.xml file,
+// which may be compressed
+func readAdvisoryNodes(path string) ([]advisoryNode, error) {
+	r, err := openCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	advisories := make([]advisoryNode, 0)
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if err == io.EOF {
+				return advisories, nil
+			}
+			return nil, err
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "update" {
+			continue
+		}
+
+		node := advisoryNode{}
+		if err := d.DecodeElement(&node.xmlNode, &start); err != nil {
+			return nil, err
+		}
+
+		advisory := &Advisory{}
+		if err := xml.Unmarshal([]byte("<update>"+node.Inner+"</update>"), advisory); err != nil {
+			return nil, err
+		}
+		node.ID = advisory.ID
+		advisories = append(advisories, node)
+	}
+}
+
+// mergeUpdateinfo adds the union of the advisories of the sources of a merge
+// target to its metadata. An advisory published by more than one source, by
+// ID, is taken from the source with the highest priority.
+func mergeUpdateinfo(repo *Repo, sources []*Repo) error {
+	merged := make([]xmlNode, 0)
+	seen := make(map[string]bool, 0)
+	for _, source := range sources {
+		path, err := sourceUpdateinfo(source)
+		if err != nil {
+			Warnf(err, "Error fetching advisories of %s", source.ID)
+			continue
+		}
+		if path == "" {
+			continue
+		}
+
+		advisories, err := readAdvisoryNodes(path)
+		if err != nil {
+			return NewErrorf("Error reading advisories of %s: %v", source.ID, err)
+		}
+
+		for _, advisory := range advisories {
+			if seen[advisory.ID] {
+				continue
+			}
+			seen[advisory.ID] = true
+			merged = append(merged, advisory.xmlNode)
+		}
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+
+	Printf("Adding %d advisories to: %s\n", len(merged), repo.ID)
+	if err := os.MkdirAll(TmpBasePath, 0750); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(TmpBasePath, TmpFilePrefix+fmt.Sprintf("%d.updateinfo.", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, mergedUpdateinfoName)
+	updateinfo := struct {
+		XMLName xml.Name  `xml:"updates"`
+		Updates []xmlNode `xml:"update"`
+	}{Updates: merged}
+	if err := writeXML(path, &updateinfo); err != nil {
+		return err
+	}
+
+	return Exec(repo.modifyrepoTool(), "--mdtype=updateinfo", path, filepath.Join(repo.Path(), "repodata"))
+}
+
+// writeXML writes a value to an XML file, which is replaced atomically
+func writeXML(path string, v interface{}) error {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(append([]byte(xml.Header+string(b)), '\n'))
+		return err
+	})
+}
+
+// reposByMergePriority sorts repos by merge priority
+type reposByMergePriority []*Repo
+
+func (c reposByMergePriority) Len() int           { return len(c) }
+func (c reposByMergePriority) Less(i, j int) bool { return c[i].MergePriority < c[j].MergePriority }
+func (c reposByMergePriority) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
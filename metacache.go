@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadataCacheDirName is the directory in the default cache directory which
+// holds decompressed copies of compressed metadata files
+const metadataCacheDirName = ".metadata"
+
+// metadataCacheMaxAge is how long a decompressed copy is kept after it was
+// last read
+const metadataCacheMaxAge = 7 * 24 * time.Hour
+
+// metadataCacheKeys memoizes the checksum of each compressed file opened by
+// this process, keyed by its path, size and modification time, so it is only
+// hashed once
+var (
+	metadataCacheKeys   = make(map[string]string, 0)
+	metadataCacheKeysMu sync.Mutex
+)
+
+// metadataCacheDir returns the directory of decompressed metadata copies
+func metadataCacheDir() string {
+	return filepath.Join(TmpYumCachePath, metadataCacheDirName)
+}
+
+// metadataCacheKey returns the sha256 checksum of a compressed file
+func metadataCacheKey(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s\x00%d\x00%d", path, fi.Size(), fi.ModTime().UnixNano())
+	metadataCacheKeysMu.Lock()
+	sum, ok := metadataCacheKeys[key]
+	metadataCacheKeysMu.Unlock()
+	if ok {
+		return sum, nil
+	}
+
+	if sum, _, err = sha256File(path); err != nil {
+		return "", err
+	}
+
+	metadataCacheKeysMu.Lock()
+	metadataCacheKeys[key] = sum
+	metadataCacheKeysMu.Unlock()
+
+	return sum, nil
+}
+
+// openCachedMetadata opens the decompressed copy of a compressed metadata
+// file, decompressing it into the cache first if there is no copy yet. Copies
+// are named after the checksum of the compressed file, so mirrors and
+// snapshots with the same metadata share one copy, and a changed file is
+// never read from a stale copy. nil is returned if the cache cannot be used.
+func openCachedMetadata(path string, open func(string) (io.ReadCloser, error)) io.ReadCloser {
+	if TmpYumCachePath == "" {
+		return nil
+	}
+
+	sum, err := metadataCacheKey(path)
+	if err != nil {
+		return nil
+	}
+
+	ext := filepath.Ext(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	cached := filepath.Join(metadataCacheDir(), sum+ext)
+	if f, err := os.Open(cached); err == nil {
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+		return f
+	}
+
+	if err := decompressMetadata(path, cached, open); err != nil {
+		Dprintf("Not caching decompressed %s: %v\n", path, err)
+		return nil
+	}
+
+	f, err := os.Open(cached)
+	if err != nil {
+		return nil
+	}
+
+	return f
+}
+
+// decompressMetadata writes the decompressed content of a metadata file to
+// dst, which is replaced atomically so concurrent readers never see a partial
+// copy
+func decompressMetadata(path, dst string, open func(string) (io.ReadCloser, error)) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	// the exit status of the decompression command is only known on close
+	return writeFileAtomic(dst, 0644, func(w io.Writer) error {
+		r, err := open(path)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, r); err != nil {
+			r.Close()
+			return err
+		}
+		return r.Close()
+	})
+}
+
+// cleanUpMetadataCache removes decompressed metadata copies which were not
+// read for metadataCacheMaxAge, and incomplete copies of processes which are
+// no longer running
+func (c *cleaner) cleanUpMetadataCache() error {
+	dir := metadataCacheDir()
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pattern := tempFilePattern()
+	for _, file := range files {
+		if m := pattern.FindStringSubmatch(file.Name()); m != nil {
+			if pid, _ := strconv.Atoi(m[1]); processAlive(pid) {
+				continue
+			}
+		} else if time.Since(file.ModTime()) < metadataCacheMaxAge {
+			continue
+		}
+
+		if err := c.remove(filepath.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
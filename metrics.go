@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsDiskUsageTTL is how long the measured disk usage of a repo is reused
+// before it is measured again, as walking a large repo is slow
+const metricsDiskUsageTTL = 5 * time.Minute
+
+// repoMetrics are the cumulative sync statistics of a repo. They are kept in
+// the repo's cache directory, so they persist between runs and can be
+// exported by the server.
+type repoMetrics struct {
+	Syncs               int64         `json:"syncs"`
+	Failures            int64         `json:"failures"`
+	ConsecutiveFailures int64         `json:"consecutive_failures"`
+	Downloaded          int64         `json:"packages_downloaded"`
+	Deleted             int64         `json:"packages_deleted"`
+	Bytes               int64         `json:"bytes_transferred"`
+	GPGFailures         int64         `json:"gpg_failures"`
+	LastDuration        time.Duration `json:"last_duration_ns"`
+	LastSync            time.Time     `json:"last_sync"`
+	LastSuccess         time.Time     `json:"last_success"`
+}
+
+// metricsPath returns the path of the sync statistics of a repo
+func (c *Repo) metricsPath() string {
+	return filepath.Join(c.CacheDir(), c.ID, "metrics.json")
+}
+
+// readRepoMetrics returns the sync statistics of a repo, which are empty if
+// it was never synchronized
+func readRepoMetrics(repo *Repo) (*repoMetrics, error) {
+	m := &repoMetrics{}
+	if err := readJSON(repo.metricsPath(), m); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// recordMetrics adds the outcome of a repo's sync to its statistics. Skipped
+// repos are not recorded.
+func recordMetrics(repo *Repo, report *RepoReport) error {
+	if report.Status == RepoStatusSkipped {
+		return nil
+	}
+
+	m, err := readRepoMetrics(repo)
+	if err != nil {
+		return err
+	}
+
+	m.Syncs++
+	m.Downloaded += int64(report.Downloaded)
+	m.Deleted += int64(report.Deleted)
+	m.Bytes += report.Bytes
+	m.GPGFailures += int64(report.GPGFailures)
+	m.LastDuration = report.Duration
+	m.LastSync = report.Start
+	if report.Status == RepoStatusFailed {
+		m.Failures++
+		m.ConsecutiveFailures++
+	} else {
+		m.ConsecutiveFailures = 0
+		m.LastSuccess = report.Start
+	}
+
+	if err := os.MkdirAll(filepath.Dir(repo.metricsPath()), 0755); err != nil {
+		return err
+	}
+
+	return writeJSON(repo.metricsPath(), m)
+}
+
+// metricDef describes a metric exported for each repo
+type metricDef struct {
+	Name  string
+	Type  string
+	Help  string
+	Value func(m *repoMetrics) (float64, bool)
+}
+
+// timestamp returns a time as seconds since the epoch, or false if it is zero
+func timestamp(t time.Time) (float64, bool) {
+	return float64(t.UnixNano()) / 1e9, !t.IsZero()
+}
+
+// repoMetricDefs are the sync metrics exported for each repo
+var repoMetricDefs = []metricDef{
+	{"y10k_repo_syncs_total", "counter", "Number of times the repo was synchronized.", func(m *repoMetrics) (float64, bool) { return float64(m.Syncs), true }},
+	{"y10k_repo_sync_failures_total", "counter", "Number of failed syncs of the repo.", func(m *repoMetrics) (float64, bool) { return float64(m.Failures), true }},
+	{"y10k_repo_packages_downloaded_total", "counter", "Number of packages downloaded for the repo.", func(m *repoMetrics) (float64, bool) { return float64(m.Downloaded), true }},
+	{"y10k_repo_packages_deleted_total", "counter", "Number of packages deleted from the repo.", func(m *repoMetrics) (float64, bool) { return float64(m.Deleted), true }},
+	{"y10k_repo_bytes_transferred_total", "counter", "Bytes of packages downloaded for the repo.", func(m *repoMetrics) (float64, bool) { return float64(m.Bytes), true }},
+	{"y10k_repo_gpg_failures_total", "counter", "Number of packages of the repo which failed GPG verification.", func(m *repoMetrics) (float64, bool) { return float64(m.GPGFailures), true }},
+	{"y10k_repo_last_sync_duration_seconds", "gauge", "Duration of the last sync of the repo.", func(m *repoMetrics) (float64, bool) { return m.LastDuration.Seconds(), !m.LastSync.IsZero() }},
+	{"y10k_repo_last_sync_timestamp_seconds", "gauge", "Time of the last sync of the repo, successful or not.", func(m *repoMetrics) (float64, bool) { return timestamp(m.LastSync) }},
+	{"y10k_repo_last_success_timestamp_seconds", "gauge", "Time of the last successful sync of the repo.", func(m *repoMetrics) (float64, bool) { return timestamp(m.LastSuccess) }},
+}
+
+// diskUsageCache caches the measured disk usage of served repos
+type diskUsageCache struct {
+	mu    sync.Mutex
+	sizes map[string]int64
+	times map[string]time.Time
+}
+
+// Get returns the disk usage of a directory, measuring it if the cached value
+// has expired
+func (c *diskUsageCache) Get(path string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sizes == nil {
+		c.sizes = make(map[string]int64, 0)
+		c.times = make(map[string]time.Time, 0)
+	}
+
+	if t, ok := c.times[path]; ok && time.Since(t) < metricsDiskUsageTTL {
+		return c.sizes[path]
+	}
+
+	c.sizes[path] = diskUsage(path)
+	c.times[path] = time.Now()
+	return c.sizes[path]
+}
+
+// metricLabelEscaper escapes Prometheus label values
+var metricLabelEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+)
+
+// metricsContentType is the content type of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// writeRepoMetrics writes the sync statistics of each repo in the Prometheus
+// text format
+func writeRepoMetrics(w io.Writer, repos []*Repo) {
+	metrics := make([]*repoMetrics, len(repos))
+	for i, repo := range repos {
+		m, err := readRepoMetrics(repo)
+		if err != nil {
+			Warnf(err, "Error reading metrics of %s", repo.ID)
+			m = &repoMetrics{}
+		}
+		metrics[i] = m
+	}
+
+	for _, def := range repoMetricDefs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", def.Name, def.Help, def.Name, def.Type)
+		for i, repo := range repos {
+			if v, ok := def.Value(metrics[i]); ok {
+				fmt.Fprintf(w, "%s{repo=\"%s\"} %g\n", def.Name, metricLabelEscaper.Replace(repo.ID), v)
+			}
+		}
+	}
+}
+
+// serveMetrics writes the sync statistics and disk usage of each served repo
+// in the Prometheus text format
+func (c *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	repos := make([]*Repo, 0, len(c.repos))
+	for _, repo := range c.repos {
+		if repo.Proxy == nil {
+			repos = append(repos, repo.Repo)
+		}
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	writeRepoMetrics(w, repos)
+
+	fmt.Fprintf(w, "# HELP y10k_repo_size_bytes Size of the repo on disk.\n# TYPE y10k_repo_size_bytes gauge\n")
+	for _, repo := range c.repos {
+		fmt.Fprintf(w, "y10k_repo_size_bytes{repo=\"%s\"} %d\n", metricLabelEscaper.Replace(repo.Repo.ID), c.diskUsage.Get(repo.Root))
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorProbeInterval is how often the mirrors of a repo are probed when
+// fastestmirror is enabled. Scores are reused between probes.
+const mirrorProbeInterval = time.Hour
+
+// mirrorProbeConcurrency is the number of mirrors probed at once
+const mirrorProbeConcurrency = 8
+
+// mirrorScoreWeight is the weight of each new measurement in the moving
+// average of a mirror's latency and throughput
+const mirrorScoreWeight = 0.3
+
+// mirrorCostSize is the transfer size used to weigh a mirror's latency
+// against its throughput when ranking mirrors
+const mirrorCostSize = 1 << 20
+
+// mirrorBlacklistDuration is how long a mirror which serves a corrupt file,
+// or repeated server errors, is not used
+const mirrorBlacklistDuration = 6 * time.Hour
+
+// mirrorMaxServerErrors is the number of consecutive server errors after
+// which a mirror is blacklisted
+const mirrorMaxServerErrors = 3
+
+// mirrorScore is the observed performance and health of one upstream mirror
+type mirrorScore struct {
+	Latency          float64   `json:"latency_s"`
+	Throughput       float64   `json:"throughput_bps"`
+	Failures         int       `json:"failures"`
+	ServerErrors     int       `json:"server_errors"`
+	Corrupt          int       `json:"corrupt_files"`
+	LastError        string    `json:"last_error,omitempty"`
+	BlacklistedUntil time.Time `json:"blacklisted_until,omitempty"`
+	Updated          time.Time `json:"updated"`
+}
+
+// blacklisted returns true if a mirror is currently blacklisted
+func (c *mirrorScore) blacklisted() bool {
+	return c != nil && time.Now().Before(c.BlacklistedUntil)
+}
+
+// mirrorScores are the scores of the mirrors of a repo
+type mirrorScores struct {
+	Probed  time.Time               `json:"probed"`
+	Mirrors map[string]*mirrorScore `json:"mirrors"`
+}
+
+// mirrorScoresMu serializes updates of mirror scores
+var mirrorScoresMu sync.Mutex
+
+// mirrorScoresPath returns the path of the mirror scores of a repo
+func (c *Repo) mirrorScoresPath() string {
+	return filepath.Join(c.CacheDir(), c.ID, "mirrors.json")
+}
+
+// readMirrorScores returns the mirror scores of a repo, which are empty if
+// its mirrors were never probed
+func readMirrorScores(repo *Repo) *mirrorScores {
+	scores := &mirrorScores{}
+	if err := readJSON(repo.mirrorScoresPath(), scores); err != nil && !os.IsNotExist(err) {
+		Dprintf("Ignoring unreadable mirror scores %s: %v\n", repo.mirrorScoresPath(), err)
+	}
+	if scores.Mirrors == nil {
+		scores.Mirrors = make(map[string]*mirrorScore, 0)
+	}
+
+	return scores
+}
+
+// get returns the score of a mirror, adding it if it has none
+func (c *mirrorScores) get(url string) *mirrorScore {
+	score := c.Mirrors[url]
+	if score == nil {
+		score = &mirrorScore{}
+		c.Mirrors[url] = score
+	}
+	score.Updated = time.Now().UTC()
+
+	return score
+}
+
+// update adds a measurement of a mirror to its moving averages, or records a
+// failure if err is not nil
+func (c *mirrorScores) update(url string, latency, throughput float64, err error) {
+	if err != nil {
+		c.fail(url, err, false)
+		return
+	}
+
+	score := c.get(url)
+	score.Failures = 0
+
+	if latency > 0 {
+		if score.Latency == 0 {
+			score.Latency = latency
+		} else {
+			score.Latency += mirrorScoreWeight * (latency - score.Latency)
+		}
+	}
+
+	if throughput > 0 {
+		if score.Throughput == 0 {
+			score.Throughput = throughput
+		} else {
+			score.Throughput += mirrorScoreWeight * (throughput - score.Throughput)
+		}
+	}
+}
+
+// fail records a failed request to a mirror, or a corrupt file served by it,
+// and blacklists the mirror if it served a corrupt file or too many server
+// errors in a row. true is returned if the mirror was blacklisted.
+func (c *mirrorScores) fail(url string, err error, corrupt bool) bool {
+	score := c.get(url)
+	score.Failures++
+	score.LastError = err.Error()
+
+	switch {
+	case corrupt:
+		score.Corrupt++
+	case isServerError(err):
+		score.ServerErrors++
+		if score.Failures < mirrorMaxServerErrors {
+			return false
+		}
+	default:
+		return false
+	}
+
+	score.BlacklistedUntil = time.Now().Add(mirrorBlacklistDuration).UTC()
+	return true
+}
+
+// cost returns the expected time in seconds to download mirrorCostSize bytes
+// from a mirror. Mirrors which failed their last request or were never
+// measured cost the most.
+func (c *mirrorScores) cost(url string) float64 {
+	score := c.Mirrors[url]
+	if score == nil || score.Failures > 0 || score.Latency == 0 {
+		return math.Inf(1)
+	}
+
+	cost := score.Latency
+	if score.Throughput > 0 {
+		cost += mirrorCostSize / score.Throughput
+	}
+
+	return cost
+}
+
+// rank returns the given mirrors sorted from the cheapest to the most costly.
+// Mirrors with equal costs keep their order.
+func (c *mirrorScores) rank(urls []string) []string {
+	ranked := make([]string, len(urls))
+	copy(ranked, urls)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return c.cost(ranked[i]) < c.cost(ranked[j])
+	})
+
+	return ranked
+}
+
+// probeMirror requests the repomd.xml of a mirror and returns the time to its
+// first byte and the throughput of the whole request
+func probeMirror(repo *Repo, baseurl string) (float64, float64, error) {
+	start := time.Now()
+	resp, err := httpGet(repo, strings.TrimSuffix(baseurl, "/")+"/repodata/repomd.xml")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start).Seconds()
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return latency, float64(n) / time.Since(start).Seconds(), nil
+}
+
+// applyMirrors selects the mirrors of a repo with more than one baseurl, a
+// mirror list or a metalink for a sync. Blacklisted mirrors are left out,
+// unless every mirror is blacklisted. If fastestmirror is enabled, mirrors
+// are ranked by their observed latency and throughput, so the fastest is used
+// first by yum and y10k. Mirrors are probed at most once per
+// mirrorProbeInterval and their scores kept in the repo's cache.
+func (c *Repo) applyMirrors() error {
+	c.Mirrors = nil
+	if c.RsyncURL() != "" {
+		return nil
+	}
+
+	urls, err := c.UpstreamURLs()
+	if err != nil {
+		return err
+	}
+	if len(urls) < 2 {
+		return nil
+	}
+	for i, url := range urls {
+		urls[i] = strings.TrimSuffix(url, "/")
+	}
+
+	mirrorScoresMu.Lock()
+	scores := readMirrorScores(c)
+	mirrorScoresMu.Unlock()
+
+	if c.FastestMirror && time.Since(scores.Probed) > mirrorProbeInterval {
+		Printf("Probing %d mirrors: %s\n", len(urls), c.ID)
+		c.probeMirrors(scores, urls)
+	}
+
+	healthy := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if score := scores.Mirrors[url]; score.blacklisted() {
+			Printf("Skipping mirror %s of %s, blacklisted until %s: %s\n", url, c.ID, score.BlacklistedUntil.Local().Format(time.RFC3339), score.LastError)
+			continue
+		}
+		healthy = append(healthy, url)
+	}
+	if len(healthy) == 0 {
+		Warnf(nil, "Every mirror of %s is blacklisted", c.ID)
+		healthy = urls
+	}
+
+	if !c.FastestMirror {
+		c.Mirrors = healthy
+		return nil
+	}
+
+	c.Mirrors = scores.rank(healthy)
+	if score := scores.Mirrors[c.Mirrors[0]]; score != nil && score.Failures == 0 {
+		Printf("Fastest mirror of %s: %s (%.0f ms, %s/s)\n", c.ID, c.Mirrors[0], score.Latency*1000, formatBytes(int64(score.Throughput)))
+	}
+
+	return nil
+}
+
+// probeMirrors probes each mirror concurrently and saves their scores
+func (c *Repo) probeMirrors(scores *mirrorScores, urls []string) {
+	type result struct {
+		url                 string
+		latency, throughput float64
+		err                 error
+	}
+
+	results := make(chan result, len(urls))
+	sem := make(chan struct{}, mirrorProbeConcurrency)
+	for _, url := range urls {
+		go func(url string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			latency, throughput, err := probeMirror(c, url)
+			results <- result{url, latency, throughput, err}
+		}(url)
+	}
+
+	mirrorScoresMu.Lock()
+	defer mirrorScoresMu.Unlock()
+	for range urls {
+		r := <-results
+		if r.err != nil {
+			Dprintf("Mirror %s failed: %v\n", r.url, r.err)
+			if scores.fail(r.url, r.err, false) {
+				Warnf(r.err, "Blacklisted mirror %s of %s for %v", r.url, c.ID, mirrorBlacklistDuration)
+			}
+			continue
+		}
+		scores.update(r.url, r.latency, r.throughput, nil)
+	}
+
+	// forget mirrors which are no longer listed
+	listed := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		listed[url] = true
+	}
+	for url := range scores.Mirrors {
+		if !listed[url] {
+			delete(scores.Mirrors, url)
+		}
+	}
+
+	scores.Probed = time.Now().UTC()
+	if err := writeJSON(c.mirrorScoresPath(), scores); err != nil {
+		Dprintf("Error saving mirror scores of %s: %v\n", c.ID, err)
+	}
+}
+
+// recordMirrorThroughput adds the throughput of a download from a mirror to
+// its score, if the repo has more than one mirror
+func recordMirrorThroughput(repo *Repo, baseurl string, n int64, d time.Duration) {
+	if len(repo.Mirrors) < 2 || d <= 0 {
+		return
+	}
+
+	mirrorScoresMu.Lock()
+	defer mirrorScoresMu.Unlock()
+
+	scores := readMirrorScores(repo)
+	if _, ok := scores.Mirrors[baseurl]; !ok {
+		return
+	}
+
+	scores.update(baseurl, 0, float64(n)/d.Seconds(), nil)
+	if err := writeJSON(repo.mirrorScoresPath(), scores); err != nil {
+		Dprintf("Error saving mirror scores of %s: %v\n", repo.ID, err)
+	}
+}
+
+// recordMirrorFailure logs a failed request to a mirror of a repo, or a
+// corrupt file served by it, so bad mirrors can be reported upstream, and
+// blacklists the mirror if it served a corrupt file or repeated server errors
+func recordMirrorFailure(repo *Repo, baseurl string, err error, corrupt bool) {
+	baseurl = strings.TrimSuffix(baseurl, "/")
+	if corrupt {
+		Errorf(err, "Mirror %s of %s served a corrupt file", baseurl, repo.ID)
+	} else {
+		Dprintf("Mirror %s of %s failed: %v\n", baseurl, repo.ID, err)
+	}
+
+	mirrorScoresMu.Lock()
+	defer mirrorScoresMu.Unlock()
+
+	scores := readMirrorScores(repo)
+	if scores.fail(baseurl, err, corrupt) {
+		Warnf(err, "Blacklisted mirror %s of %s for %v", baseurl, repo.ID, mirrorBlacklistDuration)
+	}
+
+	if err := writeJSON(repo.mirrorScoresPath(), scores); err != nil {
+		Dprintf("Error saving mirror scores of %s: %v\n", repo.ID, err)
+	}
+}
+
+// mirrorBlacklisted returns true if a mirror of a repo is blacklisted
+func mirrorBlacklisted(repo *Repo, baseurl string) bool {
+	mirrorScoresMu.Lock()
+	defer mirrorScoresMu.Unlock()
+
+	return readMirrorScores(repo).Mirrors[strings.TrimSuffix(baseurl, "/")].blacklisted()
+}
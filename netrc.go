@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEntry is the login and password for a machine in a .netrc file
+type netrcEntry struct {
+	Machine  string
+	Login    string
+	Password string
+}
+
+// netrcPath returns the path of the user's .netrc file, which may be
+// overridden with the NETRC environment variable
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".netrc")
+}
+
+// readNetrc parses a .netrc file. The default entry, if any, has an empty
+// machine name. Macro definitions are skipped.
+func readNetrc(path string) ([]netrcEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]netrcEntry, 0)
+	var entry *netrcEntry
+	lines := strings.Split(string(b), "\n")
+	for n := 0; n < len(lines); n++ {
+		fields := strings.Fields(lines[n])
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+
+			value := ""
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+
+			switch fields[i] {
+			case "machine":
+				entries = append(entries, netrcEntry{Machine: value})
+				entry = &entries[len(entries)-1]
+				i++
+
+			case "default":
+				entries = append(entries, netrcEntry{})
+				entry = &entries[len(entries)-1]
+
+			case "login", "password", "account":
+				if entry == nil {
+					return nil, NewErrorf("Syntax error in %s on line %d: %s before machine", path, n+1, fields[i])
+				}
+				if fields[i] == "login" {
+					entry.Login = value
+				} else if fields[i] == "password" {
+					entry.Password = value
+				}
+				i++
+
+			case "macdef":
+				// macros run until the next blank line
+				for n+1 < len(lines) && strings.TrimSpace(lines[n+1]) != "" {
+					n++
+				}
+				i = len(fields)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// applyNetrc sets the username and password of a repo which has none from
+// the entry for the host of its upstream URL in the user's .netrc file.
+func (c *Repo) applyNetrc() error {
+	if c.Parameters["username"] != "" {
+		return nil
+	}
+
+	host := ""
+	for _, key := range []string{"baseurl", "mirrorlist", "metalink"} {
+		if fields := strings.Fields(strings.Replace(c.Parameters[key], ",", " ", -1)); len(fields) > 0 {
+			if u, err := url.Parse(fields[0]); err == nil {
+				host = u.Hostname()
+			}
+			break
+		}
+	}
+
+	if host == "" {
+		return nil
+	}
+
+	path := netrcPath()
+	entries, err := readNetrc(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the first matching machine wins, falling back to the default entry
+	var match *netrcEntry
+	for i := range entries {
+		if entries[i].Machine == host || (entries[i].Machine == "" && match == nil) {
+			match = &entries[i]
+			if entries[i].Machine == host {
+				break
+			}
+		}
+	}
+
+	if match == nil || match.Login == "" {
+		return nil
+	}
+
+	Dprintf("Using credentials for %s from %s for %s\n", host, path, c.ID)
+	c.Parameters["username"] = match.Login
+	c.Parameters["password"] = match.Password
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultNotifyFailures is the number of consecutive failed syncs of a repo
+// after which an alert is sent
+const DefaultNotifyFailures = 3
+
+// Notifier sends a summary of each sync run, and alerts for repos which fail
+// repeatedly, to webhooks, Slack and email. It is configured by the notify_*
+// and smtp_* keys in the global section of a Yumfile.
+type Notifier struct {
+	Webhooks     []string
+	Slack        []string
+	Email        []string
+	On           string
+	Failures     int
+	SMTPServer   string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// notifyPayload is the JSON document posted to webhooks
+type notifyPayload struct {
+	Event   string     `json:"event"`
+	Summary string     `json:"summary"`
+	Alerts  []string   `json:"alerts,omitempty"`
+	Report  *RunReport `json:"report"`
+}
+
+// isNotifyKey returns true if a global Yumfile key configures notifications
+func isNotifyKey(key string) bool {
+	return strings.HasPrefix(key, "notify_") || strings.HasPrefix(key, "smtp_")
+}
+
+// parseNotifyTargets splits a comma or space separated list of notification
+// URLs or email addresses
+func parseNotifyTargets(s string) []string {
+	return strings.Fields(strings.Replace(s, ",", " ", -1))
+}
+
+// Set sets a notification option from a global Yumfile key/value pair
+func (c *Notifier) Set(key, val string) error {
+	switch key {
+	case "notify_webhook":
+		c.Webhooks = append(c.Webhooks, parseNotifyTargets(val)...)
+
+	case "notify_slack":
+		c.Slack = append(c.Slack, parseNotifyTargets(val)...)
+
+	case "notify_email":
+		c.Email = append(c.Email, parseNotifyTargets(val)...)
+
+	case "notify_on":
+		switch val {
+		case "always", "changes", "failure", "never":
+			c.On = val
+		default:
+			return NewErrorf("Invalid notify_on: %s (expected always, changes, failure or never)", val)
+		}
+
+	case "notify_failures":
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return NewErrorf("Invalid failure count: %s", val)
+		} else {
+			c.Failures = i
+		}
+
+	case "smtp_server":
+		c.SMTPServer = val
+
+	case "smtp_from":
+		c.SMTPFrom = val
+
+	case "smtp_username":
+		c.SMTPUsername = val
+
+	case "smtp_password":
+		c.SMTPPassword = val
+
+	default:
+		return NewErrorf("Unknown key: %s", key)
+	}
+
+	return nil
+}
+
+// Validate checks that email notifications can be sent if configured
+func (c *Notifier) Validate() error {
+	if len(c.Email) > 0 && c.SMTPServer == "" {
+		return NewErrorf("notify_email requires smtp_server")
+	}
+
+	return nil
+}
+
+// Enabled returns true if any notification target is configured
+func (c *Notifier) Enabled() bool {
+	return len(c.Webhooks)+len(c.Slack)+len(c.Email) > 0
+}
+
+// wantSummary returns true if a summary of a run should be sent according to
+// notify_on, which defaults to always
+func (c *Notifier) wantSummary(report *RunReport) bool {
+	switch c.On {
+	case "never":
+		return false
+	case "failure":
+		return report.Failed > 0
+	case "changes":
+		return report.Failed > 0 || report.Downloaded > 0 || report.Deleted > 0
+	}
+
+	return true
+}
+
+// failureAlerts returns an alert for each repo which failed in a run and has
+// now failed notify_failures times in a row. The alert is sent once, when
+// the threshold is reached, rather than on every failure which follows.
+func (c *Notifier) failureAlerts(report *RunReport, repos []Repo) []string {
+	threshold := c.Failures
+	if threshold == 0 {
+		threshold = DefaultNotifyFailures
+	}
+
+	alerts := make([]string, 0)
+	for _, r := range report.Repos {
+		if r.Status != RepoStatusFailed {
+			continue
+		}
+
+		for i := range repos {
+			if repos[i].ID != r.ID {
+				continue
+			}
+
+			m, err := readRepoMetrics(&repos[i])
+			if err != nil {
+				Dprintf("Error reading metrics of %s: %v\n", r.ID, err)
+				break
+			}
+
+			if m.ConsecutiveFailures == int64(threshold) {
+				alerts = append(alerts, fmt.Sprintf("%s has failed %d times in a row: %s", r.ID, m.ConsecutiveFailures, r.Error))
+			}
+			break
+		}
+	}
+
+	return alerts
+}
+
+// Notify sends a summary of a run and any failure alerts to all configured
+// targets. Errors are logged rather than returned so that one unreachable
+// target does not prevent the others being notified.
+func (c *Notifier) Notify(report *RunReport, repos []Repo) {
+	if !c.Enabled() {
+		return
+	}
+
+	alerts := c.failureAlerts(report, repos)
+	if len(alerts) == 0 && !c.wantSummary(report) {
+		return
+	}
+
+	event := "sync"
+	if len(alerts) > 0 {
+		event = "alert"
+	}
+
+	subject := fmt.Sprintf("y10k sync: %d synced, %d failed", report.Synced+report.UpToDate, report.Failed)
+	if len(alerts) > 0 {
+		subject = fmt.Sprintf("y10k alert: %d repos failing repeatedly", len(alerts))
+	}
+
+	text := &bytes.Buffer{}
+	for _, alert := range alerts {
+		fmt.Fprintf(text, "ALERT: %s\n", alert)
+	}
+	if len(alerts) > 0 {
+		fmt.Fprintf(text, "\n")
+	}
+	if err := renderReport(text, report, "text", ""); err != nil {
+		Warnf(err, "Error rendering notification")
+		return
+	}
+
+	for _, url := range c.Webhooks {
+		payload := &notifyPayload{
+			Event:   event,
+			Summary: subject,
+			Alerts:  alerts,
+			Report:  report,
+		}
+		if err := postJSON(url, payload); err != nil {
+			Warnf(err, "Error sending notification to webhook")
+		}
+	}
+
+	for _, url := range c.Slack {
+		payload := map[string]string{
+			"text": fmt.Sprintf("*%s*\n```\n%s```", subject, text.String()),
+		}
+		if err := postJSON(url, payload); err != nil {
+			Warnf(err, "Error sending notification to Slack")
+		}
+	}
+
+	if len(c.Email) > 0 {
+		if err := c.sendMail(subject, text.String()); err != nil {
+			Warnf(err, "Error sending notification email")
+		}
+	}
+}
+
+// postJSON posts a JSON document to a URL
+func postJSON(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: httpTransport}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return NewErrorf("Error posting to %s: %s", url, resp.Status)
+	}
+
+	Dprintf("Sent notification to %s\n", url)
+	return nil
+}
+
+// sendMail sends a plain text email to all notify_email recipients
+func (c *Notifier) sendMail(subject, body string) error {
+	from := c.SMTPFrom
+	if from == "" {
+		hostname, _ := os.Hostname()
+		from = "y10k@" + hostname
+	}
+
+	server := c.SMTPServer
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "25")
+	}
+
+	var auth smtp.Auth
+	if c.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(server)
+		auth = smtp.PlainAuth("", c.SMTPUsername, c.SMTPPassword, host)
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", from)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(c.Email, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	if err := smtp.SendMail(server, auth, from, c.Email, msg.Bytes()); err != nil {
+		return err
+	}
+
+	Dprintf("Sent notification to %s\n", strings.Join(c.Email, ", "))
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// accessWriteOK is the access(2) mode bit to test for write permission
+const accessWriteOK = 0x2
+
+// CheckPaths verifies that the local and cache paths of each repo exist or can
+// be created, are writable by the current user and do not overlap with the
+// paths of other repos. All problems found are returned at once so they can be
+// fixed before a long sync run starts.
+func (c *Yumfile) CheckPaths(repos []Repo) []error {
+	errs := make([]error, 0)
+	checked := make(map[string]bool, 0)
+	check := func(repo *Repo, name, path string) {
+		if checked[path] {
+			return
+		}
+		checked[path] = true
+
+		if err := checkWritableDir(path); err != nil {
+			errs = append(errs, NewErrorf("%s %s for repo %s in %s on line %d: %v", name, path, repo.ID, repo.YumfilePath, repo.YumfileLineNo, err))
+		}
+	}
+
+	for i := range repos {
+		check(&repos[i], "Local path", repos[i].Path())
+		check(&repos[i], "Cache path", repos[i].CacheDir())
+		if repos[i].SnapshotPath != "" {
+			check(&repos[i], "Snapshot path", repos[i].SnapshotDir())
+		}
+		if repos[i].StatePath != "" {
+			check(&repos[i], "State path", repos[i].StateDir())
+		}
+		if repos[i].StorePath != "" {
+			check(&repos[i], "Store path", repos[i].StorePath)
+		}
+	}
+
+	// packages are hardlinked between the package store, the repo and its
+	// snapshots, which only works within a filesystem
+	for i := range repos {
+		repo := &repos[i]
+		dev, err := pathDevice(repo.Path())
+		if err != nil {
+			continue
+		}
+
+		if store, err := pathDevice(repo.StorePath); repo.StorePath != "" && err == nil {
+			for _, path := range []string{repo.Path(), repo.SnapshotDir()} {
+				if d, err := pathDevice(path); err == nil && d != store {
+					errs = append(errs, NewErrorf("Store path %s of repo %s is not on the same filesystem as %s (in %s on line %d)", repo.StorePath, repo.ID, path, repo.YumfilePath, repo.YumfileLineNo))
+				}
+			}
+		}
+
+		if repo.SnapshotPath != "" {
+			if d, err := pathDevice(repo.SnapshotDir()); err == nil && d != dev {
+				Warnf(nil, "Snapshot path %s of repo %s is not on the same filesystem as its local path %s, so snapshots are copies rather than hardlinks", repo.SnapshotDir(), repo.ID, repo.Path())
+			}
+		}
+	}
+
+	// local paths may not be nested inside each other, or be used as a cache
+	for i := range repos {
+		a := absPath(repos[i].Path())
+		for j := range repos {
+			if b := absPath(repos[j].Path()); i != j && isSubPath(a, b) {
+				errs = append(errs, NewErrorf("Local path of repo %s (%s) is inside the local path of repo %s (%s)", repos[j].ID, b, repos[i].ID, a))
+			}
+
+			if b := absPath(repos[j].CacheDir()); a == b || isSubPath(a, b) {
+				errs = append(errs, NewErrorf("Cache path of repo %s (%s) is inside the local path of repo %s (%s)", repos[j].ID, b, repos[i].ID, a))
+			}
+		}
+	}
+
+	return errs
+}
+
+// nearestExisting returns a path, or its nearest existing parent if it is yet
+// to be created
+func nearestExisting(path string) (string, os.FileInfo, error) {
+	dir := filepath.Clean(path)
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			return dir, fi, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil, err
+		}
+		dir = parent
+	}
+}
+
+// pathDevice returns the device of the filesystem a path is, or will be
+// created, on
+func pathDevice(path string) (uint64, error) {
+	_, fi, err := nearestExisting(path)
+	if err != nil {
+		return 0, err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, NewErrorf("Unable to read the device of %s", path)
+	}
+
+	return uint64(st.Dev), nil
+}
+
+// checkWritableDir returns an error if path is not a writable directory, or
+// does not exist and cannot be created by the current user.
+func checkWritableDir(path string) error {
+	dir, fi, err := nearestExisting(path)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return NewErrorf("%s is not a directory", dir)
+	}
+
+	if err := syscall.Access(dir, accessWriteOK); err != nil {
+		return NewErrorf("%s is not writable: %v", dir, err)
+	}
+
+	return nil
+}
+
+// absPath returns the absolute form of path, or the cleaned path if the working
+// directory cannot be determined.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return filepath.Clean(path)
+}
+
+// isSubPath returns true if path is strictly inside parent
+func isSubPath(parent, path string) bool {
+	rel, err := filepath.Rel(parent, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// selinuxRestorecon is the selinux_context value which restores the default
+// SELinux context of a repo's files with restorecon, rather than setting a
+// fixed context with chcon
+const selinuxRestorecon = "restorecon"
+
+// parseFileMode parses octal file permissions such as 0644
+func parseFileMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n == 0 || n > 0777 {
+		return 0, NewErrorf("Invalid file mode: %s (expected octal, such as 0644)", s)
+	}
+
+	return os.FileMode(n), nil
+}
+
+// lookupOwner returns the user and group IDs of a repo's owner and group
+// options, which may be names or numeric IDs, or -1 for either if unset
+func lookupOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		if u, err := user.Lookup(owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+		} else if n, nerr := strconv.Atoi(owner); nerr == nil && n >= 0 {
+			uid = n
+		} else {
+			return 0, 0, NewErrorf("Unknown owner: %s", owner)
+		}
+	}
+
+	if group != "" {
+		if g, err := user.LookupGroup(group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		} else if n, nerr := strconv.Atoi(group); nerr == nil && n >= 0 {
+			gid = n
+		} else {
+			return 0, 0, NewErrorf("Unknown group: %s", group)
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// applyFilePermissions sets the mode, owner and group of every file and
+// directory of a repo, as configured with file_mode, dir_mode, owner and
+// group, and its SELinux context if selinux_context is set, so that the
+// mirror can be served by a web server without fixing them by hand.
+func applyFilePermissions(repo *Repo) error {
+	if err := applyFileModes(repo); err != nil {
+		return err
+	}
+
+	switch repo.SELinuxContext {
+	case "":
+		return nil
+
+	case selinuxRestorecon:
+		return Exec("restorecon", "-R", repo.Path())
+
+	default:
+		return Exec("chcon", "-R", repo.SELinuxContext, repo.Path())
+	}
+}
+
+// applyFileModes sets the mode, owner and group of every file and directory of
+// a repo. Only files which differ are changed. Files with other hardlinks,
+// such as packages shared with snapshots, the package store or other repos,
+// are left unchanged if they differ, as changing them would change every link.
+func applyFileModes(repo *Repo) error {
+	if repo.FileMode == 0 && repo.DirMode == 0 && repo.Owner == "" && repo.Group == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupOwner(repo.Owner, repo.Group)
+	if err != nil {
+		return err
+	}
+
+	changed, shared := 0, 0
+	err = filepath.Walk(repo.Path(), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		mode := repo.FileMode
+		if info.IsDir() {
+			mode = repo.DirMode
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		chmod := mode != 0 && info.Mode().Perm() != mode
+		chown := ok && (uid >= 0 && int(st.Uid) != uid || gid >= 0 && int(st.Gid) != gid)
+		if !chmod && !chown {
+			return nil
+		}
+
+		if ok && !info.IsDir() && st.Nlink > 1 {
+			shared++
+			return nil
+		}
+
+		if chmod {
+			if err := os.Chmod(p, mode); err != nil {
+				return err
+			}
+		}
+		if chown {
+			if err := os.Lchown(p, uid, gid); err != nil {
+				return err
+			}
+		}
+		changed++
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	Dprintf("Changed the mode or owner of %d files in %s\n", changed, repo.Path())
+	if shared > 0 {
+		Warnf(nil, "Left the mode or owner of %d hardlinked files in %s unchanged", shared, repo.Path())
+	}
+
+	return nil
+}
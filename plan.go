@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var packageFilenamePattern = regexp.MustCompile("^(.+)-[^-]+-[^-]+\\.([^.]+)\\.rpm$")
+
+// SyncPlan describes the changes a sync would make to a local repo
+type SyncPlan struct {
+	Repo         string
+	New          []string
+	Updated      []string
+	Deleted      []string
+	Local        int
+	DownloadSize int64
+
+	// downloads are the upstream packages not yet in the local repo
+	downloads []upstreamPackage
+}
+
+// upstreamPackage is a package available from a repo's upstream
+type upstreamPackage struct {
+	Path      string
+	Size      int64
+	Name      string // name.arch
+	NVRA      string // name-version-release.arch
+	Version   Version
+	BuildTime int64
+	FileTime  int64
+	License   string
+	SourceRPM string
+}
+
+// parsePackageFilename returns the name and architecture of a package from
+// its file name
+func parsePackageFilename(filename string) (string, string, bool) {
+	m := packageFilenamePattern.FindStringSubmatch(filepath.Base(filename))
+	if m == nil {
+		return "", "", false
+	}
+
+	return m[1], m[2], true
+}
+
+// Plan computes the changes a sync would make to each repo without
+// downloading any packages. Repos which cannot be planned, such as when
+// their upstream metadata cannot be fetched, are logged and skipped, and an
+// error is returned with the plans of the others.
+func (c *Yumfile) Plan(repos []Repo) ([]SyncPlan, error) {
+	defer removeYumConf()
+
+	plans := make([]SyncPlan, 0, len(repos))
+	failed := 0
+	for _, repo := range repos {
+		if repo.Disabled {
+			Printf("Skipping disabled repo: %s\n", repo.ID)
+			continue
+		}
+
+		plan, err := c.planRepo(&repo)
+		if err != nil {
+			Errorf(err, "Error planning %s", repo.ID)
+			failed++
+			continue
+		}
+
+		plans = append(plans, *plan)
+	}
+
+	if failed > 0 {
+		return plans, NewErrorf("%d of %d repos could not be planned", failed, len(repos))
+	}
+
+	return plans, nil
+}
+
+// planRepo computes the changes a sync would make to a single repo
+func (c *Yumfile) planRepo(repo *Repo) (*SyncPlan, error) {
+	if repo.DebugInfoFor != "" {
+		if err := c.filterDebugInfo(repo); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.installYumConf(repo); err != nil {
+		return nil, err
+	}
+
+	expired, err := c.applyRetention(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	windowed, err := c.applyDateWindow(repo)
+	if err != nil {
+		return nil, err
+	}
+	expired = append(expired, windowed...)
+
+	excluded, err := c.applyFilterPlugins(repo)
+	if err != nil {
+		return nil, err
+	}
+	expired = append(expired, excluded...)
+
+	plan, err := c.comparePackages(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	// expired packages, and those excluded by the date window or plugins, are
+	// excluded from
+	// upstream, so they appear as deleted only if deleteremoved is set
+	if !repo.DeleteRemoved {
+		local, err := localPackages(repo.Path())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pkg := range expired {
+			if local[pkg.Path] {
+				plan.Deleted = append(plan.Deleted, pkg.Path)
+			}
+		}
+		sort.Strings(plan.Deleted)
+	}
+
+	return plan, nil
+}
+
+// comparePackages compares the local packages of a repo with those available
+// upstream, using the installed yum.conf.
+func (c *Yumfile) comparePackages(repo *Repo) (*SyncPlan, error) {
+	upstream, err := c.repoquery(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := localPackages(repo.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	// index local packages by name.arch
+	localNames := make(map[string]bool, len(local))
+	for path := range local {
+		if name, arch, ok := parsePackageFilename(path); ok {
+			localNames[name+"."+arch] = true
+		}
+	}
+
+	plan := &SyncPlan{
+		Repo:  repo.ID,
+		Local: len(local),
+	}
+
+	upstreamPaths := make(map[string]bool, len(upstream))
+	for _, pkg := range upstream {
+		upstreamPaths[pkg.Path] = true
+		if local[pkg.Path] {
+			continue
+		}
+
+		if localNames[pkg.Name] {
+			plan.Updated = append(plan.Updated, pkg.Path)
+		} else {
+			plan.New = append(plan.New, pkg.Path)
+		}
+		plan.downloads = append(plan.downloads, pkg)
+		plan.DownloadSize += pkg.Size
+	}
+
+	if repo.DeleteRemoved {
+		for path := range local {
+			if !upstreamPaths[path] {
+				plan.Deleted = append(plan.Deleted, path)
+			}
+		}
+	}
+
+	sort.Strings(plan.New)
+	sort.Strings(plan.Updated)
+	sort.Strings(plan.Deleted)
+
+	return plan, nil
+}
+
+// checkDeletions returns an error if a sync would delete more than the
+// configured percentage of a repo's local packages, which usually means the
+// upstream metadata is truncated or the wrong repo was configured.
+func (c *Yumfile) checkDeletions(repo *Repo, plan *SyncPlan) error {
+	if !repo.DeleteRemoved || c.MaxDeletePercent <= 0 || plan == nil {
+		return nil
+	}
+
+	if plan.Local == 0 {
+		return nil
+	}
+
+	percent := float64(len(plan.Deleted)) * 100 / float64(plan.Local)
+	Dprintf("Sync would delete %d of %d local packages (%.1f%%) from %s\n", len(plan.Deleted), plan.Local, percent, repo.ID)
+	if percent > c.MaxDeletePercent {
+		return NewErrorf("Refusing to delete %d of %d local packages (%.1f%%, limit is %.1f%%); upstream metadata may be incomplete", len(plan.Deleted), plan.Local, percent, c.MaxDeletePercent)
+	}
+
+	return nil
+}
+
+// checkFreeSpace returns an error if downloading the packages in a sync plan
+// would leave less than the repo's minimum free space on the filesystem of
+// its local path, so a sync never fills the volume and leaves a mirror with
+// truncated packages.
+func checkFreeSpace(repo *Repo, plan *SyncPlan) error {
+	if repo.MinFreeSpace <= 0 || plan == nil {
+		return nil
+	}
+
+	free, err := freeSpace(repo.Path())
+	if err != nil {
+		return NewErrorf("Failed to check free space: %v", err)
+	}
+
+	Dprintf("Sync would download %s of packages to %s with %s free\n", formatBytes(plan.DownloadSize), repo.ID, formatBytes(free))
+	if free-plan.DownloadSize < repo.MinFreeSpace {
+		return NewErrorf("Refusing to download %s of packages with %s free; at least %s must remain free", formatBytes(plan.DownloadSize), formatBytes(free), formatBytes(repo.MinFreeSpace))
+	}
+
+	return nil
+}
+
+// freeSpace returns the space available to unprivileged users on the
+// filesystem of a path, or of its closest existing parent
+func freeSpace(path string) (int64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		var fs syscall.Statfs_t
+		err := syscall.Statfs(path, &fs)
+		if err == nil {
+			return int64(fs.Bavail) * int64(fs.Bsize), nil
+		}
+
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
+// repoquery lists the packages reposync would download for a repo, using
+// the installed yum.conf.
+func (c *Yumfile) repoquery(repo *Repo) ([]upstreamPackage, error) {
+	args := []string{
+		fmt.Sprintf("--config=%s", TmpYumConfPath),
+		fmt.Sprintf("--repoid=%s", repo.ID),
+		"--all",
+	}
+
+	if repo.yumBackend() == BackendDNF {
+		// dnf has no relativepath or filetime, so file times are read from
+		// the upstream metadata below, and it lists every version of a
+		// package unless limited to the latest
+		args = append(args, "--queryformat=%{location}\t%{packagesize}\t%{name}.%{arch}\t%{name}-%{version}-%{release}.%{arch}\t%{epoch}\t%{version}\t%{release}\t%{buildtime}\t%{license}\t%{sourcerpm}\t0")
+		if repo.NewOnly {
+			args = append(args, "--latest-limit=1")
+		}
+
+		if repo.Architecture != "" {
+			args = append(args, fmt.Sprintf("--arch=%s,noarch", repo.Architecture))
+		}
+	} else {
+		args = append(args, "--queryformat=%{relativepath}\t%{packagesize}\t%{name}.%{arch}\t%{name}-%{version}-%{release}.%{arch}\t%{epoch}\t%{version}\t%{release}\t%{buildtime}\t%{license}\t%{sourcerpm}\t%{filetime}")
+		if !repo.NewOnly {
+			args = append(args, "--show-duplicates")
+		}
+
+		if repo.Architecture != "" {
+			args = append(args, fmt.Sprintf("--archlist=%s,noarch", repo.Architecture))
+		}
+	}
+
+	cmd, args := repo.backendCommand("repoquery", args...)
+	out, err := ExecOutput(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := make([]upstreamPackage, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 11 {
+			continue
+		}
+
+		if !repo.IncludeSources && strings.HasSuffix(fields[0], ".src.rpm") {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(fields[1], 10, 64)
+		buildTime, _ := strconv.ParseInt(fields[7], 10, 64)
+		fileTime, _ := strconv.ParseInt(fields[10], 10, 64)
+		packages = append(packages, upstreamPackage{
+			Path: fields[0],
+			Size: size,
+			Name: fields[2],
+			NVRA: fields[3],
+			Version: Version{
+				Epoch:   fields[4],
+				Version: fields[5],
+				Release: fields[6],
+			},
+			BuildTime: buildTime,
+			FileTime:  fileTime,
+			License:   fields[8],
+			SourceRPM: fields[9],
+		})
+	}
+
+	if repo.yumBackend() == BackendDNF && repo.DateType == "file" {
+		times, err := upstreamFileTimes(repo)
+		if err != nil {
+			return nil, NewErrorf("Unable to read file times of upstream packages: %v", err)
+		}
+		for i := range packages {
+			packages[i].FileTime = times[filepath.Clean(packages[i].Path)]
+		}
+	}
+
+	return packages, nil
+}
+
+// upstreamFileTimes returns the time each package was added to the upstream
+// repo, as listed in its primary metadata, keyed by location
+func upstreamFileTimes(repo *Repo) (map[string]int64, error) {
+	source, repomd, err := upstreamRepomd(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return nil, NewErrorf("No primary metadata in %s", source)
+	}
+
+	primary := filepath.Join(source, data.Location.Href)
+	if repo.RsyncURL() == "" {
+		if primary, err = repo.fetchUpstreamMetadata(source, data); err != nil {
+			return nil, err
+		}
+	}
+
+	times := make(map[string]int64, 0)
+	err = EachPackage(primary, func(pkg *Package) error {
+		times[filepath.Clean(pkg.Location.Href)] = pkg.Time.File
+		return nil
+	})
+
+	return times, err
+}
+
+// localPackages returns the paths, relative to the repo root, of all
+// packages in a local repo
+func localPackages(path string) (map[string]bool, error) {
+	files, err := findPackages(path)
+	if os.IsNotExist(err) {
+		return make(map[string]bool, 0), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	packages := make(map[string]bool, len(files))
+	for _, file := range files {
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return nil, err
+		}
+		packages[rel] = true
+	}
+
+	return packages, nil
+}
+
+// PrintPlans prints a summary of the changes a sync would make
+func PrintPlans(plans []SyncPlan) {
+	var total int64
+	for _, plan := range plans {
+		Printf("%s: %d new, %d updated, %d to delete (%d local packages), %s to download\n", plan.Repo, len(plan.New), len(plan.Updated), len(plan.Deleted), plan.Local, formatBytes(plan.DownloadSize))
+		for _, path := range plan.New {
+			Dprintf("  + %s\n", path)
+		}
+		for _, path := range plan.Updated {
+			Dprintf("  ~ %s\n", path)
+		}
+		for _, path := range plan.Deleted {
+			Dprintf("  - %s\n", path)
+		}
+
+		total += plan.DownloadSize
+	}
+
+	Printf("Total download size: %s\n", formatBytes(total))
+}
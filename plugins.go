@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Plugins are external commands which extend a sync. Each is run with the
+// shell at a hook point and is sent a pluginRequest as JSON on its standard
+// input. It must exit successfully and may write a pluginResponse as JSON to
+// its standard output. Anything it writes to standard error is logged.
+//
+// The hook points are:
+//
+//	filter   before downloading, with the upstream packages of the repo; the
+//	         response may exclude packages from the sync
+//	publish  after the repo is published, with the report of its sync
+
+// pluginRequest is the JSON document sent to a plugin
+type pluginRequest struct {
+	Hook     string          `json:"hook"`
+	Repo     pluginRepo      `json:"repo"`
+	Packages []pluginPackage `json:"packages,omitempty"`
+	Report   *RepoReport     `json:"report,omitempty"`
+}
+
+// pluginRepo describes a repo to a plugin
+type pluginRepo struct {
+	ID      string            `json:"id"`
+	Path    string            `json:"path"`
+	URL     string            `json:"url,omitempty"`
+	Options map[string]string `json:"options"`
+}
+
+// pluginPackage describes an upstream package to a filter plugin
+type pluginPackage struct {
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	NVRA      string `json:"nvra"`
+	Epoch     string `json:"epoch"`
+	Version   string `json:"version"`
+	Release   string `json:"release"`
+	Size      int64  `json:"size"`
+	BuildTime int64  `json:"buildtime"`
+	License   string `json:"license"`
+	SourceRPM string `json:"sourcerpm"`
+}
+
+// pluginResponse is the JSON document a plugin may return
+type pluginResponse struct {
+	Exclude []pluginExclusion `json:"exclude"`
+	Error   string            `json:"error"`
+}
+
+// pluginExclusion is a package a filter plugin excludes from a sync, by its
+// path or name-version-release.arch
+type pluginExclusion struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// pluginName returns a short name for a plugin command, for logging
+func pluginName(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return command
+	}
+
+	return filepath.Base(fields[0])
+}
+
+// newPluginRequest returns a request for a hook of a repo
+func newPluginRequest(hook string, repo *Repo) *pluginRequest {
+	options := make(map[string]string, 0)
+	for _, opt := range repo.EffectiveOptions() {
+		if !secretKeys[opt[0]] {
+			options[opt[0]] = opt[1]
+		}
+	}
+
+	return &pluginRequest{
+		Hook: hook,
+		Repo: pluginRepo{
+			ID:      repo.ID,
+			Path:    absPath(repo.Path()),
+			URL:     repo.ObjectStoreURL(),
+			Options: options,
+		},
+	}
+}
+
+// runPlugin runs a plugin command with a request and returns its response
+func runPlugin(command string, req *pluginRequest) (*pluginResponse, error) {
+	name := pluginName(command)
+	Dprintf("Running %s plugin %s: %s\n", req.Hook, name, req.Repo.ID)
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := startChild(cmd); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		Printf("%s: %s\n", name, scanner.Text())
+	}
+
+	if err := waitChild(cmd); err != nil {
+		return nil, NewErrorf("Plugin %s failed: %v", name, err)
+	}
+
+	resp := &pluginResponse{}
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		if err := json.Unmarshal(out, resp); err != nil {
+			return nil, NewErrorf("Plugin %s returned an invalid response: %v", name, err)
+		}
+	}
+
+	if resp.Error != "" {
+		return nil, NewErrorf("Plugin %s failed: %s", name, resp.Error)
+	}
+
+	return resp, nil
+}
+
+// applyFilterPlugins runs the filter plugins of a repo with its upstream
+// packages and excludes the packages they reject from reposync, in the same
+// way as expired packages. The excluded packages are returned.
+func (c *Yumfile) applyFilterPlugins(repo *Repo) ([]upstreamPackage, error) {
+	if len(repo.Plugins) == 0 {
+		return nil, nil
+	}
+
+	packages, err := c.repoquery(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	req := newPluginRequest("filter", repo)
+	req.Packages = make([]pluginPackage, 0, len(packages))
+	for _, pkg := range packages {
+		req.Packages = append(req.Packages, pluginPackage{
+			Path:      pkg.Path,
+			Name:      pkg.Name,
+			NVRA:      pkg.NVRA,
+			Epoch:     pkg.Version.Epoch,
+			Version:   pkg.Version.Version,
+			Release:   pkg.Version.Release,
+			Size:      pkg.Size,
+			BuildTime: pkg.BuildTime,
+			License:   pkg.License,
+			SourceRPM: pkg.SourceRPM,
+		})
+	}
+
+	rejected := make(map[string]bool, 0)
+	for _, command := range repo.Plugins {
+		resp, err := runPlugin(command, req)
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		for _, ex := range resp.Exclude {
+			if !rejected[ex.Path] {
+				Dprintf("Plugin %s excluded %s: %s\n", pluginName(command), ex.Path, ex.Reason)
+				rejected[ex.Path] = true
+				n++
+			}
+		}
+
+		if n > 0 {
+			Printf("Plugin %s excluded %d packages: %s\n", pluginName(command), n, repo.ID)
+		}
+	}
+
+	excluded := make([]upstreamPackage, 0)
+	for _, pkg := range packages {
+		if rejected[pkg.Path] || rejected[pkg.NVRA] {
+			excluded = append(excluded, pkg)
+		}
+	}
+
+	if len(excluded) == 0 {
+		return nil, nil
+	}
+
+	if err := c.excludeUpstream(repo, excluded); err != nil {
+		return nil, err
+	}
+
+	return excluded, nil
+}
+
+// runPublishPlugins runs the publish plugins of a repo after it is published,
+// with the report of its sync
+func runPublishPlugins(repo *Repo, report *RepoReport) error {
+	if len(repo.Plugins) == 0 {
+		return nil
+	}
+
+	req := newPluginRequest("publish", repo)
+	req.Report = report
+	for _, command := range repo.Plugins {
+		if _, err := runPlugin(command, req); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Preset is a named upstream URL layout for a family of repos. The URL may
+// reference ${release}, ${major} (the release up to the first '.' or '-'),
+// ${arch} and ${repo}.
+type Preset struct {
+	Name        string
+	URL         string
+	DefaultRepo string
+	Description string
+}
+
+// presets are the upstream URL layouts which may be selected with the preset
+// option
+var presets = map[string]Preset{
+	"almalinux": {
+		URL:         "https://repo.almalinux.org/almalinux/${release}/${repo}/${arch}/os/",
+		DefaultRepo: "BaseOS",
+		Description: "AlmaLinux current releases",
+	},
+	"almalinux-vault": {
+		URL:         "https://vault.almalinux.org/${release}/${repo}/${arch}/os/",
+		DefaultRepo: "BaseOS",
+		Description: "AlmaLinux archived point releases",
+	},
+	"centos-vault": {
+		URL:         "https://vault.centos.org/${release}/${repo}/${arch}/",
+		DefaultRepo: "os",
+		Description: "CentOS archived releases",
+	},
+	"centos-stream-sig": {
+		URL:         "https://mirror.stream.centos.org/SIGs/${release}/${repo}/${arch}/",
+		Description: "CentOS Stream Special Interest Group repos (e.g. preset_repo=cloud/openstack-zed)",
+	},
+	"epel": {
+		URL:         "https://dl.fedoraproject.org/pub/epel/${release}/${repo}/${arch}/",
+		DefaultRepo: "Everything",
+		Description: "EPEL current releases",
+	},
+	"epel-archive": {
+		URL:         "https://dl.fedoraproject.org/pub/archive/epel/${release}/${repo}/${arch}/",
+		DefaultRepo: "Everything",
+		Description: "EPEL archived point releases",
+	},
+	"epel-testing": {
+		URL:         "https://dl.fedoraproject.org/pub/epel/testing/${release}/${repo}/${arch}/",
+		DefaultRepo: "Everything",
+		Description: "EPEL testing updates",
+	},
+	"oracle": {
+		URL:         "https://yum.oracle.com/repo/OracleLinux/OL${major}/${repo}/${arch}/",
+		DefaultRepo: "baseos/latest",
+		Description: "Oracle Linux (e.g. preset_repo=appstream or UEKR7)",
+	},
+	"rocky": {
+		URL:         "https://dl.rockylinux.org/pub/rocky/${release}/${repo}/${arch}/os/",
+		DefaultRepo: "BaseOS",
+		Description: "Rocky Linux current releases",
+	},
+	"rocky-staging": {
+		URL:         "https://dl.rockylinux.org/stg/rocky/${release}/${repo}/${arch}/os/",
+		DefaultRepo: "BaseOS",
+		Description: "Rocky Linux staging tree",
+	},
+	"rocky-vault": {
+		URL:         "https://dl.rockylinux.org/vault/rocky/${release}/${repo}/${arch}/os/",
+		DefaultRepo: "BaseOS",
+		Description: "Rocky Linux archived point releases",
+	},
+}
+
+// Presets returns all presets, sorted by name
+func Presets() []Preset {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]Preset, len(names))
+	for i, name := range names {
+		list[i] = presets[name]
+		list[i].Name = name
+	}
+
+	return list
+}
+
+// Expand returns the upstream base URL of the preset for the given release,
+// architecture and repo.
+func (c Preset) Expand(release, arch, repo string) string {
+	major := release
+	if i := strings.IndexAny(major, ".-"); i >= 0 {
+		major = major[:i]
+	}
+
+	return strings.NewReplacer(
+		"${release}", release,
+		"${major}", major,
+		"${arch}", arch,
+		"${repo}", repo,
+	).Replace(c.URL)
+}
+
+// applyPreset sets the base URL of a repo which uses a preset
+func (c *Repo) applyPreset() error {
+	if c.Preset == "" {
+		return nil
+	}
+
+	preset, ok := presets[c.Preset]
+	if !ok {
+		return NewErrorf("Unknown preset for '%s': %s (in %s:%d)", c.ID, c.Preset, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	if c.Parameters["baseurl"] != "" || c.Parameters["mirrorlist"] != "" || c.Parameters["metalink"] != "" {
+		return NewErrorf("Preset for '%s' conflicts with its baseurl, mirrorlist or metalink (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	if c.Release == "" {
+		return NewErrorf("Preset %s for '%s' requires a release (in %s:%d)", c.Preset, c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	repo := c.PresetRepo
+	if repo == "" {
+		repo = preset.DefaultRepo
+	}
+
+	if repo == "" && strings.Contains(preset.URL, "${repo}") {
+		return NewErrorf("Preset %s for '%s' requires preset_repo (in %s:%d)", c.Preset, c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	arch := c.Architecture
+	if arch == "" {
+		arch = hostArch()
+	}
+
+	c.Parameters["baseurl"] = preset.Expand(c.Release, arch, repo)
+	Dprintf("Using preset %s for %s: %s\n", c.Preset, c.ID, c.Parameters["baseurl"])
+
+	return nil
+}
+
+// PrintPresets prints the name, description and URL layout of each preset
+func PrintPresets() {
+	for _, preset := range Presets() {
+		fmt.Printf("%-18s %s\n", preset.Name, preset.Description)
+		fmt.Printf("%-18s %s\n", "", preset.URL)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressTTYInterval is how often the progress display is redrawn on a
+// terminal
+const progressTTYInterval = time.Second
+
+// progressLineInterval is how often a progress line is printed when STDOUT is
+// not a terminal
+const progressLineInterval = 30 * time.Second
+
+// syncProgress reports the download progress of a sync run. Downloads are
+// made by reposync or rsync, so progress is measured by polling the size of
+// each package scheduled for download in the local repo.
+type syncProgress struct {
+	tty      bool
+	interval time.Duration
+	start    time.Time
+	repos    int
+	done     int
+	bytes    int64
+	elapsed  time.Duration // time spent on finished repos
+
+	mu        sync.Mutex
+	repo      string
+	root      string
+	downloads []upstreamPackage
+	total     int64
+	received  int64
+	rate      float64
+	drawn     bool
+	stop      chan bool
+	wg        sync.WaitGroup
+}
+
+// isTerminal returns true if a file is a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newSyncProgress returns a progress display for a run of the given number of
+// repos. A live display is drawn if STDOUT is a terminal; otherwise a line is
+// printed periodically.
+func newSyncProgress(repos int) *syncProgress {
+	c := &syncProgress{
+		tty:      logFile == nil && logSinkTarget == nil && LogFormat == "text" && !DebugMode && isTerminal(os.Stdout),
+		interval: progressLineInterval,
+		start:    time.Now(),
+		repos:    repos,
+	}
+
+	if c.tty {
+		c.interval = progressTTYInterval
+	}
+
+	return c
+}
+
+// Start begins reporting the downloads of a repo in the given plan
+func (c *syncProgress) Start(repo *Repo, plan *SyncPlan) {
+	if c == nil || plan == nil || len(plan.downloads) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.repo = repo.ID
+	c.root = repo.downloadPath()
+	c.downloads = plan.downloads
+	c.total = plan.DownloadSize
+	c.received = 0
+	c.rate = 0
+	c.stop = make(chan bool)
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go c.poll()
+}
+
+// Stop stops reporting the downloads of the current repo
+func (c *syncProgress) Stop() {
+	if c == nil || c.stop == nil {
+		return
+	}
+
+	close(c.stop)
+	c.wg.Wait()
+	c.stop = nil
+	c.clear()
+}
+
+// RepoDone records that a repo has finished, with the number of bytes
+// downloaded for it
+func (c *syncProgress) RepoDone(report *RepoReport) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done++
+	c.bytes += report.Bytes
+	c.elapsed += report.Duration
+}
+
+// poll measures the progress of the current repo until it is stopped
+func (c *syncProgress) poll() {
+	defer c.wg.Done()
+
+	// measure often enough for a stable transfer rate, but only draw at the
+	// display interval
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	last := time.Now()
+	drawn := time.Now()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-tick.C:
+			c.measure(now.Sub(last))
+			last = now
+			if now.Sub(drawn) >= c.interval {
+				c.draw()
+				drawn = now
+			}
+		}
+	}
+}
+
+// measure updates the bytes received for the current repo and the transfer
+// rate, smoothed over the last few seconds
+func (c *syncProgress) measure(d time.Duration) {
+	c.mu.Lock()
+	downloads, root := c.downloads, c.root
+	c.mu.Unlock()
+
+	var received int64
+	for _, pkg := range downloads {
+		if fi, err := os.Stat(filepath.Join(root, pkg.Path)); err == nil {
+			if fi.Size() < pkg.Size {
+				received += fi.Size()
+			} else {
+				received += pkg.Size
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rate := float64(received-c.received) / d.Seconds()
+	if c.rate == 0 {
+		c.rate = rate
+	} else {
+		c.rate = 0.8*c.rate + 0.2*rate
+	}
+	c.received = received
+}
+
+// current returns the package currently being downloaded, if any
+func (c *syncProgress) current() string {
+	for _, pkg := range c.downloads {
+		fi, err := os.Stat(filepath.Join(c.root, pkg.Path))
+		if err == nil && fi.Size() < pkg.Size {
+			return filepath.Base(pkg.Path)
+		}
+	}
+
+	return ""
+}
+
+// remaining returns the estimated time to finish the current repo at the
+// current transfer rate
+func (c *syncProgress) remaining() time.Duration {
+	if c.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(c.total-c.received) / c.rate * float64(time.Second))
+}
+
+// draw prints the progress of the current repo and of the run
+func (c *syncProgress) draw() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	percent := 0.0
+	if c.total > 0 {
+		percent = float64(c.received) * 100 / float64(c.total)
+	}
+
+	repoLine := fmt.Sprintf("%s: %s of %s (%.0f%%) at %s/s", c.repo, formatBytes(c.received), formatBytes(c.total), percent, formatBytes(int64(c.rate)))
+	runLine := fmt.Sprintf("Repo %d of %d, %s downloaded in %v", c.done+1, c.repos, formatBytes(c.bytes+c.received), time.Since(c.start).Round(time.Second))
+	if c.rate > 0 {
+		repoLine += fmt.Sprintf(", ETA %v", c.remaining().Round(time.Second))
+
+		// the remaining repos are estimated to take as long as the finished
+		// ones did on average
+		if c.done > 0 {
+			eta := c.remaining() + c.elapsed/time.Duration(c.done)*time.Duration(c.repos-c.done-1)
+			runLine += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+		}
+	}
+
+	if !c.tty {
+		Printf("%s; %s\n", repoLine, runLine)
+		return
+	}
+
+	if file := c.current(); file != "" {
+		repoLine += " - " + file
+	}
+
+	if c.drawn {
+		fmt.Fprint(os.Stdout, "\033[1A")
+	}
+	fmt.Fprintf(os.Stdout, "\r\033[K%s\n\r\033[K%s", truncateLine(repoLine), truncateLine(runLine))
+	c.drawn = true
+}
+
+// clear removes the progress display from a terminal
+func (c *syncProgress) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tty && c.drawn {
+		fmt.Fprint(os.Stdout, "\r\033[K\033[1A\r\033[K")
+	}
+	c.drawn = false
+}
+
+// truncateLine shortens a line to fit the terminal width given by the COLUMNS
+// environment variable, or 80 columns
+func truncateLine(s string) string {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width < 20 {
+		width = 80
+	}
+
+	if len(s) < width {
+		return s
+	}
+
+	return strings.TrimSpace(s[:width-4]) + "..."
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProxyMetadataExpiry is how long repomd.xml is served from the cache
+// of a pull-through repo before it is refreshed from upstream, unless the
+// repo sets metadata_expire
+const defaultProxyMetadataExpiry = 6 * time.Hour
+
+// errNotInRepo is returned when a pull-through repo is asked for a file which
+// its upstream metadata does not list
+var errNotInRepo = NewErrorf("File not found in repo metadata")
+
+// pullThrough fetches the files of a repo from its upstream the first time
+// they are requested and caches them in the repo's local path. Packages are
+// only fetched if they are listed in the upstream metadata, and are verified
+// against their metadata checksum, and their GPG signature if gpgcheck is
+// enabled, before they are served.
+type pullThrough struct {
+	repo     *Repo
+	root     string
+	urls     []string
+	expiry   time.Duration
+	gpgcheck bool
+
+	mu        sync.Mutex
+	locks     map[string]*sync.Mutex
+	primary   string
+	checksums map[string]Checksum
+}
+
+// newPullThrough returns a pull-through cache for a repo
+func newPullThrough(repo *Repo) (*pullThrough, error) {
+	urls, err := repo.UpstreamURLs()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(urls) == 0 {
+		return nil, NewErrorf("No upstream URL found for pull-through repo '%s'", repo.ID)
+	}
+
+	expiry := defaultProxyMetadataExpiry
+	if s := repo.Parameters["metadata_expire"]; s != "" {
+		if d, err := parseMetadataExpire(s); err != nil {
+			return nil, NewErrorf("Invalid metadata_expire for '%s': %s", repo.ID, s)
+		} else {
+			expiry = d
+		}
+	}
+
+	gpgcheck, _ := strToBool(repo.Parameters["gpgcheck"])
+	return &pullThrough{
+		repo:     repo,
+		root:     repo.Path(),
+		urls:     urls,
+		expiry:   expiry,
+		gpgcheck: gpgcheck || len(repo.Fingerprints) > 0,
+		locks:    make(map[string]*sync.Mutex, 0),
+	}, nil
+}
+
+// parseMetadataExpire parses a yum metadata_expire value, which is a number of
+// seconds, a number with a d, h or m suffix, or "never"
+func parseMetadataExpire(s string) (time.Duration, error) {
+	switch {
+	case s == "never" || s == "-1":
+		return time.Duration(1<<63 - 1), nil
+
+	case strings.HasSuffix(s, "d"):
+		d, err := time.ParseDuration(strings.TrimSuffix(s, "d") + "h")
+		return d * 24, err
+
+	case strings.HasSuffix(s, "h"), strings.HasSuffix(s, "m"):
+		return time.ParseDuration(s)
+	}
+
+	return time.ParseDuration(s + "s")
+}
+
+// lock returns a locked mutex for a file so it is only fetched once when
+// requested concurrently
+func (c *pullThrough) lock(rel string) *sync.Mutex {
+	c.mu.Lock()
+	l, ok := c.locks[rel]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[rel] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l
+}
+
+// Fetch ensures a file of the repo is cached locally, downloading it from
+// upstream if required
+func (c *pullThrough) Fetch(rel string) error {
+	l := c.lock(rel)
+	defer l.Unlock()
+
+	path := filepath.Join(c.root, filepath.FromSlash(rel))
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		return nil
+	}
+
+	// repomd.xml and its signature are refreshed when they expire; all other
+	// files are immutable once cached
+	if strings.HasPrefix(rel, "repodata/repomd.xml") {
+		if err == nil && time.Since(fi.ModTime()) < c.expiry {
+			return nil
+		}
+
+		if derr := c.download(rel, path, nil); derr != nil {
+			if err != nil {
+				return derr
+			}
+
+			// keep serving the cached metadata while upstream is unavailable
+			Warnf(derr, "Error refreshing %s for %s", rel, c.repo.ID)
+		}
+
+		return nil
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	checksum, err := c.checksum(rel)
+	if err != nil {
+		return err
+	}
+
+	return c.download(rel, path, checksum)
+}
+
+// checksum returns the expected checksum of a file from the repo metadata
+func (c *pullThrough) checksum(rel string) (*Checksum, error) {
+	repomd, err := c.repomd()
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(rel, "repodata/") {
+		for _, data := range repomd.Data {
+			if data.Location.Href == rel {
+				return &data.Checksum, nil
+			}
+		}
+
+		return nil, errNotInRepo
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return nil, NewErrorf("No primary metadata found for '%s'", c.repo.ID)
+	}
+
+	c.mu.Lock()
+	loaded := c.primary == data.Location.Href
+	c.mu.Unlock()
+
+	if !loaded {
+		if err := c.Fetch(data.Location.Href); err != nil {
+			return nil, err
+		}
+
+		checksums := make(map[string]Checksum, 0)
+		err := EachPackage(filepath.Join(c.root, filepath.FromSlash(data.Location.Href)), func(pkg *Package) error {
+			checksums[pkg.Location.Href] = pkg.Checksum
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		c.primary, c.checksums = data.Location.Href, checksums
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if checksum, ok := c.checksums[rel]; ok {
+		return &checksum, nil
+	}
+
+	return nil, errNotInRepo
+}
+
+// repomd returns the cached repomd.xml of the repo, fetching it if it has
+// expired
+func (c *pullThrough) repomd() (*Repomd, error) {
+	if err := c.Fetch("repodata/repomd.xml"); err != nil {
+		return nil, err
+	}
+
+	return ReadRepomd(filepath.Join(c.root, "repodata", "repomd.xml"))
+}
+
+// download fetches a file from the first upstream which has it and moves it
+// into place once it is verified. Repos with staging_dir download into their
+// staging directory, so the served tree never holds partial files.
+func (c *pullThrough) download(rel, path string, checksum *Checksum) error {
+	part := path + partFileSuffix
+	if staging := c.repo.downloadStagingDir(); staging != "" {
+		part = filepath.Join(staging, filepath.FromSlash(rel)) + partFileSuffix
+		if err := os.MkdirAll(filepath.Dir(part), 0755); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		// an interrupted download is kept so it can be resumed
+		if !interrupted() {
+			os.Remove(part)
+		}
+	}()
+
+	var err error
+	baseurl := ""
+	for i, base := range c.urls {
+		// blacklisted mirrors are only tried as a last resort
+		if i < len(c.urls)-1 && mirrorBlacklisted(c.repo, base) {
+			continue
+		}
+
+		baseurl = strings.TrimSuffix(base, "/")
+		url := baseurl + "/" + rel
+		Dprintf("Fetching %s\n", url)
+
+		// only files which can be verified are resumed or downloaded in
+		// segments. Preallocated segmented downloads cannot be resumed.
+		discardSegmented(part)
+		_, statErr := os.Stat(part)
+		switch {
+		case checksum == nil:
+			_, err = download(c.repo, url, part)
+		case statErr == nil:
+			_, err = resumeDownload(c.repo, url, part)
+		default:
+			_, err = downloadSegmented(c.repo, url, part)
+		}
+		if err == nil {
+			break
+		}
+		recordMirrorFailure(c.repo, baseurl, err, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	if checksum != nil {
+		sum, err := checksumFile(part, checksum.Type)
+		if err != nil {
+			return err
+		}
+
+		if sum != strings.ToLower(checksum.Value) {
+			err := NewErrorf("Checksum mismatch for %s from upstream of '%s'", rel, c.repo.ID)
+			recordMirrorFailure(c.repo, baseurl, err, true)
+			return err
+		}
+	}
+
+	if c.gpgcheck && strings.HasSuffix(rel, ".rpm") {
+		bad, err := checkSignatures(c.repo, []string{part})
+		if err != nil {
+			return err
+		}
+
+		if len(bad) > 0 {
+			return NewErrorf("Invalid signature for %s from upstream of '%s'", rel, c.repo.ID)
+		}
+	}
+
+	Printf("Cached %s for %s\n", rel, c.repo.ID)
+	return moveFile(part, path)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PublishResult describes the outcome of publishing a repo to one target
+type PublishResult struct {
+	Target   string
+	Attempts int
+	Duration time.Duration
+	Error    error
+}
+
+// bwLimitPattern matches an rsync bandwidth limit such as 500 (KiB/s) or 5M
+var bwLimitPattern = regexp.MustCompile("^[0-9]+(\\.[0-9]+)?[KkMmGg]?$")
+
+// parsePublishTargets parses a comma separated list of publish targets
+func parsePublishTargets(s string) []string {
+	targets := make([]string, 0)
+	for _, target := range strings.Split(s, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
+
+// publish copies a synchronized repo to all of its publish targets
+// concurrently and prints the status of each target. A repo whose localpath is
+// in object storage is uploaded there from its staging directory first. An
+// error is returned if any target failed after all retries.
+func (c *Yumfile) publish(repo *Repo) error {
+	if url := repo.ObjectStoreURL(); url != "" {
+		Printf("Uploading repo: %s -> %s\n", repo.ID, url)
+		if result := publishWithRetries(repo, url); result.Error != nil {
+			return NewErrorf("Failed to upload to %s after %d attempts: %v", url, result.Attempts, result.Error)
+		}
+	}
+
+	if len(repo.PublishTargets) == 0 {
+		return nil
+	}
+
+	Printf("Publishing repo: %s\n", repo.ID)
+
+	results := make([]PublishResult, len(repo.PublishTargets))
+	var wg sync.WaitGroup
+	for i, target := range repo.PublishTargets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			results[i].Target = target
+			defer RecoverError(&results[i].Error, "Unexpected error publishing to %s", target)
+			results[i] = publishWithRetries(repo, target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	// print summary
+	failed := 0
+	for _, result := range results {
+		if result.Error != nil {
+			failed++
+			Errorf(result.Error, "Failed to publish %s to %s after %d attempts", repo.ID, result.Target, result.Attempts)
+		} else {
+			Printf("  %s: OK (%d attempts, %v)\n", result.Target, result.Attempts, result.Duration)
+		}
+	}
+
+	if failed > 0 {
+		return NewErrorf("%d of %d publish targets failed", failed, len(results))
+	}
+
+	return nil
+}
+
+// publishWithRetries publishes a repo to a single target, retrying failed
+// attempts up to the repo's configured retry count.
+func publishWithRetries(repo *Repo, target string) PublishResult {
+	result := PublishResult{Target: target}
+	start := time.Now()
+	for result.Attempts <= repo.PublishRetries {
+		result.Attempts++
+		if result.Error = publishTarget(repo, target); result.Error == nil {
+			break
+		}
+
+		Dprintf("Publish attempt %d of %s to %s failed: %v\n", result.Attempts, repo.ID, target, result.Error)
+	}
+	result.Duration = time.Since(start)
+
+	return result
+}
+
+// publishTarget copies a local repo directory to a publish target. S3 targets
+// (s3://bucket/prefix) are published with the AWS CLI; all other targets (local
+// paths, rsync:// URLs and [user@]host:path) are published with rsync. Only
+// changed files are transferred, and rsync moves them into place and deletes
+// superseded files once the whole transfer has completed, so clients of the
+// target never see metadata which references missing packages.
+func publishTarget(repo *Repo, target string) error {
+	src := strings.TrimSuffix(repo.Path(), "/") + "/"
+
+	if isObjectStoreURL(target) {
+		return publishS3(repo, src, target)
+	}
+
+	// create local targets
+	target = strings.TrimPrefix(target, "file://")
+	if strings.HasPrefix(target, "/") {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	}
+
+	args := []string{
+		"-a",
+		"--delete-delay",
+		"--delay-updates",
+		"--exclude=.repodata/",
+		"--exclude=.olddata/",
+		"--exclude=*" + partFileSuffix,
+		"--exclude=*" + partFileSuffix + ".segments",
+		"--exclude=" + repoLockName,
+	}
+
+	if repo.PublishBwLimit != "" {
+		args = append(args, "--bwlimit="+repo.PublishBwLimit)
+	}
+
+	return Exec("rsync", append(args, src, strings.TrimSuffix(target, "/")+"/")...)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Package query fields matched by a PackageQuery
+const (
+	QueryName     = "name"
+	QueryProvides = "provides"
+	QueryRequires = "requires"
+)
+
+// PackageQuery selects packages in the local metadata of mirrored repos. The
+// pattern is a shell glob; an empty pattern matches every package.
+type PackageQuery struct {
+	Pattern string
+	Field   string
+}
+
+// PackageMatch is a package found by a PackageQuery
+type PackageMatch struct {
+	Repo    string   `json:"repo"`
+	NEVRA   string   `json:"nevra"`
+	Name    string   `json:"name"`
+	Epoch   string   `json:"epoch"`
+	Version string   `json:"version"`
+	Release string   `json:"release"`
+	Arch    string   `json:"arch"`
+	Size    int64    `json:"size"`
+	Path    string   `json:"path"`
+	Summary string   `json:"summary"`
+	Matched []string `json:"matched,omitempty"`
+}
+
+// matchName returns true if a glob pattern matches the name of a package, in
+// any of the forms accepted by yum: name, name.arch, name-version,
+// name-version-release, name-version-release.arch and
+// name-epoch:version-release.arch
+func matchName(pattern string, pkg *Package) bool {
+	v := pkg.Version
+	names := []string{
+		pkg.Name,
+		pkg.Name + "." + pkg.Arch,
+		pkg.Name + "-" + v.Version,
+		pkg.Name + "-" + v.Version + "-" + v.Release,
+		pkg.Name + "-" + v.Version + "-" + v.Release + "." + pkg.Arch,
+		pkg.NEVRA(),
+	}
+
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchCapabilities returns the capabilities whose names match a glob
+// pattern
+func matchCapabilities(pattern string, caps []Capability) []string {
+	matched := make([]string, 0)
+	for _, c := range caps {
+		if ok, _ := path.Match(pattern, c.Name); ok {
+			matched = append(matched, c.String())
+		}
+	}
+
+	return matched
+}
+
+// Match returns true if a package matches the query, and the capabilities or
+// files which matched for provides and requires queries
+func (c *PackageQuery) Match(pkg *Package) (bool, []string) {
+	if c.Pattern == "" {
+		return true, nil
+	}
+
+	switch c.Field {
+	case QueryProvides:
+		matched := matchCapabilities(c.Pattern, pkg.Format.Provides)
+		for _, file := range pkg.Format.Files {
+			if ok, _ := path.Match(c.Pattern, file); ok {
+				matched = append(matched, file)
+			}
+		}
+		return len(matched) > 0, matched
+
+	case QueryRequires:
+		matched := matchCapabilities(c.Pattern, pkg.Format.Requires)
+		return len(matched) > 0, matched
+	}
+
+	return matchName(c.Pattern, pkg), nil
+}
+
+// Validate returns an error if the query's pattern is not a valid glob
+func (c *PackageQuery) Validate() error {
+	switch c.Field {
+	case QueryName, QueryProvides, QueryRequires:
+	default:
+		return NewErrorf("Invalid query field: %s", c.Field)
+	}
+
+	if _, err := path.Match(c.Pattern, ""); err != nil {
+		return NewErrorf("Invalid pattern: %s", c.Pattern)
+	}
+
+	return nil
+}
+
+// QueryRepo returns the packages in the local metadata of a repo which match
+// a query, sorted by name, version and architecture
+func QueryRepo(repo *Repo, query *PackageQuery) ([]PackageMatch, error) {
+	repomd, err := ReadRepomd(filepath.Join(repo.Path(), "repodata", "repomd.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return nil, NewErrorf("No primary metadata found in %s", repo.Path())
+	}
+
+	matches := make([]PackageMatch, 0)
+	err = EachPackage(filepath.Join(repo.Path(), data.Location.Href), func(pkg *Package) error {
+		ok, matched := query.Match(pkg)
+		if !ok {
+			return nil
+		}
+
+		matches = append(matches, PackageMatch{
+			Repo:    repo.ID,
+			NEVRA:   pkg.NEVRA(),
+			Name:    pkg.Name,
+			Epoch:   pkg.Version.Epoch,
+			Version: pkg.Version.Version,
+			Release: pkg.Version.Release,
+			Arch:    pkg.Arch,
+			Size:    pkg.Size.Package,
+			Path:    filepath.Clean(pkg.Location.Href),
+			Summary: pkg.Summary,
+			Matched: matched,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(packageMatchesByVersion(matches))
+	return matches, nil
+}
+
+// PrintPackageMatches prints one package per line with its repo and size,
+// followed by the capabilities which matched a provides or requires query
+func PrintPackageMatches(matches []PackageMatch) {
+	for _, match := range matches {
+		fmt.Printf("%-30s %-60s %10s\n", match.Repo, match.NEVRA, formatBytes(match.Size))
+		for _, s := range match.Matched {
+			fmt.Printf("  %s\n", s)
+		}
+	}
+}
+
+// version returns the epoch, version and release of a matched package
+func (c *PackageMatch) version() Version {
+	return Version{Epoch: c.Epoch, Version: c.Version, Release: c.Release}
+}
+
+// packageMatchesByVersion sorts package matches by name, version and
+// architecture
+type packageMatchesByVersion []PackageMatch
+
+func (c packageMatchesByVersion) Len() int      { return len(c) }
+func (c packageMatchesByVersion) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+func (c packageMatchesByVersion) Less(i, j int) bool {
+	if c[i].Name != c[j].Name {
+		return c[i].Name < c[j].Name
+	}
+	if n := compareVersions(c[i].version(), c[j].version()); n != 0 {
+		return n < 0
+	}
+	return c[i].Arch < c[j].Arch
+}
@@ -1,36 +1,934 @@
 package main
 
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type Repo struct {
-	ID             string
-	Parameters     map[string]string
-	CachePath      string
-	EnablePlugins  bool
-	IncludeSources bool
-	LocalPath      string
-	NewOnly        bool
-	DeleteRemoved  bool
-	GPGCheck       bool
-	Architecture   string
-	YumfilePath    string
-	YumfileLineNo  int
-	Checksum       string
-	Groupfile      string
+	ID                string
+	Parameters        map[string]string
+	CachePath         string
+	EnablePlugins     bool
+	IncludeSources    bool
+	LocalPath         string
+	NewOnly           bool
+	DeleteRemoved     bool
+	GPGCheck          bool
+	Architecture      string
+	Backend           string
+	CreaterepoTool    string
+	Zchunk            bool
+	CompressType      string
+	RetainOldMetadata int
+	RemoteTime        bool
+	MaxUpstreamAge    time.Duration
+	YumfilePath       string
+	YumfileLineNo     int
+	Checksum          string
+	Groupfile         string
+	DebugInfo         bool
+	DebugInfoURL      string
+	DebugInfoFor      string
+	Fingerprints      []string
+	PublishTargets    []string
+	PublishRetries    int
+	PublishBwLimit    string
+	SegmentThreshold  int64
+	DownloadSegments  int
+	Optional          bool
+	Disabled          bool
+	DeltaHistory      int
+	ManifestSignKey   string
+	ConnectTimeout    time.Duration
+	SyncTimeout       time.Duration
+	MaxConnsPerHost   int
+	HTTP2             bool
+	FastestMirror     bool
+	Mirrors           []string // upstream mirrors ranked by fastestmirror for the current sync
+	Retain            time.Duration
+	MinDate           string
+	MaxDate           string
+	DateType          string
+	AsOf              string
+	PinRevision       string
+	HistoryURL        string
+	Preset            string
+	PresetRepo        string
+	Release           string
+	SnapshotPath      string
+	StatePath         string
+	SnapshotRetention int
+	SmokeTest         []string
+	SmokeTestWith     []string
+	RequireClosure    bool
+	ClosureWith       []string
+	Tags              []string
+	ServePrefix       string
+	Entitlement       bool
+	EntitlementLabel  string
+	EntitlementPath   string
+	EntitlementCDN    string
+	StagingPath       string
+	DownloadStaging   string
+	FileMode          os.FileMode
+	DirMode           os.FileMode
+	Owner             string
+	Group             string
+	SELinuxContext    string
+	S3Endpoint        string
+	PullThrough       bool
+	ServeHtpasswd     string
+	ServeTokens       string
+	ServeVerify       bool
+	Schedule          *cronSchedule
+	AllowedWindow     *syncWindow
+	Interval          time.Duration
+	PreSync           string
+	PostSync          string
+	Plugins           []string
+	MergeInto         string
+	MergePriority     int
+	MergeConflict     string
+	MergeSources      []string
+	Splits            []RepoSplit
+	MinFreeSpace      int64
+	CacheMaxSize      int64
+	StorePath         string
+	RsyncUpstream     string // rsync URL of a repo whose baseurl points at its local metadata
+	Options           map[string]string
+	Inherited         map[string]bool
+}
+
+// secretKeys are the repo options whose values are not printed
+var secretKeys = map[string]bool{
+	"password":       true,
+	"proxy_password": true,
+}
+
+// metadataChecksumTypes are the checksum types which createrepo may use in
+// generated metadata. sha256 is the default; sha1 is only read by the yum of
+// EL5 clients.
+var metadataChecksumTypes = map[string]bool{
+	"sha":    true,
+	"sha1":   true,
+	"sha256": true,
+	"sha384": true,
+	"sha512": true,
+}
+
+// metadataChecksumTypeNames returns the supported metadata checksum types as
+// a sorted list, such as "sha, sha1 or sha256", for error messages
+func metadataChecksumTypeNames() string {
+	names := make([]string, 0, len(metadataChecksumTypes))
+	for name := range metadataChecksumTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// inheritableKeys are the repo options which may also be set in the global
+// section of a Yumfile. Global values apply to every repo which does not set
+// the same option explicitly.
+var inheritableKeys = map[string]bool{
+	"allowed_window":     true,
+	"arch":               true,
+	"backend":            true,
+	"bandwidth":          true,
+	"cache_max_size":     true,
+	"cachepath":          true,
+	"checksum":           true,
+	"checksum_type":      true,
+	"compress_type":      true,
+	"createrepo_tool":    true,
+	"date_type":          true,
+	"deleteremoved":      true,
+	"delta_history":      true,
+	"dir_mode":           true,
+	"download_segments":  true,
+	"entitlement":        true,
+	"entitlement_cdn":    true,
+	"entitlement_path":   true,
+	"exclude":            true,
+	"file_mode":          true,
+	"gpgcheck":           true,
+	"gpgkey":             true,
+	"group":              true,
+	"includepkgs":        true,
+	"interval":           true,
+	"ip_resolve":         true,
+	"manifest_sign_key":  true,
+	"merge_conflict":     true,
+	"max_date":           true,
+	"max_upstream_age":   true,
+	"min_date":           true,
+	"min_free_space":     true,
+	"minrate":            true,
+	"newonly":            true,
+	"optional":           true,
+	"owner":              true,
+	"password":           true,
+	"postsync":           true,
+	"preset":             true,
+	"presync":            true,
+	"pin_fingerprint":    true,
+	"plugin":             true,
+	"proxy":              true,
+	"proxy_password":     true,
+	"proxy_username":     true,
+	"publish_bwlimit":    true,
+	"publish_retries":    true,
+	"release":            true,
+	"releasever":         true,
+	"remote_time":        true,
+	"repo_gpgcheck":      true,
+	"retain":             true,
+	"retain_old_md":      true,
+	"require_closure":    true,
+	"retries":            true,
+	"s3_endpoint":        true,
+	"schedule":           true,
+	"segment_threshold":  true,
+	"selinux_context":    true,
+	"serve_htpasswd":     true,
+	"serve_tokens":       true,
+	"serve_verify":       true,
+	"snapshot_retention": true,
+	"sources":            true,
+	"store_path":         true,
+	"sslcacert":          true,
+	"sslclientcert":      true,
+	"sslclientkey":       true,
+	"sslverify":          true,
+	"staging_dir":        true,
+	"sync_timeout":       true,
+	"throttle":           true,
+	"timeout":            true,
+	"username":           true,
+	"zck":                true,
+
+	// HTTP connection options
+	"connect_timeout":          true,
+	"fastestmirror":            true,
+	"http2":                    true,
+	"max_connections_per_host": true,
 }
 
 func NewRepo() *Repo {
 	return &Repo{
-		Parameters: make(map[string]string, 0),
+		Parameters:       make(map[string]string, 0),
+		PublishRetries:   2,
+		SegmentThreshold: DefaultSegmentThreshold,
+		DownloadSegments: DefaultDownloadSegments,
+		MergePriority:    DefaultMergePriority,
+		MergeConflict:    MergeConflictPriority,
+		DateType:         "build",
+		ConnectTimeout:   DefaultConnectTimeout,
+		MaxConnsPerHost:  DefaultMaxConnectionsPerHost,
+		HTTP2:            true,
+		Options:          make(map[string]string, 0),
+		Inherited:        make(map[string]bool, 0),
 	}
 }
 
+// Set sets a repo option from a Yumfile key/value pair. Unrecognized keys are
+// passed through to yum.
+func (c *Repo) Set(key, val string) error {
+	switch key {
+	case "localpath":
+		c.LocalPath = val
+
+	case "arch":
+		c.Architecture = val
+
+	case "backend":
+		if b, err := parseBackend(val); err != nil {
+			return err
+		} else {
+			c.Backend = b
+		}
+
+	case "cachepath":
+		c.CachePath = val
+
+	case "newonly":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.NewOnly = b
+		}
+
+	case "sources":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.IncludeSources = b
+		}
+
+	case "deleteremoved":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.DeleteRemoved = b
+		}
+
+	case "gpgcheck":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.GPGCheck = b
+
+			// pass through to yum
+			c.Parameters[key] = val
+		}
+
+	case "checksum", "checksum_type":
+		if !metadataChecksumTypes[strings.ToLower(val)] {
+			return NewErrorf("Unsupported checksum type: %s (expected %s)", val, metadataChecksumTypeNames())
+		}
+		c.Checksum = strings.ToLower(val)
+
+	case "createrepo_tool":
+		if t, err := parseCreaterepoTool(val); err != nil {
+			return err
+		} else {
+			c.CreaterepoTool = t
+		}
+
+	case "zck":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.Zchunk = b
+		}
+
+	case "compress_type":
+		if t, err := parseCompressType(val); err != nil {
+			return err
+		} else {
+			c.CompressType = t
+		}
+
+	case "retain_old_md":
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return NewErrorf("Invalid retain_old_md count: %s", val)
+		} else {
+			c.RetainOldMetadata = i
+		}
+
+	case "max_upstream_age":
+		if d, err := parseRetention(val); err != nil {
+			return NewErrorf("Invalid max_upstream_age: %s", val)
+		} else {
+			c.MaxUpstreamAge = d
+		}
+
+	case "remote_time":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.RemoteTime = b
+		}
+
+	case "groupfile":
+		c.Groupfile = val
+
+	case "debuginfo":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.DebugInfo = b
+		}
+
+	case "debuginfourl":
+		c.DebugInfoURL = val
+
+	case "delta_history":
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return NewErrorf("Invalid delta history count: %s", val)
+		} else {
+			c.DeltaHistory = i
+		}
+
+	case "manifest_sign_key":
+		c.ManifestSignKey = val
+
+	case "preset":
+		c.Preset = val
+
+	case "preset_repo":
+		c.PresetRepo = val
+
+	case "release", "releasever":
+		c.Release = val
+
+	case "sslverify":
+		if _, err := strToBool(val); err != nil {
+			return err
+		}
+		c.Parameters[key] = val
+
+	case "proxy":
+		if val != noProxy {
+			if _, err := parseProxy(val); err != nil {
+				return err
+			}
+		}
+		c.Parameters[key] = val
+
+	case "serve_prefix":
+		c.ServePrefix = val
+
+	case "entitlement":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.Entitlement = b
+		}
+
+	case "entitlement_label":
+		c.EntitlementLabel = val
+
+	case "entitlement_path":
+		c.EntitlementPath = val
+
+	case "entitlement_cdn":
+		c.EntitlementCDN = val
+
+	case "stagingpath":
+		c.StagingPath = val
+
+	case "staging_dir":
+		c.DownloadStaging = val
+
+	case "file_mode":
+		if m, err := parseFileMode(val); err != nil {
+			return err
+		} else {
+			c.FileMode = m
+		}
+
+	case "dir_mode":
+		if m, err := parseFileMode(val); err != nil {
+			return err
+		} else {
+			c.DirMode = m
+		}
+
+	case "owner":
+		c.Owner = val
+
+	case "group":
+		c.Group = val
+
+	case "selinux_context":
+		c.SELinuxContext = val
+
+	case "s3_endpoint":
+		c.S3Endpoint = val
+
+	case "pullthrough":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.PullThrough = b
+		}
+
+	case "serve_htpasswd":
+		c.ServeHtpasswd = val
+
+	case "serve_tokens":
+		c.ServeTokens = val
+
+	case "serve_verify":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.ServeVerify = b
+		}
+
+	case "smoketest":
+		c.SmokeTest = append(c.SmokeTest, parsePackageList(val)...)
+
+	case "smoketest_with":
+		c.SmokeTestWith = append(c.SmokeTestWith, parsePackageList(val)...)
+
+	case "require_closure":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.RequireClosure = b
+		}
+
+	case "closure_with":
+		c.ClosureWith = append(c.ClosureWith, parsePackageList(val)...)
+
+	case "tags":
+		c.Tags = parsePackageList(val)
+
+	case "store_path":
+		c.StorePath = val
+
+	case "snapshotpath":
+		c.SnapshotPath = val
+
+	case "state_path":
+		c.StatePath = val
+
+	case "snapshot_retention":
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return NewErrorf("Invalid snapshot retention count: %s", val)
+		} else {
+			c.SnapshotRetention = i
+		}
+
+	case "retain":
+		if d, err := parseRetention(val); err != nil {
+			return err
+		} else {
+			c.Retain = d
+		}
+
+	case "min_date", "max_date":
+		if _, err := parseDateBound(val, time.Now()); err != nil {
+			return err
+		}
+		if key == "min_date" {
+			c.MinDate = val
+		} else {
+			c.MaxDate = val
+		}
+
+	case "as_of":
+		if isRelativeDateBound(val) {
+			return NewErrorf("Invalid as_of date: %s (relative dates are not reproducible)", val)
+		}
+		if _, err := parseDateBound(val, time.Now()); err != nil {
+			return err
+		}
+		c.AsOf = val
+
+	case "pin_revision":
+		c.PinRevision = val
+
+	case "history_url":
+		c.HistoryURL = val
+
+	case "date_type":
+		if val != "build" && val != "file" {
+			return NewErrorf("Invalid date type: %s (expected build or file)", val)
+		}
+		c.DateType = val
+
+	case "presync":
+		c.PreSync = val
+
+	case "postsync":
+		c.PostSync = val
+
+	case "plugin":
+		c.Plugins = append(c.Plugins, val)
+
+	case "split":
+		if split, err := parseSplit(val); err != nil {
+			return err
+		} else {
+			c.Splits = append(c.Splits, *split)
+		}
+
+	case "merge_into":
+		c.MergeInto = val
+
+	case "merge_priority", "priority":
+		if i, err := strconv.Atoi(val); err != nil || i < 1 {
+			return NewErrorf("Invalid merge priority: %s", val)
+		} else {
+			c.MergePriority = i
+		}
+
+	case "merge_conflict":
+		switch val {
+		case MergeConflictPriority, MergeConflictFail:
+			c.MergeConflict = val
+		default:
+			return NewErrorf("Invalid merge conflict policy: %s (expected %s or %s)", val, MergeConflictPriority, MergeConflictFail)
+		}
+
+	case "schedule":
+		if s, err := parseCronSchedule(val); err != nil {
+			return err
+		} else {
+			c.Schedule = s
+		}
+
+	case "allowed_window":
+		if w, err := parseSyncWindow(val); err != nil {
+			return err
+		} else {
+			c.AllowedWindow = w
+		}
+
+	case "interval":
+		if d, err := parseInterval(val); err != nil {
+			return err
+		} else {
+			c.Interval = d
+		}
+
+	case "sync_timeout":
+		if d, err := time.ParseDuration(val); err != nil || d < 0 {
+			return NewErrorf("Invalid sync timeout: %s", val)
+		} else {
+			c.SyncTimeout = d
+		}
+
+	case "optional":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.Optional = b
+		}
+
+	case "enabled":
+		// the temporary yum.conf always enables the repo being synced
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.Disabled = !b
+		}
+
+	case "pin_fingerprint":
+		c.Fingerprints = append(c.Fingerprints, parseFingerprints(val)...)
+
+	case "publish", "push":
+		c.PublishTargets = append(c.PublishTargets, parsePublishTargets(val)...)
+
+	case "publish_bwlimit":
+		if !bwLimitPattern.MatchString(val) {
+			return NewErrorf("Invalid bandwidth limit: %s", val)
+		}
+		c.PublishBwLimit = val
+
+	case "segment_threshold":
+		if n, err := parseByteSize(val); err != nil {
+			return err
+		} else {
+			c.SegmentThreshold = n
+		}
+
+	case "download_segments":
+		if i, err := strconv.Atoi(val); err != nil || i < 1 {
+			return NewErrorf("Invalid segment count: %s", val)
+		} else {
+			c.DownloadSegments = i
+		}
+
+	case "cache_max_size":
+		if n, err := parseByteSize(val); err != nil {
+			return err
+		} else {
+			c.CacheMaxSize = n
+		}
+
+	case "min_free_space":
+		if n, err := parseByteSize(val); err != nil {
+			return err
+		} else {
+			c.MinFreeSpace = n
+		}
+
+	case "connect_timeout":
+		if f, err := strconv.ParseFloat(val, 64); err != nil || f <= 0 {
+			return NewErrorf("Invalid connect timeout: %s", val)
+		} else {
+			c.ConnectTimeout = time.Duration(f * float64(time.Second))
+		}
+
+	case "max_connections_per_host":
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return NewErrorf("Invalid connection count: %s", val)
+		} else {
+			c.MaxConnsPerHost = i
+		}
+
+	case "http2":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.HTTP2 = b
+		}
+
+	case "fastestmirror":
+		if b, err := strToBool(val); err != nil {
+			return err
+		} else {
+			c.FastestMirror = b
+		}
+
+	case "ip_resolve":
+		switch strings.ToLower(val) {
+		case "4", "ipv4":
+			c.Parameters[key] = "4"
+		case "6", "ipv6":
+			c.Parameters[key] = "6"
+		case "auto", "whatever":
+			delete(c.Parameters, key)
+		default:
+			return NewErrorf("Invalid ip_resolve: %s (expected 4, 6 or auto)", val)
+		}
+
+	case "timeout":
+		if f, err := strconv.ParseFloat(val, 64); err != nil || f < 0 {
+			return NewErrorf("Invalid timeout: %s", val)
+		}
+		c.Parameters[key] = val
+
+	case "publish_retries":
+		if i, err := strconv.Atoi(val); err != nil || i < 0 {
+			return NewErrorf("Invalid retry count: %s", val)
+		} else {
+			c.PublishRetries = i
+		}
+
+	default:
+		c.Parameters[key] = val
+	}
+
+	c.Options[key] = val
+	return nil
+}
+
+// Inherit sets all global options which are not explicitly set for the repo
+func (c *Repo) Inherit(globals map[string]string) error {
+	keys := make([]string, 0, len(globals))
+	for key := range globals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, ok := c.Options[key]; ok {
+			continue
+		}
+
+		if err := c.Set(key, globals[key]); err != nil {
+			return NewErrorf("Invalid global option %s for '%s': %s", key, c.ID, err.Error())
+		}
+		c.Inherited[key] = true
+	}
+
+	return nil
+}
+
 func (c *Repo) Validate() error {
 	if c.ID == "" {
 		return NewErrorf("Upstream repository has no ID specified (in %s:%d)", c.YumfilePath, c.YumfileLineNo)
 	}
 
-	if c.Parameters["mirrorlist"] == "" && c.Parameters["baseurl"] == "" {
+	// merge targets are built from their sources instead of an upstream
+	if len(c.MergeSources) > 0 {
+		if c.Parameters["mirrorlist"] != "" || c.Parameters["baseurl"] != "" {
+			return NewErrorf("Repo '%s' has both an upstream and repos merged into it (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+		}
+	} else if c.Parameters["mirrorlist"] == "" && c.Parameters["baseurl"] == "" {
 		return NewErrorf("Upstream repository for '%s' has no mirror list or base URL (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
 	}
 
+	if c.ManifestSignKey != "" && c.DeltaHistory <= 0 {
+		return NewErrorf("manifest_sign_key requires delta_history for '%s' (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+	}
+
+	for _, fpr := range c.Fingerprints {
+		if !fingerprintPattern.MatchString(fpr) {
+			return NewErrorf("Invalid GPG key fingerprint for '%s': %s (expected a full 40 digit fingerprint; key IDs are not accepted) (in %s:%d)", c.ID, fpr, c.YumfilePath, c.YumfileLineNo)
+		}
+	}
+
 	return nil
 }
+
+// Path returns the local path where the repo is mirrored
+func (c *Repo) Path() string {
+	if c.ObjectStoreURL() != "" {
+		return c.StagingDir()
+	}
+
+	if c.LocalPath != "" {
+		return c.LocalPath
+	}
+
+	return fmt.Sprintf("./%s", c.ID)
+}
+
+// CacheDir returns the path where yum caches metadata for the repo
+func (c *Repo) CacheDir() string {
+	if c.CachePath != "" {
+		return c.CachePath
+	}
+
+	return TmpYumCachePath
+}
+
+// StateDir returns the directory where durable records of the repo, such as
+// its audit log, are kept. Unlike the cache, it is never removed by clean.
+func (c *Repo) StateDir() string {
+	if c.StatePath != "" {
+		return c.StatePath
+	}
+
+	return strings.TrimSuffix(c.Path(), "/") + ".state"
+}
+
+// HasTag returns true if a repo has the given tag
+func (c *Repo) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EffectiveOptions returns the resolved value of every option of the repo,
+// including defaults, as sorted key/value pairs.
+func (c *Repo) EffectiveOptions() [][2]string {
+	localpath := c.Path()
+	if url := c.ObjectStoreURL(); url != "" {
+		localpath = url
+	}
+
+	options := map[string]string{
+		"localpath":          localpath,
+		"arch":               c.Architecture,
+		"backend":            c.yumBackend(),
+		"cachepath":          c.CacheDir(),
+		"cache_max_size":     fmt.Sprintf("%d", c.CacheMaxSize),
+		"newonly":            fmt.Sprintf("%d", boolMap[c.NewOnly]),
+		"sources":            fmt.Sprintf("%d", boolMap[c.IncludeSources]),
+		"deleteremoved":      fmt.Sprintf("%d", boolMap[c.DeleteRemoved]),
+		"gpgcheck":           fmt.Sprintf("%d", boolMap[c.GPGCheck]),
+		"checksum":           c.Checksum,
+		"createrepo_tool":    c.createrepoTool(),
+		"zck":                fmt.Sprintf("%d", boolMap[c.Zchunk]),
+		"compress_type":      c.CompressType,
+		"retain_old_md":      fmt.Sprintf("%d", c.RetainOldMetadata),
+		"remote_time":        fmt.Sprintf("%d", boolMap[c.RemoteTime]),
+		"max_upstream_age":   c.MaxUpstreamAge.String(),
+		"groupfile":          c.Groupfile,
+		"debuginfo":          fmt.Sprintf("%d", boolMap[c.DebugInfo]),
+		"debuginfourl":       c.DebugInfoURL,
+		"pin_fingerprint":    strings.Join(c.Fingerprints, ","),
+		"publish":            strings.Join(c.PublishTargets, ","),
+		"publish_bwlimit":    c.PublishBwLimit,
+		"publish_retries":    fmt.Sprintf("%d", c.PublishRetries),
+		"optional":           fmt.Sprintf("%d", boolMap[c.Optional]),
+		"enabled":            fmt.Sprintf("%d", boolMap[!c.Disabled]),
+		"delta_history":      fmt.Sprintf("%d", c.DeltaHistory),
+		"manifest_sign_key":  c.ManifestSignKey,
+		"download_segments":  fmt.Sprintf("%d", c.DownloadSegments),
+		"segment_threshold":  fmt.Sprintf("%d", c.SegmentThreshold),
+		"min_free_space":     fmt.Sprintf("%d", c.MinFreeSpace),
+		"retain":             c.Options["retain"],
+		"min_date":           c.MinDate,
+		"max_date":           c.MaxDate,
+		"date_type":          c.DateType,
+		"as_of":              c.AsOf,
+		"pin_revision":       c.PinRevision,
+		"history_url":        c.HistoryURL,
+		"preset":             c.Preset,
+		"preset_repo":        c.PresetRepo,
+		"release":            c.Release,
+		"stagingpath":        c.StagingDir(),
+		"staging_dir":        c.DownloadStaging,
+		"owner":              c.Owner,
+		"group":              c.Group,
+		"selinux_context":    c.SELinuxContext,
+		"snapshotpath":       c.SnapshotDir(),
+		"state_path":         c.StateDir(),
+		"snapshot_retention": fmt.Sprintf("%d", c.SnapshotRetention),
+		"store_path":         c.StorePath,
+		"pullthrough":        fmt.Sprintf("%d", boolMap[c.PullThrough]),
+		"s3_endpoint":        c.S3Endpoint,
+		"entitlement":        fmt.Sprintf("%d", boolMap[c.Entitlement]),
+		"entitlement_cdn":    c.EntitlementCDN,
+		"entitlement_label":  c.EntitlementLabel,
+		"entitlement_path":   c.EntitlementPath,
+		"serve_htpasswd":     c.ServeHtpasswd,
+		"serve_prefix":       c.ServePrefix,
+		"serve_tokens":       c.ServeTokens,
+		"serve_verify":       fmt.Sprintf("%d", boolMap[c.ServeVerify]),
+		"smoketest":          strings.Join(c.SmokeTest, " "),
+		"smoketest_with":     strings.Join(c.SmokeTestWith, ","),
+		"require_closure":    fmt.Sprintf("%d", boolMap[c.RequireClosure]),
+		"closure_with":       strings.Join(c.ClosureWith, ","),
+		"tags":               strings.Join(c.Tags, ","),
+		"interval":           c.Options["interval"],
+		"sync_timeout":       c.SyncTimeout.String(),
+		"presync":            c.PreSync,
+		"postsync":           c.PostSync,
+		"plugin":             strings.Join(c.Plugins, "; "),
+		"merge_into":         c.MergeInto,
+		"merge_priority":     fmt.Sprintf("%d", c.MergePriority),
+		"merge_conflict":     c.MergeConflict,
+		"split":              strings.Join(splitSpecs(c.Splits), "; "),
+	}
+
+	if c.Schedule != nil {
+		options["schedule"] = c.Schedule.String()
+	}
+
+	if c.AllowedWindow != nil {
+		options["allowed_window"] = c.AllowedWindow.String()
+	}
+
+	if c.FileMode != 0 {
+		options["file_mode"] = fmt.Sprintf("%04o", uint32(c.FileMode))
+	}
+
+	if c.DirMode != 0 {
+		options["dir_mode"] = fmt.Sprintf("%04o", uint32(c.DirMode))
+	}
+
+	options["connect_timeout"] = fmt.Sprintf("%g", c.ConnectTimeout.Seconds())
+	options["max_connections_per_host"] = fmt.Sprintf("%d", c.MaxConnsPerHost)
+	options["http2"] = fmt.Sprintf("%d", boolMap[c.HTTP2])
+	options["fastestmirror"] = fmt.Sprintf("%d", boolMap[c.FastestMirror])
+
+	for key, val := range c.Parameters {
+		options[key] = val
+	}
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([][2]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = [2]string{key, options[key]}
+	}
+
+	return pairs
+}
+
+// OptionSource returns where the effective value of an option was set; one of
+// "repo", "global" or "default".
+func (c *Repo) OptionSource(key string) string {
+	if c.Inherited[key] {
+		return "global"
+	}
+
+	if _, ok := c.Options[key]; ok {
+		return "repo"
+	}
+
+	return "default"
+}
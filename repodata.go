@@ -0,0 +1,423 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Repomd is the index of a repository's metadata files (repomd.xml)
+type Repomd struct {
+	Revision string       `xml:"revision"`
+	Data     []RepomdData `xml:"data"`
+}
+
+// RepomdData describes one metadata file listed in repomd.xml
+type RepomdData struct {
+	Type         string   `xml:"type,attr"`
+	Location     Location `xml:"location"`
+	Checksum     Checksum `xml:"checksum"`
+	OpenChecksum Checksum `xml:"open-checksum"`
+	Timestamp    int64    `xml:"timestamp"`
+	Size         int64    `xml:"size"`
+}
+
+// Location is the path of a file relative to the repository root
+type Location struct {
+	Href string `xml:"href,attr"`
+}
+
+// Checksum is a typed file checksum
+type Checksum struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Package is a package entry in primary.xml
+type Package struct {
+	Name     string   `xml:"name"`
+	Arch     string   `xml:"arch"`
+	Version  Version  `xml:"version"`
+	Checksum Checksum `xml:"checksum"`
+	Size     struct {
+		Package   int64 `xml:"package,attr"`
+		Installed int64 `xml:"installed,attr"`
+	} `xml:"size"`
+	Time struct {
+		File  int64 `xml:"file,attr"`
+		Build int64 `xml:"build,attr"`
+	} `xml:"time"`
+	Location Location `xml:"location"`
+	Summary  string   `xml:"summary"`
+	Format   struct {
+		License   string       `xml:"license"`
+		SourceRPM string       `xml:"sourcerpm"`
+		Provides  []Capability `xml:"provides>entry"`
+		Requires  []Capability `xml:"requires>entry"`
+		Files     []string     `xml:"file"`
+	} `xml:"format"`
+}
+
+// Capability is a provides or requires entry of a package, with an optional
+// version constraint
+type Capability struct {
+	Name    string `xml:"name,attr"`
+	Flags   string `xml:"flags,attr"`
+	Epoch   string `xml:"epoch,attr"`
+	Version string `xml:"ver,attr"`
+	Release string `xml:"rel,attr"`
+}
+
+// capabilityFlags are the comparison operators of capability flags
+var capabilityFlags = map[string]string{
+	"EQ": "=",
+	"LT": "<",
+	"LE": "<=",
+	"GT": ">",
+	"GE": ">=",
+}
+
+// String returns a capability in the form name [op [epoch:]version[-release]]
+func (c Capability) String() string {
+	op, ok := capabilityFlags[c.Flags]
+	if !ok || c.Version == "" {
+		return c.Name
+	}
+
+	evr := c.Version
+	if c.Epoch != "" && c.Epoch != "0" {
+		evr = c.Epoch + ":" + evr
+	}
+	if c.Release != "" {
+		evr += "-" + c.Release
+	}
+
+	return fmt.Sprintf("%s %s %s", c.Name, op, evr)
+}
+
+// Version is the epoch, version and release of a package
+type Version struct {
+	Epoch   string `xml:"epoch,attr"`
+	Version string `xml:"ver,attr"`
+	Release string `xml:"rel,attr"`
+}
+
+func (c Version) String() string {
+	if c.Epoch != "" && c.Epoch != "0" {
+		return fmt.Sprintf("%s:%s-%s", c.Epoch, c.Version, c.Release)
+	}
+
+	return fmt.Sprintf("%s-%s", c.Version, c.Release)
+}
+
+// NEVRA returns the name, epoch, version, release and architecture of a
+// package in the form name-[epoch:]version-release.arch
+func (c *Package) NEVRA() string {
+	return fmt.Sprintf("%s-%s.%s", c.Name, c.Version, c.Arch)
+}
+
+// Advisory is an update advisory (erratum) in updateinfo.xml
+type Advisory struct {
+	ID     string `xml:"id"`
+	Type   string `xml:"type,attr"`
+	Issued struct {
+		Date string `xml:"date,attr"`
+	} `xml:"issued"`
+	Updated struct {
+		Date string `xml:"date,attr"`
+	} `xml:"updated"`
+	Packages []struct {
+		Name     string `xml:"name,attr"`
+		Arch     string `xml:"arch,attr"`
+		Epoch    string `xml:"epoch,attr"`
+		Version  string `xml:"version,attr"`
+		Release  string `xml:"release,attr"`
+		Filename string `xml:"filename"`
+	} `xml:"pkglist>collection>package"`
+}
+
+// advisoryDateFormats are the date formats found in updateinfo.xml files
+var advisoryDateFormats = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05 UTC",
+	"2006-01-02",
+}
+
+// Date returns the time the advisory was last updated, or issued if it was
+// never updated. The zero time is returned if neither date can be parsed.
+func (c *Advisory) Date() time.Time {
+	for _, s := range []string{c.Updated.Date, c.Issued.Date} {
+		if s == "" {
+			continue
+		}
+
+		// some repos use seconds since the epoch
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(n, 0)
+		}
+
+		for _, format := range advisoryDateFormats {
+			if t, err := time.Parse(format, s); err == nil {
+				return t
+			}
+		}
+	}
+
+	return time.Time{}
+}
+
+// updateinfoXML is the root element of updateinfo.xml
+type updateinfoXML struct {
+	Advisories []Advisory `xml:"update"`
+}
+
+// ReadRepomd reads a repomd.xml file
+func ReadRepomd(path string) (*Repomd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	repomd := &Repomd{}
+	if err := xml.NewDecoder(f).Decode(repomd); err != nil {
+		return nil, NewErrorf("Error reading %s: %v", path, err)
+	}
+
+	return repomd, nil
+}
+
+// Get returns the metadata file of the given type or nil if there is none
+func (c *Repomd) Get(typ string) *RepomdData {
+	for i := range c.Data {
+		if c.Data[i].Type == typ {
+			return &c.Data[i]
+		}
+	}
+
+	return nil
+}
+
+// ReadPrimary reads all packages from a primary.xml file, which may be
+// compressed. Use EachPackage to avoid holding every package in memory.
+func ReadPrimary(path string) ([]Package, error) {
+	packages := make([]Package, 0)
+	err := EachPackage(path, func(pkg *Package) error {
+		packages = append(packages, *pkg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// EachPackage calls fn for each package in a primary.xml file, which may be
+// compressed, decoding one package at a time so memory use does not grow with
+// the size of the repo. Iteration stops at the first error returned by fn.
+func EachPackage(path string, fn func(pkg *Package) error) error {
+	r, err := openCompressed(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return NewErrorf("Error reading %s: %v", path, err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "package" {
+			continue
+		}
+
+		pkg := Package{}
+		if err := d.DecodeElement(&pkg, &start); err != nil {
+			return NewErrorf("Error reading %s: %v", path, err)
+		}
+
+		if err := fn(&pkg); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadUpdateinfo reads all advisories from an updateinfo.xml file, which may
+// be compressed.
+func ReadUpdateinfo(path string) ([]Advisory, error) {
+	r, err := openCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	updateinfo := &updateinfoXML{}
+	if err := xml.NewDecoder(r).Decode(updateinfo); err != nil {
+		return nil, NewErrorf("Error reading %s: %v", path, err)
+	}
+
+	return updateinfo.Advisories, nil
+}
+
+// compressedReader reads a decompressed file
+type compressedReader struct {
+	io.Reader
+	f    *os.File
+	cmd  *exec.Cmd
+	pipe io.ReadCloser
+	eof  bool
+}
+
+func (c *compressedReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF {
+		c.eof = true
+	}
+
+	return n, err
+}
+
+// Close closes the file, or stops the decompression command. If the output of
+// the command was not read to the end, the command would block writing to it,
+// so its pipe is closed and it is killed before waiting for it, and its exit
+// status is ignored.
+func (c *compressedReader) Close() error {
+	if c.cmd == nil {
+		return c.f.Close()
+	}
+
+	if c.eof {
+		return waitChild(c.cmd)
+	}
+
+	c.pipe.Close()
+	c.cmd.Process.Kill()
+	waitChild(c.cmd)
+	return nil
+}
+
+// openCompressed opens a file for reading, decompressing it according to its
+// file extension. Compressed files are read from a decompressed copy in the
+// cache, if possible, so they are only decompressed once.
+func openCompressed(path string) (io.ReadCloser, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xz", ".zst", ".gz", ".bz2":
+		if r := openCachedMetadata(path, decompress); r != nil {
+			return r, nil
+		}
+	}
+
+	return decompress(path)
+}
+
+// decompress opens a file for reading, decompressing it according to its
+// file extension. xz and zstd compressed files are decompressed with the xz
+// and zstd commands.
+func decompress(path string) (io.ReadCloser, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xz", ".zst":
+		name := "xz"
+		if strings.HasSuffix(path, ".zst") {
+			name = "zstd"
+		}
+
+		cmd := exec.Command(name, "-d", "-c", path)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := startChild(cmd); err != nil {
+			return nil, err
+		}
+
+		return &compressedReader{Reader: stdout, cmd: cmd, pipe: stdout}, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &compressedReader{Reader: gz, f: f}, nil
+
+	case ".bz2":
+		return &compressedReader{Reader: bzip2.NewReader(f), f: f}, nil
+	}
+
+	return f, nil
+}
+
+// fetchRepodata downloads the repomd.xml and the metadata file of the given
+// type from an upstream base URL into dir. The path of the metadata file is
+// returned along with the parsed repomd.xml.
+func fetchRepodata(repo *Repo, baseurl, typ, dir string) (*Repomd, string, error) {
+	baseurl = strings.TrimSuffix(baseurl, "/")
+	repomdPath := filepath.Join(dir, "repomd.xml")
+	if _, err := download(repo, baseurl+"/repodata/repomd.xml", repomdPath); err != nil {
+		return nil, "", err
+	}
+
+	repomd, err := ReadRepomd(repomdPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := repomd.Get(typ)
+	if data == nil {
+		return nil, "", NewErrorf("No %s metadata found at %s", typ, baseurl)
+	}
+
+	path := filepath.Join(dir, filepath.Base(data.Location.Href))
+	if _, err := download(repo, baseurl+"/"+data.Location.Href, path); err != nil {
+		return nil, "", err
+	}
+
+	if err := checkRepomdData(path, data); err != nil {
+		return nil, "", NewErrorf("%v from %s", err, baseurl)
+	}
+
+	return repomd, path, nil
+}
+
+// checkRepomdData returns an error if a metadata file does not match the
+// checksum listed for it in repomd.xml, using any checksum type found in repo
+// metadata, from sha1 to sha512. Files listed without a checksum are not
+// checked.
+func checkRepomdData(path string, data *RepomdData) error {
+	if data.Checksum.Value == "" {
+		return nil
+	}
+
+	sum, err := checksumFile(path, data.Checksum.Type)
+	if err != nil {
+		return err
+	}
+
+	if sum != strings.ToLower(strings.TrimSpace(data.Checksum.Value)) {
+		return NewErrorf("Checksum mismatch for %s metadata %s", data.Type, data.Location.Href)
+	}
+
+	return nil
+}
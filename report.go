@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Repo sync statuses reported in a RunReport
+const (
+	RepoStatusOK       = "ok"
+	RepoStatusFailed   = "failed"
+	RepoStatusSkipped  = "skipped"
+	RepoStatusUpToDate = "up-to-date"
+)
+
+// RunReport summarizes the outcome of a sync run
+type RunReport struct {
+	Start       time.Time     `json:"start"`
+	End         time.Time     `json:"end"`
+	Duration    time.Duration `json:"duration_ns"`
+	Repos       []*RepoReport `json:"repos"`
+	Synced      int           `json:"repos_synced"`
+	Failed      int           `json:"repos_failed"`
+	Skipped     int           `json:"repos_skipped"`
+	UpToDate    int           `json:"repos_up_to_date"`
+	Errors      int           `json:"errors"`
+	Downloaded  int           `json:"packages_downloaded"`
+	Deleted     int           `json:"packages_deleted"`
+	Filtered    int           `json:"packages_filtered"`
+	Bytes       int64         `json:"bytes_transferred"`
+	GPGFailures int           `json:"gpg_failures"`
+
+	DownloadFailures int `json:"download_failures"`
+}
+
+// RepoReport summarizes the outcome of syncing one repo
+type RepoReport struct {
+	ID          string        `json:"id"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Errors      int           `json:"errors"`
+	Start       time.Time     `json:"start"`
+	Duration    time.Duration `json:"duration_ns"`
+	Downloaded  int           `json:"packages_downloaded"`
+	Deleted     int           `json:"packages_deleted"`
+	Filtered    int           `json:"packages_filtered"`
+	Bytes       int64         `json:"bytes_transferred"`
+	GPGFailures int           `json:"gpg_failures"`
+
+	// Packages and Size are the number and total size of the packages in
+	// the repo once it was synchronized
+	Packages int   `json:"packages,omitempty"`
+	Size     int64 `json:"size,omitempty"`
+
+	// DownloadFailures is the number of packages reposync failed to
+	// download, or removed after a failed signature check, and
+	// FailedDownloads lists the first of them
+	DownloadFailures int      `json:"download_failures,omitempty"`
+	FailedDownloads  []string `json:"failed_downloads,omitempty"`
+
+	// TimedOut is true if the sync was cancelled by the repo's sync_timeout
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// WindowClosed is true if the sync was stopped because the repo's
+	// allowed_window closed
+	WindowClosed bool `json:"window_closed,omitempty"`
+
+	// UpstreamAge is the age of the upstream metadata of a repo with
+	// max_upstream_age, and StaleUpstream is true if it was older
+	UpstreamAge   time.Duration `json:"upstream_age_ns,omitempty"`
+	StaleUpstream bool          `json:"stale_upstream,omitempty"`
+
+	// Unresolved are the requirements left unresolved by a sync of a repo
+	// with require_closure
+	Unresolved []ClosureProblem `json:"unresolved_requirements,omitempty"`
+}
+
+// NewRunReport returns a report for a run starting now
+func NewRunReport() *RunReport {
+	return &RunReport{
+		Start: time.Now(),
+		Repos: make([]*RepoReport, 0),
+	}
+}
+
+// Add appends a repo report and updates the run totals
+func (c *RunReport) Add(repo *RepoReport) {
+	c.Repos = append(c.Repos, repo)
+	switch repo.Status {
+	case RepoStatusOK:
+		c.Synced++
+	case RepoStatusFailed:
+		c.Failed++
+	case RepoStatusSkipped:
+		c.Skipped++
+	case RepoStatusUpToDate:
+		c.UpToDate++
+	}
+
+	c.Errors += repo.Errors
+	c.Downloaded += repo.Downloaded
+	c.Deleted += repo.Deleted
+	c.Filtered += repo.Filtered
+	c.Bytes += repo.Bytes
+	c.GPGFailures += repo.GPGFailures
+	c.DownloadFailures += repo.DownloadFailures
+}
+
+// Get returns the report of a repo, or nil if it is not in the run
+func (c *RunReport) Get(id string) *RepoReport {
+	for _, repo := range c.Repos {
+		if repo.ID == id {
+			return repo
+		}
+	}
+
+	return nil
+}
+
+// Failures returns the reports of the repos which failed to synchronize, and
+// of optional repos which were skipped after an error
+func (c *RunReport) Failures() []*RepoReport {
+	failures := make([]*RepoReport, 0)
+	for _, repo := range c.Repos {
+		if repo.Status == RepoStatusFailed || (repo.Status == RepoStatusSkipped && repo.Errors > 0) {
+			failures = append(failures, repo)
+		}
+	}
+
+	return failures
+}
+
+// AllFailed returns true if repos failed and none was synchronized or found
+// up to date
+func (c *RunReport) AllFailed() bool {
+	return c.Failed > 0 && c.Synced == 0 && c.UpToDate == 0
+}
+
+// logFailures logs a table of the repos which failed during a run and their
+// errors, so that failures early in a long run are not lost in its output
+func (c *RunReport) logFailures() {
+	failures := c.Failures()
+	if len(failures) == 0 {
+		return
+	}
+
+	Errorf(nil, "%d of %d repos had errors:", len(failures), len(c.Repos))
+	for _, repo := range failures {
+		status := repo.Status
+		if repo.Status == RepoStatusSkipped {
+			status = "optional"
+		}
+		Errorf(nil, "  %-30s %-8s %s", repo.ID, status, repo.Error)
+	}
+}
+
+// Finish records the end time of the run
+func (c *RunReport) Finish() {
+	c.End = time.Now()
+	c.Duration = c.End.Sub(c.Start)
+}
+
+// countChanges records the packages added and removed between two listings
+// of a local repo, as returned by packageSizes
+func (c *RepoReport) countChanges(before, after map[string]int64) {
+	for path, size := range after {
+		if _, ok := before[path]; !ok {
+			c.Downloaded++
+			c.Bytes += size
+		}
+	}
+
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			c.Deleted++
+		}
+	}
+
+	c.Packages, c.Size = len(after), 0
+	for _, size := range after {
+		c.Size += size
+	}
+}
+
+// packageSizes returns the size of each package in a local repo, keyed by
+// path relative to the repo root
+func packageSizes(path string) (map[string]int64, error) {
+	sizes := make(map[string]int64, 0)
+	files, err := findPackages(path)
+	if os.IsNotExist(err) {
+		return sizes, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return nil, err
+		}
+		sizes[rel] = fi.Size()
+	}
+
+	return sizes, nil
+}
+
+// reportTemplateFuncs are the functions available to report templates
+var reportTemplateFuncs = map[string]interface{}{
+	"bytes": formatBytes,
+	"seconds": func(d time.Duration) string {
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	},
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// WriteReport writes a run report in the given format ("json", "text" or
+// "template") to the given path, or to STDOUT if path is empty or "-". The
+// template format renders the Go template file tmpl with the report as its
+// data. Templates with a .html or .htm extension are rendered with
+// html/template so values are escaped.
+func WriteReport(report *RunReport, format, tmpl, path string) error {
+	if path == "" || path == "-" {
+		return renderReport(os.Stdout, report, format, tmpl)
+	}
+
+	return writeFileAtomic(path, 0644, func(w io.Writer) error {
+		return renderReport(w, report, format, tmpl)
+	})
+}
+
+// renderReport writes a run report in the given format, as WriteReport
+func renderReport(w io.Writer, report *RunReport, format, tmpl string) error {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+
+	case "text":
+		for _, repo := range report.Repos {
+			fmt.Fprintf(w, "%-30s %-10s %6d downloaded %6d deleted %6d filtered %10s %v\n", repo.ID, repo.Status, repo.Downloaded, repo.Deleted, repo.Filtered, formatBytes(repo.Bytes), repo.Duration)
+			if repo.Error != "" {
+				fmt.Fprintf(w, "  %s\n", repo.Error)
+			}
+			for _, problem := range repo.Unresolved {
+				fmt.Fprintf(w, "  %s requires %s\n", problem.NEVRA, problem.Requires)
+			}
+			if repo.StaleUpstream {
+				fmt.Fprintf(w, "  upstream metadata is stale: generated %v ago\n", repo.UpstreamAge.Truncate(time.Minute))
+			}
+			if repo.DownloadFailures > 0 {
+				fmt.Fprintf(w, "  %d failed downloads: %s\n", repo.DownloadFailures, strings.Join(repo.FailedDownloads, ", "))
+			}
+		}
+		fmt.Fprintf(w, "%d synced, %d up to date, %d failed, %d skipped, %d errors, %d packages downloaded (%s), %d deleted, %d filtered, %d GPG failures, %d failed downloads in %v\n", report.Synced, report.UpToDate, report.Failed, report.Skipped, report.Errors, report.Downloaded, formatBytes(report.Bytes), report.Deleted, report.Filtered, report.GPGFailures, report.DownloadFailures, report.Duration)
+		return nil
+
+	case "template":
+		return renderTemplate(w, tmpl, report)
+	}
+
+	return NewErrorf("Unsupported report format: %s", format)
+}
+
+// executer is a parsed text or HTML template
+type executer interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// parseTemplate parses the Go template file at path. Templates with a .html
+// or .htm extension are parsed with html/template so values are escaped.
+func parseTemplate(path string) (executer, error) {
+	if path == "" {
+		return nil, NewErrorf("No template file specified")
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		return htmltemplate.New(filepath.Base(path)).Funcs(reportTemplateFuncs).ParseFiles(path)
+	}
+
+	return template.New(filepath.Base(path)).Funcs(reportTemplateFuncs).ParseFiles(path)
+}
+
+// renderTemplate renders the Go template file at path with the given data
+func renderTemplate(w io.Writer, path string, data interface{}) error {
+	t, err := parseTemplate(path)
+	if err != nil {
+		return err
+	}
+
+	return t.Execute(w, data)
+}
+
+// CheckReportFormat returns an error if a report cannot be written in the
+// given format, so that a bad format or template is found before a run
+// rather than after it
+func CheckReportFormat(format, tmpl string) error {
+	switch format {
+	case "json", "text":
+		return nil
+	case "template":
+		_, err := parseTemplate(tmpl)
+		return err
+	}
+
+	return NewErrorf("Unsupported report format: %s", format)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRetention parses a retention window such as "180d", "26w" or "72h"
+func parseRetention(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil || n < 0 {
+				return 0, NewErrorf("Invalid retention window: %s", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, NewErrorf("Invalid retention window: %s", s)
+	}
+
+	return d, nil
+}
+
+// applyRetention excludes upstream packages which have expired under the
+// repo's retention window from the installed yum.conf, so they are not
+// downloaded, and returns them.
+//
+// A package expires if it was built before the start of the window, unless it
+// is the newest version of its name and architecture or is listed in an
+// advisory which was issued or updated within the window.
+func (c *Yumfile) applyRetention(repo *Repo) ([]upstreamPackage, error) {
+	if repo.Retain <= 0 {
+		return nil, nil
+	}
+
+	cutoff := time.Now().Add(-repo.Retain)
+	packages, err := c.repoquery(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	advisories, err := recentAdvisoryPackages(repo, cutoff)
+	if err != nil {
+		return nil, NewErrorf("Failed to read advisories: %v", err)
+	}
+
+	// find the newest version of each package
+	newest := make(map[string]Version, 0)
+	for _, pkg := range packages {
+		if v, ok := newest[pkg.Name]; !ok || compareVersions(pkg.Version, v) > 0 {
+			newest[pkg.Name] = pkg.Version
+		}
+	}
+
+	expired := make([]upstreamPackage, 0)
+	for _, pkg := range packages {
+		if pkg.BuildTime >= cutoff.Unix() {
+			continue
+		}
+
+		if compareVersions(pkg.Version, newest[pkg.Name]) == 0 {
+			continue
+		}
+
+		if advisories[filepath.Base(pkg.Path)] {
+			continue
+		}
+
+		expired = append(expired, pkg)
+	}
+
+	Printf("Retaining %d of %d packages built in the last %v: %s\n", len(packages)-len(expired), len(packages), repo.Retain, repo.ID)
+	if len(expired) == 0 {
+		return expired, nil
+	}
+
+	if err := c.excludeUpstream(repo, expired); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// excludeUpstream excludes the given upstream packages from the installed
+// yum.conf, so they are not downloaded
+func (c *Yumfile) excludeUpstream(repo *Repo, packages []upstreamPackage) error {
+	// exclude packages from reposync, without modifying the parameters shared
+	// with other copies of the repo
+	excludes := make([]string, 0, len(packages)+1)
+	if s := repo.Parameters["exclude"]; s != "" {
+		excludes = append(excludes, s)
+	}
+	for _, pkg := range packages {
+		excludes = append(excludes, pkg.NVRA)
+	}
+
+	params := make(map[string]string, len(repo.Parameters)+1)
+	for key, val := range repo.Parameters {
+		params[key] = val
+	}
+	params["exclude"] = strings.Join(excludes, " ")
+	repo.Parameters = params
+
+	return c.installYumConf(repo)
+}
+
+// prunePackages deletes the local copies of excluded packages, such as
+// expired packages, describing them as the given kind
+func prunePackages(repo *Repo, packages []upstreamPackage, kind string) error {
+	n := 0
+	for _, pkg := range packages {
+		path := filepath.Join(repo.Path(), pkg.Path)
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		Dprintf("Removed %s package %s\n", kind, path)
+		n++
+	}
+
+	if n > 0 {
+		Printf("Removed %d %s packages: %s\n", n, kind, repo.ID)
+	}
+
+	return nil
+}
+
+// recentAdvisoryPackages returns the file names of all packages listed in
+// upstream advisories which were issued or updated after the given time. An
+// empty set is returned if the repo publishes no advisories.
+func recentAdvisoryPackages(repo *Repo, since time.Time) (map[string]bool, error) {
+	packages := make(map[string]bool, 0)
+	baseurl, repomd, err := repo.fetchUpstreamRepomd()
+	if err != nil {
+		return nil, err
+	}
+
+	data := repomd.Get("updateinfo")
+	if data == nil {
+		Dprintf("No advisories published for %s\n", repo.ID)
+		return packages, nil
+	}
+
+	path, err := repo.fetchUpstreamMetadata(baseurl, data)
+	if err != nil {
+		return nil, err
+	}
+
+	advisories, err := ReadUpdateinfo(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, advisory := range advisories {
+		if advisory.Date().Before(since) {
+			continue
+		}
+
+		ids = append(ids, advisory.ID)
+		for _, pkg := range advisory.Packages {
+			packages[filepath.Base(pkg.Filename)] = true
+		}
+	}
+	sort.Strings(ids)
+	Dprintf("Retaining packages from %d recent advisories for %s: %s\n", len(ids), repo.ID, strings.Join(ids, ", "))
+
+	return packages, nil
+}
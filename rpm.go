@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rpmQueryBatchSize limits the number of files passed to a single rpm query
+const rpmQueryBatchSize = 256
+
+// findPackages returns the paths of all RPM package files in a directory tree
+func findPackages(path string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && strings.HasSuffix(p, ".rpm") {
+			files = append(files, p)
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// queryPackages queries the headers of the given package files using rpm and
+// returns one line of output per package, formatted with the given rpm query
+// format (without a trailing newline).
+func queryPackages(files []string, format string) ([]string, error) {
+	lines := make([]string, 0, len(files))
+	for i := 0; i < len(files); i += rpmQueryBatchSize {
+		j := i + rpmQueryBatchSize
+		if j > len(files) {
+			j = len(files)
+		}
+
+		args := []string{"-qp", "--nosignature", "--nodigest", "--queryformat", format + "\\n"}
+		out, err := ExecOutput("rpm", append(args, files[i:j]...)...)
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, strings.Split(strings.TrimRight(string(out), "\n"), "\n")...)
+	}
+
+	return lines, nil
+}
+
+// compareVersions compares two package versions using the rpmvercmp algorithm
+// used by rpm and yum, returning -1, 0 or 1. Epochs are compared first.
+func compareVersions(a, b Version) int {
+	if c := rpmvercmp(defaultEpoch(a.Epoch), defaultEpoch(b.Epoch)); c != 0 {
+		return c
+	}
+
+	if c := rpmvercmp(a.Version, b.Version); c != 0 {
+		return c
+	}
+
+	return rpmvercmp(a.Release, b.Release)
+}
+
+// defaultEpoch returns "0" for an unset epoch
+func defaultEpoch(epoch string) string {
+	if epoch == "" || epoch == "(none)" {
+		return "0"
+	}
+
+	return epoch
+}
+
+// rpmvercmp compares two version or release strings by splitting them into
+// alternating numeric and alphabetic segments, as rpm does. A tilde sorts
+// before anything, including the end of the string.
+func rpmvercmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	isAlnum := func(c byte) bool {
+		return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+	isDigit := func(c byte) bool {
+		return c >= '0' && c <= '9'
+	}
+
+	for len(a) > 0 || len(b) > 0 {
+		// skip separators
+		for len(a) > 0 && !isAlnum(a[0]) && a[0] != '~' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isAlnum(b[0]) && b[0] != '~' {
+			b = b[1:]
+		}
+
+		// tilde sorts lower than anything else
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		// take the next segment of the same type from each string
+		numeric := isDigit(a[0])
+		i, j := 0, 0
+		for i < len(a) && isAlnum(a[i]) && isDigit(a[i]) == numeric {
+			i++
+		}
+		for j < len(b) && isAlnum(b[j]) && isDigit(b[j]) == numeric {
+			j++
+		}
+		segA, segB := a[:i], b[:j]
+		a, b = a[i:], b[j:]
+
+		// numeric segments are newer than alphabetic segments
+		if len(segB) == 0 {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	// the string with segments remaining is newer
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	}
+
+	return 1
+}
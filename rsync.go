@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isRsyncURL returns true if a URL uses the rsync protocol
+func isRsyncURL(url string) bool {
+	return strings.HasPrefix(url, "rsync://")
+}
+
+// RsyncURL returns the upstream base URL of a repo if it is an rsync:// URL,
+// or an empty string if the repo is synchronized over HTTP.
+func (c *Repo) RsyncURL() string {
+	if c.RsyncUpstream != "" {
+		return c.RsyncUpstream
+	}
+
+	for _, url := range strings.Fields(strings.Replace(c.Parameters["baseurl"], ",", " ", -1)) {
+		if isRsyncURL(url) {
+			return strings.TrimSuffix(c.expandYumVars(url), "/") + "/"
+		}
+	}
+
+	return ""
+}
+
+// rsyncMetadataDir returns the directory where the upstream metadata of a
+// repo with an rsync:// base URL is cached
+func (c *Repo) rsyncMetadataDir() string {
+	return filepath.Join(c.CacheDir(), c.ID, "rsync")
+}
+
+// parseByteSize parses a yum size option such as bandwidth, which is a number
+// of bytes with an optional k, M or G suffix
+func parseByteSize(s string) (int64, error) {
+	if s == "" {
+		return 0, NewErrorf("Invalid size: %s", s)
+	}
+
+	mult := int64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		mult = 1 << 10
+	case "m":
+		mult = 1 << 20
+	case "g":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, NewErrorf("Invalid size: %s", s)
+	}
+
+	return int64(f * float64(mult)), nil
+}
+
+// rsyncArgs returns the rsync options common to all transfers for a repo
+func rsyncArgs(repo *Repo) []string {
+	args := []string{"--recursive", "--times", "--compress", "--timeout=300"}
+	if QuietMode {
+		args = append(args, "--quiet")
+	}
+
+	// yum's bandwidth option is in bytes per second; rsync's is in KiB/s
+	if s := repo.Parameters["bandwidth"]; s != "" && s != "0" {
+		if b, err := parseByteSize(s); err == nil && b >= 1024 {
+			args = append(args, fmt.Sprintf("--bwlimit=%d", b/1024))
+		}
+	}
+
+	return args
+}
+
+// rsyncMetadata fetches the upstream metadata of a repo with an rsync:// base
+// URL and points the repo's yum configuration at the local copy, so that the
+// packages to synchronize can be computed with the usual yum tools.
+func (c *Yumfile) rsyncMetadata(repo *Repo) error {
+	url := repo.RsyncURL()
+	dir := repo.rsyncMetadataDir()
+	Printf("Fetching metadata: %s\n", url)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	args := append(rsyncArgs(repo), "--delete", url+"repodata/", filepath.Join(dir, "repodata")+"/")
+	if err := Exec("rsync", args...); err != nil {
+		return err
+	}
+
+	// point yum at the local metadata, without modifying the parameters
+	// shared with other copies of the repo
+	params := make(map[string]string, len(repo.Parameters))
+	for key, val := range repo.Parameters {
+		params[key] = val
+	}
+	params["baseurl"] = "file://" + absPath(dir)
+	delete(params, "mirrorlist")
+	delete(params, "metalink")
+	repo.Parameters = params
+	repo.RsyncUpstream = url
+
+	return nil
+}
+
+// rsyncPackages downloads the packages of a repo with an rsync:// base URL,
+// in place of reposync. Only the packages yum would download are transferred,
+// using rsync's delta transfer for files which already exist locally, and each
+// transferred package is validated against the checksum in the upstream
+// metadata, and its GPG signature if gpgcheck is enabled. Packages which fail
+// validation are removed. Repos with staging_dir transfer packages into their
+// staging directory, to be moved into place once the sync is validated.
+func (c *Yumfile) rsyncPackages(repo *Repo) error {
+	Printf("Syncronizing repo: %s\n", repo.ID)
+	packages, err := c.repoquery(repo)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(TmpBasePath, fmt.Sprintf("%s%d.rsync.", TmpFilePrefix, os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	wanted := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		wanted[filepath.Clean(pkg.Path)] = true
+		fmt.Fprintf(f, "%s\n", pkg.Path)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(repo.downloadPath(), 0755); err != nil {
+		return err
+	}
+
+	// list the transferred files so only those need to be validated. With a
+	// staging directory, only packages which differ from the repo's are
+	// transferred into it.
+	args := append(rsyncArgs(repo), "--files-from="+f.Name(), "--out-format=%n", "--partial-dir=.rsync-partial")
+	if repo.downloadStagingDir() != "" {
+		args = append(args, "--compare-dest="+absPath(repo.Path()))
+	}
+	args = append(args, repo.RsyncURL(), strings.TrimSuffix(repo.downloadPath(), "/")+"/")
+	out, err := ExecOutput("rsync", args...)
+	if err != nil {
+		return err
+	}
+
+	transferred := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); strings.HasSuffix(line, ".rpm") {
+			transferred = append(transferred, line)
+		}
+	}
+	Dprintf("Transferred %d packages for %s\n", len(transferred), repo.ID)
+
+	if err := c.validateRsyncPackages(repo, transferred); err != nil {
+		return err
+	}
+
+	if err := c.copyRsyncComps(repo); err != nil {
+		return err
+	}
+
+	if !repo.DeleteRemoved {
+		return nil
+	}
+
+	local, err := localPackages(repo.Path())
+	if err != nil {
+		return err
+	}
+
+	for path := range local {
+		if !wanted[path] {
+			Dprintf("Deleting %s\n", path)
+			if err := os.Remove(filepath.Join(repo.Path(), path)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRsyncPackages checks packages transferred by rsync against the
+// checksums in the upstream metadata, and their signatures if gpgcheck is
+// enabled, removing any which fail.
+func (c *Yumfile) validateRsyncPackages(repo *Repo, files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	dir := repo.rsyncMetadataDir()
+	repomd, err := ReadRepomd(filepath.Join(dir, "repodata", "repomd.xml"))
+	if err != nil {
+		return err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return NewErrorf("No primary metadata found for %s", repo.ID)
+	}
+
+	// only keep the checksums of the transferred packages
+	checksums := make(map[string]Checksum, len(files))
+	for _, rel := range files {
+		checksums[filepath.Clean(rel)] = Checksum{}
+	}
+
+	err = EachPackage(filepath.Join(dir, data.Location.Href), func(pkg *Package) error {
+		rel := filepath.Clean(pkg.Location.Href)
+		if _, ok := checksums[rel]; ok {
+			checksums[rel] = pkg.Checksum
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sums := make([]string, len(files))
+	err = forEachParallel(len(files), func(i int) (err error) {
+		if checksum := checksums[filepath.Clean(files[i])]; checksum.Value != "" {
+			sums[i], err = checksumFile(filepath.Join(repo.downloadPath(), files[i]), checksum.Type)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	bad := make([]string, 0)
+	valid := make([]string, 0, len(files))
+	for i, rel := range files {
+		path := filepath.Join(repo.downloadPath(), rel)
+		checksum := checksums[filepath.Clean(rel)]
+		if checksum.Value == "" {
+			Errorf(nil, "Package %s is not listed in the upstream metadata", rel)
+			bad = append(bad, path)
+			continue
+		}
+
+		if sums[i] != strings.ToLower(checksum.Value) {
+			Errorf(nil, "Checksum mismatch for %s", rel)
+			bad = append(bad, path)
+			continue
+		}
+
+		valid = append(valid, path)
+	}
+
+	if repo.GPGCheck && len(valid) > 0 {
+		badsigs, err := checkSignatures(repo, valid)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range badsigs {
+			Errorf(nil, "Invalid signature for %s", path)
+		}
+		bad = append(bad, badsigs...)
+	}
+
+	for _, path := range bad {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if len(bad) > 0 {
+		return NewErrorf("%d of %d transferred packages failed validation", len(bad), len(files))
+	}
+
+	return nil
+}
+
+// copyRsyncComps copies the upstream comps file of a repo into the repo as
+// comps.xml, as reposync --downloadcomps would
+func (c *Yumfile) copyRsyncComps(repo *Repo) error {
+	dir := repo.rsyncMetadataDir()
+	repomd, err := ReadRepomd(filepath.Join(dir, "repodata", "repomd.xml"))
+	if err != nil {
+		return err
+	}
+
+	data := repomd.Get("group")
+	if data == nil {
+		return nil
+	}
+
+	return cloneFile(filepath.Join(dir, data.Location.Href), filepath.Join(repo.Path(), "comps.xml"))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// s3ImmutableCacheControl is the Cache-Control header of packages and
+// metadata files, which never change once uploaded as their names are unique
+const s3ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// s3RepomdCacheControl is the Cache-Control header of repomd.xml and its
+// signature, which change on every sync
+const s3RepomdCacheControl = "public, max-age=300, must-revalidate"
+
+// isObjectStoreURL returns true if a path is an s3:// URL
+func isObjectStoreURL(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// ObjectStoreURL returns the s3://bucket/prefix URL of a repo whose localpath
+// is in object storage, or an empty string if it is a local directory.
+func (c *Repo) ObjectStoreURL() string {
+	if isObjectStoreURL(c.LocalPath) {
+		return strings.TrimSuffix(c.LocalPath, "/")
+	}
+
+	return ""
+}
+
+// StagingDir returns the local directory where a repo whose localpath is in
+// object storage is synchronized before it is uploaded
+func (c *Repo) StagingDir() string {
+	if c.StagingPath != "" {
+		return c.StagingPath
+	}
+
+	return filepath.Join(c.CacheDir(), c.ID, "staging")
+}
+
+// publishS3 uploads a local repo directory to an s3://bucket/prefix URL with
+// the AWS CLI. Files are uploaded in an order which keeps the remote repo
+// consistent for clients: packages first, then metadata files and finally
+// repomd.xml, after which files no longer in the local repo are deleted. Each
+// file type is uploaded with an explicit Content-Type, as the AWS CLI would
+// otherwise serve compressed metadata with a Content-Encoding which clients
+// decompress transparently.
+func publishS3(repo *Repo, src, target string) error {
+	src = strings.TrimSuffix(src, "/") + "/"
+	target = strings.TrimSuffix(target, "/") + "/"
+
+	// s3sync runs aws s3 sync with the given options
+	s3sync := func(opts ...string) error {
+		args := []string{"s3", "sync", "--only-show-errors"}
+		if repo.S3Endpoint != "" {
+			args = append(args, "--endpoint-url", repo.S3Endpoint)
+		}
+		args = append(args, opts...)
+		return Exec("aws", append(args, src, target)...)
+	}
+
+	// upload syncs only the files matching the given patterns
+	upload := func(cacheControl, contentType string, patterns ...string) error {
+		opts := []string{"--no-guess-mime-type", "--cache-control", cacheControl, "--content-type", contentType, "--exclude", "*"}
+		for _, pattern := range patterns {
+			opts = append(opts, "--include", pattern)
+		}
+		return s3sync(opts...)
+	}
+
+	Dprintf("Uploading %s to %s\n", src, target)
+
+	// packages
+	if err := upload(s3ImmutableCacheControl, repoContentTypes[".rpm"], "*.rpm"); err != nil {
+		return err
+	}
+
+	// metadata files, by extension
+	exts := make([]string, 0, len(repoContentTypes))
+	for ext := range repoContentTypes {
+		if ext != ".rpm" {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		if err := upload(s3ImmutableCacheControl, repoContentTypes[ext], "repodata/*-*"+ext); err != nil {
+			return err
+		}
+	}
+
+	// repomd.xml last, so it never references missing files
+	if err := upload(s3RepomdCacheControl, repoContentTypes[".xml"], "repodata/repomd.xml"); err != nil {
+		return err
+	}
+
+	for _, ext := range []string{".asc", ".key"} {
+		if err := upload(s3RepomdCacheControl, repoContentTypes[ext], "repodata/repomd.xml"+ext); err != nil {
+			return err
+		}
+	}
+
+	// upload any remaining files and delete superseded ones
+	return s3sync("--delete", "--exclude", ".*", "--exclude", "*/.*", "--exclude", "*"+partFileSuffix)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField is the set of values matched by one field of a cron expression
+type cronField map[int]bool
+
+// cronSchedule is a standard five field cron expression: minute, hour, day of
+// month, month and day of week
+type cronSchedule struct {
+	expr   string
+	minute cronField
+	hour   cronField
+	dom    cronField
+	month  cronField
+	dow    cronField
+
+	// domAny and dowAny record whether the day fields are unrestricted, as a
+	// day matches if either restricted day field matches
+	domAny bool
+	dowAny bool
+}
+
+// cronMacros are the shorthand cron expressions
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCronSchedule parses a cron expression such as "0 */4 * * *". Each field
+// may be *, a number, a range such as 1-5, a step such as */15 or 0-30/10, or
+// a comma separated list of these. Days of the week are 0-7, where 0 and 7
+// are Sunday.
+func parseCronSchedule(s string) (*cronSchedule, error) {
+	expr := strings.TrimSpace(strings.Trim(strings.TrimSpace(s), `"'`))
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, NewErrorf("Invalid schedule: %s (expected minute, hour, day of month, month and day of week)", s)
+	}
+
+	c := &cronSchedule{expr: strings.Join(fields, " ")}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	parsed := make([]cronField, 5)
+	for i, field := range fields {
+		f, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, NewErrorf("Invalid schedule: %s (%v)", s, err)
+		}
+		parsed[i] = f
+	}
+
+	c.minute, c.hour, c.dom, c.month, c.dow = parsed[0], parsed[1], parsed[2], parsed[3], parsed[4]
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	if c.dow[7] {
+		c.dow[0] = true
+	}
+
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression with the given bounds
+func parseCronField(s string, min, max int) (cronField, error) {
+	f := make(cronField, 0)
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, NewErrorf("invalid step: %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			a, err1 := strconv.Atoi(bounds[0])
+			b, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil || a > b {
+				return nil, NewErrorf("invalid range: %s", part)
+			}
+			lo, hi = a, b
+
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, NewErrorf("invalid value: %s", part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max {
+			return nil, NewErrorf("%s out of range %d-%d", part, min, max)
+		}
+
+		for i := lo; i <= hi; i += step {
+			f[i] = true
+		}
+	}
+
+	return f, nil
+}
+
+// String returns the cron expression of the schedule
+func (c *cronSchedule) String() string {
+	return c.expr
+}
+
+// matchDay returns true if a day matches the day of month and day of week
+// fields. As in cron, if both are restricted, a day matching either matches.
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+
+	return dom || dow
+}
+
+// Next returns the first time after t which matches the schedule, or the zero
+// time if none is found within five years
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// syncWindow is a daily window of local time, such as 22:00-06:00, in which a
+// repo may be synchronized. A window whose end is before its start spans
+// midnight.
+type syncWindow struct {
+	start int // minutes after midnight
+	end   int
+}
+
+// parseSyncWindow parses a window of the form HH:MM-HH:MM
+func parseSyncWindow(s string) (*syncWindow, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 2 {
+		return nil, NewErrorf("Invalid window: %s (expected HH:MM-HH:MM)", s)
+	}
+
+	c := &syncWindow{}
+	for i, dst := range []*int{&c.start, &c.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, NewErrorf("Invalid window: %s (expected HH:MM-HH:MM)", s)
+		}
+		*dst = t.Hour()*60 + t.Minute()
+	}
+
+	if c.start == c.end {
+		return nil, NewErrorf("Invalid window: %s (starts and ends at the same time)", s)
+	}
+
+	return c, nil
+}
+
+// String returns the window as HH:MM-HH:MM
+func (c *syncWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", c.start/60, c.start%60, c.end/60, c.end%60)
+}
+
+// Contains returns true if t is within the window
+func (c *syncWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if c.start < c.end {
+		return m >= c.start && m < c.end
+	}
+
+	return m >= c.start || m < c.end
+}
+
+// at returns the first time at or after t which is the given number of
+// minutes after midnight
+func (c *syncWindow) at(t time.Time, minutes int) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), minutes/60, minutes%60, 0, 0, t.Location())
+	if next.Before(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, minutes/60, minutes%60, 0, 0, t.Location())
+	}
+
+	return next
+}
+
+// Next returns t if it is within the window, or else the time the window
+// next opens
+func (c *syncWindow) Next(t time.Time) time.Time {
+	if c.Contains(t) {
+		return t
+	}
+
+	return c.at(t, c.start)
+}
+
+// Close returns the time the window next closes after t
+func (c *syncWindow) Close(t time.Time) time.Time {
+	return c.at(t, c.end)
+}
+
+// parseInterval parses a sync interval such as "4h", "30m" or "1d"
+func parseInterval(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 1 {
+			return 0, NewErrorf("Invalid interval: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Minute {
+		return 0, NewErrorf("Invalid interval: %s (must be at least 1m)", s)
+	}
+
+	return d, nil
+}
+
+// NextSync returns the time a repo is next due to be synchronized after its
+// last sync at t, according to its schedule or interval, or def if it has
+// neither
+func (c *Repo) NextSync(t time.Time, def time.Duration) time.Time {
+	if c.Schedule != nil {
+		return c.Schedule.Next(t)
+	}
+
+	if c.Interval > 0 {
+		return t.Add(c.Interval)
+	}
+
+	return t.Add(def)
+}
+
+// syncDeadline returns the time a sync of a repo started at t must stop, which
+// is the earlier of its sync_timeout expiring and its allowed_window closing,
+// or zero if it has neither. closes is true if the deadline is the window
+// closing.
+func (c *Repo) syncDeadline(t time.Time) (deadline time.Time, closes bool) {
+	if c.SyncTimeout > 0 {
+		deadline = t.Add(c.SyncTimeout)
+	}
+
+	if c.AllowedWindow != nil {
+		if end := c.AllowedWindow.Close(t); deadline.IsZero() || end.Before(deadline) {
+			return end, true
+		}
+	}
+
+	return deadline, false
+}
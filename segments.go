@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// DefaultSegmentThreshold is the size above which files are downloaded in
+// concurrent segments
+const DefaultSegmentThreshold = 1 << 30
+
+// DefaultDownloadSegments is the number of concurrent segments a large file
+// is downloaded in
+const DefaultDownloadSegments = 4
+
+// offsetWriter writes sequentially to a file from an offset, so that several
+// segments can be written to the same file concurrently
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (c *offsetWriter) Write(p []byte) (int, error) {
+	n, err := c.f.WriteAt(p, c.offset)
+	c.offset += int64(n)
+	return n, err
+}
+
+// downloadSegmented saves the content of a URL to a local file like download,
+// but if the server accepts range requests and the file is larger than the
+// repo's segment_threshold, the file is downloaded in concurrent segments
+// which are written directly into place. The file is not verified, so callers
+// must check its checksum.
+func downloadSegmented(repo *Repo, url, path string) (int64, error) {
+	if repo.SegmentThreshold <= 0 || repo.DownloadSegments < 2 {
+		return download(repo, url, path)
+	}
+
+	resp, err := httpRequest(repo, "HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	size := resp.ContentLength
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || size < repo.SegmentThreshold {
+		return download(repo, url, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	// the file is preallocated, so a partial download is not a prefix of the
+	// file and cannot be resumed. The marker is left by a crash too, so the
+	// file is discarded rather than resumed.
+	marker := segmentsMarkerPath(path)
+	if err := ioutil.WriteFile(marker, nil, 0644); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		os.Remove(marker)
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		discardSegmented(path)
+		return 0, err
+	}
+
+	// If-Range makes the server fail the request rather than return a
+	// different version of the file if it changes between segments
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	n := int64(repo.DownloadSegments)
+	segment := (size + n - 1) / n
+	Dprintf("Downloading %s in %d segments of %s\n", url, n, formatBytes(segment))
+
+	errs := make(chan error, n)
+	for start := int64(0); start < size; start += segment {
+		end := start + segment - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		go func(start, end int64) {
+			errs <- downloadRange(repo, url, validator, f, start, end)
+		}(start, end)
+	}
+
+	for start := int64(0); start < size; start += segment {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		discardSegmented(path)
+		return 0, err
+	}
+
+	if err := os.Remove(marker); err != nil {
+		return 0, err
+	}
+
+	return size, setRemoteTime(repo, resp, path)
+}
+
+// segmentsMarkerPath returns the path of the marker of a file being
+// downloaded in segments
+func segmentsMarkerPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".segments")
+}
+
+// discardSegmented removes a file which was being downloaded in segments,
+// and its marker, if it is incomplete. It returns true if there was one.
+func discardSegmented(path string) bool {
+	if _, err := os.Stat(segmentsMarkerPath(path)); err != nil {
+		return false
+	}
+
+	Dprintf("Discarding incomplete segmented download %s\n", path)
+	os.Remove(path)
+	os.Remove(segmentsMarkerPath(path))
+	return true
+}
+
+// downloadRange writes the given inclusive byte range of a URL to the same
+// offset in a file
+func downloadRange(repo *Repo, url, validator string, f *os.File, start, end int64) error {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if validator != "" {
+		header.Set("If-Range", validator)
+	}
+
+	resp, err := httpRequest(repo, "GET", url, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return NewErrorf("Error retrieving bytes %d-%d of %s: %s", start, end, url, resp.Status)
+	}
+
+	want := end - start + 1
+	n, err := io.Copy(&offsetWriter{f: f, offset: start}, io.LimitReader(resp.Body, want))
+	if err != nil {
+		return err
+	}
+
+	if n != want {
+		return NewErrorf("Short read of bytes %d-%d of %s: got %d bytes", start, end, url, n)
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// repoContentTypes are the content types of files found in repos which are
+// missing from or wrong in the system MIME database
+var repoContentTypes = map[string]string{
+	".rpm":    "application/x-rpm",
+	".xml":    "application/xml",
+	".gz":     "application/gzip",
+	".bz2":    "application/x-bzip2",
+	".xz":     "application/x-xz",
+	".zst":    "application/zstd",
+	".sqlite": "application/vnd.sqlite3",
+	".asc":    "text/plain; charset=utf-8",
+	".key":    "text/plain; charset=utf-8",
+}
+
+// serveRepo is a repo served under a URL prefix
+type serveRepo struct {
+	Repo     *Repo
+	Prefix   string
+	Root     string
+	Auth     *serveAuth
+	Proxy    *pullThrough
+	Verifier *serveVerifier
+}
+
+// Server serves the local mirrors of repos over HTTP. Each repo is served
+// under /<serve_prefix>/, which defaults to the repo ID.
+type Server struct {
+	Listen   string
+	Listings bool
+
+	// TLSCert and TLSKey are the paths of a certificate and key used to serve
+	// HTTPS
+	TLSCert string
+	TLSKey  string
+
+	// ACMEDomains are the domain names for which certificates are obtained
+	// automatically from Let's Encrypt, cached in ACMECache
+	ACMEDomains []string
+	ACMECache   string
+	ACMEEmail   string
+
+	// MetricsPath is the URL path where Prometheus metrics are served, or
+	// empty to disable metrics
+	MetricsPath string
+
+	repos     []serveRepo
+	diskUsage diskUsageCache
+}
+
+// NewServer returns a server for the given repos
+func NewServer(repos []Repo, listen string, listings bool) (*Server, error) {
+	for ext, typ := range repoContentTypes {
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Server{
+		Listen:   listen,
+		Listings: listings,
+		repos:    make([]serveRepo, 0, len(repos)),
+	}
+
+	prefixes := make(map[string]string, len(repos))
+	for i := range repos {
+		repo := &repos[i]
+		prefix := strings.Trim(repo.ServePrefix, "/")
+		if prefix == "" {
+			prefix = repo.ID
+		}
+		prefix = "/" + prefix + "/"
+
+		if id, ok := prefixes[prefix]; ok {
+			return nil, NewErrorf("Repos %s and %s are both served at %s", id, repo.ID, prefix)
+		}
+		prefixes[prefix] = repo.ID
+
+		auth, err := loadServeAuth(repo)
+		if err != nil {
+			return nil, err
+		}
+
+		var proxy *pullThrough
+		if repo.PullThrough {
+			if proxy, err = newPullThrough(repo); err != nil {
+				return nil, err
+			}
+		}
+
+		var verifier *serveVerifier
+		if repo.ServeVerify {
+			verifier = newServeVerifier(repo)
+		}
+
+		c.repos = append(c.repos, serveRepo{
+			Repo:     repo,
+			Prefix:   prefix,
+			Root:     repo.Path(),
+			Auth:     auth,
+			Proxy:    proxy,
+			Verifier: verifier,
+		})
+	}
+
+	// match the longest prefix first
+	sort.Sort(sort.Reverse(serveReposByPrefixLength(c.repos)))
+
+	return c, nil
+}
+
+// ListenAndServe serves HTTP or HTTPS requests until an error occurs
+func (c *Server) ListenAndServe() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return NewErrorf("Both a TLS certificate and key are required")
+	}
+
+	if c.TLSCert != "" && len(c.ACMEDomains) > 0 {
+		return NewErrorf("A TLS certificate cannot be used with ACME")
+	}
+
+	secure := c.TLSCert != "" || len(c.ACMEDomains) > 0
+	for _, repo := range c.repos {
+		if repo.Proxy != nil {
+			Printf("Serving %s at %s from %s (pull-through from %s)\n", repo.Repo.ID, repo.Prefix, repo.Root, strings.Join(repo.Proxy.urls, ", "))
+		} else {
+			Printf("Serving %s at %s from %s\n", repo.Repo.ID, repo.Prefix, repo.Root)
+		}
+		if repo.Auth != nil && !secure {
+			Warnf(nil, "Credentials for %s will be sent in clear text without TLS", repo.Repo.ID)
+		}
+	}
+	if c.MetricsPath != "" {
+		Printf("Serving metrics at %s\n", c.MetricsPath)
+	}
+	Printf("Listening on %s\n", c.Listen)
+
+	switch {
+	case len(c.ACMEDomains) > 0:
+		if err := os.MkdirAll(c.ACMECache, 0700); err != nil {
+			return err
+		}
+
+		// certificates are issued using the TLS-ALPN-01 challenge, which
+		// requires the server to be reachable on port 443
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.ACMECache),
+			HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+			Email:      c.ACMEEmail,
+		}
+
+		server := &http.Server{
+			Addr:      c.Listen,
+			Handler:   c,
+			TLSConfig: manager.TLSConfig(),
+		}
+		return server.ListenAndServeTLS("", "")
+
+	case c.TLSCert != "":
+		return http.ListenAndServeTLS(c.Listen, c.TLSCert, c.TLSKey, c)
+	}
+
+	return http.ListenAndServe(c.Listen, c)
+}
+
+// ServeHTTP serves a file from the repo matching the request path
+func (c *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Dprintf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	if r.URL.Path == "/" {
+		c.serveIndex(w, r)
+		return
+	}
+
+	if c.MetricsPath != "" && urlPath == c.MetricsPath {
+		c.serveMetrics(w, r)
+		return
+	}
+
+	for _, repo := range c.repos {
+		if urlPath+"/" == repo.Prefix || strings.HasPrefix(urlPath, repo.Prefix) {
+			if repo.Auth != nil && !repo.Auth.Allow(r) {
+				Dprintf("Unauthorized request for %s from %s\n", r.URL.Path, r.RemoteAddr)
+				repo.Auth.Challenge(w)
+				return
+			}
+
+			c.serveFile(w, r, repo, strings.TrimPrefix(urlPath+"/", repo.Prefix))
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// serveFile serves a file from a repo, with support for conditional and
+// range requests
+func (c *Server) serveFile(w http.ResponseWriter, r *http.Request, repo serveRepo, rel string) {
+	rel = strings.TrimSuffix(rel, "/")
+
+	// hide temporary files and directories such as .repodata
+	for _, name := range strings.Split(rel, "/") {
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, partFileSuffix) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	// fetch missing files of pull-through repos from upstream
+	if repo.Proxy != nil && rel != "" {
+		if err := repo.Proxy.Fetch(rel); err == errNotInRepo {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			Errorf(err, "Error fetching %s for %s", rel, repo.Repo.ID)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+	}
+
+	name := filepath.Join(repo.Root, filepath.FromSlash(rel))
+	fi, err := os.Stat(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if fi.IsDir() {
+		if !c.Listings {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+	}
+
+	// refuse files which no longer match the repo metadata
+	if repo.Verifier != nil && !fi.IsDir() {
+		if err := repo.Verifier.Verify(rel, fi); err != nil {
+			if err != errCorruptFile {
+				Errorf(err, "Error verifying %s for %s", rel, repo.Repo.ID)
+			}
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if fi.IsDir() {
+		c.serveListing(w, f)
+		return
+	}
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// serveListing writes a plain HTML listing of a directory
+func (c *Server) serveListing(w http.ResponseWriter, dir *os.File) {
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, partFileSuffix) {
+			continue
+		}
+
+		if fi, err := os.Stat(filepath.Join(dir.Name(), name)); err == nil && fi.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", htmlEscaper.Replace(name), htmlEscaper.Replace(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// serveIndex lists the served repos if listings are enabled
+func (c *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if !c.Listings {
+		http.NotFound(w, r)
+		return
+	}
+
+	prefixes := make([]string, 0, len(c.repos))
+	for _, repo := range c.repos {
+		prefixes = append(prefixes, repo.Prefix)
+	}
+	sort.Strings(prefixes)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, prefix := range prefixes {
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", htmlEscaper.Replace(prefix), htmlEscaper.Replace(prefix))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// htmlEscaper escapes file names in directory listings
+var htmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	`"`, "&#34;",
+	"'", "&#39;",
+)
+
+// serveReposByPrefixLength sorts served repos by the length of their prefix
+type serveReposByPrefixLength []serveRepo
+
+func (c serveReposByPrefixLength) Len() int           { return len(c) }
+func (c serveReposByPrefixLength) Less(i, j int) bool { return len(c[i].Prefix) < len(c[j].Prefix) }
+func (c serveReposByPrefixLength) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeVerifier(t *testing.T) {
+	root, err := ioutil.TempDir("", "y10k-serve-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	pkg := []byte("not really an rpm")
+	sum := sha256.Sum256(pkg)
+	primary := fmt.Sprintf(`<metadata><package><name>test</name><checksum type="sha256">%s</checksum><location href="Packages/test.rpm"/></package></metadata>`, hex.EncodeToString(sum[:]))
+	repomd := `<repomd><data type="primary"><location href="repodata/primary.xml"/></data></repomd>`
+
+	files := map[string]string{
+		"repodata/repomd.xml":  repomd,
+		"repodata/primary.xml": primary,
+		"Packages/test.rpm":    string(pkg),
+		"Packages/extra.rpm":   "not in the metadata",
+	}
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := NewRepo()
+	repo.ID = "test"
+	repo.LocalPath = root
+	verifier := newServeVerifier(repo)
+
+	verify := func(rel string) error {
+		fi, err := os.Stat(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return verifier.Verify(rel, fi)
+	}
+
+	if err := verify("Packages/test.rpm"); err != nil {
+		t.Errorf("expected an intact package to verify: %v", err)
+	}
+	if err := verify("Packages/extra.rpm"); err != nil {
+		t.Errorf("expected a file missing from the metadata to be served: %v", err)
+	}
+
+	// the result is cached until the file changes
+	path := filepath.Join(root, "Packages", "test.rpm")
+	if err := ioutil.WriteFile(path, []byte("not really an rpn"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify("Packages/test.rpm"); err != errCorruptFile {
+		t.Errorf("expected a corrupt package to be refused, got %v", err)
+	}
+}
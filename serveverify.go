@@ -0,0 +1,175 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCorruptFile is returned when a served file fails re-verification
+var errCorruptFile = NewErrorf("File does not match the repo metadata")
+
+// serveVerifier re-verifies the packages and metadata files of a served repo
+// against its metadata the first time each is served, so that files corrupted
+// on disk since they were synchronized are refused rather than distributed to
+// clients. Results are cached in memory until the file or the repo metadata
+// changes, so each file is only read once after the server starts.
+type serveVerifier struct {
+	repo     *Repo
+	root     string
+	gpgcheck bool
+
+	mu        sync.Mutex
+	locks     map[string]*sync.Mutex
+	repomd    time.Time
+	checksums map[string]Checksum
+	verified  map[string]verifiedFile
+}
+
+// verifiedFile is the cached result of verifying a file, which is valid while
+// the file's size and modification time are unchanged
+type verifiedFile struct {
+	Info os.FileInfo
+	Err  error
+}
+
+// newServeVerifier returns a verifier for the files of a served repo
+func newServeVerifier(repo *Repo) *serveVerifier {
+	gpgcheck, _ := strToBool(repo.Parameters["gpgcheck"])
+	return &serveVerifier{
+		repo:     repo,
+		root:     repo.Path(),
+		gpgcheck: gpgcheck || len(repo.Fingerprints) > 0,
+		locks:    make(map[string]*sync.Mutex, 0),
+		verified: make(map[string]verifiedFile, 0),
+	}
+}
+
+// lock returns a locked mutex for a file so it is only verified once when
+// requested concurrently
+func (c *serveVerifier) lock(rel string) *sync.Mutex {
+	c.mu.Lock()
+	l, ok := c.locks[rel]
+	if !ok {
+		l = &sync.Mutex{}
+		c.locks[rel] = l
+	}
+	c.mu.Unlock()
+
+	l.Lock()
+	return l
+}
+
+// Verify returns errCorruptFile if a file of the repo does not match its
+// checksum in the repo metadata, or its GPG signature cannot be verified if
+// gpgcheck is enabled. Files which are not listed in the metadata, such as
+// repomd.xml itself, are not verified.
+func (c *serveVerifier) Verify(rel string, fi os.FileInfo) error {
+	l := c.lock(rel)
+	defer l.Unlock()
+
+	checksum, err := c.checksum(rel)
+	if err != nil || checksum == nil {
+		return err
+	}
+
+	c.mu.Lock()
+	prev, ok := c.verified[rel]
+	c.mu.Unlock()
+	if ok && prev.Info.Size() == fi.Size() && prev.Info.ModTime().Equal(fi.ModTime()) {
+		return prev.Err
+	}
+
+	// corrupt files are remembered as well, so they are not read again on
+	// every request
+	err = c.verify(rel, checksum)
+	if err == nil || err == errCorruptFile {
+		c.mu.Lock()
+		c.verified[rel] = verifiedFile{Info: fi, Err: err}
+		c.mu.Unlock()
+	}
+
+	return err
+}
+
+// verify checks a file against its checksum and, for packages, its GPG
+// signature
+func (c *serveVerifier) verify(rel string, checksum *Checksum) error {
+	name := filepath.Join(c.root, filepath.FromSlash(rel))
+	sum, err := checksumFile(name, checksum.Type)
+	if err != nil {
+		return err
+	}
+
+	if sum != strings.ToLower(strings.TrimSpace(checksum.Value)) {
+		Errorf(nil, "Checksum mismatch for %s of '%s': expected %s, got %s", rel, c.repo.ID, checksum.Value, sum)
+		return errCorruptFile
+	}
+
+	if c.gpgcheck && strings.HasSuffix(rel, ".rpm") {
+		bad, err := checkSignatures(c.repo, []string{name})
+		if err != nil {
+			return err
+		}
+
+		if len(bad) > 0 {
+			Errorf(nil, "Invalid signature for %s of '%s'", rel, c.repo.ID)
+			return errCorruptFile
+		}
+	}
+
+	Dprintf("Verified %s for %s\n", rel, c.repo.ID)
+	return nil
+}
+
+// checksum returns the expected checksum of a file from the repo metadata, or
+// nil if the metadata does not list it. The metadata is read again when
+// repomd.xml changes, such as after a sync.
+func (c *serveVerifier) checksum(rel string) (*Checksum, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repomdPath := filepath.Join(c.root, "repodata", "repomd.xml")
+	fi, err := os.Stat(repomdPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if c.checksums == nil || !fi.ModTime().Equal(c.repomd) {
+		repomd, err := ReadRepomd(repomdPath)
+		if err != nil {
+			return nil, err
+		}
+
+		checksums := make(map[string]Checksum, 0)
+		for _, data := range repomd.Data {
+			if data.Checksum.Value != "" {
+				checksums[path.Clean(data.Location.Href)] = data.Checksum
+			}
+		}
+
+		if data := repomd.Get("primary"); data != nil {
+			err := EachPackage(filepath.Join(c.root, filepath.FromSlash(data.Location.Href)), func(pkg *Package) error {
+				checksums[path.Clean(pkg.Location.Href)] = pkg.Checksum
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		c.repomd, c.checksums = fi.ModTime(), checksums
+		c.verified = make(map[string]verifiedFile, 0)
+	}
+
+	if checksum, ok := c.checksums[rel]; ok {
+		return &checksum, nil
+	}
+
+	return nil, nil
+}
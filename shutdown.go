@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// syncTimeoutGrace is how long the child processes of a repo which timed out,
+// or whose allowed_window closed, are given to exit before they are killed
+const syncTimeoutGrace = time.Minute
+
+// errInterrupted is returned by operations which were stopped because y10k is
+// shutting down
+var errInterrupted = NewErrorf("Interrupted")
+
+var (
+	shutdownCtx, shutdownCancel = context.WithCancel(context.Background())
+
+	// gracefulShutdown is set by commands which stop cleanly when interrupted
+	gracefulShutdown bool
+	shutdownLock     sync.Mutex
+
+	// repoCtx is the context of the repo being synchronized, which is also
+	// cancelled when its sync_timeout expires or allowed_window closes
+	repoCtx   = shutdownCtx
+	repoCtxMu sync.Mutex
+)
+
+// ShutdownContext returns a context which is cancelled when y10k is asked to
+// stop by SIGINT or SIGTERM. Downloads made with it are aborted.
+func ShutdownContext() context.Context {
+	return shutdownCtx
+}
+
+// RepoContext returns the context of the repo being synchronized, which is
+// cancelled when y10k is asked to stop or the repo's sync_timeout expires.
+// Outside of a sync, it is ShutdownContext.
+func RepoContext() context.Context {
+	repoCtxMu.Lock()
+	defer repoCtxMu.Unlock()
+	return repoCtx
+}
+
+// interrupted returns true if y10k is shutting down, or the sync of the
+// current repo timed out
+func interrupted() bool {
+	return RepoContext().Err() != nil
+}
+
+// shuttingDown returns true if y10k is shutting down
+func shuttingDown() bool {
+	return shutdownCtx.Err() != nil
+}
+
+// startRepoDeadline starts the sync of a repo which is cancelled, as if y10k
+// were interrupted, at the given deadline, such as when its sync_timeout
+// expires or its allowed_window closes; its downloads are aborted and its
+// child processes are asked to exit, and killed if they do not. A zero
+// deadline never expires. It returns a function to call once the sync has
+// finished, which returns true if the deadline expired.
+func startRepoDeadline(deadline time.Time) func() bool {
+	if deadline.IsZero() {
+		return func() bool { return false }
+	}
+
+	ctx, cancel := context.WithDeadline(shutdownCtx, deadline)
+	repoCtxMu.Lock()
+	repoCtx = ctx
+	repoCtxMu.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+
+		TerminateChildren()
+		select {
+		case <-done:
+		case <-time.After(syncTimeoutGrace):
+			KillChildren()
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		timedOut := ctx.Err() == context.DeadlineExceeded && !shuttingDown()
+		cancel()
+
+		repoCtxMu.Lock()
+		repoCtx = shutdownCtx
+		repoCtxMu.Unlock()
+
+		return timedOut
+	}
+}
+
+// EnableGracefulShutdown makes the first SIGINT or SIGTERM stop the current
+// command cleanly instead of exiting immediately. Downloads are aborted, child
+// processes are asked to terminate, no new child processes are started and
+// syncs stop at their next step, leaving partial downloads to be resumed.
+func EnableGracefulShutdown() {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	gracefulShutdown = true
+}
+
+// handleSignals handles SIGINT and SIGTERM. Unless graceful shutdown is
+// enabled, or on a second signal, child processes are killed and y10k exits
+// immediately.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range c {
+			shutdownLock.Lock()
+			graceful := gracefulShutdown && !interrupted()
+			shutdownLock.Unlock()
+
+			if graceful {
+				Printf("Caught %v. Stopping after the current step; repeat to exit immediately...\n", sig)
+				shutdownCancel()
+				TerminateChildren()
+				continue
+			}
+
+			Printf("Caught %v. Cleaning up...\n", sig)
+
+			KillChildren()
+
+			Printf("Exiting\n")
+			os.Exit(2)
+		}
+	}()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// parsePackageList parses a list of package names separated by commas or
+// whitespace
+func parsePackageList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// assumeNoPattern matches the message printed by dnf and yum when a
+// transaction is declined with --assumeno, after it was resolved
+var assumeNoPattern = regexp.MustCompile(`(?m)^(Operation aborted|Exiting on user command)`)
+
+// smokeTest checks that the packages listed in a repo's smoketest option can
+// be installed, with all of their dependencies, from the copy of the repo at
+// path, such as its local path or a snapshot, and any repos listed in its
+// smoketest_with option. Resolution is done by dnf, or yum if dnf is not
+// installed, in an empty install root; nothing is downloaded or installed.
+func (c *Yumfile) smokeTest(repo *Repo, path string) error {
+	if len(repo.SmokeTest) == 0 {
+		return nil
+	}
+
+	Printf("Resolving smoke test packages: %s\n", repo.ID)
+	dir, err := ioutil.TempDir(TmpBasePath, TmpFilePrefix+fmt.Sprintf("%d.smoketest.", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// configure the local repos to resolve against
+	repos := []*Repo{repo}
+	for _, id := range repo.SmokeTestWith {
+		r := c.GetRepoByID(id)
+		if r == nil {
+			return NewErrorf("No such repo for smoke test of %s: %s", repo.ID, id)
+		}
+		repos = append(repos, r)
+	}
+
+	conf := filepath.Join(dir, "yum.conf")
+	f, err := os.Create(conf)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(f, "[main]\n")
+	fmt.Fprintf(f, "cachedir=%s\n", filepath.Join(dir, "cache"))
+	fmt.Fprintf(f, "gpgcheck=0\n")
+	fmt.Fprintf(f, "plugins=0\n")
+	fmt.Fprintf(f, "reposdir=\n")
+	fmt.Fprintf(f, "\n")
+
+	ids := make([]string, 0, len(repos))
+	for _, r := range repos {
+		root := r.Path()
+		if r == repo {
+			root = path
+		}
+
+		root, err := filepath.Abs(root)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		fmt.Fprintf(f, "[%s]\n", r.ID)
+		fmt.Fprintf(f, "baseurl=file://%s\n", root)
+		fmt.Fprintf(f, "enabled=1\n")
+		fmt.Fprintf(f, "gpgcheck=0\n")
+		fmt.Fprintf(f, "\n")
+		ids = append(ids, r.ID)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	name := "dnf"
+	if _, err := exec.LookPath(name); err != nil {
+		name = "yum"
+	}
+
+	args := []string{
+		fmt.Sprintf("--config=%s", conf),
+		fmt.Sprintf("--installroot=%s", filepath.Join(dir, "root")),
+		"--releasever=0",
+		"--disablerepo=*",
+		fmt.Sprintf("--enablerepo=%s", strings.Join(ids, ",")),
+		"--assumeno",
+		"install",
+	}
+
+	// --assumeno exits non-zero once the transaction is resolved, which is
+	// only a success if the transaction was then declined
+	out, err := ExecCombinedOutput(name, append(args, repo.SmokeTest...)...)
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return err
+	}
+
+	problems := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Error") || strings.HasPrefix(line, "Problem") || strings.HasPrefix(line, "- nothing provides") || strings.HasPrefix(line, "Requires:") || strings.HasPrefix(line, "No package") {
+			problems = append(problems, line)
+		}
+	}
+
+	if len(problems) > 0 {
+		return NewErrorf("Failed to resolve %s: %s", strings.Join(repo.SmokeTest, " "), strings.Join(problems, "; "))
+	}
+
+	if err != nil && !assumeNoPattern.Match(out) {
+		return NewErrorf("Failed to resolve %s: %s %v: %s", strings.Join(repo.SmokeTest, " "), name, err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
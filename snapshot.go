@@ -0,0 +1,399 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// snapshotInfoFileName is the name of the file in the root of a snapshot
+// which describes it
+const snapshotInfoFileName = ".y10k-snapshot.json"
+
+// snapshotNameFormat is the time format of default snapshot names
+const snapshotNameFormat = "2006-01-02T150405"
+
+// ioctlFICLONE is the Linux ioctl which clones (reflinks) a file on
+// filesystems which support it, such as Btrfs and XFS
+const ioctlFICLONE = 0x40049409
+
+// SnapshotInfo describes a point-in-time copy of a repo
+type SnapshotInfo struct {
+	Repo     string    `json:"repo"`
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	Revision string    `json:"revision"`
+	Packages int       `json:"packages"`
+	Size     int64     `json:"size"`
+}
+
+// SnapshotDir returns the directory where snapshots of the repo are kept
+func (c *Repo) SnapshotDir() string {
+	if c.SnapshotPath != "" {
+		return c.SnapshotPath
+	}
+
+	return strings.TrimSuffix(c.Path(), "/") + ".snapshots"
+}
+
+// validSnapshotName returns an error if a snapshot name cannot be used as a
+// directory name in the snapshot directory
+func validSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return NewErrorf("Invalid snapshot name: %s", name)
+	}
+
+	return nil
+}
+
+// CreateSnapshot creates an immutable copy of a repo's current state. Package
+// files are hardlinked into the snapshot, so it uses almost no extra disk
+// space. Repo metadata is copied, using a reflink where the filesystem
+// supports it, so later syncs cannot change it. If name is empty, the
+// snapshot is named after the current time.
+func CreateSnapshot(repo *Repo, name string) (*SnapshotInfo, error) {
+	if name == "" {
+		name = time.Now().Format(snapshotNameFormat)
+	}
+
+	if err := validSnapshotName(name); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(repo.SnapshotDir(), name)
+	if _, err := os.Lstat(dir); err == nil {
+		return nil, NewErrorf("Snapshot %s of %s already exists", name, repo.ID)
+	}
+
+	if err := os.MkdirAll(repo.SnapshotDir(), 0755); err != nil {
+		return nil, err
+	}
+
+	// build the snapshot in a temporary directory so an incomplete snapshot
+	// is never visible
+	tmp, err := ioutil.TempDir(repo.SnapshotDir(), ".tmp-"+name+".")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return nil, err
+	}
+
+	Printf("Creating snapshot %s of %s\n", name, repo.ID)
+	info := &SnapshotInfo{
+		Repo:    repo.ID,
+		Name:    name,
+		Created: time.Now().UTC(),
+	}
+
+	if repomd, err := ReadRepomd(filepath.Join(repo.Path(), "repodata", "repomd.xml")); err == nil {
+		info.Revision = repomd.Revision
+	}
+
+	src := filepath.Clean(repo.Path())
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		// skip temporary files and directories, and the repo's lock file
+		base := filepath.Base(path)
+		if rel != "." && (base == ".repodata" || base == ".olddata" || rel == repoLockName || strings.HasSuffix(base, partFileSuffix) || strings.HasSuffix(base, partFileSuffix+".segments")) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dst := filepath.Join(tmp, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(dst, 0755)
+
+		case !fi.Mode().IsRegular():
+			return nil
+
+		case strings.HasPrefix(rel, "repodata"+string(filepath.Separator)):
+			return cloneFile(path, dst)
+		}
+
+		if strings.HasSuffix(path, ".rpm") {
+			info.Packages++
+			info.Size += fi.Size()
+		}
+
+		if err := os.Link(path, dst); err != nil {
+			Dprintf("Failed to hardlink %s, copying instead: %v\n", path, err)
+			return cloneFile(path, dst)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeJSON(filepath.Join(tmp, snapshotInfoFileName), info); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, err
+	}
+
+	// prevent files being added to or removed from the snapshot
+	if err := setTreeWritable(dir, false); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// ListSnapshots returns all snapshots of a repo, oldest first
+func ListSnapshots(repo *Repo) ([]SnapshotInfo, error) {
+	files, err := ioutil.ReadDir(repo.SnapshotDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]SnapshotInfo, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		info := SnapshotInfo{}
+		if err := readJSON(filepath.Join(repo.SnapshotDir(), file.Name(), snapshotInfoFileName), &info); err != nil {
+			Dprintf("Skipping %s: %v\n", file.Name(), err)
+			continue
+		}
+		info.Name = file.Name()
+		snapshots = append(snapshots, info)
+	}
+
+	sort.Sort(snapshotsByCreated(snapshots))
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes a snapshot of a repo
+func DeleteSnapshot(repo *Repo, name string) error {
+	if err := validSnapshotName(name); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(repo.SnapshotDir(), name)
+	if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() {
+		return NewErrorf("No such snapshot of %s: %s", repo.ID, name)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, snapshotInfoFileName)); err != nil {
+		return NewErrorf("No such snapshot of %s: %s", repo.ID, name)
+	}
+
+	channels, err := ListChannels(repo)
+	if err != nil {
+		return err
+	}
+
+	for channel, target := range channels {
+		if target == name {
+			return NewErrorf("Snapshot %s of %s is promoted to %s", name, repo.ID, channel)
+		}
+	}
+
+	Printf("Deleting snapshot %s of %s\n", name, repo.ID)
+	if err := setTreeWritable(dir, true); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// setTreeWritable adds or removes write permission from all directories in a
+// tree. The permissions of files are not changed as they may be hardlinks
+// shared with the mirror.
+func setTreeWritable(root string, writable bool) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			return nil
+		}
+
+		mode := fi.Mode().Perm() &^ 0222
+		if writable {
+			mode |= 0200
+		}
+
+		return os.Chmod(path, mode)
+	})
+}
+
+// cloneFile copies a file, preserving its permissions and modification time.
+// The copy is a reflink sharing the same data blocks if the filesystem
+// supports it.
+func cloneFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ioctlFICLONE, in.Fd()); errno != 0 {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// snapshotsByCreated sorts snapshots by their creation time
+type snapshotsByCreated []SnapshotInfo
+
+func (c snapshotsByCreated) Len() int           { return len(c) }
+func (c snapshotsByCreated) Less(i, j int) bool { return c[i].Created.Before(c[j].Created) }
+func (c snapshotsByCreated) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// ListChannels returns the snapshot each promotion channel of a repo points
+// to, keyed by channel name
+func ListChannels(repo *Repo) (map[string]string, error) {
+	files, err := ioutil.ReadDir(repo.SnapshotDir())
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	channels := make(map[string]string, 0)
+	for _, file := range files {
+		if file.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := os.Readlink(filepath.Join(repo.SnapshotDir(), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		channels[file.Name()] = filepath.Base(target)
+	}
+
+	return channels, nil
+}
+
+// PromoteSnapshot points a channel, such as "stable" or "testing", at a
+// snapshot of a repo. Channels are symlinks in the snapshot directory, so
+// clients configured with the channel's path switch to the new snapshot
+// atomically. The repo's smoke test is run against the snapshot first, and
+// the channel is left unchanged if it fails.
+func (c *Yumfile) PromoteSnapshot(repo *Repo, name, channel string) error {
+	if err := validSnapshotName(name); err != nil {
+		return err
+	}
+
+	if err := validSnapshotName(channel); err != nil {
+		return NewErrorf("Invalid channel name: %s", channel)
+	}
+
+	if _, err := os.Stat(filepath.Join(repo.SnapshotDir(), name, snapshotInfoFileName)); err != nil {
+		return NewErrorf("No such snapshot of %s: %s", repo.ID, name)
+	}
+
+	path := filepath.Join(repo.SnapshotDir(), channel)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return NewErrorf("Cannot use %s as a channel name as it is not a symlink", path)
+	}
+
+	if err := c.smokeTest(repo, filepath.Join(repo.SnapshotDir(), name)); err != nil {
+		return NewErrorf("Smoke test of snapshot %s failed: %v", name, err)
+	}
+
+	// replace the channel link atomically
+	tmp := filepath.Join(repo.SnapshotDir(), ".tmp-"+channel)
+	os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := syncDir(repo.SnapshotDir()); err != nil {
+		return err
+	}
+
+	Printf("Promoted snapshot %s of %s to %s\n", name, repo.ID, channel)
+	return nil
+}
+
+// PruneSnapshots deletes the oldest snapshots of a repo beyond its configured
+// snapshot_retention count. Snapshots which a channel points to are never
+// deleted and do not count towards the limit.
+func PruneSnapshots(repo *Repo) error {
+	if repo.SnapshotRetention <= 0 {
+		return nil
+	}
+
+	snapshots, err := ListSnapshots(repo)
+	if err != nil {
+		return err
+	}
+
+	channels, err := ListChannels(repo)
+	if err != nil {
+		return err
+	}
+
+	promoted := make(map[string]bool, len(channels))
+	for _, name := range channels {
+		promoted[name] = true
+	}
+
+	unpromoted := make([]SnapshotInfo, 0, len(snapshots))
+	for _, info := range snapshots {
+		if !promoted[info.Name] {
+			unpromoted = append(unpromoted, info)
+		}
+	}
+
+	for i := 0; i < len(unpromoted)-repo.SnapshotRetention; i++ {
+		if err := DeleteSnapshot(repo, unpromoted[i].Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RepoSplit is a subset of a repo's packages which is written to a tree of
+// its own, with its own metadata, each time the repo is synchronized
+type RepoSplit struct {
+	Name      string
+	Selectors []splitSelector
+	Spec      string
+}
+
+// splitSelector matches packages by name or architecture against a list of
+// shell globs. A negated selector matches packages which match none of them.
+type splitSelector struct {
+	Field    string
+	Patterns []string
+	Negate   bool
+}
+
+// parseSplit parses a split option of the form
+// "<name> <field>=<glob>[,<glob>...] ..." where field is name or arch,
+// optionally prefixed with ! to negate it. A package is included in the split
+// if it matches every selector.
+func parseSplit(s string) (*RepoSplit, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return nil, NewErrorf("Invalid split: %s (expected a name and selectors such as arch=x86_64,noarch)", s)
+	}
+
+	split := &RepoSplit{Name: fields[0], Spec: s}
+	if err := validSnapshotName(split.Name); err != nil {
+		return nil, NewErrorf("Invalid split name: %s", split.Name)
+	}
+
+	for _, field := range fields[1:] {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return nil, NewErrorf("Invalid split selector: %s (expected name=<glob> or arch=<glob>)", field)
+		}
+
+		selector := splitSelector{Field: field[:i]}
+		if strings.HasPrefix(selector.Field, "!") {
+			selector.Field, selector.Negate = selector.Field[1:], true
+		}
+		if selector.Field != "name" && selector.Field != "arch" {
+			return nil, NewErrorf("Invalid split selector: %s (expected name=<glob> or arch=<glob>)", field)
+		}
+
+		for _, pattern := range strings.Split(field[i+1:], ",") {
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, NewErrorf("Invalid pattern in split selector: %s", pattern)
+			}
+			selector.Patterns = append(selector.Patterns, pattern)
+		}
+		if len(selector.Patterns) == 0 {
+			return nil, NewErrorf("Invalid split selector: %s (no patterns)", field)
+		}
+
+		split.Selectors = append(split.Selectors, selector)
+	}
+
+	return split, nil
+}
+
+// Match returns true if a package matches every selector of the split
+func (c *RepoSplit) Match(pkg *Package) bool {
+	for _, selector := range c.Selectors {
+		value := pkg.Name
+		if selector.Field == "arch" {
+			value = pkg.Arch
+		}
+
+		matched := false
+		for _, pattern := range selector.Patterns {
+			if ok, _ := path.Match(pattern, value); ok {
+				matched = true
+				break
+			}
+		}
+
+		if matched == selector.Negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splitRepo returns the repo of a split's tree. It is written beside the
+// repo, with the split's name appended to the repo's ID, local path and each
+// publish target.
+func (c *Repo) splitRepo(split *RepoSplit) *Repo {
+	repo := *c
+	repo.ID = c.ID + "-" + split.Name
+	repo.Splits = nil
+
+	if c.LocalPath != "" {
+		repo.LocalPath = strings.TrimSuffix(c.LocalPath, "/") + "-" + split.Name
+	}
+
+	if c.StagingPath != "" {
+		repo.StagingPath = strings.TrimSuffix(c.StagingPath, "/") + "-" + split.Name
+	}
+
+	repo.PublishTargets = make([]string, len(c.PublishTargets))
+	for i, target := range c.PublishTargets {
+		repo.PublishTargets[i] = strings.TrimSuffix(target, "/") + "-" + split.Name
+	}
+
+	return &repo
+}
+
+// writeSplits writes the packages of a repo selected by each of its splits to
+// the split's tree and updates the tree's metadata. Packages are hardlinked
+// from the repo, so a split costs no extra download or disk space.
+func (c *Yumfile) writeSplits(repo *Repo) error {
+	if len(repo.Splits) == 0 {
+		return nil
+	}
+
+	source, err := localDiffSource(repo.ID, repo.Path())
+	if err != nil {
+		return err
+	}
+
+	for i := range repo.Splits {
+		if interrupted() {
+			return errInterrupted
+		}
+
+		split := &repo.Splits[i]
+		if err := c.writeSplit(repo, split, source.Primary); err != nil {
+			return NewErrorf("Failed to write split %s: %v", split.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeSplit writes the tree of one split of a repo
+func (c *Yumfile) writeSplit(repo *Repo, split *RepoSplit, primary string) error {
+	splitRepo := repo.splitRepo(split)
+	files := make(map[string]bool, 0)
+	err := EachPackage(primary, func(pkg *Package) error {
+		if !split.Match(pkg) {
+			return nil
+		}
+
+		rel := filepath.Clean(pkg.Location.Href)
+		if strings.HasPrefix(rel, "..") || filepath.IsAbs(rel) {
+			return NewErrorf("Invalid package location: %s", pkg.Location.Href)
+		}
+		files[rel] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	Printf("Writing %d packages to split: %s\n", len(files), splitRepo.ID)
+	paths := make([]string, 0, len(files))
+	for rel := range files {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		if err := linkPackage(filepath.Join(repo.Path(), rel), filepath.Join(splitRepo.Path(), rel)); err != nil {
+			return err
+		}
+	}
+
+	// splits share the repo's groups
+	if repo.Groupfile != "" {
+		if err := linkPackage(filepath.Join(repo.Path(), repo.Groupfile), filepath.Join(splitRepo.Path(), repo.Groupfile)); err != nil {
+			return err
+		}
+	}
+
+	current, err := localPackages(splitRepo.Path())
+	if err != nil {
+		return err
+	}
+
+	stale := make([]upstreamPackage, 0)
+	for rel := range current {
+		if !files[rel] {
+			stale = append(stale, upstreamPackage{Path: rel})
+		}
+	}
+
+	if err := prunePackages(splitRepo, stale, "unselected"); err != nil {
+		return err
+	}
+
+	if err := c.createrepo(splitRepo); err != nil {
+		return err
+	}
+
+	return applyFilePermissions(splitRepo)
+}
+
+// publishSplits publishes the tree of each split of a repo to the repo's
+// publish targets, with the split's name appended
+func (c *Yumfile) publishSplits(repo *Repo) error {
+	for i := range repo.Splits {
+		if err := c.publish(repo.splitRepo(&repo.Splits[i])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitSpecs returns the split options of a repo, for printing
+func splitSpecs(splits []RepoSplit) []string {
+	specs := make([]string, len(splits))
+	for i, split := range splits {
+		specs[i] = split.Spec
+	}
+
+	return specs
+}
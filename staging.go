@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// downloadStagingDir returns the directory where packages of a repo with
+// staging_dir are downloaded and validated before they are moved into the
+// repo, or an empty string if the repo downloads into its local path
+func (c *Repo) downloadStagingDir() string {
+	if c.DownloadStaging == "" {
+		return ""
+	}
+
+	return filepath.Join(c.DownloadStaging, c.ID)
+}
+
+// downloadPath returns the directory the packages of a repo are downloaded
+// into
+func (c *Repo) downloadPath() string {
+	if dir := c.downloadStagingDir(); dir != "" {
+		return dir
+	}
+
+	return c.Path()
+}
+
+// moveFile moves a file into place, copying it if the destination is on
+// another filesystem. A copy is written beside the destination under a hidden
+// name and renamed, so the destination never holds a partial file.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	err := renameSynced(src, dst)
+	if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+partFileSuffix)
+	if err := cloneFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := renameSynced(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// stageLocalPackages links each package of a repo into its staging directory,
+// so that reposync only downloads packages the repo does not have. Packages
+// left in the staging directory by an interrupted sync are kept, to be
+// validated with the new downloads.
+func stageLocalPackages(repo *Repo) error {
+	staging := repo.downloadStagingDir()
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+
+	// links of a previous sync may point at packages since removed
+	if err := removeStagedLinks(staging); err != nil {
+		return err
+	}
+
+	root := absPath(repo.Path())
+	files, err := findPackages(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		link := filepath.Join(staging, rel)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Symlink(path, link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeStagedLinks removes the links to local packages from a staging
+// directory
+func removeStagedLinks(staging string) error {
+	return filepath.Walk(staging, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		return os.Remove(p)
+	})
+}
+
+// commitStaged moves the files downloaded into the staging directory of a
+// repo into its local path, once they have been validated. If the local
+// packages were linked into the staging directory, packages whose links were
+// removed, by reposync --delete or because they failed validation, are also
+// removed from the repo. It returns the number of files moved.
+func commitStaged(repo *Repo, linked bool) (int, error) {
+	staging := repo.downloadStagingDir()
+	if staging == "" {
+		return 0, nil
+	}
+
+	moved := 0
+	staged := make(map[string]bool, 0)
+	err := filepath.Walk(staging, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// partial downloads are kept to be resumed by the next sync
+		hidden := p != staging && strings.HasPrefix(info.Name(), ".")
+		if info.IsDir() && hidden {
+			return filepath.SkipDir
+		} else if info.IsDir() || hidden || strings.HasSuffix(p, partFileSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(staging, p)
+		if err != nil {
+			return err
+		}
+
+		staged[filepath.Clean(rel)] = true
+		if info.Mode()&os.ModeSymlink != 0 {
+			return os.Remove(p)
+		}
+
+		if err := moveFile(p, filepath.Join(repo.Path(), rel)); err != nil {
+			return err
+		}
+		moved++
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+	Dprintf("Moved %d staged files into %s\n", moved, repo.Path())
+
+	if !linked {
+		return moved, nil
+	}
+
+	files, err := findPackages(repo.Path())
+	if os.IsNotExist(err) {
+		return moved, nil
+	} else if err != nil {
+		return moved, err
+	}
+
+	for _, path := range files {
+		rel, err := filepath.Rel(repo.Path(), path)
+		if err != nil {
+			return moved, err
+		}
+
+		if staged[filepath.Clean(rel)] {
+			continue
+		}
+
+		Dprintf("Removing %s, which was removed from the staging directory\n", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return moved, err
+		}
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StatsEntry records the outcome of one sync of a repo in its stats history
+type StatsEntry struct {
+	Time       time.Time     `json:"time"`
+	Status     string        `json:"status"`
+	Duration   time.Duration `json:"duration_ns"`
+	Downloaded int           `json:"packages_downloaded"`
+	Deleted    int           `json:"packages_deleted"`
+	Filtered   int           `json:"packages_filtered"`
+	Bytes      int64         `json:"bytes_transferred"`
+	Errors     int           `json:"errors"`
+
+	// Packages and Size are the number and total size of the packages in
+	// the repo after the sync, or zero if it was up to date or failed
+	// before they were counted
+	Packages int   `json:"packages,omitempty"`
+	Size     int64 `json:"size,omitempty"`
+}
+
+// statsPath returns the path of the stats history of a repo. The history has
+// one JSON entry per line and is only ever appended to.
+func (c *Repo) statsPath() string {
+	return filepath.Join(c.CacheDir(), c.ID, "stats.jsonl")
+}
+
+// recordStats appends the outcome of a repo's sync to its stats history.
+// Skipped repos are not recorded.
+func recordStats(repo *Repo, report *RepoReport) error {
+	if report.Status == RepoStatusSkipped {
+		return nil
+	}
+
+	entry := &StatsEntry{
+		Time:       report.Start.UTC(),
+		Status:     report.Status,
+		Duration:   report.Duration,
+		Downloaded: report.Downloaded,
+		Deleted:    report.Deleted,
+		Filtered:   report.Filtered,
+		Bytes:      report.Bytes,
+		Errors:     report.Errors,
+		Packages:   report.Packages,
+		Size:       report.Size,
+	}
+
+	path := repo.statsPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// ReadStats returns the last n entries of a repo's stats history, oldest
+// first, or every entry if n is zero. Malformed lines, such as a line left
+// incomplete by an interrupted sync, are skipped with a warning.
+func ReadStats(repo *Repo, n int) ([]StatsEntry, error) {
+	entries := make([]StatsEntry, 0)
+	f, err := os.Open(repo.statsPath())
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := StatsEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			Warnf(err, "Skipping invalid stats entry in %s:%d", repo.statsPath(), line)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+
+	return entries, nil
+}
+
+// PrintStats prints one line per entry of a repo's stats history, followed by
+// the totals and trends of the entries
+func PrintStats(w io.Writer, repo *Repo, entries []StatsEntry) {
+	if len(entries) == 0 {
+		fmt.Fprintf(w, "No stats recorded for %s\n", repo.ID)
+		return
+	}
+
+	fmt.Fprintf(w, "%-20s %-10s %10s %10s %8s %8s %8s %10s\n", "TIME", "STATUS", "DURATION", "TRANSFER", "ADDED", "DELETED", "PACKAGES", "SIZE")
+	for _, entry := range entries {
+		packages, size := "-", "-"
+		if entry.Packages > 0 {
+			packages, size = fmt.Sprintf("%d", entry.Packages), formatBytes(entry.Size)
+		}
+		fmt.Fprintf(w, "%-20s %-10s %10v %10s %8d %8d %8s %10s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Status, entry.Duration.Truncate(time.Second), formatBytes(entry.Bytes), entry.Downloaded, entry.Deleted, packages, size)
+	}
+
+	var duration time.Duration
+	var bytes int64
+	downloaded, deleted, failed := 0, 0, 0
+	for _, entry := range entries {
+		duration += entry.Duration
+		bytes += entry.Bytes
+		downloaded += entry.Downloaded
+		deleted += entry.Deleted
+		if entry.Status == RepoStatusFailed {
+			failed++
+		}
+	}
+
+	n := len(entries)
+	fmt.Fprintf(w, "\n%d syncs since %s, %d failed\n", n, entries[0].Time.Local().Format("2006-01-02"), failed)
+	fmt.Fprintf(w, "Transferred %s (%s per sync), %d packages added, %d deleted\n", formatBytes(bytes), formatBytes(bytes/int64(n)), downloaded, deleted)
+	fmt.Fprintf(w, "Average duration %v\n", (duration / time.Duration(n)).Truncate(time.Second))
+
+	// growth between the first and last syncs which counted the repo
+	var first, last *StatsEntry
+	for i := range entries {
+		if entries[i].Packages == 0 {
+			continue
+		}
+		if first == nil {
+			first = &entries[i]
+		}
+		last = &entries[i]
+	}
+	if first == nil || first == last {
+		return
+	}
+
+	growth := last.Size - first.Size
+	days := last.Time.Sub(first.Time).Hours() / 24
+	fmt.Fprintf(w, "Grew by %d packages, %s", last.Packages-first.Packages, formatSignedBytes(growth))
+	if days >= 1 {
+		fmt.Fprintf(w, " (%s per day)", formatSignedBytes(int64(float64(growth)/days)))
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// formatSignedBytes formats a size which may be negative
+func formatSignedBytes(n int64) string {
+	if n < 0 {
+		return "-" + formatBytes(-n)
+	}
+
+	return formatBytes(n)
+}
+
+// WriteStatsCSV writes the entries of a repo's stats history as CSV, with a
+// header row
+func WriteStatsCSV(w io.Writer, repo *Repo, entries []StatsEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"repo", "time", "status", "duration_seconds", "bytes_transferred", "packages_downloaded", "packages_deleted", "packages_filtered", "errors", "packages", "size"})
+	for _, entry := range entries {
+		cw.Write([]string{
+			repo.ID,
+			entry.Time.Format(time.RFC3339),
+			entry.Status,
+			fmt.Sprintf("%.0f", entry.Duration.Seconds()),
+			fmt.Sprintf("%d", entry.Bytes),
+			fmt.Sprintf("%d", entry.Downloaded),
+			fmt.Sprintf("%d", entry.Deleted),
+			fmt.Sprintf("%d", entry.Filtered),
+			fmt.Sprintf("%d", entry.Errors),
+			fmt.Sprintf("%d", entry.Packages),
+			fmt.Sprintf("%d", entry.Size),
+		})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RepoStatus describes the freshness of the local mirror of a repo, from its
+// sync statistics, its local metadata and the last upstream metadata fetched
+type RepoStatus struct {
+	Repo                string         `json:"repo"`
+	Path                string         `json:"path"`
+	LastSync            time.Time      `json:"last_sync"`
+	LastSuccess         time.Time      `json:"last_success"`
+	ConsecutiveFailures int64          `json:"consecutive_failures"`
+	Packages            int            `json:"packages"`
+	Size                int64          `json:"size_bytes"`
+	LocalRevision       string         `json:"local_revision"`
+	SyncedRevision      string         `json:"synced_revision"`
+	UpstreamRevision    string         `json:"upstream_revision"`
+	Pending             *PendingChange `json:"pending,omitempty"`
+	Error               string         `json:"error,omitempty"`
+}
+
+// PendingChange estimates the packages the next sync of a repo would
+// download and delete, by comparing the upstream package list with the local
+// packages. Package filters such as exclude, includepkgs and retain are not
+// applied.
+type PendingChange struct {
+	Downloads int   `json:"downloads"`
+	Deletes   int   `json:"deletes"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Current returns true if the local mirror was last synchronized from the
+// upstream revision last fetched. The local metadata is generated by
+// createrepo, so its own revision differs from upstream.
+func (c *RepoStatus) Current() bool {
+	return c.SyncedRevision != "" && c.SyncedRevision == c.UpstreamRevision
+}
+
+// Status returns the status of the local mirror of a repo. Unless online is
+// set, the upstream revision and pending changes are those of the upstream
+// metadata cached by the last sync or status check.
+func Status(repo *Repo, online bool) *RepoStatus {
+	status := &RepoStatus{
+		Repo: repo.ID,
+		Path: repo.Path(),
+	}
+
+	unlock, err := readLockCaches(repo)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer unlock()
+
+	if err := status.read(repo, online); err != nil {
+		status.Error = err.Error()
+	}
+
+	return status
+}
+
+func (c *RepoStatus) read(repo *Repo, online bool) error {
+	m, err := readRepoMetrics(repo)
+	if err != nil {
+		return err
+	}
+	c.LastSync = m.LastSync
+	c.LastSuccess = m.LastSuccess
+	c.ConsecutiveFailures = m.ConsecutiveFailures
+
+	state := &syncState{}
+	if err := readJSON(repo.syncStatePath(), state); err == nil {
+		c.SyncedRevision = state.Revision
+	}
+
+	local, err := localPackages(c.Path)
+	if err != nil {
+		return err
+	}
+	c.Size = diskUsage(c.Path)
+
+	// count the packages clients see in the local metadata
+	if repomd, err := ReadRepomd(filepath.Join(c.Path, "repodata", "repomd.xml")); err == nil {
+		c.LocalRevision = repomd.Revision
+		if data := repomd.Get("primary"); data != nil {
+			err := EachPackage(filepath.Join(c.Path, data.Location.Href), func(pkg *Package) error {
+				c.Packages++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if repo.RsyncURL() != "" {
+		return nil
+	}
+
+	primary, err := c.upstreamPrimary(repo, online)
+	if err != nil || primary == "" {
+		return err
+	}
+
+	c.Pending, err = pendingChanges(repo, primary, local)
+	return err
+}
+
+// upstreamPrimary returns the path of the cached upstream primary metadata
+// of a repo, fetching it first if online is set, or an empty path if it is
+// not cached
+func (c *RepoStatus) upstreamPrimary(repo *Repo, online bool) (string, error) {
+	var repomd *Repomd
+	baseurl := ""
+	if online {
+		var err error
+		if baseurl, repomd, err = repo.fetchUpstreamRepomd(); err != nil {
+			return "", NewErrorf("Failed to fetch upstream metadata: %v", err)
+		}
+	} else {
+		var err error
+		if repomd, err = ReadRepomd(filepath.Join(repo.upstreamCacheDir(), "repomd.xml")); err != nil {
+			return "", nil
+		}
+	}
+	c.UpstreamRevision = repomd.Revision
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return "", nil
+	}
+
+	if online {
+		return repo.fetchUpstreamMetadata(baseurl, data)
+	}
+
+	path := filepath.Join(repo.upstreamCacheDir(), filepath.Base(data.Location.Href))
+	if _, err := os.Stat(path); err != nil {
+		return "", nil
+	}
+
+	return path, nil
+}
+
+// pendingChanges estimates the changes the next sync of a repo would make
+// from its upstream primary metadata and local packages. With newonly, only
+// the newest version of each package is counted.
+func pendingChanges(repo *Repo, primary string, local map[string]bool) (*PendingChange, error) {
+	packages := make(map[string]Package, 0)
+	err := EachPackage(primary, func(pkg *Package) error {
+		key := filepath.Clean(pkg.Location.Href)
+		if repo.NewOnly {
+			key = pkg.Name + "." + pkg.Arch
+		}
+
+		if p, ok := packages[key]; !ok || compareVersions(pkg.Version, p.Version) > 0 {
+			packages[key] = *pkg
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &PendingChange{}
+	upstream := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		rel := filepath.Clean(pkg.Location.Href)
+		upstream[rel] = true
+		if !local[rel] {
+			pending.Downloads++
+			pending.Bytes += pkg.Size.Package
+		}
+	}
+
+	if repo.DeleteRemoved {
+		for rel := range local {
+			if !upstream[rel] {
+				pending.Deletes++
+			}
+		}
+	}
+
+	return pending, nil
+}
+
+// formatAge formats the time since t for status output
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+
+	return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+}
+
+// PrintRepoStatuses prints the status of each repo as a table
+func PrintRepoStatuses(statuses []*RepoStatus) {
+	fmt.Printf("%-30s %-10s %-10s %8s %10s %-12s %-12s %s\n", "REPO", "SYNCED", "SUCCEEDED", "PACKAGES", "SIZE", "REVISION", "UPSTREAM", "PENDING")
+	for _, status := range statuses {
+		upstream := status.UpstreamRevision
+		switch {
+		case upstream == "":
+			upstream = "-"
+		case status.Current():
+			upstream = "current"
+		}
+
+		pending := "-"
+		if status.Pending != nil {
+			pending = fmt.Sprintf("+%d -%d (%s)", status.Pending.Downloads, status.Pending.Deletes, formatBytes(status.Pending.Bytes))
+		}
+
+		local := status.SyncedRevision
+		if local == "" {
+			local = "-"
+		}
+
+		fmt.Printf("%-30s %-10s %-10s %8d %10s %-12s %-12s %s\n", status.Repo, formatAge(status.LastSync), formatAge(status.LastSuccess), status.Packages, formatBytes(status.Size), local, upstream, pending)
+		if status.Error != "" {
+			fmt.Printf("  error: %s\n", status.Error)
+		}
+	}
+}
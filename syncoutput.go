@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// maxReportedDownloadFailures limits the failed downloads listed in the
+// report of a repo
+const maxReportedDownloadFailures = 50
+
+var (
+	// reposyncProgressPattern matches the line logged by reposync for each
+	// package it downloads, such as "[epel: 3 of 120 ] Downloading foo.rpm"
+	reposyncProgressPattern = regexp.MustCompile(`^\[[^\]]*?(\d+)\s+of\s+(\d+)\s*\]\s+Downloading\s+(\S+)`)
+
+	// downloadProgressPattern matches the progress line of each download by
+	// yum or dnf, such as "(3/120): foo-1.0-1.noarch.rpm | 1.2 MB 00:00"
+	downloadProgressPattern = regexp.MustCompile(`^\((\d+)/(\d+)\):\s+(\S+\.rpm)`)
+
+	// downloadFailurePatterns match the errors logged by reposync when a
+	// package cannot be downloaded or fails its signature check, capturing
+	// the package
+	downloadFailurePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)could not retrieve package\s+(\S+)`),
+		regexp.MustCompile(`(?i)^removing\s+(\S+?),?\s+due to`),
+		regexp.MustCompile(`(\S+\.rpm):\s+\[Errno\s+-?\d+\]`),
+		regexp.MustCompile(`(?i)failed to download.*?(\S+\.rpm)`),
+	}
+)
+
+// reposyncOutput parses the output of reposync into the download progress
+// and failed downloads of a repo, which are added to its report
+type reposyncOutput struct {
+	report  *RepoReport
+	verbose bool
+	failed  map[string]bool
+	last    string
+}
+
+// newReposyncOutput returns a parser of reposync output for a repo report.
+// If verbose is true, each download is logged; otherwise it is only logged
+// to debug, such as while a progress display is shown.
+func newReposyncOutput(report *RepoReport, verbose bool) *reposyncOutput {
+	return &reposyncOutput{
+		report:  report,
+		verbose: verbose,
+		failed:  make(map[string]bool, 0),
+	}
+}
+
+// Line parses a line of reposync output
+func (c *reposyncOutput) Line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	c.last = line
+
+	for _, pattern := range []*regexp.Regexp{reposyncProgressPattern, downloadProgressPattern} {
+		if m := pattern.FindStringSubmatch(line); m != nil {
+			if c.verbose {
+				Printf("Downloading %s of %s: %s\n", m[1], m[2], path.Base(m[3]))
+			}
+			return
+		}
+	}
+
+	for _, pattern := range downloadFailurePatterns {
+		m := pattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		pkg := strings.TrimRight(path.Base(m[1]), ".,:")
+		if c.failed[pkg] {
+			return
+		}
+		c.failed[pkg] = true
+
+		Warnf(nil, "Failed to download %s: %s", pkg, line)
+		c.report.DownloadFailures++
+		c.report.Errors++
+		if len(c.report.FailedDownloads) < maxReportedDownloadFailures {
+			c.report.FailedDownloads = append(c.report.FailedDownloads, pkg)
+		}
+		return
+	}
+}
+
+// Err adds the last line of output to an error returned by the command, as
+// it usually explains the failure
+func (c *reposyncOutput) Err(err error) error {
+	if err == nil || c.last == "" {
+		return err
+	}
+
+	return NewErrorf("%v: %s", err, c.last)
+}
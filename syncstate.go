@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncState records the upstream metadata and options of a repo's last
+// successful sync
+type syncState struct {
+	Revision  string            `json:"revision"`
+	Checksums map[string]string `json:"checksums"`
+	Options   string            `json:"options"`
+	Time      time.Time         `json:"time"`
+}
+
+// newSyncState returns the state of a repo with the given upstream metadata
+// and its current options
+func newSyncState(repo *Repo, repomd *Repomd) *syncState {
+	state := &syncState{
+		Revision:  repomd.Revision,
+		Checksums: make(map[string]string, len(repomd.Data)),
+		Options:   repo.optionsHash(),
+	}
+
+	for _, data := range repomd.Data {
+		state.Checksums[data.Type] = strings.ToLower(data.Checksum.Value)
+	}
+
+	return state
+}
+
+// Equal returns true if two states have the same upstream metadata and
+// options. Metadata is compared by revision and the checksum of each file, so
+// that mirrors which serve the same metadata with a different repomd.xml
+// layout or signature are not treated as changes.
+func (c *syncState) Equal(state *syncState) bool {
+	if c.Revision != state.Revision || c.Options != state.Options || len(c.Checksums) != len(state.Checksums) {
+		return false
+	}
+
+	for typ, sum := range c.Checksums {
+		if state.Checksums[typ] != sum {
+			return false
+		}
+	}
+
+	return true
+}
+
+// upstreamCacheDir returns the directory where upstream metadata fetched by
+// y10k itself, rather than by yum, is cached for a repo
+func (c *Repo) upstreamCacheDir() string {
+	return filepath.Join(c.CacheDir(), c.ID, "upstream")
+}
+
+// syncStatePath returns the path of the state of a repo's last sync
+func (c *Repo) syncStatePath() string {
+	return filepath.Join(c.CacheDir(), c.ID, "sync-state.json")
+}
+
+// optionsHash returns a hash of the effective options of a repo, so a change
+// to its configuration is detected. Options which do not affect the content
+// of the repo, such as its schedule, hooks and connection options, are
+// ignored.
+func (c *Repo) optionsHash() string {
+	h := sha256.New()
+	for _, opt := range c.EffectiveOptions() {
+		switch opt[0] {
+		case "schedule", "interval", "allowed_window", "sync_timeout", "tags", "enabled", "presync", "postsync", "cache_max_size", "staging_dir", "state_path", "backend", "remote_time", "max_upstream_age", "timeout", "keepalive", "ip_resolve", "connect_timeout", "max_connections_per_host", "http2", "fastestmirror":
+			continue
+		}
+		fmt.Fprintf(h, "%s=%s\n", opt[0], opt[1])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fetchUpstreamRepomd downloads the upstream repomd.xml of a repo into its
+// upstream cache directory, using a conditional request if it was downloaded
+// before, and returns it with the base URL it was downloaded from.
+func (c *Repo) fetchUpstreamRepomd() (string, *Repomd, error) {
+	urls, err := c.UpstreamURLs()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(urls) == 0 {
+		return "", nil, NewErrorf("No upstream URLs found for %s", c.ID)
+	}
+
+	unlock, err := c.lockUpstreamCache()
+	if err != nil {
+		return "", nil, err
+	}
+	defer unlock()
+
+	path := filepath.Join(c.upstreamCacheDir(), "repomd.xml")
+	baseurl := ""
+	for _, url := range urls {
+		baseurl = strings.TrimSuffix(url, "/")
+		if _, err = downloadIfModified(c, baseurl+"/repodata/repomd.xml", path); err == nil {
+			break
+		}
+		recordMirrorFailure(c, baseurl, err, false)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	repomd, err := ReadRepomd(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return baseurl, repomd, nil
+}
+
+// checkUpToDate returns true if a repo's upstream metadata and options have
+// not changed since its last successful sync, in which case the sync can be
+// skipped without reading the metadata or scanning the local packages. The
+// state to record once the repo is synchronized is also returned. Repos whose
+// content depends on anything other than the upstream metadata, such as the
+// current time, are never considered up to date.
+func (c *Yumfile) checkUpToDate(repo *Repo) (bool, *syncState, error) {
+	if repo.RsyncURL() != "" || repo.DebugInfoFor != "" || repo.Retain > 0 || repo.hasRelativeDateWindow() {
+		return false, nil, nil
+	}
+
+	_, repomd, err := repo.fetchUpstreamRepomd()
+	if err != nil {
+		return false, nil, err
+	}
+
+	state := newSyncState(repo, repomd)
+
+	if c.Force {
+		return false, state, nil
+	}
+
+	last := &syncState{}
+	if err := readJSON(repo.syncStatePath(), last); err != nil {
+		return false, state, nil
+	}
+
+	// the local repo must still be intact
+	if _, err := os.Stat(filepath.Join(repo.Path(), "repodata", "repomd.xml")); err != nil {
+		return false, state, nil
+	}
+
+	return last.Equal(state), state, nil
+}
+
+// saveSyncState records the state of a successful sync
+func saveSyncState(repo *Repo, state *syncState) error {
+	if state == nil {
+		return nil
+	}
+
+	state.Time = time.Now().UTC()
+	if err := os.MkdirAll(filepath.Dir(repo.syncStatePath()), 0755); err != nil {
+		return err
+	}
+
+	return writeJSON(repo.syncStatePath(), state)
+}
+
+// clearSyncState forgets the last sync of a repo, so the next sync is not
+// skipped
+func clearSyncState(repo *Repo) {
+	os.Remove(repo.syncStatePath())
+}
+
+// fetchUpstreamMetadata downloads a metadata file listed in a repo's cached
+// upstream repomd.xml, unless it was downloaded before. Metadata file names
+// include their checksum, so a cached file never changes.
+func (c *Repo) fetchUpstreamMetadata(baseurl string, data *RepomdData) (string, error) {
+	path := filepath.Join(c.upstreamCacheDir(), filepath.Base(data.Location.Href))
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	unlock, err := c.lockUpstreamCache()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// another process may have downloaded it while the lock was awaited
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	url := strings.TrimSuffix(baseurl, "/") + "/" + data.Location.Href
+	start := time.Now()
+	n, err := download(c, url, path+partFileSuffix)
+	if err != nil {
+		os.Remove(path + partFileSuffix)
+		recordMirrorFailure(c, baseurl, err, false)
+		return "", err
+	}
+	recordMirrorThroughput(c, strings.TrimSuffix(baseurl, "/"), n, time.Since(start))
+
+	if err := checkRepomdData(path+partFileSuffix, data); err != nil {
+		os.Remove(path + partFileSuffix)
+		err = NewErrorf("%v from %s", err, url)
+		recordMirrorFailure(c, baseurl, err, true)
+		return "", err
+	}
+
+	if err := renameSynced(path+partFileSuffix, path); err != nil {
+		return "", err
+	}
+
+	c.pruneUpstreamCache(filepath.Base(path))
+	return path, nil
+}
+
+// pruneUpstreamCache removes cached metadata files which are no longer listed
+// in the cached upstream repomd.xml, except the given files, which may have
+// been downloaded for a repomd.xml since replaced by another process. It must
+// be called with the upstream cache locked.
+func (c *Repo) pruneUpstreamCache(keepFiles ...string) {
+	dir := c.upstreamCacheDir()
+	repomd, err := ReadRepomd(filepath.Join(dir, "repomd.xml"))
+	if err != nil {
+		return
+	}
+
+	keep := map[string]bool{"repomd.xml": true, filepath.Base(validatorsPath("repomd.xml")): true}
+	for _, data := range repomd.Data {
+		keep[filepath.Base(data.Location.Href)] = true
+	}
+	for _, name := range keepFiles {
+		keep[name] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if !keep[file.Name()] {
+			Dprintf("Removing superseded metadata %s\n", filepath.Join(dir, file.Name()))
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+}
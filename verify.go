@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VerifyResult is the outcome of auditing one local repo
+type VerifyResult struct {
+	Repo     string   `json:"repo"`
+	Path     string   `json:"path"`
+	Checked  int      `json:"checked"`
+	Corrupt  []string `json:"corrupt"`
+	BadSig   []string `json:"bad_signature"`
+	Orphaned []string `json:"orphaned"`
+	Missing  []string `json:"missing"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Passed returns true if no problems were found in the repo
+func (c *VerifyResult) Passed() bool {
+	return c.Error == "" && len(c.Corrupt) == 0 && len(c.BadSig) == 0 && len(c.Orphaned) == 0 && len(c.Missing) == 0
+}
+
+// Verify audits the local mirror of a repo without contacting its upstream.
+// Every package listed in the repo's metadata must exist and match its
+// metadata checksum, every package file must be listed in the metadata and,
+// unless signatures is false, every package must have a valid GPG signature
+// from a key in the rpm database and from a pinned key if the repo has any.
+func Verify(repo *Repo, signatures bool) *VerifyResult {
+	result := &VerifyResult{
+		Repo:     repo.ID,
+		Path:     repo.Path(),
+		Corrupt:  make([]string, 0),
+		BadSig:   make([]string, 0),
+		Orphaned: make([]string, 0),
+		Missing:  make([]string, 0),
+	}
+
+	if err := result.verify(repo, signatures); err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+func (c *VerifyResult) verify(repo *Repo, signatures bool) error {
+	Dprintf("Verifying repo: %s\n", repo.ID)
+	repomd, err := ReadRepomd(filepath.Join(c.Path, "repodata", "repomd.xml"))
+	if err != nil {
+		return err
+	}
+
+	data := repomd.Get("primary")
+	if data == nil {
+		return NewErrorf("No primary metadata found in %s", c.Path)
+	}
+
+	// check the metadata files listed in repomd.xml
+	for i := range repomd.Data {
+		entry := &repomd.Data[i]
+		err := checkRepomdData(filepath.Join(c.Path, entry.Location.Href), entry)
+		if os.IsNotExist(err) {
+			c.Missing = append(c.Missing, filepath.Clean(entry.Location.Href))
+		} else if err != nil {
+			Dprintf("%v\n", err)
+			c.Corrupt = append(c.Corrupt, filepath.Clean(entry.Location.Href))
+		}
+	}
+
+	local, err := localPackages(c.Path)
+	if err != nil {
+		return err
+	}
+
+	// find each package listed in the metadata, removing it from the local
+	// set so only orphans remain
+	rels := make([]string, 0, len(local))
+	checksums := make([]Checksum, 0, len(local))
+	err = EachPackage(filepath.Join(c.Path, data.Location.Href), func(pkg *Package) error {
+		rel := filepath.Clean(pkg.Location.Href)
+		if !local[rel] {
+			c.Missing = append(c.Missing, rel)
+			return nil
+		}
+		delete(local, rel)
+
+		rels = append(rels, rel)
+		checksums = append(checksums, pkg.Checksum)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// check the checksum of each package
+	sums := make([]string, len(rels))
+	err = forEachParallel(len(rels), func(i int) (err error) {
+		sums[i], err = checksumFile(filepath.Join(c.Path, rels[i]), checksums[i].Type)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(rels))
+	for i, rel := range rels {
+		path := filepath.Join(c.Path, rel)
+		c.Checked++
+		if sums[i] != strings.ToLower(checksums[i].Value) {
+			Dprintf("Checksum mismatch for %s: expected %s, got %s\n", path, checksums[i].Value, sums[i])
+			c.Corrupt = append(c.Corrupt, rel)
+			continue
+		}
+
+		files = append(files, path)
+	}
+
+	// find package files missing from the metadata
+	for rel := range local {
+		c.Orphaned = append(c.Orphaned, rel)
+	}
+
+	if signatures && len(files) > 0 {
+		bad, err := checkSignatures(repo, files)
+		if err != nil {
+			return err
+		}
+
+		for _, path := range bad {
+			rel, _ := filepath.Rel(c.Path, path)
+			c.BadSig = append(c.BadSig, rel)
+		}
+	}
+
+	sort.Strings(c.Corrupt)
+	sort.Strings(c.BadSig)
+	sort.Strings(c.Orphaned)
+	sort.Strings(c.Missing)
+
+	return nil
+}
+
+// checksumFile returns the hex encoded checksum of a file using one of the
+// checksum types found in repo metadata
+func checksumFile(path, typ string) (string, error) {
+	if fipsWeakChecksum(typ) {
+		return "", NewErrorf("%s checksums are not allowed in FIPS mode", typ)
+	}
+
+	var h hash.Hash
+	switch strings.ToLower(typ) {
+	case "md5":
+		h = md5.New()
+	case "sha", "sha1":
+		h = sha1.New()
+	case "sha224":
+		h = sha256.New224()
+	case "sha256":
+		h = sha256.New()
+	case "sha384":
+		h = sha512.New384()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", NewErrorf("Unsupported checksum type: %s", typ)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkSignatures returns the packages whose signatures cannot be verified by
+// rpm, or which are not signed by a key pinned for the repo. Packages of repos
+// with pinned keys are verified only against the keys imported from the
+// repo's gpgkey, and the signer named in each package header must be one of
+// them with a pinned fingerprint.
+func checkSignatures(repo *Repo, files []string) ([]string, error) {
+	var keyring *repoKeyring
+	args := []string{"--checksig"}
+	if len(repo.Fingerprints) > 0 {
+		k, err := loadRepoKeyring(repo)
+		if err != nil {
+			return nil, err
+		}
+		keyring = k
+		args = append([]string{"--dbpath", k.DBPath}, args...)
+	}
+
+	bad := make([]string, 0)
+	ok := make(map[string]bool, len(files))
+	for i := 0; i < len(files); i += rpmQueryBatchSize {
+		j := i + rpmQueryBatchSize
+		if j > len(files) {
+			j = len(files)
+		}
+
+		// rpm exits non-zero if any package fails, so read its output instead
+		out, err := ExecOutput("rpm", append(args, files[i:j]...)...)
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return nil, err
+		}
+
+		for file := range parseChecksig(string(out)) {
+			ok[file] = true
+		}
+
+		for _, file := range files[i:j] {
+			if !ok[file] {
+				Dprintf("Invalid signature: %s\n", file)
+				bad = append(bad, file)
+			}
+		}
+	}
+
+	if keyring == nil {
+		return bad, nil
+	}
+
+	// check the signer in each package header against pinned fingerprints
+	sigs, err := queryPackages(files, rpmSignatureFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sigs) != len(files) {
+		return nil, NewErrorf("Expected %d package signatures from rpm, got %d", len(files), len(sigs))
+	}
+
+	for i, sig := range sigs {
+		// packages which failed the rpm check are already reported
+		if !ok[files[i]] {
+			continue
+		}
+
+		key, err := keyring.signer(sig)
+		if err != nil {
+			Dprintf("Package %s is %v\n", files[i], err)
+			bad = append(bad, files[i])
+		} else if !key.pinned(repo) {
+			Dprintf("Package %s is signed with unpinned key %s\n", files[i], key.Fingerprint)
+			bad = append(bad, files[i])
+		}
+	}
+
+	return bad, nil
+}
+
+// checksigSignatureTokens are the words rpm --checksig prints for a verified
+// signature: "signatures" since rpm 4.14, and the signature types before it.
+// Failed signatures are printed in upper case.
+var checksigSignatureTokens = map[string]bool{
+	"signatures": true,
+	"pgp":        true,
+	"gpg":        true,
+	"rsa":        true,
+	"dsa":        true,
+}
+
+// parseChecksig returns the files which the output of rpm --checksig reports
+// as signed with a valid signature. Unsigned packages, reported only with
+// "digests OK" or "sha1 md5 OK", are not included.
+func parseChecksig(out string) map[string]bool {
+	ok := make(map[string]bool, 0)
+	for _, line := range strings.Split(out, "\n") {
+		k := strings.LastIndex(line, ": ")
+		if k <= 0 {
+			continue
+		}
+
+		fields := strings.Fields(line[k+2:])
+		if len(fields) < 2 || fields[len(fields)-1] != "OK" || fields[len(fields)-2] == "NOT" {
+			continue
+		}
+
+		for _, field := range fields[:len(fields)-1] {
+			if checksigSignatureTokens[strings.Trim(field, "()")] {
+				ok[line[:k]] = true
+				break
+			}
+		}
+	}
+
+	return ok
+}
+
+// PrintVerifyResults prints a summary of each audited repo
+func PrintVerifyResults(results []*VerifyResult) {
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed() {
+			status = "FAIL"
+		}
+
+		Printf("%s %s: %d packages checked, %d corrupt, %d bad signatures, %d orphaned, %d missing\n", status, result.Repo, result.Checked, len(result.Corrupt), len(result.BadSig), len(result.Orphaned), len(result.Missing))
+		if result.Error != "" {
+			Printf("  error: %s\n", result.Error)
+		}
+		for _, path := range result.Corrupt {
+			Printf("  corrupt: %s\n", path)
+		}
+		for _, path := range result.BadSig {
+			Printf("  bad signature: %s\n", path)
+		}
+		for _, path := range result.Orphaned {
+			Printf("  orphaned: %s\n", path)
+		}
+		for _, path := range result.Missing {
+			Printf("  missing: %s\n", path)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseChecksig(t *testing.T) {
+	out, err := ioutil.ReadFile("testdata/checksig.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := parseChecksig(string(out))
+	expect := map[string]bool{
+		"/srv/repo/signed-1.0-1.noarch.rpm":       true,
+		"/srv/repo/unsigned-1.0-1.noarch.rpm":     false,
+		"/srv/repo/badkey-1.0-1.noarch.rpm":       false,
+		"/srv/repo/el7-signed-1.0-1.noarch.rpm":   true,
+		"/srv/repo/el7-unsigned-1.0-1.noarch.rpm": false,
+		"/srv/repo/el7-missing-1.0-1.noarch.rpm":  false,
+		"/srv/repo/el7-corrupt-1.0-1.noarch.rpm":  false,
+	}
+
+	for file, want := range expect {
+		if ok[file] != want {
+			t.Errorf("%s: expected verified=%v, got %v", file, want, ok[file])
+		}
+	}
+
+	if len(ok) != 2 {
+		t.Errorf("expected 2 verified packages, got %d", len(ok))
+	}
+}
@@ -3,15 +3,35 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Yumfile struct {
-	Repos           []Repo
-	LocalPathPrefix string
+	Repos            []Repo
+	LocalPathPrefix  string
+	Variables        map[string]string
+	Globals          map[string]string
+	FailFast         bool
+	MaxDeletePercent float64
+	VerifyAll        bool
+	Force            bool
+	StrictFreshness  bool
+	Wait             bool
+	WaitTimeout      time.Duration
+	Progress         bool
+	Notify           Notifier
+	Files            []string // the Yumfile and each file it includes
+	Includes         []string // include patterns, which may match new files
+	progress         *syncProgress
+	diagnostics      *[]Diagnostic
 }
 
 var boolMap = map[bool]int{
@@ -23,20 +43,127 @@ var (
 	sectionHeadPattern = regexp.MustCompile("^\\[(.*)\\]")
 	keyValPattern      = regexp.MustCompile("^(\\w+)\\s*=\\s*(.*)")
 	commentPattern     = regexp.MustCompile("(^$)|(^\\s+$)|(^#)|(^;)")
+	includePattern     = regexp.MustCompile("^include\\s+(.*\\S)\\s*$")
+	setPattern         = regexp.MustCompile("^set\\s+(\\w+)\\s*=\\s*(.*)")
+	variablePattern    = regexp.MustCompile("\\$?\\$\\{([^}]*)\\}")
 )
 
 // LoadYumfile loads a Yumfile from disk
 func LoadYumfile(path string) (*Yumfile, error) {
 	Dprintf("Loading Yumfile: %s\n", path)
 
-	yumfile := Yumfile{}
+	yumfile := NewYumfile()
+	if err := yumfile.loadAll(path); err != nil {
+		return nil, err
+	}
+
+	return yumfile, nil
+}
+
+// NewYumfile returns an empty Yumfile
+func NewYumfile() *Yumfile {
+	return &Yumfile{
+		Variables: make(map[string]string, 0),
+		Globals:   make(map[string]string, 0),
+	}
+}
+
+// loadAll loads a Yumfile and its includes, applies global options, derives
+// companion repos and validates the result.
+func (c *Yumfile) loadAll(path string) error {
+	var err error
+	if isStructuredYumfile(path) {
+		err = c.loadStructured(path)
+	} else {
+		err = c.load(path, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	// apply global options
+	for i := range c.Repos {
+		if err := c.Repos[i].Inherit(c.Globals); err != nil {
+			if err := c.repoError(&c.Repos[i], err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// expand upstream URL presets, entitled CDN content and upstream history,
+	// and find credentials in .netrc
+	for i := range c.Repos {
+		if err := c.Repos[i].applyPreset(); err != nil {
+			if err := c.repoError(&c.Repos[i], err); err != nil {
+				return err
+			}
+		}
+
+		if err := c.Repos[i].applyEntitlement(); err != nil {
+			if err := c.repoError(&c.Repos[i], err); err != nil {
+				return err
+			}
+		}
+
+		if err := c.Repos[i].applyNetrc(); err != nil {
+			if err := c.repoError(&c.Repos[i], err); err != nil {
+				return err
+			}
+		}
+
+		if err := c.Repos[i].applyHistory(); err != nil {
+			if err := c.repoError(&c.Repos[i], err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// derive debuginfo companion repos
+	if err := c.addDebugInfoRepos(); err != nil {
+		return err
+	}
+
+	// find the repos merged into each merge target
+	if err := c.resolveMergeTargets(); err != nil {
+		return err
+	}
+
+	// require signatures in FIPS mode
+	for i := range c.Repos {
+		if err := c.Repos[i].applyFIPS(); err != nil {
+			if err := c.repoError(&c.Repos[i], err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// validate
+	return c.Validate()
+}
+
+// load parses a Yumfile, or a file included by a Yumfile, and appends its
+// settings and repos. parents lists the canonical paths of the files
+// currently being loaded and is used to detect include loops.
+//
+// An include directive closes the current repo section, so any key/value
+// pairs which follow it are treated as global settings until the next
+// section header.
+func (c *Yumfile) load(path string, parents []string) error {
+	canonical := canonicalPath(path)
+	for _, parent := range parents {
+		if parent == canonical {
+			return NewErrorf("Include loop detected in %s", path)
+		}
+	}
+	parents = append(parents, canonical)
 
 	// open file
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer f.Close()
+	c.Files = append(c.Files, path)
 
 	// read each line
 	n := 0
@@ -46,13 +173,48 @@ func LoadYumfile(path string) (*Yumfile, error) {
 		n++
 		s := scanner.Text()
 
-		if matches := sectionHeadPattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
+		if m := setPattern.FindStringSubmatchIndex(s); m != nil {
+			// line is a variable definition
+			val, err := c.interpolate(s[m[4]:m[5]])
+			if err != nil {
+				if err := c.syntaxError(path, n, m[4]+1, "%s", err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+
+			c.Variables[s[m[2]:m[3]]] = val
+		} else if m := includePattern.FindStringSubmatchIndex(s); m != nil {
+			// line is an include directive
+			if repo != nil {
+				c.Repos = append(c.Repos, *repo)
+				repo = nil
+			}
+
+			pattern, err := c.interpolate(s[m[2]:m[3]])
+			if err != nil {
+				if err := c.syntaxError(path, n, m[2]+1, "%s", err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := c.include(path, n, pattern, parents); err != nil {
+				return err
+			}
+		} else if m := sectionHeadPattern.FindStringSubmatchIndex(s); m != nil {
 			// line is a [section header]
-			id := matches[0][1]
+			id, err := c.interpolate(s[m[2]:m[3]])
+			if err != nil {
+				if err := c.syntaxError(path, n, m[2]+1, "%s", err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
 
 			// append previous section
 			if repo != nil {
-				yumfile.Repos = append(yumfile.Repos, *repo)
+				c.Repos = append(c.Repos, *repo)
 			}
 
 			// create new repo def
@@ -61,113 +223,246 @@ func LoadYumfile(path string) (*Yumfile, error) {
 			repo.YumfilePath = path
 			repo.YumfileLineNo = n
 			repo.ID = id
-		} else if matches := keyValPattern.FindAllStringSubmatch(s, -1); len(matches) > 0 {
+		} else if m := keyValPattern.FindStringSubmatchIndex(s); m != nil {
 			// line is a key=val pair
-			key := matches[0][1]
-			val := matches[0][2]
+			key := s[m[2]:m[3]]
+			col := m[4] + 1
+			val, err := c.interpolate(s[m[4]:m[5]])
+			if err != nil {
+				if err := c.syntaxError(path, n, col, "%s", err.Error()); err != nil {
+					return err
+				}
+				continue
+			}
 
 			if repo == nil {
 				// global key/val pair
 				switch key {
 				case "pathprefix":
-					yumfile.LocalPathPrefix = val
+					c.LocalPathPrefix = val
 
 				default:
-					return nil, NewErrorf("Syntax error in Yumfile on line %d: Unknown key: %s", n, key)
-				}
-			} else {
-				// add key/val to current repo
-				switch key {
-				case "localpath":
-					repo.LocalPath = val
-
-				case "arch":
-					repo.Architecture = val
-
-				case "newonly":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.NewOnly = b
+					if isNotifyKey(key) {
+						if err := c.Notify.Set(key, val); err != nil {
+							if err := c.syntaxError(path, n, col, "%s", err.Error()); err != nil {
+								return err
+							}
+						}
+						continue
 					}
 
-				case "sources":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.IncludeSources = b
+					if !inheritableKeys[key] {
+						if err := c.syntaxError(path, n, 1, "Unknown key: %s", key); err != nil {
+							return err
+						}
+						continue
 					}
 
-				case "deleteremoved":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.DeleteRemoved = b
+					// ensure value is valid for inheritance
+					if err := NewRepo().Set(key, val); err != nil {
+						if err := c.syntaxError(path, n, col, "%s", err.Error()); err != nil {
+							return err
+						}
+						continue
 					}
 
-				case "gpgcheck":
-					if b, err := strToBool(val); err != nil {
-						return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, err.Error())
-					} else {
-						repo.GPGCheck = b
-
-						// pass through to yum
-						repo.Parameters[key] = val
+					c.Globals[key] = val
+				}
+			} else {
+				// add key/val to current repo
+				if err := repo.Set(key, val); err != nil {
+					if err := c.syntaxError(path, n, col, "%s", err.Error()); err != nil {
+						return err
 					}
+					continue
+				}
 
-				case "checksum":
-					repo.Checksum = val
-
-				case "groupfile":
-					repo.Groupfile = val
-
-				default:
-					repo.Parameters[key] = val
+				if !isKnownRepoKey(key) {
+					c.lintf(path, n, 1, LintWarning, "Unknown key (passed through to yum): %s", key)
 				}
 			}
 		} else if commentPattern.MatchString(s) {
 			// ignore line
-		} else {
-			return nil, NewErrorf("Syntax error in Yumfile on line %d: %s", n, s)
+		} else if err := c.syntaxError(path, n, 1, "%s", s); err != nil {
+			return err
 		}
 	}
 
 	// add last scanned repo
 	if repo != nil {
-		yumfile.Repos = append(yumfile.Repos, *repo)
+		c.Repos = append(c.Repos, *repo)
 	}
 
 	// check for scan errors
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	return scanner.Err()
+}
+
+// canonicalPath returns the absolute path of a file with symlinks resolved,
+// so the same file is recognized however it is included, or the path as given
+// if it cannot be resolved
+func canonicalPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
 	}
 
-	// validate
-	if err = yumfile.Validate(); err != nil {
-		return nil, err
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+
+	return abs
+}
+
+// include loads all files matching the glob pattern of an include directive.
+// Relative patterns are resolved from the directory of the including file.
+func (c *Yumfile) include(path string, n int, pattern string, parents []string) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+	c.Includes = append(c.Includes, pattern)
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return c.syntaxError(path, n, 1, "Invalid include pattern: %s", pattern)
+	}
+
+	if len(matches) == 0 && !hasGlobMeta(pattern) {
+		return c.syntaxError(path, n, 1, "No such file: %s", pattern)
 	}
 
-	return &yumfile, nil
+	sort.Strings(matches)
+	for _, match := range matches {
+		Dprintf("Including Yumfile: %s (from %s:%d)\n", match, path, n)
+		if isStructuredYumfile(match) {
+			err = c.loadStructured(match)
+		} else {
+			err = c.load(match, parents)
+		}
+
+		if err != nil {
+			if c.diagnostics == nil {
+				return err
+			}
+			c.lintf(path, n, 1, LintError, "%s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// interpolate replaces all ${name} references in a string with the value of
+// the named Yumfile variable, or with the value of an environment variable for
+// ${env:NAME} references. References to yum variables, such as ${releasever},
+// which are not Yumfile variables are left for yum, and $${ is written for a
+// literal ${.
+func (c *Yumfile) interpolate(s string) (string, error) {
+	var err error
+	s = variablePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+
+		name := variablePattern.FindStringSubmatch(ref)[1]
+		if strings.HasPrefix(name, "env:") {
+			val, ok := os.LookupEnv(strings.TrimPrefix(name, "env:"))
+			if !ok && err == nil {
+				err = NewErrorf("Undefined environment variable: %s", strings.TrimPrefix(name, "env:"))
+			}
+			return val
+		}
+
+		val, ok := c.Variables[name]
+		if !ok && isYumVarName(name) {
+			return ref
+		}
+		if !ok && err == nil {
+			err = NewErrorf("Undefined variable: %s", name)
+		}
+
+		return val
+	})
+
+	return s, err
+}
+
+// syntaxError returns a syntax error for the given Yumfile and line number,
+// or records it and returns nil if the Yumfile is being linted.
+func (c *Yumfile) syntaxError(path string, n, col int, format string, a ...interface{}) error {
+	if c.diagnostics != nil {
+		c.lintf(path, n, col, LintError, format, a...)
+		return nil
+	}
+
+	return syntaxErrorf(path, n, format, a...)
+}
+
+// syntaxErrorf returns a syntax error for the given Yumfile and line number
+func syntaxErrorf(path string, n int, format string, a ...interface{}) error {
+	return NewErrorf("Syntax error in %s on line %d: %s", path, n, fmt.Sprintf(format, a...))
+}
+
+// hasGlobMeta returns true if a path contains any glob metacharacters
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
 }
 
 // Validate ensures all Yumfile fields contain valid values
 func (c *Yumfile) Validate() error {
-	for i, repo := range c.Repos {
+	if err := c.Notify.Validate(); err != nil {
+		return err
+	}
+
+	ids := make(map[string]*Repo, 0)
+	paths := make(map[string]*Repo, 0)
+	for i := range c.Repos {
+		repo := &c.Repos[i]
 		if err := repo.Validate(); err != nil {
-			return err
+			if err := c.repoError(repo, err); err != nil {
+				return err
+			}
 		}
 
 		// append path prefix to each repo
 		if c.LocalPathPrefix != "" {
-			c.Repos[i].LocalPath = fmt.Sprintf("%s/%s", c.LocalPathPrefix, repo.LocalPath)
+			if repo.LocalPath == "" {
+				repo.LocalPath = repo.ID
+			}
+			repo.LocalPath = fmt.Sprintf("%s/%s", c.LocalPathPrefix, repo.LocalPath)
+		}
+
+		// prevent duplicate repo IDs and local paths
+		if other, ok := ids[repo.ID]; ok {
+			err := NewErrorf("Duplicate repo ID '%s' (in %s:%d, first defined in %s:%d)", repo.ID, repo.YumfilePath, repo.YumfileLineNo, other.YumfilePath, other.YumfileLineNo)
+			if err := c.repoError(repo, err); err != nil {
+				return err
+			}
 		}
+		ids[repo.ID] = repo
 
-		// TODO: Prevent duplicate local paths and repo IDs
+		path := filepath.Clean(repo.Path())
+		if other, ok := paths[path]; ok {
+			err := NewErrorf("Repos '%s' and '%s' share the same local path: %s (in %s:%d)", other.ID, repo.ID, path, repo.YumfilePath, repo.YumfileLineNo)
+			if err := c.repoError(repo, err); err != nil {
+				return err
+			}
+		}
+		paths[path] = repo
 	}
 
 	return nil
 }
 
+// repoError returns an error found in a repo definition, or records it and
+// returns nil if the Yumfile is being linted.
+func (c *Yumfile) repoError(repo *Repo, err error) error {
+	if c.diagnostics != nil {
+		c.lintf(repo.YumfilePath, repo.YumfileLineNo, 1, LintError, "%s", err.Error())
+		return nil
+	}
+
+	return err
+}
+
 func (c *Yumfile) GetRepoByID(id string) *Repo {
 	for _, repo := range c.Repos {
 		if repo.ID == id {
@@ -178,39 +473,542 @@ func (c *Yumfile) GetRepoByID(id string) *Repo {
 	return nil
 }
 
-func (c *Yumfile) SyncAll() error {
+// SelectRepos returns the given repos whose IDs match any of the only shell
+// globs, or all of them if there are none, and none of the skip globs. Each
+// pattern may list several globs separated by commas. An error is returned
+// if a glob is invalid or an only glob matches no repo.
+func SelectRepos(repos []Repo, only, skip []string) ([]Repo, error) {
+	only, skip = splitRepoPatterns(only), splitRepoPatterns(skip)
+	for _, pattern := range append(only, skip...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, NewErrorf("Invalid repo pattern: %s", pattern)
+		}
+	}
+
+	matched := make(map[string]bool, len(only))
+	selected := make([]Repo, 0, len(repos))
+	for _, repo := range repos {
+		if len(only) > 0 && !matchRepoID(only, repo.ID, matched) {
+			continue
+		}
+		if matchRepoID(skip, repo.ID, matched) {
+			Dprintf("Skipping %s\n", repo.ID)
+			continue
+		}
+		selected = append(selected, repo)
+	}
+
+	for _, pattern := range only {
+		if !matched[pattern] {
+			return nil, NewErrorf("No repo matches --only %s", pattern)
+		}
+	}
+	for _, pattern := range skip {
+		if !matched[pattern] {
+			Warnf(nil, "No repo matches --skip %s", pattern)
+		}
+	}
+
+	return selected, nil
+}
+
+// SelectReposByTags returns the given repos which have any of the given tags,
+// or all of them if no tags are given. Each tag argument may list several tags
+// separated by commas. An error is returned if a tag is on no repo.
+func SelectReposByTags(repos []Repo, tags []string) ([]Repo, error) {
+	tags = splitRepoPatterns(tags)
+	if len(tags) == 0 {
+		return repos, nil
+	}
+
+	found := make(map[string]bool, len(tags))
+	selected := make([]Repo, 0, len(repos))
+	for _, repo := range repos {
+		tagged := false
+		for _, tag := range tags {
+			if repo.HasTag(tag) {
+				found[tag] = true
+				tagged = true
+			}
+		}
+		if tagged {
+			selected = append(selected, repo)
+		}
+	}
+
+	for _, tag := range tags {
+		if !found[tag] {
+			return nil, NewErrorf("No repo is tagged %s", tag)
+		}
+	}
+
+	return selected, nil
+}
+
+// splitRepoPatterns splits comma separated repo globs
+func splitRepoPatterns(patterns []string) []string {
+	globs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		for _, glob := range strings.Split(pattern, ",") {
+			if glob = strings.TrimSpace(glob); glob != "" {
+				globs = append(globs, glob)
+			}
+		}
+	}
+
+	return globs
+}
+
+// matchRepoID returns true if a repo ID matches any of the given globs, and
+// records each glob which matched
+func matchRepoID(globs []string, id string, matched map[string]bool) bool {
+	match := false
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, id); ok {
+			matched[glob] = true
+			match = true
+		}
+	}
+
+	return match
+}
+
+func (c *Yumfile) SyncAll() (*RunReport, error) {
 	return c.Sync(c.Repos)
 }
 
-// Sync processes all repository mirrors defined in a Yumfile
-func (c *Yumfile) Sync(repos []Repo) error {
+// Sync processes all repository mirrors defined in a Yumfile and returns a
+// report of the run
+func (c *Yumfile) Sync(repos []Repo) (*RunReport, error) {
 	//if err := c.installYumConf(repos); err != nil {
 	//	return err
 	//}
 
+	// remove temporary yum.conf when finished, and those of earlier runs
+	// which did not exit cleanly
+	removeStaleTempFiles()
+	defer removeYumConf()
+
+	// show download progress when run by hand
+	if c.Progress && !QuietMode {
+		c.progress = newSyncProgress(len(repos))
+		defer func() { c.progress = nil }()
+	}
+
+	report := NewRunReport()
+	stopped := 0
 	for _, repo := range repos {
-		if err := c.installYumConf(&repo); err != nil {
-			Errorf(err, "Failed to create yum.conf for %s", repo.ID)
-		} else {
-			if err := c.reposync(&repo); err != nil {
-				Errorf(err, "Failed to download updates for %s", repo.ID)
+		repoReport := &RepoReport{
+			ID:     repo.ID,
+			Status: RepoStatusOK,
+			Start:  time.Now(),
+		}
+
+		// skip remaining repos once y10k is shutting down
+		if shuttingDown() {
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = errInterrupted.Error()
+			report.Add(repoReport)
+			stopped++
+			continue
+		}
+
+		// skip remaining repos after the first failure in fail-fast mode
+		if c.FailFast && report.Failed > 0 {
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = "skipped after an earlier failure"
+			report.Add(repoReport)
+			continue
+		}
+
+		// pull-through repos are populated on demand by the serve command
+		if repo.PullThrough {
+			Printf("Skipping pull-through repo: %s\n", repo.ID)
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = "pull-through repo"
+			report.Add(repoReport)
+			continue
+		}
+
+		if repo.Disabled {
+			Printf("Skipping disabled repo: %s\n", repo.ID)
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = "disabled with enabled=0"
+			report.Add(repoReport)
+			continue
+		}
+
+		// debuginfo companions are restricted to the packages of their
+		// parent, which was not synchronized if it was skipped
+		if parent := report.Get(repo.DebugInfoFor); repo.DebugInfoFor != "" && parent != nil && parent.Status == RepoStatusSkipped {
+			Printf("Skipping debuginfo repo of skipped repo %s: %s\n", parent.ID, repo.ID)
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = "parent repo " + parent.ID + " was skipped"
+			report.Add(repoReport)
+			continue
+		}
+
+		// large downloads only happen within the repo's allowed_window
+		if repo.AllowedWindow != nil && !repo.AllowedWindow.Contains(repoReport.Start) {
+			Printf("Skipping repo outside its allowed window %s: %s\n", repo.AllowedWindow, repo.ID)
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = "outside allowed_window " + repo.AllowedWindow.String()
+			report.Add(repoReport)
+			continue
+		}
+
+		SetLogRepo(repo.ID)
+		deadline, windowCloses := repo.syncDeadline(repoReport.Start)
+		stopDeadline := startRepoDeadline(deadline)
+		err := c.syncRepoIsolated(&repo, repoReport)
+		if stopDeadline() && err != nil {
+			// the repo's downloads were aborted; move on to the next repo
+			if windowCloses {
+				repoReport.WindowClosed = true
+				err = NewErrorf("Stopped when its allowed_window %s closed", repo.AllowedWindow)
 			} else {
-				if err := c.createrepo(&repo); err != nil {
-					Errorf(err, "Failed to update repo database for %s", repo.ID)
-				}
+				repoReport.TimedOut = true
+				err = NewErrorf("Timed out after %v (sync_timeout)", repo.SyncTimeout)
+			}
+		}
+
+		if err != nil && repoReport.WindowClosed {
+			// like an interrupted repo, its next sync resumes where this
+			// one stopped
+			Warnf(err, "Stopped synchronizing %s", repo.ID)
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = err.Error()
+		} else if err != nil && shuttingDown() {
+			// an interrupted repo has not failed; its next sync resumes
+			// where this one stopped
+			Warnf(nil, "Interrupted synchronizing %s", repo.ID)
+			repoReport.Status = RepoStatusSkipped
+			repoReport.Error = errInterrupted.Error()
+			stopped++
+		} else if err != nil {
+			repoReport.Error = err.Error()
+			repoReport.Errors++
+			if repo.Optional && isUpstreamUnavailable(err) {
+				Warnf(err, "Skipped optional repo %s", repo.ID)
+				repoReport.Status = RepoStatusSkipped
+			} else {
+				Errorf(err, "Error synchronizing %s", repo.ID)
+				repoReport.Status = RepoStatusFailed
 			}
 		}
+
+		repoReport.Duration = time.Since(repoReport.Start)
+		report.Add(repoReport)
+		if err := recordMetrics(&repo, repoReport); err != nil {
+			Warnf(err, "Error recording metrics of %s", repo.ID)
+		}
+		if err := recordStats(&repo, repoReport); err != nil {
+			Warnf(err, "Error recording stats of %s", repo.ID)
+		}
+		c.progress.RepoDone(repoReport)
+		SetLogRepo("")
+	}
+	report.Finish()
+	report.logFailures()
+	c.Notify.Notify(report, repos)
+
+	if err := evictMetadataCache(c.metadataCacheMaxSize()); err != nil {
+		Warnf(err, "Error evicting decompressed metadata from the cache")
+	}
+
+	if stopped > 0 {
+		return report, NewErrorf("Interrupted; %d of %d repos were not synchronized", stopped, len(repos))
+	}
+
+	if report.AllFailed() {
+		return report, NewErrorf("All %d repos which were attempted failed to synchronize", report.Failed)
+	}
+
+	if report.Failed > 0 {
+		return report, NewErrorf("%d of %d repos failed to synchronize", report.Failed, len(repos))
+	}
+
+	return report, nil
+}
+
+// syncRepoIsolated locks a repo and calls syncRepo, returning any panic as an
+// error so that a failure in one repo does not abort the remaining repos.
+func (c *Yumfile) syncRepoIsolated(repo *Repo, report *RepoReport) (err error) {
+	defer RecoverError(&err, "Unexpected error synchronizing %s", repo.ID)
+
+	unlock, err := c.lockRepo(repo)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = c.syncRepoWithHooks(repo, report)
+	if cerr := evictCache(repo); cerr != nil {
+		Warnf(cerr, "Error evicting old metadata from the cache of %s", repo.ID)
+	}
+
+	return err
+}
+
+// syncRepo downloads updates for a single repo, updates its metadata and
+// publishes it to all configured targets.
+func (c *Yumfile) syncRepo(repo *Repo, report *RepoReport) error {
+	// merge targets are built from the local mirrors of their sources
+	if len(repo.MergeSources) > 0 {
+		return c.syncMergedRepo(repo, report)
+	}
+
+	// restrict debuginfo companions to the packages mirrored by the parent
+	if repo.DebugInfoFor != "" {
+		if err := c.filterDebugInfo(repo); err != nil {
+			return NewErrorf("Failed to compute debuginfo packages: %v", err)
+		}
+	}
+
+	if err := repo.applyMirrors(); err != nil {
+		Warnf(err, "Failed to select the mirrors of %s", repo.ID)
+	}
+
+	// an upstream which stopped updating is unchanged, so it is checked
+	// before the sync is skipped. rsync upstreams are checked once their
+	// metadata is fetched.
+	if repo.RsyncURL() == "" {
+		if err := c.checkFreshness(repo, report); err != nil {
+			return err
+		}
+	}
+
+	// skip repos which have not changed since their last sync
+	upToDate, state, err := c.checkUpToDate(repo)
+	if err != nil {
+		Warnf(err, "Unable to check %s for upstream changes", repo.ID)
+	} else if upToDate {
+		Printf("Repo is up to date: %s\n", repo.ID)
+		report.Status = RepoStatusUpToDate
+		return nil
+	}
+	clearSyncState(repo)
+
+	// fetch the metadata of rsync repos so yum can read it locally
+	if repo.RsyncURL() != "" {
+		if err := c.rsyncMetadata(repo); err != nil {
+			return NewErrorf("Failed to fetch metadata: %v", err)
+		}
+
+		if err := c.checkFreshness(repo, report); err != nil {
+			return err
+		}
+	}
+
+	if err := checkFIPSChecksums(repo); err != nil {
+		return NewErrorf("Refused upstream metadata: %v", err)
+	}
+
+	if err := checkPinnedRevision(repo); err != nil {
+		return err
+	}
+
+	if err := c.installYumConf(repo); err != nil {
+		return NewErrorf("Failed to create yum.conf: %v", err)
+	}
+
+	// compare local and upstream packages only if something needs the plan,
+	// as listing a large upstream repo is slow
+	var plan *SyncPlan
+	if c.progress != nil || (repo.DeleteRemoved && c.MaxDeletePercent > 0) || repo.MinFreeSpace > 0 {
+		if plan, err = c.comparePackages(repo); err != nil {
+			return err
+		}
+	}
+
+	if err := c.checkDeletions(repo, plan); err != nil {
+		return err
+	}
+
+	if err := checkFreeSpace(repo, plan); err != nil {
+		return err
+	}
+
+	before, err := packageSizes(repo.Path())
+	if err != nil {
+		return NewErrorf("Failed to read local packages: %v", err)
+	}
+
+	if err := removeEmptyPackages(repo.Path(), before); err != nil {
+		return NewErrorf("Failed to remove empty packages: %v", err)
+	}
+
+	expired, err := c.applyRetention(repo)
+	if err != nil {
+		return NewErrorf("Failed to apply retention: %v", err)
+	}
+
+	if err := prunePackages(repo, expired, "expired"); err != nil {
+		return NewErrorf("Failed to remove expired packages: %v", err)
+	}
+
+	windowed, err := c.applyDateWindow(repo)
+	if err != nil {
+		return NewErrorf("Failed to apply date window: %v", err)
+	}
+
+	if err := prunePackages(repo, windowed, "out-of-window"); err != nil {
+		return NewErrorf("Failed to remove out-of-window packages: %v", err)
+	}
+
+	excluded, err := c.applyFilterPlugins(repo)
+	if err != nil {
+		return NewErrorf("Failed to apply filter plugins: %v", err)
+	}
+
+	if err := prunePackages(repo, excluded, "excluded"); err != nil {
+		return NewErrorf("Failed to remove excluded packages: %v", err)
+	}
+	report.Filtered = len(expired) + len(windowed) + len(excluded)
+
+	// reposync only downloads packages the staging directory does not have
+	if repo.downloadStagingDir() != "" && repo.RsyncURL() == "" {
+		if err := stageLocalPackages(repo); err != nil {
+			return NewErrorf("Failed to prepare staging directory: %v", err)
+		}
+	}
+
+	c.progress.Start(repo, plan)
+	defer c.progress.Stop()
+	if repo.RsyncURL() != "" {
+		err = c.rsyncPackages(repo)
+	} else {
+		err = c.reposync(repo, report)
+	}
+	c.progress.Stop()
+	if interrupted() {
+		return errInterrupted
+	}
+	if err != nil {
+		return NewErrorf("Failed to download updates: %v", err)
+	}
+
+	rejected, err := c.verifyFingerprints(repo)
+	report.GPGFailures = rejected
+	report.Errors += rejected
+	if err != nil {
+		return NewErrorf("Failed to verify GPG signatures: %v", err)
+	}
+
+	// validated downloads are only now moved into the served tree
+	if _, err := commitStaged(repo, repo.RsyncURL() == ""); err != nil {
+		return NewErrorf("Failed to move staged downloads into place: %v", err)
+	}
+
+	// new packages take their permissions before they are hardlinked into
+	// the package store, splits and snapshots
+	if err := applyFileModes(repo); err != nil {
+		return NewErrorf("Failed to set file permissions: %v", err)
+	}
+
+	if _, err := dedupRepo(repo); err != nil {
+		return NewErrorf("Failed to link packages to the package store: %v", err)
+	}
+
+	after, err := packageSizes(repo.Path())
+	if err != nil {
+		return NewErrorf("Failed to read local packages: %v", err)
+	}
+	report.countChanges(before, after)
+
+	if err := syncNewPackages(repo.Path(), before, after); err != nil {
+		return NewErrorf("Failed to flush downloaded packages to disk: %v", err)
+	}
+
+	if err := recordAudit(repo, report, before, after, true); err != nil {
+		return NewErrorf("Failed to write audit log: %v", err)
+	}
+
+	if repo.isPinned() {
+		err = c.installUpstreamRepodata(repo)
+	} else {
+		err = c.createrepo(repo)
+	}
+	if err != nil {
+		return NewErrorf("Failed to update repo database: %v", err)
+	}
+
+	if err := c.writeSplits(repo); err != nil {
+		return err
+	}
+
+	if err := c.smokeTest(repo, repo.Path()); err != nil {
+		return NewErrorf("Smoke test failed: %v", err)
+	}
+
+	if err := c.checkRequiredClosure(repo, report); err != nil {
+		return NewErrorf("Dependency closure check failed: %v", err)
+	}
+
+	if err := c.writeDelta(repo); err != nil {
+		return NewErrorf("Failed to write delta manifest: %v", err)
+	}
+
+	if err := applyFilePermissions(repo); err != nil {
+		return NewErrorf("Failed to set file permissions: %v", err)
+	}
+
+	// an interrupted repo is left unpublished rather than half published
+	if interrupted() {
+		return errInterrupted
+	}
+
+	if err := c.publish(repo); err != nil {
+		return NewErrorf("Failed to publish: %v", err)
+	}
+
+	if err := c.publishSplits(repo); err != nil {
+		return NewErrorf("Failed to publish splits: %v", err)
+	}
+
+	if err := runPublishPlugins(repo, report); err != nil {
+		return NewErrorf("Failed to run publish plugins: %v", err)
+	}
+
+	// rejected packages were removed before publishing, but the mirror is
+	// still incomplete
+	if rejected > 0 {
+		return NewErrorf("%d packages failed GPG verification", rejected)
+	}
+
+	if err := saveSyncState(repo, state); err != nil {
+		Dprintf("Error saving sync state of %s: %v\n", repo.ID, err)
 	}
 
 	return nil
 }
 
+// yumConfDir returns the private directory of the yum.conf of this process,
+// which holds its repo file and the state yum would otherwise keep in /var
+func yumConfDir() string {
+	return strings.TrimSuffix(TmpYumConfPath, ".conf") + ".d"
+}
+
+// removeYumConf removes the yum.conf of this process and its directory
+func removeYumConf() {
+	os.Remove(TmpYumConfPath)
+	os.RemoveAll(yumConfDir())
+}
+
+// installYumConf writes a self-contained yum.conf for a repo, with the repo in
+// a private repos directory, so that reposync and repoquery never read the
+// system's repos or write to /etc or /var and can run unprivileged. The repo
+// file may hold credentials, so it is only readable by its owner.
 func (c *Yumfile) installYumConf(repo *Repo) error {
 	Dprintf("Installing yum.conf file: %s\n", TmpYumConfPath)
 
 	// create temp path
-	if err := os.MkdirAll(TmpBasePath, 0750); err != nil {
-		return err
+	reposDir := filepath.Join(yumConfDir(), "repos.d")
+	persistDir := filepath.Join(yumConfDir(), "persist")
+	for _, dir := range []string{TmpBasePath, reposDir, persistDir} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
 	}
 
 	// create config file
@@ -222,29 +1020,67 @@ func (c *Yumfile) installYumConf(repo *Repo) error {
 
 	// global yum conf
 	fmt.Fprintf(f, "[main]\n")
-	fmt.Fprintf(f, "cachedir=%s\n", TmpYumCachePath)
+	fmt.Fprintf(f, "cachedir=%s\n", repo.CacheDir())
 	fmt.Fprintf(f, "debuglevel=10\n")
 	fmt.Fprintf(f, "exactarch=0\n")
 	fmt.Fprintf(f, "gpgcheck=0\n")
 	fmt.Fprintf(f, "keepcache=0\n")
 	fmt.Fprintf(f, "logfile=%s\n", TmpYumLogFile)
+	if repo.yumBackend() == BackendDNF {
+		// dnf ignores logfile and logs to /var/log by default
+		fmt.Fprintf(f, "logdir=%s\n", yumConfDir())
+	}
+	fmt.Fprintf(f, "persistdir=%s\n", persistDir)
 	fmt.Fprintf(f, "plugins=0\n")
-	fmt.Fprintf(f, "reposdir=\n")
+	fmt.Fprintf(f, "reposdir=%s\n", reposDir)
 	fmt.Fprintf(f, "rpmverbosity=debug\n")
 	fmt.Fprintf(f, "timeout=5\n")
 	fmt.Fprintf(f, "\n")
 
-	// append repo config
+	// replace the repo file of the previous repo
+	files, err := filepath.Glob(filepath.Join(reposDir, "*.repo"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+
+	r, err := os.OpenFile(filepath.Join(reposDir, repo.ID+".repo"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeYumRepo(r, repo)
+}
+
+// writeYumRepo writes the section of a repo in a yum .repo file
+func writeYumRepo(f io.Writer, repo *Repo) error {
 	fmt.Fprintf(f, "[%s]\n", repo.ID)
 	for key, val := range repo.Parameters {
+		// ranked mirrors replace the configured upstream
+		if len(repo.Mirrors) > 0 && (key == "baseurl" || key == "mirrorlist" || key == "metalink" || key == "failovermethod") {
+			continue
+		}
+		// expand yum variables as y10k does, so yum fetches the same URLs
+		if key == "baseurl" || key == "mirrorlist" || key == "metalink" || key == "gpgkey" {
+			val = repo.expandYumVars(val)
+		}
 		fmt.Fprintf(f, "%s=%s\n", key, val)
 	}
-	fmt.Fprintf(f, "\n")
+	if len(repo.Mirrors) > 0 {
+		fmt.Fprintf(f, "baseurl=%s\n", strings.Join(repo.Mirrors, " "))
+		fmt.Fprintf(f, "failovermethod=priority\n")
+	}
+	_, err := fmt.Fprintf(f, "\n")
 
-	return nil
+	return err
 }
 
-func (c *Yumfile) reposync(repo *Repo) error {
+// reposync downloads the packages of a repo with reposync, logging each
+// download and recording failed downloads in the repo's report
+func (c *Yumfile) reposync(repo *Repo, report *RepoReport) error {
 	Printf("Syncronizing repo: %s\n", repo.ID)
 
 	// compute args for reposync command
@@ -256,10 +1092,6 @@ func (c *Yumfile) reposync(repo *Repo) error {
 		"--download-metadata",
 	}
 
-	if QuietMode {
-		args = append(args, "--quiet")
-	}
-
 	if repo.NewOnly {
 		args = append(args, "--newest-only")
 	}
@@ -280,15 +1112,26 @@ func (c *Yumfile) reposync(repo *Repo) error {
 		args = append(args, fmt.Sprintf("--arch=%s", repo.Architecture))
 	}
 
-	if repo.LocalPath != "" {
-		args = append(args, fmt.Sprintf("--download_path=%s", repo.LocalPath))
+	// dnf reposync renamed --download_path, and only it can keep the
+	// upstream times of packages
+	if repo.yumBackend() == BackendDNF {
+		args = append(args, fmt.Sprintf("--download-path=%s", repo.downloadPath()))
+		if repo.RemoteTime {
+			args = append(args, "--remote-time")
+		}
 	} else {
-		args = append(args, fmt.Sprintf("--download_path=./%s", repo.ID))
+		args = append(args, fmt.Sprintf("--download_path=%s", repo.downloadPath()))
+		if repo.RemoteTime {
+			Warnf(nil, "remote_time of %s is not supported by yum-utils reposync and is ignored", repo.ID)
+		}
 	}
 
-	// execute and capture output
-	if err := Exec("reposync", args...); err != nil {
-		return err
+	// parse the output, rather than passing --quiet, for the progress and
+	// failures of each download
+	out := newReposyncOutput(report, c.progress == nil && !QuietMode)
+	cmd, args := repo.backendCommand("reposync", args...)
+	if err := ExecLines(out.Line, cmd, args...); err != nil {
+		return out.Err(err)
 	}
 
 	return nil
@@ -305,9 +1148,11 @@ func (c *Yumfile) createrepo(repo *Repo) error {
 		fmt.Sprintf("--workers=%d", runtime.NumCPU()*2),
 	}
 
+	// createrepo_c has no --profile
+	tool := repo.createrepoTool()
 	if QuietMode {
 		args = append(args, "--quiet")
-	} else {
+	} else if tool == Createrepo {
 		args = append(args, "--profile")
 	}
 
@@ -315,13 +1160,10 @@ func (c *Yumfile) createrepo(repo *Repo) error {
 	if DebugMode {
 		args = append(args, "--verbose")
 	}
-	
+
 	// set path to create repo for
-	repoPath :=fmt.Sprintf("./%s", repo.ID)
-	if repo.LocalPath != "" {
-		repoPath = repo.LocalPath
-	}
-	
+	repoPath := repo.Path()
+
 	// Set groupfile, relative to the repoPath
 	if repo.Groupfile != "" {
 		args = append(args, fmt.Sprintf("--groupfile=%s/%s", repoPath, repo.Groupfile))
@@ -332,15 +1174,32 @@ func (c *Yumfile) createrepo(repo *Repo) error {
 		args = append(args, fmt.Sprintf("--checksum=%s", repo.Checksum))
 	}
 
+	// options of the createrepo tool, such as zchunk metadata
+	args = append(args, repo.createrepoToolArgs()...)
+
 	// path to create repo for
 	args = append(args, repoPath)
-	
-	// execute and capture output
-	if err := Exec("createrepo", args...); err != nil {
+
+	// execute and keep the last line of output, which explains a failure
+	last := ""
+	err := ExecLines(func(line string) {
+		if line = strings.TrimSpace(line); line != "" {
+			last = line
+		}
+	}, tool, args...)
+	if err != nil && last != "" {
+		return NewErrorf("%v: %s", err, last)
+	} else if err != nil {
 		return err
 	}
 
-	return nil
+	// createrepo does not flush the metadata it writes, so a crash could
+	// leave a repomd.xml referencing empty files
+	if err := syncTree(filepath.Join(repoPath, "repodata")); err != nil {
+		return err
+	}
+
+	return syncDir(repoPath)
 }
 
 func strToBool(s string) (bool, error) {
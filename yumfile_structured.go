@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// structuredYumfile is the document layout of YAML and TOML Yumfiles. E.g.
+//
+//	pathprefix: /var/www/html/pub
+//	set:
+//	  mirrorhost: mirror.centos.org
+//	globals:
+//	  arch: x86_64
+//	repos:
+//	  - id: centos-7-x86_64-base
+//	    mirrorlist: http://${mirrorhost}/?release=7&arch=x86_64&repo=os
+//	    localpath: centos/7/os/x86_64
+//
+// Repo options use the same keys as the legacy Yumfile format.
+type structuredYumfile struct {
+	PathPrefix string                   `yaml:"pathprefix" toml:"pathprefix"`
+	Set        map[string]string        `yaml:"set" toml:"set"`
+	Globals    map[string]interface{}   `yaml:"globals" toml:"globals"`
+	Repos      []map[string]interface{} `yaml:"repos" toml:"repos"`
+}
+
+// isStructuredYumfile returns true if a Yumfile should be loaded as YAML or
+// TOML, based on its file extension.
+func isStructuredYumfile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".toml":
+		return true
+	}
+
+	return false
+}
+
+// loadStructured loads a YAML or TOML Yumfile
+func (c *Yumfile) loadStructured(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	c.Files = append(c.Files, path)
+
+	doc := structuredYumfile{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		_, err = toml.Decode(string(b), &doc)
+	} else {
+		err = yaml.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return NewErrorf("Syntax error in %s: %s", path, err.Error())
+	}
+
+	// variables
+	for _, name := range sortedKeys(doc.Set) {
+		val, err := c.interpolate(doc.Set[name])
+		if err != nil {
+			return NewErrorf("Error in %s: %s", path, err.Error())
+		}
+		c.Variables[name] = val
+	}
+
+	if doc.PathPrefix != "" {
+		if c.LocalPathPrefix, err = c.interpolate(doc.PathPrefix); err != nil {
+			return NewErrorf("Error in %s: %s", path, err.Error())
+		}
+	}
+
+	// global options
+	for key, v := range doc.Globals {
+		if !inheritableKeys[key] && !isNotifyKey(key) {
+			return NewErrorf("Error in %s: Unknown global key: %s", path, key)
+		}
+
+		val, err := c.interpolate(structuredValue(v))
+		if err != nil {
+			return NewErrorf("Error in %s: %s", path, err.Error())
+		}
+
+		if isNotifyKey(key) {
+			if err := c.Notify.Set(key, val); err != nil {
+				return NewErrorf("Error in %s: global %s: %s", path, key, err.Error())
+			}
+			continue
+		}
+
+		if err := NewRepo().Set(key, val); err != nil {
+			return NewErrorf("Error in %s: global %s: %s", path, key, err.Error())
+		}
+
+		c.Globals[key] = val
+	}
+
+	// repos
+	for i, options := range doc.Repos {
+		repo := NewRepo()
+		repo.YumfilePath = path
+		repo.YumfileLineNo = i + 1
+
+		keys := make([]string, 0, len(options))
+		for key := range options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			val, err := c.interpolate(structuredValue(options[key]))
+			if err != nil {
+				return NewErrorf("Error in %s (repo %d): %s", path, i+1, err.Error())
+			}
+
+			if key == "id" {
+				repo.ID = val
+				continue
+			}
+
+			if err := repo.Set(key, val); err != nil {
+				return NewErrorf("Error in %s (repo %d): %s: %s", path, i+1, key, err.Error())
+			}
+		}
+
+		c.Repos = append(c.Repos, *repo)
+	}
+
+	return nil
+}
+
+// structuredValue converts a decoded YAML or TOML value into the equivalent
+// legacy Yumfile value. Lists are joined with commas.
+func structuredValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+
+	case bool:
+		return fmt.Sprintf("%d", boolMap[t])
+
+	case []interface{}:
+		vals := make([]string, len(t))
+		for i, item := range t {
+			vals[i] = structuredValue(item)
+		}
+		return strings.Join(vals, ",")
+	}
+
+	return fmt.Sprintf("%v", v)
+}
+
+// sortedKeys returns the keys of a string map in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	yumfile := NewYumfile()
+	yumfile.Variables["mirrorhost"] = "mirror.example.com"
+	os.Setenv("Y10K_TEST_PASSWORD", "secret")
+	defer os.Unsetenv("Y10K_TEST_PASSWORD")
+
+	tests := []struct {
+		in, want string
+	}{
+		{"https://${mirrorhost}/centos/", "https://mirror.example.com/centos/"},
+		{"${env:Y10K_TEST_PASSWORD}", "secret"},
+		{"https://${mirrorhost}/${releasever}/os/${basearch}/", "https://mirror.example.com/${releasever}/os/${basearch}/"},
+		{"$YUM0/$releasever/", "$YUM0/$releasever/"},
+		{"${YUM3}/os/", "${YUM3}/os/"},
+		{"literal $${mirrorhost}", "literal ${mirrorhost}"},
+	}
+
+	for _, test := range tests {
+		got, err := yumfile.interpolate(test.in)
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.in, test.want, got)
+		}
+	}
+
+	if _, err := yumfile.interpolate("${undefined_name}"); err == nil {
+		t.Errorf("expected an error for an undefined variable")
+	}
+}
+
+func TestEscapeYumfileValue(t *testing.T) {
+	yumfile := NewYumfile()
+	for _, s := range []string{"https://example.com/${undefined_name}/$basearch/", "$${x}", "plain"} {
+		got, err := yumfile.interpolate(escapeYumfileValue(s))
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if got != s {
+			t.Errorf("%s: expected it unchanged, got %s", s, got)
+		}
+	}
+}
+
+func TestImportRepoFilesRejectsKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "y10k-import-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		repo string
+		ok   bool
+	}{
+		{"[base]\nbaseurl=http://example.com/\nskip_if_unavailable=1\n", true},
+		{"[base]\nbaseurl=http://example.com/\nmodule.hotfixes=1\n", false},
+		{"[base]\nbaseurl=http://example.com/\nx-key=1\n", false},
+	}
+	for _, test := range tests {
+		path := dir + "/test.repo"
+		if err := ioutil.WriteFile(path, []byte(test.repo), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := ImportRepoFiles(ioutil.Discard, path)
+		if test.ok && err != nil {
+			t.Errorf("%q: %v", test.repo, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%q: expected an error", test.repo)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// yumVarDirs are the directories whose files define custom yum variables,
+// named after the file and set to its first line, as read by yum and dnf
+var yumVarDirs = []string{"/etc/yum/vars", "/etc/dnf/vars"}
+
+var (
+	yumVarPattern = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
+
+	hostYumVars     map[string]string
+	hostYumVarsOnce sync.Once
+
+	warnedYumVars   = make(map[string]bool, 0)
+	warnedYumVarsMu sync.Mutex
+)
+
+// loadHostYumVars returns the yum variables of the host: those defined in
+// /etc/yum/vars and /etc/dnf/vars, $YUM0 to $YUM9 from the environment, and
+// the defaults of $contentdir and $infra, as yum sets them
+func loadHostYumVars() map[string]string {
+	hostYumVarsOnce.Do(func() {
+		hostYumVars = map[string]string{
+			"contentdir": "centos",
+			"infra":      "stock",
+		}
+		if arch := hostArch(); arch != "x86_64" && arch != "i386" {
+			hostYumVars["contentdir"] = "altarch"
+		}
+
+		for _, dir := range yumVarDirs {
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, fi := range files {
+				if fi.IsDir() {
+					continue
+				}
+				b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+				if err != nil {
+					continue
+				}
+				hostYumVars[fi.Name()] = strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0])
+			}
+		}
+
+		for _, name := range []string{"YUM0", "YUM1", "YUM2", "YUM3", "YUM4", "YUM5", "YUM6", "YUM7", "YUM8", "YUM9"} {
+			if val, ok := os.LookupEnv(name); ok {
+				hostYumVars[name] = val
+			}
+		}
+	})
+
+	return hostYumVars
+}
+
+// builtinYumVarNames are the yum variables which are always defined
+var builtinYumVarNames = map[string]bool{
+	"arch":             true,
+	"basearch":         true,
+	"contentdir":       true,
+	"infra":            true,
+	"releasever":       true,
+	"releasever_major": true,
+	"releasever_minor": true,
+}
+
+// isYumVarName returns true if name is a yum variable: a built-in one, $YUM0
+// to $YUM9, or one defined in the host's yum variable directories
+func isYumVarName(name string) bool {
+	if builtinYumVarNames[name] || len(name) == 4 && strings.HasPrefix(name, "YUM") && name[3] >= '0' && name[3] <= '9' {
+		return true
+	}
+
+	_, ok := loadHostYumVars()[name]
+	return ok
+}
+
+// hostReleasever returns the major release of the host's distribution, from
+// VERSION_ID in /etc/os-release, which yum uses as $releasever
+func hostReleasever() string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "VERSION_ID=") {
+			v := strings.Trim(strings.TrimPrefix(line, "VERSION_ID="), `"'`)
+			return strings.SplitN(v, ".", 2)[0]
+		}
+	}
+
+	return ""
+}
+
+// yumVars returns the yum variables of a repo: the host's variables, with
+// $basearch and $arch set to the repo's architecture and $releasever to its
+// release, if either is configured
+func (c *Repo) yumVars() map[string]string {
+	vars := make(map[string]string, 0)
+	for key, val := range loadHostYumVars() {
+		vars[key] = val
+	}
+
+	arch := c.Architecture
+	if arch == "" {
+		arch = hostArch()
+	}
+	vars["basearch"] = arch
+	vars["arch"] = arch
+
+	release := c.Release
+	if release == "" {
+		release = hostReleasever()
+	}
+	if release != "" {
+		parts := strings.SplitN(release, ".", 2)
+		vars["releasever"] = release
+		vars["releasever_major"] = parts[0]
+		if len(parts) > 1 {
+			vars["releasever_minor"] = parts[1]
+		}
+	}
+
+	return vars
+}
+
+// expandYumVars replaces the yum variables in a URL, such as $basearch,
+// $releasever, $contentdir, $infra and $YUM0, with their values for the repo.
+// Unknown variables are left in place, with a warning, as the URL is then
+// unlikely to be fetchable.
+func (c *Repo) expandYumVars(url string) string {
+	vars := c.yumVars()
+	unknown := make([]string, 0)
+	url = yumVarPattern.ReplaceAllStringFunc(url, func(s string) string {
+		m := yumVarPattern.FindStringSubmatch(s)
+		name := m[1] + m[2]
+		if val, ok := vars[name]; ok {
+			return val
+		}
+		unknown = append(unknown, s)
+		return s
+	})
+
+	if len(unknown) > 0 {
+		warnedYumVarsMu.Lock()
+		if !warnedYumVars[c.ID+"\x00"+url] {
+			warnedYumVars[c.ID+"\x00"+url] = true
+			Warnf(nil, "Unknown yum variables %s in %s for %s; set releasever or define them in /etc/yum/vars", strings.Join(unknown, ", "), url, c.ID)
+		}
+		warnedYumVarsMu.Unlock()
+	}
+
+	return url
+}
+
+// hostArch returns the RPM architecture name of the host
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	case "arm64":
+		return "aarch64"
+	case "ppc64le", "ppc64", "s390x":
+		return runtime.GOARCH
+	}
+
+	return runtime.GOARCH
+}